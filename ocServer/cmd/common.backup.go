@@ -0,0 +1,619 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	kivik "github.com/go-kivik/kivik/v4"
+	"go.uber.org/zap"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// a full server backup is a single .tar.gz laid out as
+//
+//	manifest.json                      BackupManifest, written last so it can carry the final counts; restore seeks it out first
+//	couch/<database>/security.json     the database _security document
+//	couch/<database>/docs.ndjson       one document per line, including _rev and _revisions so restore can keep revision history
+//	root/jams.json                     .. plus avatars/, avatars_source/ and static/ from the server root
+//	stems/<key>                        optional; raw stem data stored under the S3 key it was uploaded with
+//
+// bump the version if that layout changes, restore refuses anything newer than it understands
+const cBackupFormatName string = "ourocosm-backup"
+const cBackupFormatVersion int = 1
+
+// how many documents we ask Couch for in one go, both when reading and when restoring
+const cBackupDocBatchSize int = 500
+
+// the bits of the server root worth keeping; everything else in there is assumed to be regenerated on boot
+var backupServerRootEntries = []string{
+	"jams.json",
+	"avatars",
+	"avatars_source",
+	"static",
+}
+
+type BackupDatabaseEntry struct {
+	Name      string `json:"name"`
+	Documents int    `json:"documents"`
+}
+type BackupManifest struct {
+	Format    string                `json:"format"`
+	Version   int                   `json:"version"`
+	Created   int64                 `json:"created"`
+	FourCC    string                `json:"fourcc"`
+	Databases []BackupDatabaseEntry `json:"databases"`
+	Files     int                   `json:"files"`
+	Stems     int                   `json:"stems"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// which databases should be captured in a backup; system users, client config and every jam / solo database
+func isBackupDatabase(databaseName string) bool {
+	return databaseName == "_users" ||
+		databaseName == CouchKnownDatabase_AppClientConfig ||
+		strings.HasPrefix(databaseName, "user_appdata$")
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// write a single in-memory blob into the tar stream
+func writeTarBytes(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// stream a file on disk into the tar stream under the given name
+func writeTarFile(tw *tar.Writer, name string, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// dump every document in a database into an ndjson temporary file, returning the path, the document count and any stem
+// keys we found along the way in Loop documents
+func backupDatabaseToTemp(couchClient *kivik.Client, databaseName string) (string, int, []EndpointAudio, error) {
+
+	db := couchClient.DB(databaseName)
+
+	tempFile, err := os.CreateTemp("", "ocbackup-*.ndjson")
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer tempFile.Close()
+
+	tempWriter := bufio.NewWriter(tempFile)
+	documentCount := 0
+	stemEndpoints := []EndpointAudio{}
+
+	// page through all the document IDs, then ask for them back in batches with their revision trees and attachments
+	flushBatch := func(batch []kivik.BulkGetReference) error {
+		if len(batch) == 0 {
+			return nil
+		}
+		resultSet := db.BulkGet(context.TODO(), batch, kivik.Params(map[string]interface{}{
+			"revs":        true,
+			"attachments": true,
+		}))
+		defer resultSet.Close()
+
+		for resultSet.Next() {
+			var rawDoc json.RawMessage
+			if err := resultSet.ScanDoc(&rawDoc); err != nil {
+				return err
+			}
+
+			// keep track of loops so we can optionally fetch their audio
+			var docType struct {
+				Type string `json:"type"`
+			}
+			if json.Unmarshal(rawDoc, &docType) == nil && docType.Type == "Loop" {
+				var stemData JamStemData
+				if json.Unmarshal(rawDoc, &stemData) == nil {
+					stemEndpoints = append(stemEndpoints, *getActiveEndpoint(stemData))
+				}
+			}
+
+			tempWriter.Write(rawDoc)
+			tempWriter.WriteByte('\n')
+			documentCount++
+		}
+		return resultSet.Err()
+	}
+
+	resultSet := db.AllDocs(context.TODO())
+	defer resultSet.Close()
+
+	batch := make([]kivik.BulkGetReference, 0, cBackupDocBatchSize)
+	for resultSet.Next() {
+		docID, err := resultSet.ID()
+		if err != nil {
+			os.Remove(tempFile.Name())
+			return "", 0, nil, err
+		}
+		batch = append(batch, kivik.BulkGetReference{ID: docID})
+
+		if len(batch) == cBackupDocBatchSize {
+			if err = flushBatch(batch); err != nil {
+				os.Remove(tempFile.Name())
+				return "", 0, nil, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if resultSet.Err() != nil {
+		os.Remove(tempFile.Name())
+		return "", 0, nil, resultSet.Err()
+	}
+	if err = flushBatch(batch); err != nil {
+		os.Remove(tempFile.Name())
+		return "", 0, nil, err
+	}
+
+	if err = tempWriter.Flush(); err != nil {
+		os.Remove(tempFile.Name())
+		return "", 0, nil, err
+	}
+	return tempFile.Name(), documentCount, stemEndpoints, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// write the archive to a .partial alongside, only moving it into place once the gzip stream and file have closed cleanly, so a
+// failed or interrupted backup never leaves behind something that looks complete
+func writeBackupArchive(archivePath string, write func(tw *tar.Writer) error) error {
+
+	partialPath := archivePath + ".partial"
+	archiveFile, err := os.Create(partialPath)
+	if err != nil {
+		return errors.Join(fmt.Errorf("Unable to create backup archive"), err)
+	}
+	defer os.Remove(partialPath)
+
+	gzw := gzip.NewWriter(archiveFile)
+	tw := tar.NewWriter(gzw)
+
+	err = write(tw)
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gzw.Close()
+	}
+	if closeErr := archiveFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(partialPath, archivePath)
+}
+
+// fetch each stem into the archive under its key; Loop documents are often copied between jams, so the same key can turn up
+// many times and is only fetched once. returns how many were stored
+func backupStemsToTar(tw *tar.Writer, stemStore *StemStore, stemEndpoints []EndpointAudio, ignoreMissingStems bool) (int, error) {
+
+	stemCount := 0
+	seenKeys := make(map[string]bool, len(stemEndpoints))
+	for _, endpoint := range stemEndpoints {
+		if len(endpoint.Key) == 0 || seenKeys[endpoint.Key] {
+			continue
+		}
+		seenKeys[endpoint.Key] = true
+
+		tempStem, err := os.CreateTemp("", "ocbackup-*.stem")
+		if err != nil {
+			return stemCount, err
+		}
+		tempStem.Close()
+
+		stemDownloadUrl := stemStore.ObjectURL(endpoint.Key)
+		err = downloadStem(stemStore, &endpoint, tempStem.Name(), nil)
+		if err == nil {
+			err = writeTarFile(tw, path.Join("stems", endpoint.Key), tempStem.Name())
+			if err == nil {
+				stemCount++
+			}
+		}
+		os.Remove(tempStem.Name())
+		os.Remove(tempStem.Name() + cStemDownloadPartialSuffix)
+
+		if err != nil {
+			if !ignoreMissingStems {
+				return stemCount, errors.Join(fmt.Errorf("Stem download failed [%s]", stemDownloadUrl), err)
+			}
+			SysLog.Warn("Stem download failed", zap.Error(err), zap.String("url", stemDownloadUrl))
+		}
+	}
+	return stemCount, nil
+}
+
+// produce a complete backup archive of this instance; returns the path to the written archive
+func backupServerToDisk(outputDir string, serverRootPath string, fourcc string, stemStore *StemStore, ignoreMissingStems bool) (string, error) {
+
+	couchClient, err := connectToCouchDB()
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("Connection to CouchDB failed"), err)
+	}
+	defer couchClient.Close()
+
+	allDatabases, err := couchClient.AllDBs(context.TODO())
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("Unable to list Couch databases"), err)
+	}
+
+	os.MkdirAll(outputDir, os.ModePerm)
+	archivePath := path.Join(outputDir, fmt.Sprintf("ourocosm.backup.%s.%s.tar.gz",
+		strings.ToLower(fourcc),
+		time.Now().UTC().Format("20060102-150405"),
+	))
+
+	err = writeBackupArchive(archivePath, func(tw *tar.Writer) error {
+
+		manifest := BackupManifest{
+			Format:  cBackupFormatName,
+			Version: cBackupFormatVersion,
+			Created: time.Now().Unix(),
+			FourCC:  fourcc,
+		}
+		stemEndpoints := []EndpointAudio{}
+
+		// databases first
+		for _, databaseName := range allDatabases {
+			if !isBackupDatabase(databaseName) {
+				continue
+			}
+
+			security, err := couchClient.DB(databaseName).Security(context.TODO())
+			if err != nil {
+				return errors.Join(fmt.Errorf("Unable to read security for [%s]", databaseName), err)
+			}
+			securityJson, _ := json.Marshal(security)
+			if err = writeTarBytes(tw, path.Join("couch", databaseName, "security.json"), securityJson); err != nil {
+				return err
+			}
+
+			tempDump, documentCount, databaseStems, err := backupDatabaseToTemp(couchClient, databaseName)
+			if err != nil {
+				return errors.Join(fmt.Errorf("Unable to read documents from [%s]", databaseName), err)
+			}
+			err = writeTarFile(tw, path.Join("couch", databaseName, "docs.ndjson"), tempDump)
+			os.Remove(tempDump)
+			if err != nil {
+				return err
+			}
+
+			SysLog.Info("Backed up database", zap.String("Database", databaseName), zap.Int("Documents", documentCount))
+
+			manifest.Databases = append(manifest.Databases, BackupDatabaseEntry{databaseName, documentCount})
+			stemEndpoints = append(stemEndpoints, databaseStems...)
+		}
+
+		// then the on-disk server assets
+		if len(serverRootPath) > 0 {
+			for _, rootEntry := range backupServerRootEntries {
+				err := filepath.WalkDir(filepath.Join(serverRootPath, rootEntry), func(filePath string, d fs.DirEntry, err error) error {
+					if err != nil {
+						if errors.Is(err, fs.ErrNotExist) {
+							SysLog.Warn("Server root entry missing, skipping", zap.String("Path", filePath))
+							return nil
+						}
+						return err
+					}
+					if d.IsDir() {
+						return nil
+					}
+					relativePath, err := filepath.Rel(serverRootPath, filePath)
+					if err != nil {
+						return err
+					}
+					manifest.Files++
+					return writeTarFile(tw, path.Join("root", filepath.ToSlash(relativePath)), filePath)
+				})
+				if err != nil {
+					return errors.Join(fmt.Errorf("Failed to archive server root entry [%s]", rootEntry), err)
+				}
+			}
+			SysLog.Info("Backed up server root", zap.Int("Files", manifest.Files))
+		}
+
+		// optionally, pull every stem down too
+		if stemStore != nil {
+			stemCount, err := backupStemsToTar(tw, stemStore, stemEndpoints, ignoreMissingStems)
+			if err != nil {
+				return err
+			}
+			manifest.Stems = stemCount
+			SysLog.Info("Backed up stems", zap.Int("Stems", manifest.Stems))
+		}
+
+		manifestJson, _ := json.MarshalIndent(manifest, "", "  ")
+		return writeTarBytes(tw, "manifest.json", manifestJson)
+	})
+	if err != nil {
+		return "", err
+	}
+	return archivePath, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// the part of *kivik.DB that restore and import write through, so they can be tested without a Couch to hand
+type couchBulkWriter interface {
+	Name() string
+	BulkDocs(ctx context.Context, docs []interface{}, options ...kivik.Option) ([]kivik.BulkResult, error)
+}
+
+// push a batch of documents back into couch, keeping their original revisions; returns how many couldn't be written
+func restoreDocumentBatch(db couchBulkWriter, batch []interface{}) (int, error) {
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	results, err := db.BulkDocs(context.TODO(), batch, kivik.Param("new_edits", false))
+	if err != nil {
+		return 0, err
+	}
+	failed := 0
+	for _, result := range results {
+		if result.Error != nil {
+			SysLog.Warn("Document restore failed", zap.String("Database", db.Name()), zap.String("ID", result.ID), zap.Error(result.Error))
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+// read a docs.ndjson stream back into a database, returning how many documents were read and how many of those failed
+func restoreDatabaseDocuments(db couchBulkWriter, docStream io.Reader) (int, int, error) {
+
+	scanner := bufio.NewScanner(docStream)
+	scanner.Buffer(make([]byte, 0, 1024*1024), 256*1024*1024) // documents with inlined attachments can get chunky
+
+	documentCount, failedCount := 0, 0
+	batch := make([]interface{}, 0, cBackupDocBatchSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		batch = append(batch, json.RawMessage(append([]byte(nil), line...)))
+		documentCount++
+
+		if len(batch) == cBackupDocBatchSize {
+			failed, err := restoreDocumentBatch(db, batch)
+			failedCount += failed
+			if err != nil {
+				return documentCount, failedCount, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return documentCount, failedCount, err
+	}
+	failed, err := restoreDocumentBatch(db, batch)
+	return documentCount, failedCount + failed, err
+}
+
+// make sure a database exists before we start filling it up
+func ensureDatabaseExists(couchClient *kivik.Client, databaseName string) error {
+	exists, err := doesDatabaseExist(couchClient, databaseName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	return couchClient.CreateDB(context.TODO(), databaseName)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// open a backup archive for reading, returning the tar stream and a closer for the underlying file + gzip layers
+func openBackupArchive(archivePath string) (*tar.Reader, func(), error) {
+
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		return nil, nil, errors.Join(fmt.Errorf("Unable to open backup archive"), err)
+	}
+	gzr, err := gzip.NewReader(archiveFile)
+	if err != nil {
+		archiveFile.Close()
+		return nil, nil, errors.Join(fmt.Errorf("Backup archive is not a valid .tar.gz"), err)
+	}
+	return tar.NewReader(gzr), func() {
+		gzr.Close()
+		archiveFile.Close()
+	}, nil
+}
+
+// the manifest is the last thing in the archive, so this is a full pass over the stream to go find it
+func readBackupManifest(archivePath string) (*BackupManifest, error) {
+
+	tr, closer, err := openBackupArchive(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("backup archive has no manifest")
+		}
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("Failed reading backup archive"), err)
+		}
+		if header.Name != "manifest.json" {
+			continue
+		}
+		var manifest BackupManifest
+		if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+			return nil, errors.Join(fmt.Errorf("Unable to parse backup manifest"), err)
+		}
+		return &manifest, nil
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// unpack a backup archive into couch, the server root and (optionally) the stem store
+func restoreServerFromDisk(archivePath string, serverRootPath string, stemStore *StemStore) error {
+
+	// check we understand this archive before touching anything
+	manifest, err := readBackupManifest(archivePath)
+	if err != nil {
+		return err
+	}
+	if manifest.Format != cBackupFormatName || manifest.Version > cBackupFormatVersion {
+		return fmt.Errorf("unsupported backup format [%s] version %d", manifest.Format, manifest.Version)
+	}
+	SysLog.Info("Backup manifest",
+		zap.String("FourCC", manifest.FourCC),
+		zap.Time("Created", time.Unix(manifest.Created, 0)),
+		zap.Int("Databases", len(manifest.Databases)),
+		zap.Int("Files", manifest.Files),
+		zap.Int("Stems", manifest.Stems),
+	)
+
+	tr, closer, err := openBackupArchive(archivePath)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	couchClient, err := connectToCouchDB()
+	if err != nil {
+		return errors.Join(fmt.Errorf("Connection to CouchDB failed"), err)
+	}
+	defer couchClient.Close()
+
+	restoredStems := 0
+	restoredFiles := 0
+	restoredDocuments, failedDocuments := 0, 0
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Join(fmt.Errorf("Failed reading backup archive"), err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		entryParts := strings.SplitN(header.Name, "/", 2)
+		switch {
+
+		case entryParts[0] == "couch" && len(entryParts) == 2:
+			databaseName, entryName := path.Split(entryParts[1])
+			databaseName = strings.TrimSuffix(databaseName, "/")
+			if !isBackupDatabase(databaseName) {
+				SysLog.Warn("Skipping unexpected database in backup", zap.String("Database", databaseName))
+				continue
+			}
+			if err := ensureDatabaseExists(couchClient, databaseName); err != nil {
+				return errors.Join(fmt.Errorf("Unable to create database [%s]", databaseName), err)
+			}
+
+			switch entryName {
+			case "security.json":
+				var security kivik.Security
+				if err := json.NewDecoder(tr).Decode(&security); err != nil {
+					return errors.Join(fmt.Errorf("Unable to parse security for [%s]", databaseName), err)
+				}
+				if err := couchClient.DB(databaseName).SetSecurity(context.TODO(), &security); err != nil {
+					return errors.Join(fmt.Errorf("Unable to set security for [%s]", databaseName), err)
+				}
+			case "docs.ndjson":
+				documentCount, failedCount, err := restoreDatabaseDocuments(couchClient.DB(databaseName), tr)
+				if err != nil {
+					return errors.Join(fmt.Errorf("Unable to restore documents for [%s]", databaseName), err)
+				}
+				SysLog.Info("Restored database", zap.String("Database", databaseName), zap.Int("Documents", documentCount), zap.Int("Failed", failedCount))
+				restoredDocuments += documentCount
+				failedDocuments += failedCount
+			}
+
+		case entryParts[0] == "root" && len(entryParts) == 2:
+			if len(serverRootPath) == 0 {
+				continue
+			}
+			// don't let a hostile archive write outside of the chosen root
+			targetPath := filepath.Join(serverRootPath, filepath.FromSlash(path.Clean("/"+entryParts[1])))
+			os.MkdirAll(filepath.Dir(targetPath), os.ModePerm)
+			targetFile, err := os.Create(targetPath)
+			if err != nil {
+				return errors.Join(fmt.Errorf("Unable to restore [%s]", targetPath), err)
+			}
+			_, err = io.Copy(targetFile, tr)
+			targetFile.Close()
+			if err != nil {
+				return errors.Join(fmt.Errorf("Unable to restore [%s]", targetPath), err)
+			}
+			restoredFiles++
+
+		case entryParts[0] == "stems" && len(entryParts) == 2:
+			if stemStore == nil {
+				continue
+			}
+			if err := stemStore.Put(entryParts[1], tr, header.Size); err != nil {
+				return errors.Join(fmt.Errorf("Stem upload failed [%s]", stemStore.ObjectURL(entryParts[1])), err)
+			}
+			restoredStems++
+		}
+	}
+
+	SysLog.Info("Restore complete",
+		zap.Int("Documents", restoredDocuments),
+		zap.Int("FailedDocuments", failedDocuments),
+		zap.Int("Files", restoredFiles),
+		zap.Int("Stems", restoredStems),
+	)
+	// carry on through the rest of the archive either way, but don't let a partial restore pass for a good one
+	if failedDocuments > 0 {
+		return fmt.Errorf("%d of %d documents failed to restore, see the warnings above", failedDocuments, restoredDocuments)
+	}
+	return nil
+}
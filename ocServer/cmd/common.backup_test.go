@@ -0,0 +1,217 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	kivik "github.com/go-kivik/kivik/v4"
+)
+
+// a per-document refusal from Couch, carrying its HTTP status as kivik's own errors do
+type testCouchError int
+
+func (status testCouchError) Error() string {
+	return fmt.Sprintf("couch status %d", int(status))
+}
+
+func (status testCouchError) HTTPStatus() int {
+	return int(status)
+}
+
+// stands in for a Couch database, refusing any document whose ID is in reject with that status
+type testBulkWriter struct {
+	batches [][]interface{}
+	reject  map[string]int
+	fail    error
+}
+
+func (db *testBulkWriter) Name() string {
+	return "test"
+}
+
+func (db *testBulkWriter) BulkDocs(ctx context.Context, docs []interface{}, options ...kivik.Option) ([]kivik.BulkResult, error) {
+	if db.fail != nil {
+		return nil, db.fail
+	}
+	db.batches = append(db.batches, docs)
+	results := []kivik.BulkResult{}
+	for _, doc := range docs {
+		var document struct {
+			ID string `json:"_id"`
+		}
+		docJson, _ := json.Marshal(doc)
+		json.Unmarshal(docJson, &document)
+		result := kivik.BulkResult{ID: document.ID, Rev: "1-abc"}
+		if status, ok := db.reject[document.ID]; ok {
+			result.Error = testCouchError(status)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func testDocStream(count int) io.Reader {
+	var docs strings.Builder
+	for i := range count {
+		fmt.Fprintf(&docs, "{\"_id\":\"doc%d\",\"_rev\":\"1-abc\"}\n\n", i)
+	}
+	return strings.NewReader(docs.String())
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func TestRestoreDatabaseDocuments(t *testing.T) {
+
+	db := &testBulkWriter{reject: map[string]int{"doc3": 409, "doc600": 500}}
+	documentCount, failedCount, err := restoreDatabaseDocuments(db, testDocStream(cBackupDocBatchSize+150))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if documentCount != cBackupDocBatchSize+150 || failedCount != 2 {
+		t.Errorf("restored %d, failed %d", documentCount, failedCount)
+	}
+	if len(db.batches) != 2 || len(db.batches[0]) != cBackupDocBatchSize || len(db.batches[1]) != 150 {
+		t.Errorf("sent %d batches", len(db.batches))
+	}
+
+	// a batch that can't be sent at all stops the restore
+	db = &testBulkWriter{fail: errors.New("couch is down")}
+	if _, _, err = restoreDatabaseDocuments(db, testDocStream(10)); err == nil {
+		t.Error("expected an error when the batch can't be written")
+	}
+}
+
+func TestWriteBackupArchive(t *testing.T) {
+
+	outputDir := t.TempDir()
+	archivePath := filepath.Join(outputDir, "backup.tar.gz")
+
+	// nothing is left behind if writing fails partway through
+	err := writeBackupArchive(archivePath, func(tw *tar.Writer) error {
+		if err := writeTarBytes(tw, "manifest.json", []byte("{}")); err != nil {
+			return err
+		}
+		return errors.New("ran out of stems")
+	})
+	if err == nil {
+		t.Error("expected the write error back")
+	}
+	if leftovers, _ := os.ReadDir(outputDir); len(leftovers) != 0 {
+		t.Errorf("failed backup left %d files", len(leftovers))
+	}
+
+	// and a finished one only appears under its real name
+	err = writeBackupArchive(archivePath, func(tw *tar.Writer) error {
+		return writeTarBytes(tw, "manifest.json", []byte(`{"format":"test"}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leftovers, _ := os.ReadDir(outputDir); len(leftovers) != 1 {
+		t.Errorf("backup left %d files", len(leftovers))
+	}
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archiveFile.Close()
+	gzr, err := gzip.NewReader(archiveFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gzr)
+	if header, err := tr.Next(); err != nil || header.Name != "manifest.json" {
+		t.Fatalf("first entry: %v", err)
+	}
+	if contents, _ := io.ReadAll(tr); string(contents) != `{"format":"test"}` {
+		t.Errorf("manifest: %q", contents)
+	}
+}
+
+func TestBackupStemsToTar(t *testing.T) {
+
+	// objects are their key's name; anything under gone/ is missing
+	var requestsLock sync.Mutex
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/stems/")
+		requestsLock.Lock()
+		requests[key]++
+		requestsLock.Unlock()
+		if strings.HasPrefix(key, "gone/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(key)))
+		w.Write([]byte(key))
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	stemStore := &StemStore{httpClient: server.Client(), scheme: "http", host: serverURL.Host, bucket: "stems", pathStyle: true}
+	endpoint := func(key string) EndpointAudio {
+		return EndpointAudio{Key: key, Length: len(key)}
+	}
+
+	// the same loop copied between jams shows up under the same key more than once
+	stemEndpoints := []EndpointAudio{endpoint("oggs/one"), endpoint("oggs/two"), endpoint("oggs/one"), endpoint(""), endpoint("oggs/one")}
+	tarPath := filepath.Join(t.TempDir(), "stems.tar")
+	tarFile, err := os.Create(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(tarFile)
+	stemCount, err := backupStemsToTar(tw, stemStore, stemEndpoints, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	tarFile.Close()
+
+	if stemCount != 2 || requests["oggs/one"] != 1 || requests["oggs/two"] != 1 || len(requests) != 2 {
+		t.Errorf("stored %d stems from requests %v", stemCount, requests)
+	}
+	tarFile, _ = os.Open(tarPath)
+	defer tarFile.Close()
+	tr := tar.NewReader(tarFile)
+	entries := []string{}
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		entries = append(entries, header.Name)
+	}
+	if strings.Join(entries, ",") != path.Join("stems", "oggs/one")+","+path.Join("stems", "oggs/two") {
+		t.Errorf("archive entries: %v", entries)
+	}
+
+	// a missing stem fails the backup, unless asked to carry on without it
+	missing := []EndpointAudio{endpoint("gone/three"), endpoint("oggs/four")}
+	if _, err = backupStemsToTar(tar.NewWriter(io.Discard), stemStore, missing, false); err == nil {
+		t.Error("expected an error for a missing stem")
+	}
+	stemCount, err = backupStemsToTar(tar.NewWriter(io.Discard), stemStore, missing, true)
+	if err != nil || stemCount != 1 {
+		t.Errorf("ignoring missing stems: stored %d, %v", stemCount, err)
+	}
+}
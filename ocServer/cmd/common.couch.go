@@ -120,6 +120,42 @@ func createNewJamDatabase(client *kivik.Client, jamName string) (*kivik.DB, erro
 	return newJamDB, nil
 }
 
+// -----------------------------------------------------------------------------------------------------------------------------------
+// jam databases are made read-only with a design doc whose validation refuses writes from anyone but Couch admins, so
+// ocServer and replication can still fill them; each reason for locking a jam gets its own design doc id, so lifting
+// one doesn't undo another
+func isJamDatabaseReadOnly(jamDb *kivik.DB, designDocID string) (bool, error) {
+
+	_, err := jamDb.GetRev(context.TODO(), designDocID)
+	if err == nil {
+		return true, nil
+	}
+	if kivik.HTTPStatus(err) == 404 {
+		return false, nil
+	}
+	return false, err
+}
+
+func setJamDatabaseReadOnly(jamDb *kivik.DB, designDocID string, reason string, readOnly bool) error {
+
+	rev, err := jamDb.GetRev(context.TODO(), designDocID)
+	if err != nil && kivik.HTTPStatus(err) != 404 {
+		return err
+	}
+	hasDesignDoc := err == nil
+
+	switch {
+	case readOnly && !hasDesignDoc:
+		_, err = jamDb.Put(context.TODO(), designDocID, map[string]interface{}{
+			"_id":                 designDocID,
+			"validate_doc_update": fmt.Sprintf("function (newDoc, oldDoc, userCtx) {\n  if (userCtx.roles.indexOf('_admin') === -1) {\n    throw({forbidden: %q});\n  }\n}", reason),
+		})
+	case !readOnly && hasDesignDoc:
+		_, err = jamDb.Delete(context.TODO(), designDocID, rev)
+	}
+	return err
+}
+
 // -----------------------------------------------------------------------------------------------------------------------------------
 // call something on a DB to see if it errors out with a particular failure string, indicating the database doesn't exist
 func doesDatabaseExist(couchClient *kivik.Client, databaseName string) (bool, error) {
@@ -178,6 +214,9 @@ func createDefaultPublicJamDatabase(couchClient *kivik.Client, jamName string) e
 		return fmt.Errorf("unable to set jam Profile document: %s", err.Error())
 	}
 
+	// keep the standby in step, if we have one
+	addReplicationForNewDatabase(couchClient, newJamDB.Name())
+
 	return nil
 }
 
@@ -221,3 +260,38 @@ func generateInternalCouchUserPassword(username string) string {
 	md5Hash := md5.Sum(byteInput)
 	return hex.EncodeToString(md5Hash[:])
 }
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// the fields from a _users record we need when doing bulk work across every user
+
+type UserExportData struct {
+	ID        string `json:"_id"`
+	UserName  string `json:"name"`
+	LoginPass string `json:"login"`
+}
+
+// walk the _users database and return every real user record, skipping design documents and anything without a name
+func fetchAllUsersFromCouch(client *kivik.Client) ([]UserExportData, error) {
+
+	userDb := client.DB("_users")
+	resultSet := userDb.AllDocs(context.TODO(), kivik.Params(map[string]interface{}{
+		"include_docs": true,
+	}))
+	defer resultSet.Close()
+
+	users := []UserExportData{}
+	for resultSet.Next() {
+		var doc UserExportData
+		if err := resultSet.ScanDoc(&doc); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(doc.ID, "_design/") || len(doc.UserName) == 0 {
+			continue
+		}
+		users = append(users, doc)
+	}
+	if resultSet.Err() != nil {
+		return nil, resultSet.Err()
+	}
+	return users, nil
+}
@@ -0,0 +1,393 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/Unbundlesss/OUROCOSM/ocServer/cmd/internal/lore"
+	kivik "github.com/go-kivik/kivik/v4"
+	"go.uber.org/zap"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// incremental exports record where they got up to in the jam; the first incremental run writes a normal full archive, every
+// run after that writes a numbered delta alongside it into _archives/_deltas until they are consolidated back into the base
+type JamExportState struct {
+	BaseName        string `json:"base_name"`         // orx.[prefix]_name.id of the base archive these deltas apply to
+	UpdateSeq       string `json:"update_seq"`        // couch sequence the last export was consistent with
+	LastRiffCreated int64  `json:"last_riff_created"` // unixmilli of the newest riff exported so far
+	LastStemCreated int64  `json:"last_stem_created"` // .. and stem
+	LastExportTime  int64  `json:"last_export_time"`  // unix time of the last export run
+	Deltas          int    `json:"deltas"`            // number of delta archives written since the base
+}
+
+func getJamExportStatePath(outputDir string, exportLOREID string) string {
+	return path.Join(outputDir, "_archives", "_deltas", fmt.Sprintf("%s.state.json", exportLOREID))
+}
+
+func getJamExportDeltaBasePath(exportState *JamExportState, deltaIndex int) string {
+	return fmt.Sprintf("%s.delta.%04d", exportState.BaseName, deltaIndex)
+}
+
+// returns nil with no error if there is no state recorded yet
+func loadJamExportState(outputDir string, exportLOREID string) (*JamExportState, error) {
+
+	stateJson, err := os.ReadFile(getJamExportStatePath(outputDir, exportLOREID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var exportState JamExportState
+	if err = json.Unmarshal(stateJson, &exportState); err != nil {
+		return nil, err
+	}
+	return &exportState, nil
+}
+
+func saveJamExportState(outputDir string, exportLOREID string, exportState *JamExportState) error {
+
+	statePath := getJamExportStatePath(outputDir, exportLOREID)
+	os.MkdirAll(path.Dir(statePath), os.ModePerm)
+
+	stateJson, err := json.MarshalIndent(exportState, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// written to the side and renamed over, so an interrupted write can't leave a state that loses track of the deltas
+	stateFile, err := os.CreateTemp(path.Dir(statePath), path.Base(statePath)+".*.partial")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(stateFile.Name())
+
+	_, err = stateFile.Write(stateJson)
+	if err == nil {
+		err = stateFile.Chmod(0644)
+	}
+	if closeErr := stateFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(stateFile.Name(), statePath)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// collect every Rifff, Loop and ChatMessage document that has changed since the given sequence; returned sorted by creation
+// time so the delta archive reads the same way a full one does
+func collectJamChangesSince(jamDb *kivik.DB, sinceSeq string) ([]JamRiffData, []JamStemData, []JamChatData, string, error) {
+
+	changes := jamDb.Changes(context.TODO(), kivik.Params(map[string]interface{}{
+		"since":        sinceSeq,
+		"include_docs": true,
+	}))
+	defer changes.Close()
+
+	riffs := []JamRiffData{}
+	stems := []JamStemData{}
+	chat := []JamChatData{}
+	for changes.Next() {
+		if changes.Deleted() {
+			continue
+		}
+
+		var docType struct {
+			Type string `json:"type"`
+		}
+		if err := changes.ScanDoc(&docType); err != nil {
+			return nil, nil, nil, "", err
+		}
+
+		switch docType.Type {
+		case "Rifff":
+			var riffData JamRiffData
+			if err := changes.ScanDoc(&riffData); err != nil {
+				return nil, nil, nil, "", err
+			}
+			riffs = append(riffs, riffData)
+		case "Loop":
+			var stemData JamStemData
+			if err := changes.ScanDoc(&stemData); err != nil {
+				return nil, nil, nil, "", err
+			}
+			stems = append(stems, stemData)
+		case "ChatMessage":
+			var chatData JamChatData
+			if err := changes.ScanDoc(&chatData); err != nil {
+				return nil, nil, nil, "", err
+			}
+			chat = append(chat, chatData)
+		}
+	}
+	if changes.Err() != nil {
+		return nil, nil, nil, "", changes.Err()
+	}
+	changesMeta, err := changes.Metadata()
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+
+	sort.SliceStable(riffs, func(i, j int) bool { return riffs[i].Created < riffs[j].Created })
+	sort.SliceStable(stems, func(i, j int) bool { return stems[i].Created < stems[j].Created })
+	sort.SliceStable(chat, func(i, j int) bool { return chat[i].Created < chat[j].Created })
+
+	return riffs, stems, chat, changesMeta.LastSeq, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// read a LORE yaml file from disk
+func parseLOREArchiveFile(yamlPath string) (*lore.Archive, error) {
+
+	yamlFile, err := os.Open(yamlPath)
+	if err != nil {
+		return nil, err
+	}
+	defer yamlFile.Close()
+
+	return lore.Parse(yamlFile)
+}
+
+// fold a delta into the archive; entries are matched by couch ID, replacements keep their original position and anything new
+// is added on the end
+func mergeLOREArchive(archive *lore.Archive, delta *lore.Archive) {
+
+	riffIndex := make(map[string]int, len(archive.Riffs))
+	for i, riff := range archive.Riffs {
+		riffIndex[riff.ID] = i
+	}
+	for _, riff := range delta.Riffs {
+		if i, exists := riffIndex[riff.ID]; exists {
+			archive.Riffs[i] = riff
+		} else {
+			riffIndex[riff.ID] = len(archive.Riffs)
+			archive.Riffs = append(archive.Riffs, riff)
+		}
+	}
+
+	stemIndex := make(map[string]int, len(archive.Stems))
+	for i, stem := range archive.Stems {
+		stemIndex[stem.ID] = i
+	}
+	for _, stem := range delta.Stems {
+		if i, exists := stemIndex[stem.ID]; exists {
+			archive.Stems[i] = stem
+		} else {
+			stemIndex[stem.ID] = len(archive.Stems)
+			archive.Stems = append(archive.Stems, stem)
+		}
+	}
+
+	chatIndex := make(map[string]int, len(archive.Chat))
+	for i, chat := range archive.Chat {
+		chatIndex[chat.ID] = i
+	}
+	for _, chat := range delta.Chat {
+		if i, exists := chatIndex[chat.ID]; exists {
+			archive.Chat[i] = chat
+		} else {
+			chatIndex[chat.ID] = len(archive.Chat)
+			archive.Chat = append(archive.Chat, chat)
+		}
+	}
+}
+
+func writeLOREArchiveFile(yamlPath string, archive *lore.Archive) error {
+
+	yamlFile, err := os.Create(yamlPath)
+	if err != nil {
+		return err
+	}
+
+	loreWriter := lore.NewWriter(yamlFile)
+	loreWriter.WriteHeader(&archive.Header)
+	for i := range archive.Riffs {
+		loreWriter.WriteRiff(&archive.Riffs[i])
+	}
+	for i := range archive.Stems {
+		loreWriter.WriteStem(&archive.Stems[i])
+	}
+	for i := range archive.Chat {
+		loreWriter.WriteChat(&archive.Chat[i])
+	}
+	if err = loreWriter.Close(); err != nil {
+		yamlFile.Close()
+		return err
+	}
+	return yamlFile.Close()
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// concatenate a set of stem .tar files into one, skipping any entry names we've already written
+func mergeLOREStemArchives(inputTars []string, outputTar string) error {
+
+	outputFile, err := os.Create(outputTar)
+	if err != nil {
+		return err
+	}
+
+	// the tar footer and the final flush are part of the archive too, so their errors count
+	tw := tar.NewWriter(outputFile)
+	err = copyLOREStemArchiveEntries(tw, inputTars)
+	if closeErr := tw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := outputFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func copyLOREStemArchiveEntries(tw *tar.Writer, inputTars []string) error {
+
+	writtenEntries := make(map[string]bool)
+	for _, inputTar := range inputTars {
+
+		err := func() error {
+			inputFile, err := os.Open(inputTar)
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			defer inputFile.Close()
+
+			tr := tar.NewReader(inputFile)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if writtenEntries[header.Name] {
+					continue
+				}
+				writtenEntries[header.Name] = true
+
+				if err = tw.WriteHeader(header); err != nil {
+					return err
+				}
+				if _, err = io.Copy(tw, tr); err != nil {
+					return err
+				}
+			}
+		}()
+		if err != nil {
+			return errors.Join(fmt.Errorf("Failed merging [%s]", inputTar), err)
+		}
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// fold all the deltas recorded for a jam back into its base archive, leaving a single full export behind
+func consolidateJamExport(outputDir string, jamToExport string) ([]string, error) {
+
+	_, exportLOREID, _ := deduceOutputParametersForJam(jamToExport)
+
+	exportState, err := loadJamExportState(outputDir, exportLOREID)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to read incremental export state"), err)
+	}
+	if exportState == nil {
+		return nil, fmt.Errorf("no incremental export state found for [%s]", jamToExport)
+	}
+
+	archiveRoot := path.Join(outputDir, "_archives")
+	deltaRoot := path.Join(archiveRoot, "_deltas")
+
+	baseYamlPath := path.Join(archiveRoot, fmt.Sprintf("%s.yaml", exportState.BaseName))
+	baseTarPath := path.Join(archiveRoot, fmt.Sprintf("%s.tar", exportState.BaseName))
+
+	if exportState.Deltas == 0 {
+		SysLog.Info("Nothing to consolidate", zap.String("Base", exportState.BaseName))
+		return []string{baseYamlPath, baseTarPath}, nil
+	}
+
+	consolidated, err := parseLOREArchiveFile(baseYamlPath)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to read base archive"), err)
+	}
+
+	deltaFiles := []string{}
+	tarInputs := []string{baseTarPath}
+	for deltaIndex := 1; deltaIndex <= exportState.Deltas; deltaIndex++ {
+
+		deltaBase := path.Join(deltaRoot, getJamExportDeltaBasePath(exportState, deltaIndex))
+
+		delta, err := parseLOREArchiveFile(deltaBase + ".yaml")
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("Unable to read delta archive %d", deltaIndex), err)
+		}
+		mergeLOREArchive(consolidated, delta)
+
+		deltaFiles = append(deltaFiles, deltaBase+".yaml", deltaBase+".tar", getJamExportManifestPath(deltaBase+".yaml"))
+		tarInputs = append(tarInputs, deltaBase+".tar")
+	}
+
+	SysLog.Info("Consolidating",
+		zap.String("Base", exportState.BaseName),
+		zap.Int("Deltas", exportState.Deltas),
+		zap.Int("Riffs", len(consolidated.Riffs)),
+		zap.Int("Stems", len(consolidated.Stems)),
+		zap.Int("Chat", len(consolidated.Chat)),
+	)
+
+	// stamp the consolidation time as the export time
+	consolidated.Header.ExportTimeUnix = time.Now().Unix()
+
+	// write everything out to the side first, then swap into place
+	if err = writeLOREArchiveFile(baseYamlPath+".tmp", consolidated); err != nil {
+		os.Remove(baseYamlPath + ".tmp")
+		return nil, errors.Join(fmt.Errorf("Unable to write consolidated archive"), err)
+	}
+	if err = mergeLOREStemArchives(tarInputs, baseTarPath+".tmp"); err != nil {
+		os.Remove(baseYamlPath + ".tmp")
+		os.Remove(baseTarPath + ".tmp")
+		return nil, errors.Join(fmt.Errorf("Unable to write consolidated stem archive"), err)
+	}
+	if err = os.Rename(baseYamlPath+".tmp", baseYamlPath); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(baseTarPath+".tmp", baseTarPath); err != nil {
+		return nil, err
+	}
+
+	// the base's manifest still describes the archive as it was before the deltas went in, so it's rewritten to match
+	manifestFile, err := writeJamExportManifest(exportLOREID, baseYamlPath, baseTarPath, true)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to write export manifest"), err)
+	}
+
+	exportState.Deltas = 0
+	if err = saveJamExportState(outputDir, exportLOREID, exportState); err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to write incremental export state"), err)
+	}
+
+	// only once nothing refers to them any more; failing before here leaves the deltas in place, and folding them in again
+	// on the next run changes nothing
+	for _, deltaFile := range deltaFiles {
+		os.Remove(deltaFile)
+	}
+
+	return []string{baseYamlPath, baseTarPath, manifestFile}, nil
+}
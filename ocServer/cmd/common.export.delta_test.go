@@ -0,0 +1,247 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/Unbundlesss/OUROCOSM/ocServer/cmd/internal/lore"
+)
+
+func TestMergeLOREArchive(t *testing.T) {
+
+	base := &lore.Archive{
+		Riffs: []lore.Riff{{ID: "r1", User: "alice"}, {ID: "r2", User: "bob"}},
+		Stems: []lore.Stem{{ID: "s1", Length: 10}},
+		Chat:  []lore.Chat{{ID: "c1", Message: "hello"}},
+	}
+	delta := &lore.Archive{
+		Riffs: []lore.Riff{{ID: "r3", User: "carol"}, {ID: "r1", User: "alice-edited"}},
+		Stems: []lore.Stem{{ID: "s2", Length: 20}, {ID: "s1", Length: 11}},
+		Chat:  []lore.Chat{{ID: "c1", Message: "hello again"}, {ID: "c2", Message: "bye"}},
+	}
+	mergeLOREArchive(base, delta)
+
+	// replacements stay where they were, new entries go on the end in delta order
+	wantRiffs := []lore.Riff{{ID: "r1", User: "alice-edited"}, {ID: "r2", User: "bob"}, {ID: "r3", User: "carol"}}
+	if len(base.Riffs) != len(wantRiffs) {
+		t.Fatalf("riffs: got %d, want %d", len(base.Riffs), len(wantRiffs))
+	}
+	for i, want := range wantRiffs {
+		if base.Riffs[i].ID != want.ID || base.Riffs[i].User != want.User {
+			t.Errorf("riff %d: got %s/%s, want %s/%s", i, base.Riffs[i].ID, base.Riffs[i].User, want.ID, want.User)
+		}
+	}
+
+	if len(base.Stems) != 2 || base.Stems[0].ID != "s1" || base.Stems[0].Length != 11 || base.Stems[1].ID != "s2" {
+		t.Errorf("stems merged wrongly: %+v", base.Stems)
+	}
+	if len(base.Chat) != 2 || base.Chat[0].Message != "hello again" || base.Chat[1].ID != "c2" {
+		t.Errorf("chat merged wrongly: %+v", base.Chat)
+	}
+
+	// merging the same delta twice changes nothing further
+	mergeLOREArchive(base, delta)
+	if len(base.Riffs) != 3 || len(base.Stems) != 2 || len(base.Chat) != 2 {
+		t.Errorf("second merge duplicated entries: %d riffs, %d stems, %d chat", len(base.Riffs), len(base.Stems), len(base.Chat))
+	}
+}
+
+func writeTestTar(t *testing.T, tarPath string, entries map[string]string, order []string) {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, name := range order {
+		body := entries[name]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tarPath, buffer.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeLOREStemArchives(t *testing.T) {
+
+	dir := t.TempDir()
+	baseTar := path.Join(dir, "base.tar")
+	deltaTar := path.Join(dir, "delta.tar")
+	outputTar := path.Join(dir, "out.tar")
+
+	writeTestTar(t, baseTar, map[string]string{"a/1.ogg": "one", "a/2.ogg": "two"}, []string{"a/1.ogg", "a/2.ogg"})
+	writeTestTar(t, deltaTar, map[string]string{"a/2.ogg": "two-again", "b/3.ogg": "three"}, []string{"a/2.ogg", "b/3.ogg"})
+
+	// a delta with no new stems never writes a .tar, so missing inputs are skipped
+	missingTar := path.Join(dir, "missing.tar")
+
+	if err := mergeLOREStemArchives([]string{baseTar, missingTar, deltaTar}, outputTar); err != nil {
+		t.Fatal(err)
+	}
+
+	outputFile, err := os.Open(outputTar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outputFile.Close()
+
+	got := map[string]string{}
+	var order []string
+	tr := tar.NewReader(outputFile)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("merged tar unreadable: %v", err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[header.Name] = string(body)
+		order = append(order, header.Name)
+	}
+
+	want := map[string]string{"a/1.ogg": "one", "a/2.ogg": "two", "b/3.ogg": "three"}
+	if len(order) != len(want) {
+		t.Fatalf("entries: got %v, want %d entries", order, len(want))
+	}
+	for name, body := range want {
+		if got[name] != body {
+			t.Errorf("entry [%s]: got %q, want %q", name, got[name], body)
+		}
+	}
+}
+
+func TestMergeLOREStemArchivesBadInput(t *testing.T) {
+
+	dir := t.TempDir()
+	brokenTar := path.Join(dir, "broken.tar")
+	if err := os.WriteFile(brokenTar, bytes.Repeat([]byte{0x55}, 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := mergeLOREStemArchives([]string{brokenTar}, path.Join(dir, "out.tar")); err == nil {
+		t.Error("expected an error merging a damaged tar")
+	}
+}
+
+func TestWriteLOREArchiveFileRoundTrip(t *testing.T) {
+
+	archive := &lore.Archive{
+		Header: lore.Header{ExportTimeUnix: 1700000000, OuroveonVersion: lore.OuroveonVersion, JamName: "test jam", JamCouchID: "bandcsmxjam001"},
+		Riffs:  []lore.Riff{{ID: "r1", User: "alice", CreatedUnix: 1700000001, BPS: 2, BarLength: 16}},
+		Stems:  []lore.Stem{{ID: "s1", Key: "attachments/oggs/s1", Length: 1234, SampleRate: 44100, BPS: 2, Length16ths: 16}},
+		Chat:   []lore.Chat{{ID: "c1", User: "bob", CreatedUnixMilli: 1700000002000, Message: "hi"}},
+	}
+	yamlPath := path.Join(t.TempDir(), "archive.yaml")
+	if err := writeLOREArchiveFile(yamlPath, archive); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseLOREArchiveFile(yamlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header.JamName != archive.Header.JamName || len(parsed.Riffs) != 1 || len(parsed.Stems) != 1 || len(parsed.Chat) != 1 {
+		t.Fatalf("round trip lost data: %+v", parsed)
+	}
+	if parsed.Stems[0].Length != 1234 || parsed.Chat[0].Message != "hi" || parsed.Riffs[0].User != "alice" {
+		t.Errorf("round trip changed data: %+v", parsed)
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// a base export with one delta on top, laid out as incremental export leaves them
+func writeTestDeltaExport(t *testing.T, outputDir string, exportLOREID string) *JamExportState {
+	t.Helper()
+
+	exportState := &JamExportState{BaseName: "orx.solo_tester." + exportLOREID, Deltas: 1}
+	archiveRoot := path.Join(outputDir, "_archives")
+	deltaBase := path.Join(archiveRoot, "_deltas", getJamExportDeltaBasePath(exportState, 1))
+	if err := os.MkdirAll(path.Dir(deltaBase), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	header := lore.Header{JamName: "tester", JamCouchID: exportLOREID, OuroveonVersion: lore.OuroveonVersion}
+	base := &lore.Archive{Header: header, Stems: []lore.Stem{{ID: "s1", BPS: 2, Length: 8}}}
+	delta := &lore.Archive{Header: header, Stems: []lore.Stem{{ID: "s2", BPS: 2, Length: 8}}}
+	if err := writeLOREArchiveFile(path.Join(archiveRoot, exportState.BaseName+".yaml"), base); err != nil {
+		t.Fatal(err)
+	}
+	writeTestTar(t, path.Join(archiveRoot, exportState.BaseName+".tar"), map[string]string{"t/s/s1": "s1 audio"}, []string{"t/s/s1"})
+	if err := writeLOREArchiveFile(deltaBase+".yaml", delta); err != nil {
+		t.Fatal(err)
+	}
+	writeTestTar(t, deltaBase+".tar", map[string]string{"t/s/s2": "s2 audio"}, []string{"t/s/s2"})
+	if _, err := writeJamExportManifest(exportLOREID, deltaBase+".yaml", deltaBase+".tar", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveJamExportState(outputDir, exportLOREID, exportState); err != nil {
+		t.Fatal(err)
+	}
+	return exportState
+}
+
+func TestConsolidateJamExport(t *testing.T) {
+
+	_, exportLOREID, _ := deduceOutputParametersForJam("tester")
+
+	outputDir := t.TempDir()
+	exportState := writeTestDeltaExport(t, outputDir, exportLOREID)
+	deltaRoot := path.Join(outputDir, "_archives", "_deltas")
+
+	// the manifest can't be written, so the deltas have to stay where they are
+	baseManifestPath := getJamExportManifestPath(path.Join(outputDir, "_archives", exportState.BaseName+".yaml"))
+	if err := os.MkdirAll(path.Join(baseManifestPath, "in-the-way"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := consolidateJamExport(outputDir, "tester"); err == nil {
+		t.Fatal("expected an error writing the manifest")
+	}
+	if leftovers, _ := os.ReadDir(deltaRoot); len(leftovers) != 4 {
+		t.Errorf("failed consolidation left %d of the 4 delta files", len(leftovers))
+	}
+
+	// and are folded in again on the next run without doubling anything up
+	os.RemoveAll(baseManifestPath)
+	outputFiles, err := consolidateJamExport(outputDir, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	consolidated, err := parseLOREArchiveFile(outputFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(consolidated.Stems) != 2 {
+		t.Errorf("consolidated %d stems, want 2", len(consolidated.Stems))
+	}
+	manifest, err := loadJamExportManifest(outputFiles[2])
+	if err != nil || len(manifest.StemFiles) != 2 || len(manifest.MissingStems) != 0 {
+		t.Errorf("manifest: %+v, %v", manifest, err)
+	}
+
+	// all that's left beside the state is the state itself
+	leftovers, _ := os.ReadDir(deltaRoot)
+	if len(leftovers) != 1 || leftovers[0].Name() != path.Base(getJamExportStatePath(outputDir, exportLOREID)) {
+		t.Errorf("consolidation left %d files in _deltas", len(leftovers))
+	}
+	if savedState, err := loadJamExportState(outputDir, exportLOREID); err != nil || savedState.Deltas != 0 {
+		t.Errorf("state after consolidation: %+v, %v", savedState, err)
+	}
+}
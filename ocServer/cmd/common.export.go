@@ -2,22 +2,33 @@ package cmd
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
-	"net/http"
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/Unbundlesss/OUROCOSM/ocServer/cmd/internal/lore"
 	kivik "github.com/go-kivik/kivik/v4"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 )
 
+// the server name prefix goes into archive file names, so anything that arrives over the network is held to what
+// a fourcc could be made of
+var serverNamePrefixRegExp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,16}$`)
+
+func validateServerNamePrefix(prefix string) error {
+	if !serverNamePrefixRegExp.MatchString(prefix) {
+		return fmt.Errorf("server name prefix [%s] must be 1-16 letters, digits, '_' or '-'", prefix)
+	}
+	return nil
+}
+
 func deduceOutputParametersForJam(jamToExport string) (string, string, string) {
 
 	// if we're exporting a public/private jam, it begins with the COSMID prefix "jam_"
@@ -71,20 +82,202 @@ func deduceOutputParametersForJam(jamToExport string) (string, string, string) {
 	}
 }
 
-func exportJamToDisk(outputDir string, jamToExport string, serverNamePrefix string, stemS3Server string, ignoreMissingStems bool) ([]string, error) {
+// -----------------------------------------------------------------------------------------------------------------------------------
+// knobs for exportJamToDisk
+type JamExportOptions struct {
+	OutputDir           string      // root to write _archives / _stems into
+	ServerNamePrefix    string      // prefix applied to the jam name and the output filenames
+	StemS3Server        string      // if given (or an s3 store is configured), fetch the stems from there and bake them into a .tar
+	IgnoreMissingStems  bool        // carry on if a stem can't be downloaded
+	StemDownloadWorkers int         // number of stems to download at once; 0 for the default
+	StemDownloadRetries int         // attempts after the first before a stem download is counted as failed
+	Incremental         bool        // only emit riffs and stems that have changed since the last incremental export, as a delta archive
+	Session             *JamSession // if set, only export the riffs from this session and the stems they use
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// personal jams have no name until we go and look at their Profile document
+func getJamProfileDisplayName(jamDb *kivik.DB, jamToExport string, exportCouchID string, deducedName string) (string, error) {
+
+	if len(deducedName) > 0 {
+		return deducedName, nil
+	}
+	var currentJamProfile JamDatabaseProfileUpdate
+	err := jamDb.Get(context.TODO(), "Profile").ScanDoc(&currentJamProfile)
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("Unable to fetch jam Profile document COSMID:[%s] CouchID:[%s]", jamToExport, exportCouchID), err)
+	}
+	return currentJamProfile.DisplayName, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// walk a creation-time view in order, decoding each document into T and handing it to the callback
+func forEachJamDocumentByCreateTime[T any](jamDb *kivik.DB, viewName string, fn func(T) error) error {
+
+	resultSet := jamDb.Query(context.TODO(), "types", viewName, kivik.Params(map[string]interface{}{
+		"descending":   false,
+		"include_docs": true,
+	}))
+	defer resultSet.Close()
+
+	for resultSet.Next() {
+		var resultData T
+		if err := resultSet.ScanDoc(&resultData); err != nil {
+			return err
+		}
+		if err := fn(resultData); err != nil {
+			return err
+		}
+	}
+	return resultSet.Err()
+}
+
+// as above but only for documents created within [fromMilli, toMilli]
+func forEachJamDocumentCreatedBetween[T any](jamDb *kivik.DB, viewName string, fromMilli int64, toMilli int64, fn func(T) error) error {
+
+	resultSet := jamDb.Query(context.TODO(), "types", viewName, kivik.Params(map[string]interface{}{
+		"descending":   false,
+		"include_docs": true,
+		"startkey":     fromMilli,
+		"endkey":       toMilli,
+	}))
+	defer resultSet.Close()
+
+	for resultSet.Next() {
+		var resultData T
+		if err := resultSet.ScanDoc(&resultData); err != nil {
+			return err
+		}
+		if err := fn(resultData); err != nil {
+			return err
+		}
+	}
+	return resultSet.Err()
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// convert couch documents into LORE archive rows
+
+func loreRiffFromJamRiff(resultData *JamRiffData) *lore.Riff {
+
+	riff := &lore.Riff{
+		ID:          resultData.ID,
+		User:        resultData.UserName,
+		CreatedUnix: resultData.Created / 1000, // convert from unixmilli
+		Root:        resultData.Root,
+		Scale:       resultData.Scale,
+		BPS:         resultData.State.Bps,
+		BarLength:   resultData.State.BarLength,
+		AppVersion:  resultData.AppVersion,
+		Magnitude:   resultData.Magnitude,
+	}
+	for i := range riff.Slots {
+		stemData := &resultData.State.Playback[i].Slot.Current
+
+		riff.Slots[i] = lore.RiffSlot{
+			StemID: stemData.CurrentLoop,
+			Gain:   stemData.Gain,
+			On:     stemData.On,
+		}
+		// only write stem CID if its "on" (matching LORE's export)
+		if !stemData.On {
+			riff.Slots[i].StemID = lore.EmptyStemID
+		}
+	}
+	return riff
+}
+
+func loreStemFromJamStem(resultData *JamStemData) *lore.Stem {
+
+	cdnEndpoint := getActiveEndpoint(*resultData)
+
+	return &lore.Stem{
+		ID:            resultData.ID,
+		Endpoint:      cdnEndpoint.Endpoint,
+		Bucket:        "",
+		Key:           cdnEndpoint.Key,
+		Mime:          cdnEndpoint.Mime,
+		Length:        int64(cdnEndpoint.Length),
+		SampleRate:    int(resultData.SampleRate),
+		CreatedUnix:   resultData.Created / 1000, // convert from unixmilli
+		Preset:        resultData.PresetName,
+		User:          resultData.CreatorUserName,
+		Colour:        resultData.PrimaryColour,
+		BPS:           resultData.Bps,
+		Length16ths:   resultData.Length16Ths,
+		OriginalPitch: int(resultData.OriginalPitch),
+		BarLength:     resultData.BarLength,
+		IsDrum:        resultData.IsDrum,
+		IsNote:        resultData.IsNote,
+		IsBass:        resultData.IsBass,
+		IsMic:         resultData.IsMic,
+	}
+}
+
+func loreChatFromJamChat(resultData *JamChatData) *lore.Chat {
+
+	return &lore.Chat{
+		ID:               resultData.ID,
+		User:             resultData.UserName,
+		CreatedUnixMilli: resultData.Created,
+		Message:          resultData.Message,
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// to pacify LORE, a stem .tar also carries all the required directory structure; gather that up and bolt the stem files on
+func writeLOREStemArchive(outputDir string, exportLOREID string, stemFilePaths []string, tarOutputFile string) error {
+
+	// do the directories first to get the structure built upfront
+	directoryBasePaths := []string{}
+	err := filepath.Walk(filepath.Join(outputDir, "_stems", exportLOREID), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			directoryBasePaths = append(directoryBasePaths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("TAR preparation failed"), err)
+	}
+
+	// bolt on all the stems to write to the TAR
+	finalTARLayout := append(directoryBasePaths, stemFilePaths[:]...)
+
+	SysLog.Info(fmt.Sprintf("tar creation with %d entries", len(finalTARLayout)))
+
+	// remove (if required) and recreate the archive
+	os.Remove(tarOutputFile)
+	err = createTarArchive(finalTARLayout, path.Join(outputDir, "_stems"), tarOutputFile)
+	if err != nil {
+		os.Remove(tarOutputFile)
+		return errors.Join(fmt.Errorf("TAR archive creation failed"), err)
+	}
+	SysLog.Info(" ... TAR archive written")
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func exportJamToDisk(jamToExport string, options JamExportOptions) ([]string, error) {
 
 	if len(jamToExport) == 0 {
 		return nil, fmt.Errorf("Jam to export cannot be null")
 	}
+	if options.Incremental && options.Session != nil {
+		return nil, fmt.Errorf("Incremental exports can't be limited to a session")
+	}
+
+	outputDir := options.OutputDir
+	serverNamePrefix := options.ServerNamePrefix
 
 	resultingFiles := []string{}
 
-	// when yanking stems from our server, we might be pointing at localhost or similar which
-	// (as it has to be over https) would kick up cert issues, so skip verification by default
-	httpTransport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	stemStore, err := resolveStemStore(options.StemS3Server)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to configure stem storage"), err)
 	}
-	httpClient := &http.Client{Transport: httpTransport}
 
 	exportCouchID, exportLOREID, jamProfileDisplayNameUnsanitised := deduceOutputParametersForJam(jamToExport)
 
@@ -110,16 +303,66 @@ func exportJamToDisk(outputDir string, jamToExport string, serverNamePrefix stri
 	}
 	jamProfileDisplayName := sanitiseNameForPath(jamProfileDisplayNameUnsanitised, '_', false)
 
+	// session exports are still the same jam as far as LORE is concerned, just tagged to tell them apart
+	jamHeaderName := fmt.Sprintf("[%s] %s", serverNamePrefix, jamProfileDisplayNameUnsanitised)
+	if options.Session != nil {
+		jamProfileDisplayName = fmt.Sprintf("%s_%s", jamProfileDisplayName, options.Session.Label())
+		jamHeaderName = fmt.Sprintf("%s (session %s)", jamHeaderName, options.Session.Start.UTC().Format("2006-01-02 15:04"))
+	}
+
 	// common yaml/tar base filename
 	orxBasePath := fmt.Sprintf("orx.[%s]_%s.%s", strings.ToLower(serverNamePrefix), jamProfileDisplayName, exportLOREID)
 
+	// incremental exports either produce the base archive (if we have no state yet) or the next delta after it
+	var exportState *JamExportState
+	var deltaRiffs []JamRiffData
+	var deltaStems []JamStemData
+	var deltaChat []JamChatData
+	yamlFileRoot := path.Join(outputDir, "_archives")
+
+	if options.Incremental {
+		exportState, err = loadJamExportState(outputDir, exportLOREID)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("Unable to read incremental export state"), err)
+		}
+
+		if exportState == nil {
+			// no state; fall through to a full export, but note down where the database is at before we begin
+			// reading so anything that arrives while we work will turn up in the next delta
+			jamStats, err := jamDb.Stats(context.TODO())
+			if err != nil {
+				return nil, errors.Join(fmt.Errorf("Unable to read jam database sequence"), err)
+			}
+			exportState = &JamExportState{
+				BaseName:  orxBasePath,
+				UpdateSeq: jamStats.UpdateSeq,
+			}
+		} else {
+			var lastSeq string
+			deltaRiffs, deltaStems, deltaChat, lastSeq, err = collectJamChangesSince(jamDb, exportState.UpdateSeq)
+			if err != nil {
+				return nil, errors.Join(fmt.Errorf("Unable to read jam changes since last export"), err)
+			}
+			exportState.UpdateSeq = lastSeq
+
+			if len(deltaRiffs) == 0 && len(deltaStems) == 0 && len(deltaChat) == 0 {
+				SysLog.Info("No changes since last incremental export", zap.String("Jam", jamToExport), zap.String("Base", exportState.BaseName))
+				exportState.LastExportTime = time.Now().Unix()
+				return resultingFiles, saveJamExportState(outputDir, exportLOREID, exportState)
+			}
+
+			exportState.Deltas++
+			orxBasePath = getJamExportDeltaBasePath(exportState, exportState.Deltas)
+			yamlFileRoot = path.Join(outputDir, "_archives", "_deltas")
+		}
+	}
+
 	SysLog.Info("Jam Profile",
 		zap.String("Name", jamProfileDisplayName),
 		zap.String("Output", orxBasePath),
 	)
 
 	// we will write the yaml line by line, open it upfront
-	yamlFileRoot := path.Join(outputDir, "_archives")
 	os.MkdirAll(yamlFileRoot, os.ModePerm)
 
 	yamlFilePath := path.Join(yamlFileRoot, fmt.Sprintf("%s.yaml", orxBasePath))
@@ -131,213 +374,257 @@ func exportJamToDisk(outputDir string, jamToExport string, serverNamePrefix stri
 	resultingFiles = append(resultingFiles, yamlFilePath)
 
 	// write the standard header describing the export
-	yamlFile.WriteString(fmt.Sprintf("# export from OUROCOSM private server '%s'\n", serverNamePrefix))
-	yamlFile.WriteString(fmt.Sprintf("export_time_unix: %d\n", time.Now().Unix()))
-	yamlFile.WriteString("export_ouroveon_version: \"1.1.4\"\n") // compliant with 1.1.4, so we pretend
-	yamlFile.WriteString(fmt.Sprintf("jam_name: \"[%s] %s\"\n", serverNamePrefix, jamProfileDisplayNameUnsanitised))
-	yamlFile.WriteString(fmt.Sprintf("jam_couch_id: \"%s\"\n", exportLOREID))
+	loreWriter := lore.NewWriter(yamlFile)
+	err = loreWriter.WriteHeader(&lore.Header{
+		ServerName:     serverNamePrefix,
+		ExportTimeUnix: time.Now().Unix(),
+		JamName:        jamHeaderName,
+		JamCouchID:     exportLOREID,
+	})
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to write output YAML"), err)
+	}
+
+	// source of riffs, stems and chat; either the full creation-time views, or the changes we collected for a delta
+	forEachRiff := func(fn func(JamRiffData) error) error {
+		return forEachJamDocumentByCreateTime(jamDb, "rifffsByCreateTime", fn)
+	}
+	forEachStem := func(fn func(JamStemData) error) error {
+		return forEachJamDocumentByCreateTime(jamDb, "loopsByCreateTime", fn)
+	}
+	forEachChat := func(fn func(JamChatData) error) error {
+		return forEachJamDocumentByCreateTime(jamDb, "chatsByCreateTime", fn)
+	}
+	if deltaRiffs != nil {
+		forEachRiff = func(fn func(JamRiffData) error) error {
+			for _, riffData := range deltaRiffs {
+				if err := fn(riffData); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		forEachStem = func(fn func(JamStemData) error) error {
+			for _, stemData := range deltaStems {
+				if err := fn(stemData); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		forEachChat = func(fn func(JamChatData) error) error {
+			for _, chatData := range deltaChat {
+				if err := fn(chatData); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	if options.Session != nil {
+		// only the session's riffs, then only the stems those riffs reference; riffs are always walked first
+		sessionStemIDs := map[string]bool{}
+		forEachRiff = func(fn func(JamRiffData) error) error {
+			return forEachJamDocumentCreatedBetween(jamDb, "rifffsByCreateTime", options.Session.Start.UnixMilli(), options.Session.End.UnixMilli(), func(riffData JamRiffData) error {
+				for _, playback := range riffData.State.Playback {
+					if playback.Slot.Current.On {
+						sessionStemIDs[playback.Slot.Current.CurrentLoop] = true
+					}
+				}
+				return fn(riffData)
+			})
+		}
+		forEachStem = func(fn func(JamStemData) error) error {
+			return forEachJamDocumentByCreateTime(jamDb, "loopsByCreateTime", func(stemData JamStemData) error {
+				if !sessionStemIDs[stemData.ID] {
+					return nil
+				}
+				return fn(stemData)
+			})
+		}
+		forEachChat = func(fn func(JamChatData) error) error {
+			return forEachJamDocumentCreatedBetween(jamDb, "chatsByCreateTime", options.Session.Start.UnixMilli(), options.Session.End.UnixMilli(), fn)
+		}
+	}
 
 	{
 		// walk the riffs
-		resultSet := jamDb.Query(context.TODO(), "types", "rifffsByCreateTime", kivik.Params(map[string]interface{}{
-			"descending":   false,
-			"include_docs": true,
-		}))
-		defer resultSet.Close()
-
 		SysLog.Info("Riffs ...")
 		var riffCount uint32 = 0
 
-		yamlFile.WriteString("# riffs schema\n")
-		yamlFile.WriteString("# couch ID, user, creation unix time, root index, root name, scale index, scale name, BPS (float), BPS (hex float), BPM (float), BPM (hex float), bar length, app version, 8x [ stem couch ID, stem gain (float), stem gain (hex float), stem enabled ]\n")
-		yamlFile.WriteString("riffs:\n")
-
 		// page through the whole set, emit data to match archival schema
-		for resultSet.Next() {
-			var resultData JamRiffData
-			if err := resultSet.ScanDoc(&resultData); err != nil {
-				return nil, errors.Join(fmt.Errorf("Failed while reading riff documents"), err)
-			}
-			if resultSet.Err() != nil {
-				return nil, errors.Join(fmt.Errorf("Failed during iteration of riff document set"), resultSet.Err())
+		err = forEachRiff(func(resultData JamRiffData) error {
+			if err := loreWriter.WriteRiff(loreRiffFromJamRiff(&resultData)); err != nil {
+				return err
 			}
 
-			yamlFile.WriteString(fmt.Sprintf(` "%s": [`, resultData.ID))
-			yamlFile.WriteString(fmt.Sprintf(`"%s", %d, %d, "%s", %d, "%s", %f, "%s", %f, "%s", %d, %d, `,
-				resultData.UserName,
-				resultData.Created/1000, // convert from unixmilli
-				resultData.Root,
-				getRootName(resultData.Root),
-				resultData.Scale,
-				getScaleName(resultData.Scale),
-				resultData.State.Bps,
-				strconv.FormatFloat(resultData.State.Bps, 'x', -1, 64),
-				bpsToRoundedBPM(resultData.State.Bps),
-				strconv.FormatFloat(bpsToRoundedBPM(resultData.State.Bps), 'x', -1, 64),
-				resultData.State.BarLength,
-				resultData.AppVersion,
-			))
-
-			for i := 0; i < 8; i++ {
-				stemData := &resultData.State.Playback[i].Slot.Current
-
-				// only write stem CID if its "on" (matching LORE's export)
-				stemIDToWrite := stemData.CurrentLoop
-				if !stemData.On {
-					stemIDToWrite = ""
-				}
-				yamlFile.WriteString(fmt.Sprintf(`[ "%s", %f, "%s", %s ], `,
-					stemIDToWrite,
-					stemData.Gain,
-					strconv.FormatFloat(stemData.Gain, 'x', -1, 64),
-					strconv.FormatBool(stemData.On),
-				))
+			if exportState != nil && resultData.Created > exportState.LastRiffCreated {
+				exportState.LastRiffCreated = resultData.Created
 			}
-
-			yamlFile.WriteString(fmt.Sprintf(` %f ]`, resultData.Magnitude))
-			yamlFile.WriteString("\n")
-
 			riffCount++
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("Failed while reading riff documents"), err)
 		}
 		SysLog.Info(fmt.Sprintf(" ... wrote %d riffs", riffCount))
 	}
+	tarOutputFile := ""
 	{
 		// walk the stems
-		resultSet := jamDb.Query(context.TODO(), "types", "loopsByCreateTime", kivik.Params(map[string]interface{}{
-			"descending":   false,
-			"include_docs": true,
-		}))
-		defer resultSet.Close()
-
 		SysLog.Info("Stems ...")
 		var stemCount uint32 = 0
-		var stemDownloads uint32 = 0
 		stemFilePaths := []string{}
-
-		yamlFile.WriteString("# stems schema\n")
-		yamlFile.WriteString("# couch ID, file endpoint, file bucket, file key, file MIME, file length in bytes, sample rate, creation unix time, preset, user, colour hex, BPS (float), BPS (hex float), BPM (float), BPM (hex float), length 16ths, original pitch, bar length, is-drum, is-note, is-bass, is-mic\n")
-		yamlFile.WriteString("stems:\n")
+		stemDownloadJobs := []StemDownloadJob{}
+		unusableStems := []StemDownloadFailure{}
 
 		// same as before, just stems now
-		for resultSet.Next() {
-			var resultData JamStemData
-			if err := resultSet.ScanDoc(&resultData); err != nil {
-				return nil, errors.Join(fmt.Errorf("Failed while reading stem documents"), err)
-			}
-			if resultSet.Err() != nil {
-				return nil, errors.Join(fmt.Errorf("Failed during iteration of stem document set"), resultSet.Err())
-			}
+		err = forEachStem(func(resultData JamStemData) error {
 
-			cdnEndpoint := getActiveEndpoint(resultData)
-
-			yamlFile.WriteString(fmt.Sprintf(` "%s": [`, resultData.ID))
-			yamlFile.WriteString(fmt.Sprintf(`"%s", "%s", "%s", "%s", %d, %d, %d, "%s", "%s", "%s", %f, "%s", %f, "%s", %d, %d, %d, %s, %s, %s, %s ]`,
-				cdnEndpoint.Endpoint,
-				"",
-				cdnEndpoint.Key,
-				cdnEndpoint.Mime,
-				cdnEndpoint.Length,
-				int32(resultData.SampleRate),
-				resultData.Created/1000, // convert from unixmilli
-				resultData.PresetName,
-				resultData.CreatorUserName,
-				resultData.PrimaryColour,
-				resultData.Bps,
-				strconv.FormatFloat(resultData.Bps, 'x', -1, 64),
-				bpsToRoundedBPM(resultData.Bps),
-				strconv.FormatFloat(bpsToRoundedBPM(resultData.Bps), 'x', -1, 64),
-				resultData.Length16Ths,
-				int32(resultData.OriginalPitch),
-				resultData.BarLength,
-				strconv.FormatBool(resultData.IsDrum),
-				strconv.FormatBool(resultData.IsNote),
-				strconv.FormatBool(resultData.IsBass),
-				strconv.FormatBool(resultData.IsMic),
-			))
-			yamlFile.WriteString("\n")
+			if err := loreWriter.WriteStem(loreStemFromJamStem(&resultData)); err != nil {
+				return err
+			}
 
+			if exportState != nil && resultData.Created > exportState.LastStemCreated {
+				exportState.LastStemCreated = resultData.Created
+			}
 			stemCount++
 
 			// stem download server was specified
-			if len(stemS3Server) > 0 {
-
-				// create a LORE-cache compatible output path
-				stemPath := filepath.Join(outputDir, "_stems", exportLOREID, resultData.ID[0:1])
-				os.MkdirAll(stemPath, os.ModePerm)
+			if stemStore != nil {
 
 				cdnEndpoint := getActiveEndpoint(resultData)
 
-				// create from/to locations
-				stemDownloadUrl := fmt.Sprintf("https://%s/%s", stemS3Server, cdnEndpoint.Key)
-				stemDownloadFile := filepath.Join(stemPath, resultData.ID)
+				// IDs come from documents jam members wrote, so one that can't name a file is counted as missing
+				// rather than being allowed anywhere near a path
+				if !isUsableStemID(resultData.ID) {
+					unusableStems = append(unusableStems, StemDownloadFailure{
+						StemID: resultData.ID,
+						Key:    cdnEndpoint.Key,
+						URL:    stemStore.ObjectURL(cdnEndpoint.Key),
+						Error:  "unusable stem ID",
+					})
+					return nil
+				}
 
-				stemFileExist := false
+				// create a LORE-cache compatible output path; files only land there once fully downloaded and verified,
+				// so anything already present can be used as-is
+				stemDownloadFile := filepath.Join(outputDir, "_stems", exportLOREID, resultData.ID[0:1], resultData.ID)
+				stemFilePaths = append(stemFilePaths, stemDownloadFile)
 
-				// download if we don't already have it
 				if _, err := os.Stat(stemDownloadFile); errors.Is(err, os.ErrNotExist) {
-					err = downloadStem(httpClient, cdnEndpoint.Length, stemDownloadFile, stemDownloadUrl)
-					if err != nil {
-						if !ignoreMissingStems {
-							return nil, errors.Join(fmt.Errorf("Stem download failed [%s]", stemDownloadUrl), err)
-						} else {
-							SysLog.Warn("Stem download failed", zap.Error(err), zap.String("url", stemDownloadUrl))
-						}
-						os.Remove(stemDownloadFile)
-					} else {
-						// file downloaded ok
-						stemDownloads++
-						stemFileExist = true
-					}
-				} else {
-					// file already in cache
-					stemFileExist = true
-				}
-
-				if stemFileExist {
-					stemFilePaths = append(stemFilePaths, stemDownloadFile)
+					stemDownloadJobs = append(stemDownloadJobs, StemDownloadJob{
+						StemID:   resultData.ID,
+						Endpoint: *cdnEndpoint,
+						URL:      stemStore.ObjectURL(cdnEndpoint.Key),
+						FilePath: stemDownloadFile,
+					})
 				}
 			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("Failed while reading stem documents"), err)
 		}
 		SysLog.Info(fmt.Sprintf(" ... wrote %d stems", stemCount))
-		if stemDownloads > 0 {
-			SysLog.Info(fmt.Sprintf(" ... downloaded %d stems", stemDownloads))
+
+		// chat goes last, after the sections LORE cares about
+		var chatCount uint32 = 0
+		err = forEachChat(func(resultData JamChatData) error {
+			chatCount++
+			return loreWriter.WriteChat(loreChatFromJamChat(&resultData))
+		})
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("Failed while reading chat documents"), err)
 		}
-		// if we were processing downloaded stems, emit the collected list of stem files into the final LORE-importable .TAR
-		if len(stemFilePaths) > 0 {
+		if err = loreWriter.Close(); err != nil {
+			return nil, errors.Join(fmt.Errorf("Unable to write output YAML"), err)
+		}
+		SysLog.Info(fmt.Sprintf(" ... wrote %d chat messages", chatCount))
 
-			// to pacify LORE, we also write out all the required directory structure - do this first to get the structure built upfront
-			directoryBasePaths := []string{}
-			err := filepath.Walk(filepath.Join(outputDir, "_stems", exportLOREID), func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				if info.IsDir() {
-					directoryBasePaths = append(directoryBasePaths, path)
-				}
-				return nil
-			})
+		if len(stemDownloadJobs) > 0 || len(unusableStems) > 0 {
+
+			// anything that failed last time goes to the front of the queue
+			previousFailures, err := loadStemDownloadManifest(outputDir, exportLOREID)
 			if err != nil {
-				SysLog.Fatal("TAR preparation failed", zap.Error(err))
+				SysLog.Warn("Unable to read failed stem manifest", zap.Error(err))
+			}
+			if previousFailures != nil {
+				SysLog.Info(fmt.Sprintf(" ... retrying %d stems that failed previously", len(previousFailures.Failed)))
+
+				previouslyFailed := make(map[string]bool, len(previousFailures.Failed))
+				for _, failure := range previousFailures.Failed {
+					previouslyFailed[failure.StemID] = true
+				}
+				sort.SliceStable(stemDownloadJobs, func(i, j int) bool {
+					return previouslyFailed[stemDownloadJobs[i].StemID] && !previouslyFailed[stemDownloadJobs[j].StemID]
+				})
 			}
 
-			// bolt on all the stems to write to the TAR
-			finalTARLayout := append(directoryBasePaths, stemFilePaths[:]...)
+			SysLog.Info(fmt.Sprintf(" ... downloading %d stems", len(stemDownloadJobs)))
+			downloaded, failures := downloadStemsConcurrently(stemStore, stemDownloadJobs, options.StemDownloadWorkers, options.StemDownloadRetries)
+			SysLog.Info(fmt.Sprintf(" ... downloaded %d stems", len(downloaded)))
+			for _, unusable := range unusableStems {
+				SysLog.Warn("Stem has an unusable ID", zap.String("Stem", unusable.StemID), zap.String("Key", unusable.Key))
+			}
+			failures = append(failures, unusableStems...)
 
-			SysLog.Info(fmt.Sprintf("tar creation with %d entries", len(finalTARLayout)))
+			if err = saveStemDownloadManifest(outputDir, exportLOREID, failures); err != nil {
+				SysLog.Warn("Unable to write failed stem manifest", zap.Error(err))
+			}
+			if len(failures) > 0 {
+				if !options.IgnoreMissingStems {
+					return nil, fmt.Errorf("%d stem downloads failed, see [%s]; run the export again to resume", len(failures), getStemDownloadManifestPath(outputDir, exportLOREID))
+				}
+
+				// leave the failures out of the .tar
+				failedPaths := make(map[string]bool, len(failures))
+				for _, job := range stemDownloadJobs {
+					failedPaths[job.FilePath] = true
+				}
+				for _, job := range downloaded {
+					delete(failedPaths, job.FilePath)
+				}
+				availableFilePaths := []string{}
+				for _, stemFilePath := range stemFilePaths {
+					if !failedPaths[stemFilePath] {
+						availableFilePaths = append(availableFilePaths, stemFilePath)
+					}
+				}
+				stemFilePaths = availableFilePaths
+			}
+		} else if stemStore != nil {
+			// everything came from the cache, nothing is outstanding any more
+			saveStemDownloadManifest(outputDir, exportLOREID, nil)
+		}
 
-			// remove (if required) and recreate the archive
-			tarOutputFile := path.Join(outputDir, "_archives", fmt.Sprintf("%s.tar", orxBasePath))
-			os.Remove(tarOutputFile)
-			err = createTarArchive(finalTARLayout, path.Join(outputDir, "_stems"), tarOutputFile)
+		// if we were processing downloaded stems, emit the collected list of stem files into the final LORE-importable .TAR
+		if len(stemFilePaths) > 0 {
+
+			tarOutputFile = path.Join(yamlFileRoot, fmt.Sprintf("%s.tar", orxBasePath))
+			err = writeLOREStemArchive(outputDir, exportLOREID, stemFilePaths, tarOutputFile)
 			if err != nil {
-				SysLog.Fatal("TAR archive creation failed", zap.Error(err))
-				os.Remove(tarOutputFile)
+				return nil, errors.Join(fmt.Errorf("TAR archive creation failed"), err)
 			}
-			SysLog.Info(" ... TAR archive written")
 
 			resultingFiles = append(resultingFiles, tarOutputFile)
 		}
+	}
 
-		return resultingFiles, nil
+	// checksum what we wrote, and note down anything that didn't make it
+	manifestFile, err := writeJamExportManifest(exportLOREID, yamlFilePath, tarOutputFile, stemStore != nil)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to write export manifest"), err)
 	}
+	resultingFiles = append(resultingFiles, manifestFile)
+
+	// everything written, move the incremental state forward
+	if exportState != nil {
+		exportState.LastExportTime = time.Now().Unix()
+		if err = saveJamExportState(outputDir, exportLOREID, exportState); err != nil {
+			return nil, errors.Join(fmt.Errorf("Unable to write incremental export state"), err)
+		}
+	}
+
+	return resultingFiles, nil
 }
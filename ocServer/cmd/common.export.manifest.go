@@ -0,0 +1,190 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Unbundlesss/OUROCOSM/ocServer/cmd/internal/lore"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// a list of the files that make up one export with their sizes and checksums, carried alongside them so whoever ends up holding
+// the archive can tell if anything went missing or got damaged along the way; checked by 'export verify'
+type JamExportManifest struct {
+	Jam          string                  `json:"jam"`         // LORE export ID
+	ExportTime   int64                   `json:"export_time"` // unix time
+	Riffs        int                     `json:"riffs"`
+	Stems        int                     `json:"stems"`
+	Files        []JamExportManifestFile `json:"files"`                   // the .yaml and .tar
+	StemFiles    []JamExportManifestFile `json:"stem_files,omitempty"`    // every stem in the .tar, named by stem ID
+	MissingStems []string                `json:"missing_stems,omitempty"` // stems in the .yaml we couldn't get the audio for
+}
+
+type JamExportManifestFile struct {
+	Name   string `json:"name"` // base filename, as it sits next to the manifest
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// manifests sit next to the .yaml they describe
+func getJamExportManifestPath(yamlPath string) string {
+	return strings.TrimSuffix(yamlPath, ".yaml") + ".manifest.json"
+}
+
+func hashJamExportStream(name string, r io.Reader) (JamExportManifestFile, error) {
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, r)
+	if err != nil {
+		return JamExportManifestFile{}, err
+	}
+	return JamExportManifestFile{
+		Name:   name,
+		Size:   size,
+		SHA256: fmt.Sprintf("%x", hasher.Sum(nil)),
+	}, nil
+}
+
+func hashJamExportFile(filePath string) (JamExportManifestFile, error) {
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return JamExportManifestFile{}, err
+	}
+	defer file.Close()
+
+	return hashJamExportStream(filepath.Base(filePath), file)
+}
+
+// walk the stem files inside a LORE stem .tar
+func forEachStemArchiveEntry(tarPath string, fn func(stemID string, r io.Reader) error) error {
+
+	tarFile, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer tarFile.Close()
+
+	tr := tar.NewReader(tarFile)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err = fn(path.Base(header.Name), tr); err != nil {
+			return err
+		}
+	}
+}
+
+// hash every stem inside a stem .tar, keyed by stem ID
+func hashStemArchiveEntries(tarPath string) ([]JamExportManifestFile, error) {
+
+	stemFiles := []JamExportManifestFile{}
+	err := forEachStemArchiveEntry(tarPath, func(stemID string, r io.Reader) error {
+		stemFile, err := hashJamExportStream(stemID, r)
+		stemFiles = append(stemFiles, stemFile)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stemFiles, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// build and write the manifest for an on-disk export from what actually landed; the .yaml gives the counts and the list of stems,
+// the .tar (if one was written) what audio we have. with stemsExpected set, any stem not in the .tar is recorded as missing.
+// returns the manifest path
+func writeJamExportManifest(exportLOREID string, yamlPath string, tarPath string, stemsExpected bool) (string, error) {
+
+	archive, err := parseLOREArchiveFile(yamlPath)
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("Unable to read back [%s]", yamlPath), err)
+	}
+
+	manifest := JamExportManifest{
+		Jam:        exportLOREID,
+		ExportTime: time.Now().Unix(),
+		Riffs:      len(archive.Riffs),
+		Stems:      len(archive.Stems),
+	}
+
+	yamlFile, err := hashJamExportFile(yamlPath)
+	if err != nil {
+		return "", err
+	}
+	manifest.Files = append(manifest.Files, yamlFile)
+
+	stemsPresent := map[string]bool{}
+	if len(tarPath) > 0 {
+		tarFile, err := hashJamExportFile(tarPath)
+		if err != nil {
+			return "", err
+		}
+		manifest.Files = append(manifest.Files, tarFile)
+
+		if manifest.StemFiles, err = hashStemArchiveEntries(tarPath); err != nil {
+			return "", errors.Join(fmt.Errorf("Unable to read back [%s]", tarPath), err)
+		}
+		for _, stemFile := range manifest.StemFiles {
+			stemsPresent[stemFile.Name] = true
+		}
+		stemsExpected = true
+	}
+	if stemsExpected {
+		for _, stem := range archive.Stems {
+			if !stemsPresent[stem.ID] {
+				manifest.MissingStems = append(manifest.MissingStems, stem.ID)
+			}
+		}
+	}
+
+	manifestPath := getJamExportManifestPath(yamlPath)
+	manifestJson, _ := json.MarshalIndent(manifest, "", "  ")
+	return manifestPath, os.WriteFile(manifestPath, manifestJson, 0644)
+}
+
+func loadJamExportManifest(manifestPath string) (*JamExportManifest, error) {
+
+	manifestJson, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	var manifest JamExportManifest
+	if err = json.Unmarshal(manifestJson, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// the stem IDs riffs point at, for checking against what's actually there
+func forEachRiffStemReference(archive *lore.Archive, fn func(riffID string, stemID string)) {
+	for _, riff := range archive.Riffs {
+		for _, slot := range riff.Slots {
+			if slot.StemID != lore.EmptyStemID {
+				fn(riff.ID, slot.StemID)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Unbundlesss/OUROCOSM/ocServer/cmd/internal/reaper"
+	"go.uber.org/zap"
+)
+
+// work out what Reaper should decode a cached stem as; the files have no extension, so look at the first few bytes
+func getReaperSourceType(stemFile string) string {
+
+	header := make([]byte, 4)
+	if f, err := os.Open(stemFile); err == nil {
+		f.Read(header)
+		f.Close()
+	}
+	if bytes.Equal(header, []byte("OggS")) {
+		return reaper.SourceVorbis
+	}
+	return reaper.SourceFLAC
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// lay a jam (or one session of it) out as a Reaper project; one track per riff slot, one region per riff, each slot's stem
+// looped across the riff at the riff's tempo and gain. stems are referenced in place in the _stems cache (fetching anything
+// that isn't there yet) so the project works offline, as long as it stays next to the cache
+func exportJamToReaper(jamToExport string, options JamExportOptions) (string, error) {
+
+	if len(jamToExport) == 0 {
+		return "", fmt.Errorf("Jam to export cannot be null")
+	}
+
+	stemStore, err := resolveStemStore(options.StemS3Server)
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("Unable to configure stem storage"), err)
+	}
+
+	exportCouchID, exportLOREID, jamProfileDisplayNameUnsanitised := deduceOutputParametersForJam(jamToExport)
+
+	couchClient, err := connectToCouchDB()
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("Connection to CouchDB failed"), err)
+	}
+	defer couchClient.Close()
+
+	jamDb := couchClient.DB(fmt.Sprintf("user_appdata$%s", exportCouchID))
+
+	jamProfileDisplayNameUnsanitised, err = getJamProfileDisplayName(jamDb, jamToExport, exportCouchID, jamProfileDisplayNameUnsanitised)
+	if err != nil {
+		return "", err
+	}
+	jamProfileDisplayName := sanitiseNameForPath(jamProfileDisplayNameUnsanitised, '_', false)
+
+	riffs := []JamRiffData{}
+	collectRiff := func(resultData JamRiffData) error {
+		riffs = append(riffs, resultData)
+		return nil
+	}
+	if options.Session != nil {
+		jamProfileDisplayName = fmt.Sprintf("%s_%s", jamProfileDisplayName, options.Session.Label())
+		err = forEachJamDocumentCreatedBetween(jamDb, "rifffsByCreateTime", options.Session.Start.UnixMilli(), options.Session.End.UnixMilli(), collectRiff)
+	} else {
+		err = forEachJamDocumentByCreateTime(jamDb, "rifffsByCreateTime", collectRiff)
+	}
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("Failed while reading riff documents"), err)
+	}
+	if len(riffs) == 0 {
+		return "", fmt.Errorf("no riffs to export")
+	}
+
+	cachedStems, err := cacheRiffStems(jamDb, stemStore, riffs, options.OutputDir, exportLOREID, options.StemDownloadWorkers, options.StemDownloadRetries)
+	if err != nil {
+		return "", err
+	}
+
+	projectDir := filepath.Join(options.OutputDir, "_projects")
+	os.MkdirAll(projectDir, os.ModePerm)
+	projectFile := filepath.Join(projectDir, fmt.Sprintf("orx.[%s]_%s.%s.rpp", strings.ToLower(options.ServerNamePrefix), jamProfileDisplayName, exportLOREID))
+
+	stemsByID := map[string]*CachedStem{}
+	stemLengths := map[string]int{}
+	for i := range cachedStems {
+		stemsByID[cachedStems[i].Data.ID] = &cachedStems[i]
+		stemLengths[cachedStems[i].Data.ID] = cachedStems[i].Data.Length16Ths
+	}
+
+	project := &reaper.Project{
+		Tempo: riffs[0].State.Bps * 60,
+	}
+	for i := range 8 {
+		project.Tracks = append(project.Tracks, &reaper.Track{Name: fmt.Sprintf("Slot %d", i+1)})
+	}
+	if len(cachedStems) > 0 {
+		project.SampleRate = int(cachedStems[0].Data.SampleRate)
+	}
+
+	timelinePosition := 0.0
+	for i := range riffs {
+		riff := &riffs[i]
+
+		riffLength16ths, err := getRiffLength16ths(riff, stemLengths)
+		if err != nil || riff.State.Bps <= 0 {
+			SysLog.Warn("Skipping riff", zap.String("Riff", riff.ID), zap.Error(err))
+			continue
+		}
+		secondsPer16th := 1.0 / (riff.State.Bps * 4)
+		riffLength := float64(riffLength16ths) * secondsPer16th
+
+		project.TempoMap = append(project.TempoMap, reaper.TempoPoint{
+			Position: timelinePosition,
+			BPM:      riff.State.Bps * 60,
+		})
+		project.Regions = append(project.Regions, reaper.Region{
+			Name:  fmt.Sprintf("%s %s", time.UnixMilli(riff.Created).Local().Format("15:04:05"), riff.UserName),
+			Start: timelinePosition,
+			End:   timelinePosition + riffLength,
+		})
+
+		for _, slot := range getRiffPlayingSlots(riff) {
+			stem, ok := stemsByID[slot.StemID]
+			if !ok {
+				continue
+			}
+			relativeStemFile, err := filepath.Rel(projectDir, stem.FilePath)
+			if err != nil {
+				relativeStemFile = stem.FilePath
+			}
+			project.Tracks[slot.Index].Items = append(project.Tracks[slot.Index].Items, reaper.Item{
+				Name:     fmt.Sprintf("%s [%s]", stem.Data.PresetName, stem.Data.CreatorUserName),
+				Position: timelinePosition,
+				Length:   riffLength,
+				Volume:   slot.Gain,
+				Colour:   stem.Data.PrimaryColour,
+				Source: reaper.Source{
+					Type:       getReaperSourceType(stem.FilePath),
+					File:       filepath.ToSlash(relativeStemFile),
+					LoopLength: float64(stem.Data.Length16Ths) * secondsPer16th,
+				},
+			})
+		}
+		timelinePosition += riffLength
+	}
+
+	projectOut, err := os.Create(projectFile)
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("Unable to create project file"), err)
+	}
+	err = project.Write(projectOut)
+	if closeErr := projectOut.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(projectFile)
+		return "", errors.Join(fmt.Errorf("Unable to write project file"), err)
+	}
+
+	SysLog.Info("Exported Reaper project",
+		zap.String("File", projectFile),
+		zap.Int("Riffs", len(project.Regions)),
+		zap.Duration("Length", time.Duration(timelinePosition*float64(time.Second))),
+	)
+	return projectFile, nil
+}
@@ -0,0 +1,247 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// knobs for exportSoloJams; every solo lands in <out>/_solos/<user>.solo_encrypted.zip, encrypted with that user's login
+type SoloExportOptions struct {
+	Export       JamExportOptions  // used for the loose .yaml / .tar export that gets zipped up
+	Stream       *JamStreamOptions // if set, stream each solo straight into its zip instead; password is filled in per user
+	UserPatterns []string          // only users whose name matches one of these globs; everyone if empty
+	ActiveSince  time.Time         // only users with a riff at or after this time; ignored if zero
+	SkipEmpty    bool              // skip solos with no riffs at all
+	Parallel     int               // solos to export at once
+}
+
+type SoloExportStatus string
+
+const (
+	SoloExportStatusExported SoloExportStatus = "exported"
+	SoloExportStatusSkipped  SoloExportStatus = "skipped"
+	SoloExportStatusFailed   SoloExportStatus = "failed"
+)
+
+type SoloExportResult struct {
+	User   string           `json:"user"`
+	Status SoloExportStatus `json:"status"`
+	Reason string           `json:"reason,omitempty"`
+	File   string           `json:"file,omitempty"`
+}
+
+// written to <out>/_solos/exportsolo.report.json after every run
+type SoloExportReport struct {
+	StartTime int64              `json:"start_time"` // unix time
+	EndTime   int64              `json:"end_time"`   //
+	Results   []SoloExportResult `json:"results"`    // sorted by user; users filtered out by name aren't listed
+}
+
+func (report *SoloExportReport) Count(status SoloExportStatus) int {
+	count := 0
+	for _, result := range report.Results {
+		if result.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+func matchesAnyUserPattern(userName string, patterns []string) (bool, error) {
+	if len(patterns) == 0 {
+		return true, nil
+	}
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, userName)
+		if err != nil {
+			return false, fmt.Errorf("bad user pattern [%s]: %w", pattern, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// export one user's solo into an encrypted zip, along with a manifest of what went in
+func exportSoloJam(user UserExportData, outputFile string, options SoloExportOptions) SoloExportResult {
+
+	result := SoloExportResult{User: user.UserName, Status: SoloExportStatusFailed}
+
+	// stream straight into the encrypted zip, no intermediate files
+	if options.Stream != nil {
+		streamOptions := *options.Stream
+		streamOptions.Format = JamArchiveZip
+		streamOptions.Password = user.LoginPass
+
+		plan, err := prepareJamStream(user.UserName, streamOptions)
+		if err == nil {
+			err = writeJamStreamToFile(plan, outputFile)
+		}
+		if err != nil {
+			result.Reason = err.Error()
+			return result
+		}
+		result.Status, result.File = SoloExportStatusExported, outputFile
+		return result
+	}
+
+	// grab the solo data from Couch and S3, should produce a .yaml, .tar and manifest
+	generatedFiles, err := exportJamToDisk(user.UserName, options.Export)
+	if err != nil {
+		result.Reason = err.Error()
+		return result
+	}
+	if !slices.ContainsFunc(generatedFiles, func(file string) bool { return strings.HasSuffix(file, ".tar") }) {
+		result.Status, result.Reason = SoloExportStatusSkipped, "no stems to archive"
+		return result
+	}
+
+	// compress those files into an encrypted .zip with the users' password
+	// so it's easy to archive these but with enough protection to stop idle snooping
+	if err = compressWithPassword(generatedFiles, user.LoginPass, outputFile); err != nil {
+		os.Remove(outputFile)
+		result.Reason = errors.Join(fmt.Errorf("compression failed"), err).Error()
+		return result
+	}
+	result.Status, result.File = SoloExportStatusExported, outputFile
+	return result
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// pick out the solos that pass the filters and export them, returning what happened to each
+func exportSoloJams(options SoloExportOptions) (*SoloExportReport, error) {
+
+	report := &SoloExportReport{StartTime: time.Now().Unix()}
+
+	couchClient, err := connectToCouchDB()
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Connection to CouchDB failed"), err)
+	}
+	defer couchClient.Close()
+
+	users, err := fetchAllUsersFromCouch(couchClient)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to list users"), err)
+	}
+
+	// create a special output root for all the encrypted results
+	soloEncFileRoot := path.Join(options.Export.OutputDir, "_solos")
+	os.MkdirAll(soloEncFileRoot, os.ModePerm)
+
+	// decide who to export before starting on anyone, so a bad pattern fails early
+	selectedUsers := []UserExportData{}
+	unselectedCount := 0
+	for _, user := range users {
+
+		matched, err := matchesAnyUserPattern(user.UserName, options.UserPatterns)
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			unselectedCount++
+			continue
+		}
+
+		skipped := func(reason string) {
+			report.Results = append(report.Results, SoloExportResult{User: user.UserName, Status: SoloExportStatusSkipped, Reason: reason})
+		}
+
+		// admin and service accounts live in _users too, but never get a solo
+		hasSolo, err := doesJamDatabaseExist(couchClient, user.UserName)
+		if err != nil {
+			report.Results = append(report.Results, SoloExportResult{User: user.UserName, Status: SoloExportStatusFailed, Reason: err.Error()})
+			continue
+		}
+		if !hasSolo {
+			skipped("no solo jam database")
+			continue
+		}
+
+		if options.SkipEmpty || !options.ActiveSince.IsZero() {
+			headRiff, err := getRiffHeadDataFromJam(user.UserName, couchClient)
+			if err != nil {
+				report.Results = append(report.Results, SoloExportResult{User: user.UserName, Status: SoloExportStatusFailed, Reason: err.Error()})
+				continue
+			}
+			if headRiff.Created == 0 && options.SkipEmpty {
+				skipped("solo jam is empty")
+				continue
+			}
+			if !options.ActiveSince.IsZero() && headRiff.Created < options.ActiveSince.UnixMilli() {
+				skipped(fmt.Sprintf("no riffs since %s", options.ActiveSince.Format(time.RFC3339)))
+				continue
+			}
+		}
+		selectedUsers = append(selectedUsers, user)
+	}
+	SysLog.Info("Solo export",
+		zap.Int("Selected", len(selectedUsers)),
+		zap.Int("Skipped", len(report.Results)),
+		zap.Int("NotMatched", unselectedCount),
+	)
+
+	parallel := options.Parallel
+	if parallel <= 0 {
+		parallel = 1
+	}
+
+	var resultsLock sync.Mutex
+	userQueue := make(chan UserExportData)
+	var workerGroup sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		workerGroup.Add(1)
+		go func() {
+			defer workerGroup.Done()
+
+			for user := range userQueue {
+				encFilePath := path.Join(soloEncFileRoot, fmt.Sprintf("%s.solo_encrypted.zip", user.UserName))
+				result := exportSoloJam(user, encFilePath, options)
+
+				switch result.Status {
+				case SoloExportStatusExported:
+					SysLog.Info("Exported user ["+user.UserName+"]", zap.String("File", result.File))
+				case SoloExportStatusSkipped:
+					SysLog.Warn("Ignoring user ["+user.UserName+"]", zap.String("Reason", result.Reason))
+				default:
+					SysLog.Error("[ExportSolo] Export process failed", zap.String("User", user.UserName), zap.String("Reason", result.Reason))
+				}
+
+				resultsLock.Lock()
+				report.Results = append(report.Results, result)
+				resultsLock.Unlock()
+			}
+		}()
+	}
+	for _, user := range selectedUsers {
+		userQueue <- user
+	}
+	close(userQueue)
+	workerGroup.Wait()
+
+	sort.SliceStable(report.Results, func(i, j int) bool { return report.Results[i].User < report.Results[j].User })
+	report.EndTime = time.Now().Unix()
+
+	reportJson, _ := json.MarshalIndent(report, "", "  ")
+	if err = os.WriteFile(path.Join(soloEncFileRoot, "exportsolo.report.json"), reportJson, 0644); err != nil {
+		SysLog.Warn("Unable to write solo export report", zap.Error(err))
+	}
+	return report, nil
+}
@@ -0,0 +1,458 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	kivik "github.com/go-kivik/kivik/v4"
+	"go.uber.org/zap"
+)
+
+const cStemDownloadDefaultWorkers int = 4
+const cStemDownloadDefaultRetries int = 3
+const cStemDownloadBaseBackoff time.Duration = 500 * time.Millisecond
+
+// partially downloaded stems sit alongside their final path with this on the end until they are complete and verified
+const cStemDownloadPartialSuffix string = ".part"
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// a non-200 response; kept as a type so the retry loop can tell missing files from transient server trouble
+type stemDownloadStatusError struct {
+	StatusCode int
+}
+
+func (e *stemDownloadStatusError) Error() string {
+	return fmt.Sprintf("error while downloading: %v", e.StatusCode)
+}
+
+// 4xx responses won't get any better by asking again, except for timeouts and rate limiting
+func isStemDownloadErrorPermanent(err error) bool {
+	var statusErr *stemDownloadStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 400 && statusErr.StatusCode < 500 &&
+			statusErr.StatusCode != http.StatusRequestTimeout &&
+			statusErr.StatusCode != http.StatusTooManyRequests
+	}
+	return false
+}
+
+// the studio's hash field has appeared both bare and as "algo:hex"; pick a hasher to match. returns nil if we can't tell
+func newStemHasher(expectedHash string) (hash.Hash, string) {
+
+	algorithm, digest, found := strings.Cut(expectedHash, ":")
+	if !found {
+		algorithm, digest = "", expectedHash
+	}
+	digest = strings.ToLower(digest)
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) == 0 {
+		return nil, ""
+	}
+
+	switch strings.ToLower(algorithm) {
+	case "md5":
+		return md5.New(), digest
+	case "sha1":
+		return sha1.New(), digest
+	case "sha256":
+		return sha256.New(), digest
+	case "":
+		switch len(digest) {
+		case md5.Size * 2:
+			return md5.New(), digest
+		case sha1.Size * 2:
+			return sha1.New(), digest
+		case sha256.Size * 2:
+			return sha256.New(), digest
+		}
+	}
+	return nil, ""
+}
+
+// check a file on disk against the length and (if we understand it) the hash recorded in the stem's endpoint data
+func verifyStemFile(filepath string, endpoint *EndpointAudio) error {
+
+	stemFile, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
+	defer stemFile.Close()
+
+	hasher, expectedDigest := newStemHasher(endpoint.Hash)
+	if hasher == nil {
+		hasher = md5.New() // only used to read through the file, result is ignored
+	}
+
+	bytesRead, err := io.Copy(hasher, stemFile)
+	if err != nil {
+		return err
+	}
+	if int64(endpoint.Length) != bytesRead {
+		return fmt.Errorf("stem file size mismatch, got %d, expected %d", bytesRead, endpoint.Length)
+	}
+	if len(expectedDigest) > 0 {
+		if digest := hex.EncodeToString(hasher.Sum(nil)); digest != expectedDigest {
+			return fmt.Errorf("stem file hash mismatch, got %s, expected %s", digest, expectedDigest)
+		}
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// fetch a stem into a .part file beside the destination, picking up where a previous attempt left off if the server supports
+// ranged requests; only once the whole thing is verified does it get renamed into place
+func downloadStem(stemStore *StemStore, endpoint *EndpointAudio, filepath string, progress *atomic.Int64) error {
+
+	partialPath := filepath + cStemDownloadPartialSuffix
+
+	var resumeFrom int64 = 0
+	if partialInfo, err := os.Stat(partialPath); err == nil {
+		resumeFrom = partialInfo.Size()
+		if resumeFrom >= int64(endpoint.Length) {
+			// too big to be a prefix of what we want, start again
+			os.Remove(partialPath)
+			resumeFrom = 0
+		}
+	}
+
+	req, err := stemStore.NewRequest(http.MethodGet, endpoint.Key, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resumeFrom > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", resumeFrom))
+	}
+
+	resp, err := stemStore.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	openFlags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		openFlags |= os.O_APPEND
+	case http.StatusOK:
+		// server ignored the range (or we didn't ask), write from scratch
+		openFlags |= os.O_TRUNC
+	default:
+		return &stemDownloadStatusError{StatusCode: resp.StatusCode}
+	}
+
+	out, err := os.OpenFile(partialPath, openFlags, 0644)
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader = resp.Body
+	if progress != nil {
+		body = io.TeeReader(resp.Body, &stemProgressCounter{progress})
+	}
+	_, err = io.Copy(out, body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// leave the .part file where it is, the next attempt will resume from it
+		return err
+	}
+
+	if err = verifyStemFile(partialPath, endpoint); err != nil {
+		// whatever we have is wrong, don't try to resume from it
+		os.Remove(partialPath)
+		return err
+	}
+	return os.Rename(partialPath, filepath)
+}
+
+type stemProgressCounter struct {
+	total *atomic.Int64
+}
+
+func (c *stemProgressCounter) Write(p []byte) (int, error) {
+	c.total.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+type StemDownloadJob struct {
+	StemID   string
+	Endpoint EndpointAudio
+	URL      string // for reporting; the request itself is built by the StemStore from the endpoint key
+	FilePath string
+}
+
+type StemDownloadFailure struct {
+	StemID   string `json:"stem_id"`
+	Key      string `json:"key"`
+	URL      string `json:"url"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+// written next to a jam's stem cache whenever an export couldn't fetch everything; the next export of that jam retries these first
+type StemDownloadManifest struct {
+	Updated int64                 `json:"updated"`
+	Failed  []StemDownloadFailure `json:"failed"`
+}
+
+func getStemDownloadManifestPath(outputDir string, exportLOREID string) string {
+	return path.Join(outputDir, "_stems", fmt.Sprintf("%s.failed.json", exportLOREID))
+}
+
+// returns nil with no error if the last export didn't leave anything behind
+func loadStemDownloadManifest(outputDir string, exportLOREID string) (*StemDownloadManifest, error) {
+
+	manifestJson, err := os.ReadFile(getStemDownloadManifestPath(outputDir, exportLOREID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest StemDownloadManifest
+	if err = json.Unmarshal(manifestJson, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// write out the failures, or clear the manifest away if there weren't any
+func saveStemDownloadManifest(outputDir string, exportLOREID string, failures []StemDownloadFailure) error {
+
+	manifestPath := getStemDownloadManifestPath(outputDir, exportLOREID)
+	if len(failures) == 0 {
+		err := os.Remove(manifestPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	os.MkdirAll(path.Dir(manifestPath), os.ModePerm)
+
+	manifestJson, _ := json.MarshalIndent(StemDownloadManifest{
+		Updated: time.Now().Unix(),
+		Failed:  failures,
+	}, "", "  ")
+	return os.WriteFile(manifestPath, manifestJson, 0644)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// periodically report how the download pool is getting on; a single rewritten line on a terminal, plain log lines otherwise
+func runStemDownloadProgress(done <-chan struct{}, totalJobs int, completed *atomic.Int64, failed *atomic.Int64, bytes *atomic.Int64) {
+
+	isTerminal := false
+	if stat, err := os.Stderr.Stat(); err == nil {
+		isTerminal = (stat.Mode() & os.ModeCharDevice) != 0
+	}
+
+	interval := 10 * time.Second
+	if isTerminal {
+		interval = 250 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	started := time.Now()
+	report := func() {
+		elapsed := time.Since(started).Seconds()
+		rate := uint64(0)
+		if elapsed > 0 {
+			rate = uint64(float64(bytes.Load()) / elapsed)
+		}
+		status := fmt.Sprintf("stems %d/%d, %d failed, %s (%s/s)",
+			completed.Load(),
+			totalJobs,
+			failed.Load(),
+			humanize.Bytes(uint64(bytes.Load())),
+			humanize.Bytes(rate),
+		)
+		if isTerminal {
+			fmt.Fprintf(os.Stderr, "\r%-80s", status)
+		} else {
+			SysLog.Info(status)
+		}
+	}
+
+	for {
+		select {
+		case <-done:
+			report()
+			if isTerminal {
+				fmt.Fprintln(os.Stderr)
+			}
+			return
+		case <-ticker.C:
+			report()
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// run a set of stem downloads across a fixed number of workers, retrying transient failures with exponential backoff. returns the
+// jobs that made it to disk and details of any that didn't
+func downloadStemsConcurrently(stemStore *StemStore, jobs []StemDownloadJob, workers int, retries int) ([]StemDownloadJob, []StemDownloadFailure) {
+
+	if workers <= 0 {
+		workers = cStemDownloadDefaultWorkers
+	}
+	if retries < 0 {
+		retries = 0
+	}
+
+	var completedCount, failedCount, bytesDownloaded atomic.Int64
+
+	progressDone := make(chan struct{})
+	progressFinished := make(chan struct{})
+	go func() {
+		runStemDownloadProgress(progressDone, len(jobs), &completedCount, &failedCount, &bytesDownloaded)
+		close(progressFinished)
+	}()
+
+	var resultsLock sync.Mutex
+	downloaded := []StemDownloadJob{}
+	failures := []StemDownloadFailure{}
+
+	jobQueue := make(chan StemDownloadJob)
+	var workerGroup sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		workerGroup.Add(1)
+		go func() {
+			defer workerGroup.Done()
+
+			for job := range jobQueue {
+				os.MkdirAll(path.Dir(job.FilePath), os.ModePerm)
+
+				var err error
+				attempt := 0
+				for {
+					attempt++
+					err = downloadStem(stemStore, &job.Endpoint, job.FilePath, &bytesDownloaded)
+					if err == nil || attempt > retries || isStemDownloadErrorPermanent(err) {
+						break
+					}
+					time.Sleep(cStemDownloadBaseBackoff * time.Duration(1<<(attempt-1)))
+				}
+
+				resultsLock.Lock()
+				if err == nil {
+					downloaded = append(downloaded, job)
+					completedCount.Add(1)
+				} else {
+					failures = append(failures, StemDownloadFailure{
+						StemID:   job.StemID,
+						Key:      job.Endpoint.Key,
+						URL:      job.URL,
+						Attempts: attempt,
+						Error:    err.Error(),
+					})
+					failedCount.Add(1)
+				}
+				resultsLock.Unlock()
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		jobQueue <- job
+	}
+	close(jobQueue)
+	workerGroup.Wait()
+
+	close(progressDone)
+	<-progressFinished
+
+	for _, failure := range failures {
+		SysLog.Warn("Stem download failed", zap.String("url", failure.URL), zap.Int("attempts", failure.Attempts), zap.String("error", failure.Error))
+	}
+	return downloaded, failures
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// a stem document and where its audio sits in the _stems cache
+type CachedStem struct {
+	Data     JamStemData
+	FilePath string
+}
+
+// make sure every stem playing in the given riffs is in the export _stems cache, downloading what's missing. returns the stems
+// in order of first use; any that couldn't be fetched are logged and left out
+func cacheRiffStems(jamDb *kivik.DB, stemStore *StemStore, riffs []JamRiffData, outputDir string, exportLOREID string, workers int, retries int) ([]CachedStem, error) {
+
+	cachedStems := []CachedStem{}
+	seen := map[string]bool{}
+	failed := map[string]bool{}
+	stemDownloadJobs := []StemDownloadJob{}
+
+	for i := range riffs {
+		for _, playback := range riffs[i].State.Playback {
+			slot := &playback.Slot.Current
+			if !slot.On || len(slot.CurrentLoop) == 0 || seen[slot.CurrentLoop] {
+				continue
+			}
+			seen[slot.CurrentLoop] = true
+
+			var stemData JamStemData
+			if err := jamDb.Get(context.TODO(), slot.CurrentLoop).ScanDoc(&stemData); err != nil {
+				SysLog.Warn("Unable to fetch stem", zap.String("Stem", slot.CurrentLoop), zap.Error(err))
+				continue
+			}
+			if !isUsableStemID(stemData.ID) {
+				SysLog.Warn("Stem has an unusable ID", zap.String("Stem", stemData.ID))
+				continue
+			}
+
+			stemFile := filepath.Join(outputDir, "_stems", exportLOREID, stemData.ID[0:1], stemData.ID)
+			cachedStems = append(cachedStems, CachedStem{stemData, stemFile})
+
+			if _, err := os.Stat(stemFile); errors.Is(err, os.ErrNotExist) {
+				if stemStore == nil {
+					return nil, fmt.Errorf("stem [%s] isn't cached and no stem server is configured", stemData.ID)
+				}
+				cdnEndpoint := getActiveEndpoint(stemData)
+				stemDownloadJobs = append(stemDownloadJobs, StemDownloadJob{
+					StemID:   stemData.ID,
+					Endpoint: *cdnEndpoint,
+					URL:      stemStore.ObjectURL(cdnEndpoint.Key),
+					FilePath: stemFile,
+				})
+			}
+		}
+	}
+
+	if len(stemDownloadJobs) > 0 {
+		SysLog.Info("Downloading stems", zap.Int("Count", len(stemDownloadJobs)))
+		_, failures := downloadStemsConcurrently(stemStore, stemDownloadJobs, workers, retries)
+		for _, failure := range failures {
+			failed[failure.StemID] = true
+		}
+	}
+
+	return slices.DeleteFunc(cachedStems, func(stem CachedStem) bool {
+		return failed[stem.Data.ID]
+	}), nil
+}
@@ -0,0 +1,576 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Unbundlesss/OUROCOSM/ocServer/cmd/internal/lore"
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+
+	zip2 "github.com/kdungs/zip"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// streamed exports write the LORE .yaml, stem .tar and their manifest as entries of a single compressed (or encrypted) container,
+// pulling stems from S3 straight into it; nothing touches the disk and only the YAML (metadata, not audio) is ever held in memory
+type JamArchiveFormat string
+
+const (
+	JamArchiveTarZstd JamArchiveFormat = "tar.zst"
+	JamArchiveTarGzip JamArchiveFormat = "tar.gz"
+	JamArchiveZip     JamArchiveFormat = "zip" // AES-256 encrypted entries, needs a password
+)
+
+func parseJamArchiveFormat(format string) (JamArchiveFormat, error) {
+	switch JamArchiveFormat(strings.TrimPrefix(strings.ToLower(format), ".")) {
+	case JamArchiveTarZstd:
+		return JamArchiveTarZstd, nil
+	case JamArchiveTarGzip:
+		return JamArchiveTarGzip, nil
+	case JamArchiveZip:
+		return JamArchiveZip, nil
+	}
+	return "", fmt.Errorf("unknown archive format [%s], expected one of tar.zst, tar.gz, zip", format)
+}
+
+func (format JamArchiveFormat) ContentType() string {
+	switch format {
+	case JamArchiveTarZstd:
+		return "application/zstd"
+	case JamArchiveTarGzip:
+		return "application/gzip"
+	}
+	return "application/zip"
+}
+
+type JamStreamOptions struct {
+	ServerNamePrefix    string
+	StemS3Server        string // as per JamExportOptions; with no stem store, the archive only carries the .yaml
+	IgnoreMissingStems  bool   // check every stem up front and leave out any that can't be fetched
+	StemDownloadWorkers int    // concurrency for that up-front check
+	StemDownloadRetries int    // attempts to resume a stem that drops out mid-stream
+	Format              JamArchiveFormat
+	Password            string // for JamArchiveZip
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// everything we need to know before the first byte goes out; built by prepareJamStream, consumed by Write
+type JamStreamPlan struct {
+	BaseName string // orx.[prefix]_name.id, as the on-disk export would use
+	FileName string // BaseName plus the container extension
+
+	options   JamStreamOptions
+	loreID    string
+	yamlData  []byte
+	stems     []streamedStem
+	manifest  JamExportManifest // counts and missing stems filled in up front, checksums as the container is written
+	stemStore *StemStore
+	created   time.Time
+}
+
+type streamedStem struct {
+	ID       string
+	Endpoint EndpointAudio
+}
+
+// build the YAML and the list of stems to fetch
+func prepareJamStream(jamToExport string, options JamStreamOptions) (*JamStreamPlan, error) {
+
+	if len(jamToExport) == 0 {
+		return nil, fmt.Errorf("Jam to export cannot be null")
+	}
+	if options.Format == JamArchiveZip && len(options.Password) == 0 {
+		return nil, fmt.Errorf("encrypted zip export needs a password")
+	}
+
+	stemStore, err := resolveStemStore(options.StemS3Server)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to configure stem storage"), err)
+	}
+
+	exportCouchID, exportLOREID, jamProfileDisplayNameUnsanitised := deduceOutputParametersForJam(jamToExport)
+
+	couchClient, err := connectToCouchDB()
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Connection to CouchDB failed"), err)
+	}
+	defer couchClient.Close()
+
+	jamDb := couchClient.DB(fmt.Sprintf("user_appdata$%s", exportCouchID))
+
+	jamProfileDisplayNameUnsanitised, err = getJamProfileDisplayName(jamDb, jamToExport, exportCouchID, jamProfileDisplayNameUnsanitised)
+	if err != nil {
+		return nil, err
+	}
+	jamProfileDisplayName := sanitiseNameForPath(jamProfileDisplayNameUnsanitised, '_', false)
+
+	plan := &JamStreamPlan{
+		BaseName:  fmt.Sprintf("orx.[%s]_%s.%s", strings.ToLower(options.ServerNamePrefix), jamProfileDisplayName, exportLOREID),
+		options:   options,
+		loreID:    exportLOREID,
+		stemStore: stemStore,
+		created:   time.Now(),
+	}
+	plan.FileName = fmt.Sprintf("%s.%s", plan.BaseName, options.Format)
+
+	var yamlBuffer bytes.Buffer
+	loreWriter := lore.NewWriter(&yamlBuffer)
+	loreWriter.WriteHeader(&lore.Header{
+		ServerName:     options.ServerNamePrefix,
+		ExportTimeUnix: plan.created.Unix(),
+		JamName:        fmt.Sprintf("[%s] %s", options.ServerNamePrefix, jamProfileDisplayNameUnsanitised),
+		JamCouchID:     exportLOREID,
+	})
+
+	plan.manifest = JamExportManifest{
+		Jam:        exportLOREID,
+		ExportTime: plan.created.Unix(),
+	}
+
+	err = forEachJamDocumentByCreateTime(jamDb, "rifffsByCreateTime", func(resultData JamRiffData) error {
+		plan.manifest.Riffs++
+		return loreWriter.WriteRiff(loreRiffFromJamRiff(&resultData))
+	})
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Failed while reading riff documents"), err)
+	}
+	err = forEachJamDocumentByCreateTime(jamDb, "loopsByCreateTime", func(resultData JamStemData) error {
+		if stemStore != nil {
+			// the ID names the stem's entry in the archive, so one that could climb out of <lore id>/ is left out
+			if isUsableStemID(resultData.ID) {
+				plan.stems = append(plan.stems, streamedStem{ID: resultData.ID, Endpoint: *getActiveEndpoint(resultData)})
+			} else {
+				SysLog.Warn("Stem has an unusable ID", zap.String("Stem", resultData.ID))
+				plan.manifest.MissingStems = append(plan.manifest.MissingStems, resultData.ID)
+			}
+		}
+		plan.manifest.Stems++
+		return loreWriter.WriteStem(loreStemFromJamStem(&resultData))
+	})
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Failed while reading stem documents"), err)
+	}
+	err = forEachJamDocumentByCreateTime(jamDb, "chatsByCreateTime", func(resultData JamChatData) error {
+		return loreWriter.WriteChat(loreChatFromJamChat(&resultData))
+	})
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Failed while reading chat documents"), err)
+	}
+	if err = loreWriter.Close(); err != nil {
+		return nil, err
+	}
+	plan.yamlData = yamlBuffer.Bytes()
+
+	// once the stem .tar header is out we're committed to its size, so anything we might not be able to fetch has to be
+	// weeded out beforehand
+	if options.IgnoreMissingStems && len(plan.stems) > 0 {
+		availableStems := filterAvailableStems(stemStore, plan.stems, options.StemDownloadWorkers)
+
+		stemAvailable := make(map[string]bool, len(availableStems))
+		for _, stem := range availableStems {
+			stemAvailable[stem.ID] = true
+		}
+		for _, stem := range plan.stems {
+			if !stemAvailable[stem.ID] {
+				plan.manifest.MissingStems = append(plan.manifest.MissingStems, stem.ID)
+			}
+		}
+		plan.stems = availableStems
+	}
+
+	SysLog.Info("Streamed export prepared",
+		zap.String("Jam", jamToExport),
+		zap.String("File", plan.FileName),
+		zap.Int("YAMLBytes", len(plan.yamlData)),
+		zap.Int("Stems", len(plan.stems)),
+	)
+	return plan, nil
+}
+
+// HEAD every stem, keeping only those that are there and the size we expect
+func filterAvailableStems(stemStore *StemStore, stems []streamedStem, workers int) []streamedStem {
+
+	if workers <= 0 {
+		workers = cStemDownloadDefaultWorkers
+	}
+
+	available := make([]bool, len(stems))
+	stemIndices := make(chan int)
+
+	var workerGroup sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		workerGroup.Add(1)
+		go func() {
+			defer workerGroup.Done()
+			for i := range stemIndices {
+				err := checkStemAvailable(stemStore, &stems[i].Endpoint)
+				if err != nil {
+					SysLog.Warn("Stem unavailable, leaving it out", zap.String("ID", stems[i].ID), zap.Error(err))
+				}
+				available[i] = err == nil
+			}
+		}()
+	}
+	for i := range stems {
+		stemIndices <- i
+	}
+	close(stemIndices)
+	workerGroup.Wait()
+
+	result := make([]streamedStem, 0, len(stems))
+	for i, stem := range stems {
+		if available[i] {
+			result = append(result, stem)
+		}
+	}
+	return result
+}
+
+// the object is there but isn't the length its Loop document says
+var errStemSizeMismatch = errors.New("stem file size mismatch")
+
+func checkStemAvailable(stemStore *StemStore, endpoint *EndpointAudio) error {
+
+	req, err := stemStore.NewRequest(http.MethodHead, endpoint.Key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := stemStore.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &stemDownloadStatusError{StatusCode: resp.StatusCode}
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength != int64(endpoint.Length) {
+		return fmt.Errorf("%w, got %d, expected %d", errStemSizeMismatch, resp.ContentLength, endpoint.Length)
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// the outer container; entries must declare their size up front, as tar needs it in the header
+type jamArchiveContainer interface {
+	addFile(name string, size int64, modTime time.Time, write func(io.Writer) error) error
+	Close() error
+}
+
+type tarArchiveContainer struct {
+	compressor io.WriteCloser
+	tw         *tar.Writer
+}
+
+func (container *tarArchiveContainer) addFile(name string, size int64, modTime time.Time, write func(io.Writer) error) error {
+	err := container.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	return write(container.tw)
+}
+
+func (container *tarArchiveContainer) Close() error {
+	return errors.Join(container.tw.Close(), container.compressor.Close())
+}
+
+type zipArchiveContainer struct {
+	zw       *zip2.Writer
+	password string
+}
+
+func (container *zipArchiveContainer) addFile(name string, size int64, modTime time.Time, write func(io.Writer) error) error {
+	w, err := container.zw.Encrypt(name, container.password, zip2.AES256Encryption)
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to create encrypted entry [%s] in zip file", name), err)
+	}
+	return write(w)
+}
+
+func (container *zipArchiveContainer) Close() error {
+	return container.zw.Close()
+}
+
+func newJamArchiveContainer(w io.Writer, format JamArchiveFormat, password string) (jamArchiveContainer, error) {
+	switch format {
+	case JamArchiveTarZstd:
+		compressor, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchiveContainer{compressor: compressor, tw: tar.NewWriter(compressor)}, nil
+	case JamArchiveTarGzip:
+		compressor := gzip.NewWriter(w)
+		return &tarArchiveContainer{compressor: compressor, tw: tar.NewWriter(compressor)}, nil
+	case JamArchiveZip:
+		return &zipArchiveContainer{zw: zip2.NewWriter(w), password: password}, nil
+	}
+	return nil, fmt.Errorf("unknown archive format [%s]", format)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// the stem .tar inside the container follows the same <lore id>/<first character>/<stem id> layout as the on-disk export
+
+type countingWriter struct {
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.count += int64(len(p))
+	return len(p), nil
+}
+
+func (plan *JamStreamPlan) stemTarHeaders() []*tar.Header {
+
+	headers := []*tar.Header{{
+		Typeflag: tar.TypeDir,
+		Name:     plan.loreID + "/",
+		Mode:     0755,
+		ModTime:  plan.created,
+	}}
+	seenDirectories := make(map[string]bool)
+	for _, stem := range plan.stems {
+		directory := plan.loreID + "/" + stem.ID[0:1] + "/"
+		if !seenDirectories[directory] {
+			seenDirectories[directory] = true
+			headers = append(headers, &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     directory,
+				Mode:     0755,
+				ModTime:  plan.created,
+			})
+		}
+	}
+	for _, stem := range plan.stems {
+		headers = append(headers, &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     plan.loreID + "/" + stem.ID[0:1] + "/" + stem.ID,
+			Size:     int64(stem.Endpoint.Length),
+			Mode:     0644,
+			ModTime:  plan.created,
+		})
+	}
+	return headers
+}
+
+// work out exactly how big the stem .tar will be without writing any of it; header blocks are measured by really encoding
+// them (so long names turning into PAX records are accounted for), file data is padded to 512-byte blocks, plus the two
+// zero blocks at the end
+func stemTarSize(headers []*tar.Header) (int64, error) {
+	var total int64 = 0
+	for _, header := range headers {
+		counter := &countingWriter{}
+		if err := tar.NewWriter(counter).WriteHeader(header); err != nil {
+			return 0, err
+		}
+		total += counter.count + ((header.Size+511)/512)*512
+	}
+	return total + 1024, nil
+}
+
+// pull a stem from the store into w, resuming with a ranged request if the connection drops part way; every byte that goes out
+// is hashed so we can at least report a bad stem, even if we can't take it back
+func streamStemTo(w io.Writer, stemStore *StemStore, endpoint *EndpointAudio, retries int) error {
+
+	hasher, expectedDigest := newStemHasher(endpoint.Hash)
+	var written int64 = 0
+
+	attempt := 0
+	for {
+		attempt++
+		err := func() error {
+			req, err := stemStore.NewRequest(http.MethodGet, endpoint.Key, nil, nil)
+			if err != nil {
+				return err
+			}
+			if written > 0 {
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+			}
+			resp, err := stemStore.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			switch resp.StatusCode {
+			case http.StatusPartialContent:
+			case http.StatusOK:
+				// no range support, skip what we already sent
+				if _, err = io.CopyN(io.Discard, resp.Body, written); err != nil {
+					return err
+				}
+			default:
+				return &stemDownloadStatusError{StatusCode: resp.StatusCode}
+			}
+
+			remaining := int64(endpoint.Length) - written
+			destination := w
+			if hasher != nil {
+				destination = io.MultiWriter(w, hasher)
+			}
+			copied, err := io.CopyN(destination, resp.Body, remaining)
+			written += copied
+			if err == io.EOF {
+				return fmt.Errorf("stem file size mismatch, got %d, expected %d", written, endpoint.Length)
+			}
+			return err
+		}()
+		if err == nil {
+			break
+		}
+		if attempt > retries || isStemDownloadErrorPermanent(err) {
+			return err
+		}
+		time.Sleep(cStemDownloadBaseBackoff * time.Duration(1<<(attempt-1)))
+	}
+
+	if hasher != nil {
+		if digest := fmt.Sprintf("%x", hasher.Sum(nil)); digest != expectedDigest {
+			return fmt.Errorf("stem file hash mismatch, got %s, expected %s", digest, expectedDigest)
+		}
+	}
+	return nil
+}
+
+func (plan *JamStreamPlan) writeStemTar(w io.Writer, headers []*tar.Header) error {
+
+	tw := tar.NewWriter(w)
+	stemIndex := 0
+	for _, header := range headers {
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		stem := &plan.stems[stemIndex]
+		stemIndex++
+		stemHasher := sha256.New()
+		if err := streamStemTo(io.MultiWriter(tw, stemHasher), plan.stemStore, &stem.Endpoint, plan.options.StemDownloadRetries); err != nil {
+			return errors.Join(fmt.Errorf("Stem download failed [%s]", plan.stemStore.ObjectURL(stem.Endpoint.Key)), err)
+		}
+		plan.manifest.StemFiles = append(plan.manifest.StemFiles, JamExportManifestFile{
+			Name:   stem.ID,
+			Size:   header.Size,
+			SHA256: fmt.Sprintf("%x", stemHasher.Sum(nil)),
+		})
+	}
+	return tw.Close()
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// write the whole container out; if this fails part way the output is incomplete and should be thrown away
+func (plan *JamStreamPlan) Write(w io.Writer) error {
+
+	container, err := newJamArchiveContainer(w, plan.options.Format, plan.options.Password)
+	if err != nil {
+		return err
+	}
+
+	manifest := &plan.manifest
+	manifest.Files, manifest.StemFiles = nil, nil
+
+	err = container.addFile(plan.BaseName+".yaml", int64(len(plan.yamlData)), plan.created, func(entry io.Writer) error {
+		_, err := entry.Write(plan.yamlData)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	manifest.Files = append(manifest.Files, JamExportManifestFile{
+		Name:   plan.BaseName + ".yaml",
+		Size:   int64(len(plan.yamlData)),
+		SHA256: fmt.Sprintf("%x", sha256.Sum256(plan.yamlData)),
+	})
+
+	if len(plan.stems) > 0 {
+		headers := plan.stemTarHeaders()
+		tarSize, err := stemTarSize(headers)
+		if err != nil {
+			return err
+		}
+		tarHasher := sha256.New()
+		err = container.addFile(plan.BaseName+".tar", tarSize, plan.created, func(entry io.Writer) error {
+			return plan.writeStemTar(io.MultiWriter(entry, tarHasher), headers)
+		})
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, JamExportManifestFile{
+			Name:   plan.BaseName + ".tar",
+			Size:   tarSize,
+			SHA256: fmt.Sprintf("%x", tarHasher.Sum(nil)),
+		})
+	}
+
+	// the checksums are only known once everything else is out, so the manifest goes last
+	manifestJson, _ := json.MarshalIndent(manifest, "", "  ")
+	err = container.addFile(plan.BaseName+".manifest.json", int64(len(manifestJson)), plan.created, func(entry io.Writer) error {
+		_, err := entry.Write(manifestJson)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return container.Close()
+}
+
+// streamed export to a single file under <out>/_archives
+func exportJamToArchive(jamToExport string, outputDir string, options JamStreamOptions) (string, error) {
+
+	plan, err := prepareJamStream(jamToExport, options)
+	if err != nil {
+		return "", err
+	}
+	return plan.FileName, writeJamStreamToFile(plan, path.Join(outputDir, "_archives", plan.FileName))
+}
+
+func writeJamStreamToFile(plan *JamStreamPlan, outputPath string) error {
+
+	os.MkdirAll(path.Dir(outputPath), os.ModePerm)
+
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	bufferedOutput := bufio.NewWriter(outputFile)
+
+	err = plan.Write(bufferedOutput)
+	if err == nil {
+		err = bufferedOutput.Flush()
+	}
+	if closeErr := outputFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outputPath)
+		return err
+	}
+	return nil
+}
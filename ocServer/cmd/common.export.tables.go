@@ -0,0 +1,304 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Unbundlesss/OUROCOSM/ocServer/cmd/internal/tables"
+	kivik "github.com/go-kivik/kivik/v4"
+	"go.uber.org/zap"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// normalised layout of a jam's metadata; times are unix seconds, matching LORE
+
+var jamTableRiffs = &tables.Table{
+	Name: "riffs",
+	Columns: []tables.Column{
+		{Name: "id", Type: tables.Text, PrimaryKey: true},
+		{Name: "user", Type: tables.Text},
+		{Name: "created", Type: tables.Integer},
+		{Name: "root", Type: tables.Integer},
+		{Name: "scale", Type: tables.Integer},
+		{Name: "bps", Type: tables.Real},
+		{Name: "bpm", Type: tables.Real},
+		{Name: "bar_length", Type: tables.Integer},
+		{Name: "magnitude", Type: tables.Real},
+		{Name: "app_version", Type: tables.Integer},
+	},
+	Indices: [][]string{{"user"}, {"created"}},
+}
+
+var jamTableStems = &tables.Table{
+	Name: "stems",
+	Columns: []tables.Column{
+		{Name: "id", Type: tables.Text, PrimaryKey: true},
+		{Name: "user", Type: tables.Text},
+		{Name: "created", Type: tables.Integer},
+		{Name: "preset", Type: tables.Text},
+		{Name: "colour", Type: tables.Text},
+		{Name: "bps", Type: tables.Real},
+		{Name: "bpm", Type: tables.Real},
+		{Name: "bar_length", Type: tables.Integer},
+		{Name: "length_16ths", Type: tables.Integer},
+		{Name: "original_pitch", Type: tables.Integer},
+		{Name: "sample_rate", Type: tables.Integer},
+		{Name: "mime", Type: tables.Text},
+		{Name: "file_key", Type: tables.Text},
+		{Name: "file_length", Type: tables.Integer},
+		{Name: "is_drum", Type: tables.Boolean},
+		{Name: "is_note", Type: tables.Boolean},
+		{Name: "is_bass", Type: tables.Boolean},
+		{Name: "is_mic", Type: tables.Boolean},
+	},
+	Indices: [][]string{{"user"}, {"created"}},
+}
+
+// one row per riff per slot that had a loop in it, playing or not
+var jamTableRiffSlots = &tables.Table{
+	Name: "riff_slots",
+	Columns: []tables.Column{
+		{Name: "riff_id", Type: tables.Text, PrimaryKey: true},
+		{Name: "slot", Type: tables.Integer, PrimaryKey: true},
+		{Name: "stem_id", Type: tables.Text},
+		{Name: "gain", Type: tables.Real},
+		{Name: "playing", Type: tables.Boolean},
+	},
+	Indices: [][]string{{"stem_id"}},
+}
+
+// everyone who left a trace in the jam, rolled up from the other tables
+var jamTableUsers = &tables.Table{
+	Name: "users",
+	Columns: []tables.Column{
+		{Name: "name", Type: tables.Text, PrimaryKey: true},
+		{Name: "riffs", Type: tables.Integer},
+		{Name: "stems", Type: tables.Integer},
+		{Name: "chat_messages", Type: tables.Integer},
+		{Name: "first_active", Type: tables.Integer},
+		{Name: "last_active", Type: tables.Integer},
+	},
+}
+
+var jamTableChat = &tables.Table{
+	Name: "chat",
+	Columns: []tables.Column{
+		{Name: "id", Type: tables.Text, PrimaryKey: true},
+		{Name: "user", Type: tables.Text},
+		{Name: "created", Type: tables.Integer},
+		{Name: "message", Type: tables.Text},
+	},
+	Indices: [][]string{{"user"}, {"created"}},
+}
+
+// what an empty slot's currentLoop is set to in riffs that have had something in that slot before
+const cJamTableNullStemID = "00000000000000000000000000000000"
+
+type jamTableUser struct {
+	riffs, stems, chatMessages int
+	firstActive, lastActive    int64
+}
+
+func (user *jamTableUser) touch(createdUnix int64) {
+	if user.firstActive == 0 || createdUnix < user.firstActive {
+		user.firstActive = createdUnix
+	}
+	if createdUnix > user.lastActive {
+		user.lastActive = createdUnix
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// write a jam's (or one session's) riffs, stems, slot usage, users and chat into tables for offline querying; format is
+// either cExportFormatSQLite for a single .sqlite database, or cExportFormatCSV for a directory of .csv files
+func exportJamToTables(jamToExport string, format string, options JamExportOptions) (string, error) {
+
+	if len(jamToExport) == 0 {
+		return "", fmt.Errorf("Jam to export cannot be null")
+	}
+
+	exportCouchID, exportLOREID, jamProfileDisplayNameUnsanitised := deduceOutputParametersForJam(jamToExport)
+
+	couchClient, err := connectToCouchDB()
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("Connection to CouchDB failed"), err)
+	}
+	defer couchClient.Close()
+
+	jamDb := couchClient.DB(fmt.Sprintf("user_appdata$%s", exportCouchID))
+
+	jamProfileDisplayNameUnsanitised, err = getJamProfileDisplayName(jamDb, jamToExport, exportCouchID, jamProfileDisplayNameUnsanitised)
+	if err != nil {
+		return "", err
+	}
+	jamProfileDisplayName := sanitiseNameForPath(jamProfileDisplayNameUnsanitised, '_', false)
+	if options.Session != nil {
+		jamProfileDisplayName = fmt.Sprintf("%s_%s", jamProfileDisplayName, options.Session.Label())
+	}
+
+	tablesDir := filepath.Join(options.OutputDir, "_tables")
+	os.MkdirAll(tablesDir, os.ModePerm)
+	tablesBasePath := filepath.Join(tablesDir, fmt.Sprintf("orx.[%s]_%s.%s", strings.ToLower(options.ServerNamePrefix), jamProfileDisplayName, exportLOREID))
+
+	var tableWriter tables.Writer
+	switch format {
+	case cExportFormatSQLite:
+		tablesBasePath += ".sqlite"
+		tableWriter, err = tables.NewSQLiteWriter(tablesBasePath)
+	case cExportFormatCSV:
+		tableWriter, err = tables.NewCSVWriter(tablesBasePath)
+	default:
+		return "", fmt.Errorf("unknown table format [%s]", format)
+	}
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("Unable to create table output [%s]", tablesBasePath), err)
+	}
+
+	err = writeJamTables(jamDb, tableWriter, options.Session)
+	if closeErr := tableWriter.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.RemoveAll(tablesBasePath)
+		return "", err
+	}
+
+	SysLog.Info("Exported jam tables", zap.String("Output", tablesBasePath))
+	return tablesBasePath, nil
+}
+
+func writeJamTables(jamDb *kivik.DB, tableWriter tables.Writer, session *JamSession) error {
+
+	for _, table := range []*tables.Table{jamTableRiffs, jamTableStems, jamTableRiffSlots, jamTableUsers, jamTableChat} {
+		if err := tableWriter.Create(table); err != nil {
+			return err
+		}
+	}
+
+	users := map[string]*jamTableUser{}
+	getUser := func(name string) *jamTableUser {
+		user, ok := users[name]
+		if !ok {
+			user = &jamTableUser{}
+			users[name] = user
+		}
+		return user
+	}
+
+	// riffs first, so a session export knows which stems to keep
+	sessionStemIDs := map[string]bool{}
+	riffCount := 0
+	writeRiff := func(riffData JamRiffData) error {
+		riff := loreRiffFromJamRiff(&riffData)
+
+		err := tableWriter.Insert(jamTableRiffs.Name,
+			riff.ID, riff.User, riff.CreatedUnix, riff.Root, riff.Scale,
+			riff.BPS, riff.BPS*60, riff.BarLength, riff.Magnitude, riff.AppVersion,
+		)
+		if err != nil {
+			return err
+		}
+		for slotIndex, playback := range riffData.State.Playback {
+			slot := &playback.Slot.Current
+			if len(slot.CurrentLoop) == 0 || slot.CurrentLoop == cJamTableNullStemID {
+				continue
+			}
+			if err := tableWriter.Insert(jamTableRiffSlots.Name, riff.ID, slotIndex, slot.CurrentLoop, slot.Gain, slot.On); err != nil {
+				return err
+			}
+			if slot.On {
+				sessionStemIDs[slot.CurrentLoop] = true
+			}
+		}
+
+		user := getUser(riff.User)
+		user.riffs++
+		user.touch(riff.CreatedUnix)
+		riffCount++
+		return nil
+	}
+
+	stemCount := 0
+	writeStem := func(stemData JamStemData) error {
+		if session != nil && !sessionStemIDs[stemData.ID] {
+			return nil
+		}
+		stem := loreStemFromJamStem(&stemData)
+
+		err := tableWriter.Insert(jamTableStems.Name,
+			stem.ID, stem.User, stem.CreatedUnix, stem.Preset, stem.Colour,
+			stem.BPS, stem.BPS*60, stem.BarLength, stem.Length16ths, stem.OriginalPitch, stem.SampleRate,
+			stem.Mime, stem.Key, stem.Length,
+			stem.IsDrum, stem.IsNote, stem.IsBass, stem.IsMic,
+		)
+		if err != nil {
+			return err
+		}
+
+		user := getUser(stem.User)
+		user.stems++
+		user.touch(stem.CreatedUnix)
+		stemCount++
+		return nil
+	}
+
+	chatCount := 0
+	writeChat := func(chatData JamChatData) error {
+		createdUnix := chatData.Created / 1000 // convert from unixmilli
+
+		if err := tableWriter.Insert(jamTableChat.Name, chatData.ID, chatData.UserName, createdUnix, chatData.Message); err != nil {
+			return err
+		}
+
+		user := getUser(chatData.UserName)
+		user.chatMessages++
+		user.touch(createdUnix)
+		chatCount++
+		return nil
+	}
+
+	var err error
+	if session != nil {
+		err = forEachJamDocumentCreatedBetween(jamDb, "rifffsByCreateTime", session.Start.UnixMilli(), session.End.UnixMilli(), writeRiff)
+	} else {
+		err = forEachJamDocumentByCreateTime(jamDb, "rifffsByCreateTime", writeRiff)
+	}
+	if err != nil {
+		return errors.Join(fmt.Errorf("Failed while reading riff documents"), err)
+	}
+	if err = forEachJamDocumentByCreateTime(jamDb, "loopsByCreateTime", writeStem); err != nil {
+		return errors.Join(fmt.Errorf("Failed while reading stem documents"), err)
+	}
+	if session != nil {
+		err = forEachJamDocumentCreatedBetween(jamDb, "chatsByCreateTime", session.Start.UnixMilli(), session.End.UnixMilli(), writeChat)
+	} else {
+		err = forEachJamDocumentByCreateTime(jamDb, "chatsByCreateTime", writeChat)
+	}
+	if err != nil {
+		return errors.Join(fmt.Errorf("Failed while reading chat documents"), err)
+	}
+
+	userNames := make([]string, 0, len(users))
+	for name := range users {
+		userNames = append(userNames, name)
+	}
+	sort.Strings(userNames)
+	for _, name := range userNames {
+		user := users[name]
+		if err := tableWriter.Insert(jamTableUsers.Name, name, user.riffs, user.stems, user.chatMessages, user.firstActive, user.lastActive); err != nil {
+			return err
+		}
+	}
+
+	SysLog.Info(fmt.Sprintf(" ... wrote %d riffs, %d stems, %d chat messages, %d users", riffCount, stemCount, chatCount, len(userNames)))
+	return nil
+}
@@ -0,0 +1,237 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/Unbundlesss/OUROCOSM/ocServer/cmd/internal/lore"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// what 'export verify' found; an export is good if every list is empty
+type JamVerifyReport struct {
+	Manifest      string
+	FilesChecked  int
+	StemsChecked  int
+	CorruptFiles  []string // "name: reason" for anything that doesn't match its manifest entry
+	MissingFiles  []string // files (or stem IDs) the manifest lists that aren't there
+	MissingStems  []string // stems in the .yaml with no audio that the manifest doesn't have either
+	DanglingRiffs []string // "riff -> stem" for riff slots pointing at a stem that isn't in the export, or has no audio
+	Mismatches    []string // counts that disagree with the manifest
+}
+
+func (report *JamVerifyReport) OK() bool {
+	return len(report.CorruptFiles) == 0 &&
+		len(report.MissingFiles) == 0 &&
+		len(report.MissingStems) == 0 &&
+		len(report.DanglingRiffs) == 0 &&
+		len(report.Mismatches) == 0
+}
+
+func checkAgainstManifest(expected JamExportManifestFile, actual JamExportManifestFile) string {
+	if actual.Size != expected.Size {
+		return fmt.Sprintf("%s: size %d, expected %d", expected.Name, actual.Size, expected.Size)
+	}
+	if actual.SHA256 != expected.SHA256 {
+		return fmt.Sprintf("%s: sha256 %s, expected %s", expected.Name, actual.SHA256, expected.SHA256)
+	}
+	return ""
+}
+
+// stem IDs double as file names in the stem cache and .tar, so one that's empty or could step out of its folder can only be damage
+func isUsableStemID(stemID string) bool {
+	return len(stemID) > 0 && stemID != "." && stemID != ".." && !strings.ContainsAny(stemID, "/\\")
+}
+
+// a _stems/<lore id> cache directory has no manifest of its own; look for the one export of that jam in the neighbouring _archives
+func findManifestForStemCache(stemCacheDir string) (string, error) {
+
+	exportLOREID := filepath.Base(filepath.Clean(stemCacheDir))
+	archiveRoot := filepath.Join(filepath.Dir(filepath.Dir(filepath.Clean(stemCacheDir))), "_archives")
+
+	candidates, _ := filepath.Glob(filepath.Join(archiveRoot, fmt.Sprintf("*.%s.manifest.json", exportLOREID)))
+	switch len(candidates) {
+	case 0:
+		return "", fmt.Errorf("no manifest for [%s] found in [%s], use --manifest", exportLOREID, archiveRoot)
+	case 1:
+		return candidates[0], nil
+	}
+	return "", fmt.Errorf("several manifests for [%s] in [%s], pick one with --manifest: %s", exportLOREID, archiveRoot, strings.Join(candidates, ", "))
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// re-check an on-disk export against its manifest. target is the export's .yaml or .manifest.json, in which case the stems are
+// checked inside the .tar; or a _stems/<lore id> cache directory, in which case the cached stem files are checked instead.
+// manifestPath overrides where the manifest is read from
+func verifyJamExport(target string, manifestPath string) (*JamVerifyReport, error) {
+
+	targetInfo, err := os.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+	stemCacheDir := ""
+	if targetInfo.IsDir() {
+		stemCacheDir = target
+	}
+
+	if len(manifestPath) == 0 {
+		switch {
+		case len(stemCacheDir) > 0:
+			if manifestPath, err = findManifestForStemCache(stemCacheDir); err != nil {
+				return nil, err
+			}
+		case strings.HasSuffix(target, ".manifest.json"):
+			manifestPath = target
+		case strings.HasSuffix(target, ".yaml"):
+			manifestPath = getJamExportManifestPath(target)
+		default:
+			return nil, fmt.Errorf("expected a .yaml, .manifest.json or _stems directory, got [%s]", target)
+		}
+	}
+	manifest, err := loadJamExportManifest(manifestPath)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to read manifest [%s]", manifestPath), err)
+	}
+	archiveDir := filepath.Dir(manifestPath)
+
+	report := &JamVerifyReport{Manifest: manifestPath}
+
+	// the .yaml and .tar themselves
+	yamlPath, tarPath := "", ""
+	for _, expected := range manifest.Files {
+		filePath := filepath.Join(archiveDir, expected.Name)
+		switch {
+		case strings.HasSuffix(expected.Name, ".yaml"):
+			yamlPath = filePath
+		case strings.HasSuffix(expected.Name, ".tar"):
+			tarPath = filePath
+			// checking the cache, the .tar doesn't need to be there
+			if len(stemCacheDir) > 0 {
+				if _, err := os.Stat(filePath); errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+			}
+		}
+
+		actual, err := hashJamExportFile(filePath)
+		if errors.Is(err, os.ErrNotExist) {
+			report.MissingFiles = append(report.MissingFiles, expected.Name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.FilesChecked++
+		if problem := checkAgainstManifest(expected, actual); len(problem) > 0 {
+			report.CorruptFiles = append(report.CorruptFiles, problem)
+		}
+	}
+	if len(yamlPath) == 0 {
+		return nil, fmt.Errorf("manifest [%s] lists no .yaml", manifestPath)
+	}
+
+	archive, err := parseLOREArchiveFile(yamlPath)
+	if err != nil {
+		// already reported as corrupt or missing, nothing more we can check without it
+		if len(report.CorruptFiles) > 0 || len(report.MissingFiles) > 0 {
+			return report, nil
+		}
+		return nil, errors.Join(fmt.Errorf("Unable to parse [%s]", yamlPath), err)
+	}
+	if len(archive.Riffs) != manifest.Riffs {
+		report.Mismatches = append(report.Mismatches, fmt.Sprintf("%d riffs, manifest says %d", len(archive.Riffs), manifest.Riffs))
+	}
+	if len(archive.Stems) != manifest.Stems {
+		report.Mismatches = append(report.Mismatches, fmt.Sprintf("%d stems, manifest says %d", len(archive.Stems), manifest.Stems))
+	}
+	archive.Stems = slices.DeleteFunc(archive.Stems, func(stem lore.Stem) bool {
+		if isUsableStemID(stem.ID) {
+			return false
+		}
+		report.CorruptFiles = append(report.CorruptFiles, fmt.Sprintf("%s: stem with unusable ID %q", filepath.Base(yamlPath), stem.ID))
+		return true
+	})
+
+	// now the audio; whatever we can find, hashed and checked against the manifest where it has an entry for it
+	expectedStems := make(map[string]JamExportManifestFile, len(manifest.StemFiles))
+	for _, stemFile := range manifest.StemFiles {
+		expectedStems[stemFile.Name] = stemFile
+	}
+	stemsPresent := map[string]bool{}
+	checkStem := func(actual JamExportManifestFile) {
+		stemsPresent[actual.Name] = true
+		report.StemsChecked++
+		if expected, ok := expectedStems[actual.Name]; ok {
+			if problem := checkAgainstManifest(expected, actual); len(problem) > 0 {
+				report.CorruptFiles = append(report.CorruptFiles, problem)
+			}
+		}
+	}
+
+	stemsExpected := len(manifest.StemFiles) > 0 || len(manifest.MissingStems) > 0
+	if len(stemCacheDir) > 0 {
+		stemsExpected = true
+		for _, stem := range archive.Stems {
+			actual, err := hashJamExportFile(filepath.Join(stemCacheDir, stem.ID[0:1], stem.ID))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			checkStem(actual)
+		}
+	} else if len(tarPath) > 0 {
+		if err := forEachStemArchiveEntry(tarPath, func(stemID string, r io.Reader) error {
+			actual, err := hashJamExportStream(stemID, r)
+			if err == nil {
+				checkStem(actual)
+			}
+			return err
+		}); err != nil && !errors.Is(err, os.ErrNotExist) {
+			report.CorruptFiles = append(report.CorruptFiles, fmt.Sprintf("%s: %s", filepath.Base(tarPath), err.Error()))
+		}
+	}
+
+	if stemsExpected {
+		for _, stemFile := range manifest.StemFiles {
+			if !stemsPresent[stemFile.Name] {
+				report.MissingFiles = append(report.MissingFiles, stemFile.Name)
+			}
+		}
+		for _, stem := range archive.Stems {
+			_, inManifest := expectedStems[stem.ID]
+			if !stemsPresent[stem.ID] && !inManifest {
+				report.MissingStems = append(report.MissingStems, stem.ID)
+			}
+		}
+	}
+
+	stemsInArchive := make(map[string]bool, len(archive.Stems))
+	for _, stem := range archive.Stems {
+		stemsInArchive[stem.ID] = true
+	}
+	forEachRiffStemReference(archive, func(riffID string, stemID string) {
+		switch {
+		case !stemsInArchive[stemID]:
+			report.DanglingRiffs = append(report.DanglingRiffs, fmt.Sprintf("%s -> %s (not in export)", riffID, stemID))
+		case stemsExpected && !stemsPresent[stemID]:
+			report.DanglingRiffs = append(report.DanglingRiffs, fmt.Sprintf("%s -> %s (no audio)", riffID, stemID))
+		}
+	})
+
+	sort.Strings(report.MissingFiles)
+	sort.Strings(report.MissingStems)
+	return report, nil
+}
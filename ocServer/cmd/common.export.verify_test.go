@@ -0,0 +1,93 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Unbundlesss/OUROCOSM/ocServer/cmd/internal/lore"
+)
+
+// an export of the given stems laid out as export leaves it, with every usable stem's audio in the _stems cache
+func writeTestVerifyExport(t *testing.T, stemIDs ...string) (string, string) {
+	t.Helper()
+
+	outputDir := t.TempDir()
+	const exportLOREID = "verifyjam"
+	archiveDir := filepath.Join(outputDir, "_archives")
+	stemCacheDir := filepath.Join(outputDir, "_stems", exportLOREID)
+
+	archive := &lore.Archive{Header: lore.Header{JamName: "verify", OuroveonVersion: lore.OuroveonVersion}}
+	for _, stemID := range stemIDs {
+		archive.Stems = append(archive.Stems, lore.Stem{ID: stemID, BPS: 2})
+		if !isUsableStemID(stemID) {
+			continue
+		}
+		stemPath := filepath.Join(stemCacheDir, stemID[0:1], stemID)
+		if err := os.MkdirAll(filepath.Dir(stemPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(stemPath, []byte("audio for "+stemID), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	yamlPath := filepath.Join(archiveDir, "verify."+exportLOREID+".yaml")
+	if err := writeLOREArchiveFile(yamlPath, archive); err != nil {
+		t.Fatal(err)
+	}
+	manifestPath, err := writeJamExportManifest(exportLOREID, yamlPath, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stemCacheDir, manifestPath
+}
+
+func TestVerifyStemCache(t *testing.T) {
+
+	stemCacheDir, manifestPath := writeTestVerifyExport(t, "s1", "s2")
+	report, err := verifyJamExport(stemCacheDir, manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.StemsChecked != 2 {
+		t.Errorf("clean export: %+v", report)
+	}
+}
+
+// stem IDs come out of the .yaml; one that can't name a file is reported rather than used to build a path
+func TestVerifyReportsUnusableStemIDs(t *testing.T) {
+
+	for _, badID := range []string{"", "..", "a/b", "..\\x"} {
+		t.Run(badID, func(t *testing.T) {
+			stemCacheDir, manifestPath := writeTestVerifyExport(t, "s1", badID)
+			report, err := verifyJamExport(stemCacheDir, manifestPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.OK() || len(report.CorruptFiles) != 1 || !strings.Contains(report.CorruptFiles[0], "unusable ID") {
+				t.Errorf("report: %+v", report)
+			}
+			if report.StemsChecked != 1 {
+				t.Errorf("checked %d stems, want the 1 good one", report.StemsChecked)
+			}
+		})
+	}
+}
+
+func TestIsUsableStemID(t *testing.T) {
+	for stemID, want := range map[string]bool{"s1": true, "abcdef0123": true, "a.b": true, "": false, ".": false, "..": false, "a/b": false, "a\\b": false, "/": false} {
+		if got := isUsableStemID(stemID); got != want {
+			t.Errorf("isUsableStemID(%q) = %v", stemID, got)
+		}
+	}
+}
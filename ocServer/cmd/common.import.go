@@ -0,0 +1,420 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Unbundlesss/OUROCOSM/ocServer/cmd/internal/lore"
+	kivik "github.com/go-kivik/kivik/v4"
+	"go.uber.org/zap"
+)
+
+type JamImportOptions struct {
+	CreateJam      bool   // create the target jam database if it doesn't exist
+	ServerRootPath string // where jams.json lives; a created jam is set up as it is declared there
+	StemS3Server   string // if given, upload stems from the .tar to this S3 server
+	StemEndpoint   string // endpoint to record in cdn_attachments; defaults to StemS3Server
+	ImportTarPath  string // stem .tar to read from; defaults to the .yaml path with .tar on the end
+	ImportYamlPath string
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// rebuild a couch Rifff document from a LORE riff row
+func buildRiffDocumentFromLORE(riff *lore.Riff) map[string]interface{} {
+
+	playback := make([]interface{}, len(riff.Slots))
+	for i, slot := range riff.Slots {
+
+		// LORE only records the loop ID for enabled slots, so anything else comes back as an empty slot
+		var current interface{}
+		if slot.StemID != lore.EmptyStemID {
+			current = map[string]interface{}{
+				"on":          slot.On,
+				"type":        "Loop",
+				"currentLoop": slot.StemID,
+				"gain":        slot.Gain,
+			}
+		}
+		playback[i] = map[string]interface{}{
+			"slot": map[string]interface{}{
+				"current": current,
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"_id":  riff.ID,
+		"type": "Rifff",
+		"state": map[string]interface{}{
+			"barLength": riff.BarLength,
+			"bps":       riff.BPS,
+			"playback":  playback,
+		},
+		"scale":       riff.Scale,
+		"root":        riff.Root,
+		"app_version": riff.AppVersion,
+		"userName":    riff.User,
+		"sentBy":      riff.User,
+		"created":     riff.CreatedUnix * 1000, // back to unixmilli
+		"magnitude":   riff.Magnitude,
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// rebuild a couch Loop document from a LORE stem row, pointing its attachment at the given endpoint; LORE's length column is
+// the size of the audio file, so it only goes into the attachment and the Loop's own sample-count length is left out
+func buildStemDocumentFromLORE(stem *lore.Stem, stemEndpoint string) (map[string]interface{}, *EndpointAudio) {
+
+	endpoint := &EndpointAudio{
+		Endpoint: stemEndpoint,
+		Key:      stem.Key,
+		Length:   int(stem.Length),
+		Mime:     stem.Mime,
+	}
+	if len(stemEndpoint) == 0 {
+		endpoint.Endpoint = stem.Endpoint
+	}
+	endpoint.URL = fmt.Sprintf("https://%s/%s", endpoint.Endpoint, endpoint.Key)
+
+	// studio writes one or the other depending on what it recorded
+	cdnAttachments := map[string]interface{}{}
+	if strings.Contains(endpoint.Mime, "flac") {
+		cdnAttachments["flacAudio"] = endpoint
+	} else {
+		cdnAttachments["oggAudio"] = endpoint
+	}
+
+	return map[string]interface{}{
+		"_id":             stem.ID,
+		"type":            "Loop",
+		"barLength":       stem.BarLength,
+		"bps":             stem.BPS,
+		"cdn_attachments": cdnAttachments,
+		"colourHistory":   []string{stem.Colour},
+		"created":         stem.CreatedUnix * 1000, // back to unixmilli
+		"creatorUserName": stem.User,
+		"isBass":          stem.IsBass,
+		"isDrum":          stem.IsDrum,
+		"isMic":           stem.IsMic,
+		"isNote":          stem.IsNote,
+		"length16ths":     stem.Length16ths,
+		"originalPitch":   stem.OriginalPitch,
+		"presetName":      stem.Preset,
+		"primaryColour":   stem.Colour,
+		"sampleRate":      stem.SampleRate,
+	}, endpoint
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// rebuild a couch ChatMessage document from a LORE chat row
+func buildChatDocumentFromLORE(chat *lore.Chat) map[string]interface{} {
+
+	return map[string]interface{}{
+		"_id":      chat.ID,
+		"type":     "ChatMessage",
+		"created":  chat.CreatedUnixMilli,
+		"userName": chat.User,
+		"message":  chat.Message,
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// jams are addressed by COSMID, solos by username; turn either into the couch database suffix
+func resolveJamCouchID(jamName string) (string, bool, error) {
+
+	if strings.HasPrefix(jamName, "jam_") {
+		lutID, ok := SysBankIDs.Bank().Entries[jamName]
+		if !ok {
+			return "", false, fmt.Errorf("unable to resolve COSMID [%s] to Endlesss jam IDs", jamName)
+		}
+		return lutID.CouchID, true, nil
+	}
+	return jamName, false, nil
+}
+
+// write documents in batches, counting anything that already existed as skipped; any other refusal fails the import, as
+// a rerun will pick up where this one stopped
+func importDocumentBatch(jamDb couchBulkWriter, batch []interface{}) (int, int, error) {
+
+	if len(batch) == 0 {
+		return 0, 0, nil
+	}
+	results, err := jamDb.BulkDocs(context.TODO(), batch)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	written, skipped, failed := 0, 0, 0
+	for _, result := range results {
+		if result.Error == nil {
+			written++
+		} else if kivik.HTTPStatus(result.Error) == 409 {
+			skipped++
+		} else {
+			SysLog.Warn("Document import failed", zap.String("ID", result.ID), zap.Error(result.Error))
+			failed++
+		}
+	}
+	if failed > 0 {
+		return written, skipped, fmt.Errorf("%d of %d documents failed to import", failed, len(batch))
+	}
+	return written, skipped, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// push the audio from a stem .tar up to the stem store; LORE only records each stem's file length, so every entry is checked
+// against that before it goes up and again once it has landed. returns how many were uploaded
+func uploadImportStems(stemStore *StemStore, tarPath string, stemKeys map[string]*EndpointAudio) (int, error) {
+
+	tarFile, err := os.Open(tarPath)
+	if err != nil {
+		return 0, errors.Join(fmt.Errorf("Unable to open stem archive"), err)
+	}
+	defer tarFile.Close()
+
+	stemUploads := 0
+
+	// the .tar is laid out LORE-style as <jam>/<first character>/<stem id>
+	tr := tar.NewReader(tarFile)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stemUploads, errors.Join(fmt.Errorf("Failed reading stem archive"), err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		endpoint, ok := stemKeys[path.Base(header.Name)]
+		if !ok || len(endpoint.Key) == 0 {
+			SysLog.Warn("Stem archive entry has no matching stem", zap.String("Entry", header.Name))
+			continue
+		}
+		if header.Size != int64(endpoint.Length) {
+			return stemUploads, fmt.Errorf("Stem archive entry size mismatch [%s], got %d, expected %d", header.Name, header.Size, endpoint.Length)
+		}
+
+		if err = stemStore.Put(endpoint.Key, tr, header.Size); err != nil {
+			return stemUploads, errors.Join(fmt.Errorf("Stem upload failed [%s]", stemStore.ObjectURL(endpoint.Key)), err)
+		}
+		if err = checkStemAvailable(stemStore, endpoint); err != nil {
+			return stemUploads, errors.Join(fmt.Errorf("Stem upload could not be verified [%s]", stemStore.ObjectURL(endpoint.Key)), err)
+		}
+		stemUploads++
+	}
+	return stemUploads, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// create the database for a jam that's being imported, set up the way jams.json declares it; private jams get their
+// members' My Jams records now rather than waiting for the next server boot
+func createImportedJamDatabase(couchClient *kivik.Client, cosmid string, couchID string, serverRootPath string) error {
+
+	if len(serverRootPath) == 0 {
+		return fmt.Errorf("creating a jam needs --root to find jams.json")
+	}
+	jamData, err := loadJamManifestData(serverRootPath)
+	if err != nil {
+		return err
+	}
+
+	var jamDecl *CosmServerJamDecl
+	isPublic := false
+	for i := range jamData.Public {
+		if jamData.Public[i].COSMID == cosmid {
+			jamDecl, isPublic = &jamData.Public[i], true
+		}
+	}
+	for i := range jamData.Private {
+		if jamData.Private[i].COSMID == cosmid {
+			jamDecl = &jamData.Private[i]
+		}
+	}
+	if jamDecl == nil {
+		return fmt.Errorf("jam [%s] is not declared in jams.json, add it there before importing into it", cosmid)
+	}
+	if jamDecl.Mirror != nil {
+		return fmt.Errorf("jam [%s] is mirrored from [%s], it can't be imported into", cosmid, jamDecl.Mirror.Server)
+	}
+
+	if err = createDefaultPublicJamDatabase(couchClient, couchID); err != nil {
+		return err
+	}
+	if !isPublic {
+		addJamMembershipRecords(couchClient, *jamDecl, couchID)
+	}
+	SysLog.Info("Created jam database", zap.String("COSMID", cosmid), zap.String("CouchID", couchID), zap.Bool("IsPublic", isPublic))
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// read a LORE archive back into a jam database, optionally pushing the stems back up to S3 beforehand
+func importJamFromDisk(jamName string, options JamImportOptions) error {
+
+	yamlFile, err := os.Open(options.ImportYamlPath)
+	if err != nil {
+		return errors.Join(fmt.Errorf("Unable to read LORE archive"), err)
+	}
+	archive, err := lore.Parse(yamlFile)
+	yamlFile.Close()
+	if err != nil {
+		return errors.Join(fmt.Errorf("Unable to parse LORE archive"), err)
+	}
+
+	SysLog.Info("LORE archive",
+		zap.String("Name", archive.Header.JamName),
+		zap.String("LoreExID", archive.Header.JamCouchID),
+		zap.Int("Riffs", len(archive.Riffs)),
+		zap.Int("Stems", len(archive.Stems)),
+		zap.Int("Chat", len(archive.Chat)),
+	)
+
+	targetCouchID, isCOSMID, err := resolveJamCouchID(jamName)
+	if err != nil {
+		return err
+	}
+
+	couchClient, err := connectToCouchDB()
+	if err != nil {
+		return errors.Join(fmt.Errorf("Connection to CouchDB failed"), err)
+	}
+	defer couchClient.Close()
+
+	jamExists, err := doesJamDatabaseExist(couchClient, targetCouchID)
+	if err != nil {
+		return err
+	}
+	if !jamExists {
+		if !options.CreateJam {
+			return fmt.Errorf("target jam database for [%s] does not exist, use --create to make it", jamName)
+		}
+		if !isCOSMID {
+			return fmt.Errorf("solo jam databases are created by 'newuser', not import")
+		}
+	}
+
+	stemEndpoint := options.StemEndpoint
+	if len(stemEndpoint) == 0 {
+		stemEndpoint = options.StemS3Server
+	}
+
+	stemDocs := make([]interface{}, 0, len(archive.Stems))
+	stemKeys := make(map[string]*EndpointAudio)
+	for i := range archive.Stems {
+		stemDoc, endpoint := buildStemDocumentFromLORE(&archive.Stems[i], stemEndpoint)
+		stemKeys[archive.Stems[i].ID] = endpoint
+		stemDocs = append(stemDocs, stemDoc)
+	}
+
+	// push the audio up first, if we've been asked to, so Loop documents never go in ahead of their audio
+	if len(options.StemS3Server) > 0 {
+
+		tarPath := options.ImportTarPath
+		if len(tarPath) == 0 {
+			tarPath = strings.TrimSuffix(options.ImportYamlPath, ".yaml") + ".tar"
+		}
+		stemStore, err := resolveStemStore(options.StemS3Server)
+		if err != nil {
+			return errors.Join(fmt.Errorf("Unable to configure stem storage"), err)
+		}
+		stemUploads, err := uploadImportStems(stemStore, tarPath, stemKeys)
+		if err != nil {
+			return err
+		}
+		SysLog.Info(fmt.Sprintf(" ... uploaded %d stems", stemUploads))
+		if stemUploads < len(stemKeys) {
+			SysLog.Warn("Stem archive is missing audio for some stems", zap.Int("Missing", len(stemKeys)-stemUploads))
+		}
+	}
+
+	if !jamExists {
+		if err = createImportedJamDatabase(couchClient, jamName, targetCouchID, options.ServerRootPath); err != nil {
+			return err
+		}
+	}
+	jamDb := couchClient.DB(fmt.Sprintf("user_appdata$%s", targetCouchID))
+
+	// stems before riffs, so riffs never land pointing at loops that aren't there yet
+	totalWritten, totalSkipped := 0, 0
+	{
+		batch := make([]interface{}, 0, cBackupDocBatchSize)
+		for _, stemDoc := range stemDocs {
+			batch = append(batch, stemDoc)
+
+			if len(batch) == cBackupDocBatchSize {
+				written, skipped, err := importDocumentBatch(jamDb, batch)
+				if err != nil {
+					return errors.Join(fmt.Errorf("Failed writing stem documents"), err)
+				}
+				totalWritten, totalSkipped = totalWritten+written, totalSkipped+skipped
+				batch = batch[:0]
+			}
+		}
+		written, skipped, err := importDocumentBatch(jamDb, batch)
+		if err != nil {
+			return errors.Join(fmt.Errorf("Failed writing stem documents"), err)
+		}
+		totalWritten, totalSkipped = totalWritten+written, totalSkipped+skipped
+		SysLog.Info(fmt.Sprintf(" ... imported %d stems, %d already present", totalWritten, totalSkipped))
+	}
+	totalWritten, totalSkipped = 0, 0
+	{
+		batch := make([]interface{}, 0, cBackupDocBatchSize)
+		for i := range archive.Riffs {
+			batch = append(batch, buildRiffDocumentFromLORE(&archive.Riffs[i]))
+
+			if len(batch) == cBackupDocBatchSize {
+				written, skipped, err := importDocumentBatch(jamDb, batch)
+				if err != nil {
+					return errors.Join(fmt.Errorf("Failed writing riff documents"), err)
+				}
+				totalWritten, totalSkipped = totalWritten+written, totalSkipped+skipped
+				batch = batch[:0]
+			}
+		}
+		written, skipped, err := importDocumentBatch(jamDb, batch)
+		if err != nil {
+			return errors.Join(fmt.Errorf("Failed writing riff documents"), err)
+		}
+		totalWritten, totalSkipped = totalWritten+written, totalSkipped+skipped
+		SysLog.Info(fmt.Sprintf(" ... imported %d riffs, %d already present", totalWritten, totalSkipped))
+	}
+	totalWritten, totalSkipped = 0, 0
+	{
+		batch := make([]interface{}, 0, cBackupDocBatchSize)
+		for i := range archive.Chat {
+			batch = append(batch, buildChatDocumentFromLORE(&archive.Chat[i]))
+
+			if len(batch) == cBackupDocBatchSize {
+				written, skipped, err := importDocumentBatch(jamDb, batch)
+				if err != nil {
+					return errors.Join(fmt.Errorf("Failed writing chat documents"), err)
+				}
+				totalWritten, totalSkipped = totalWritten+written, totalSkipped+skipped
+				batch = batch[:0]
+			}
+		}
+		written, skipped, err := importDocumentBatch(jamDb, batch)
+		if err != nil {
+			return errors.Join(fmt.Errorf("Failed writing chat documents"), err)
+		}
+		totalWritten, totalSkipped = totalWritten+written, totalSkipped+skipped
+		SysLog.Info(fmt.Sprintf(" ... imported %d chat messages, %d already present", totalWritten, totalSkipped))
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func TestImportDocumentBatch(t *testing.T) {
+
+	batch := []interface{}{
+		map[string]interface{}{"_id": "new"},
+		map[string]interface{}{"_id": "existing"},
+		map[string]interface{}{"_id": "also-new"},
+	}
+
+	// documents already there are skipped, so an import can be rerun
+	written, skipped, err := importDocumentBatch(&testBulkWriter{reject: map[string]int{"existing": 409}}, batch)
+	if err != nil || written != 2 || skipped != 1 {
+		t.Errorf("written %d, skipped %d, %v", written, skipped, err)
+	}
+
+	// anything else Couch refuses fails the import
+	written, skipped, err = importDocumentBatch(&testBulkWriter{reject: map[string]int{"existing": 409, "also-new": 400}}, batch)
+	if err == nil {
+		t.Error("expected an error for a refused document")
+	}
+	if written != 1 || skipped != 1 {
+		t.Errorf("written %d, skipped %d", written, skipped)
+	}
+}
+
+func TestUploadImportStems(t *testing.T) {
+
+	store := newTestBuiltinStemStore(t)
+	store.clock = nil
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	stemStore := &StemStore{
+		httpClient: server.Client(),
+		scheme:     "http",
+		host:       serverURL.Host,
+		bucket:     awsExampleBucket,
+		pathStyle:  true,
+		region:     cS3DefaultRegion,
+		accessKey:  awsExampleAccessKey,
+		secretKey:  awsExampleSecretKey,
+	}
+
+	newStemKeys := func() map[string]*EndpointAudio {
+		return map[string]*EndpointAudio{
+			"s1": {Key: "attachments/oggs/s1", Length: 8},
+			"s2": {Key: "attachments/oggs/s2", Length: 6},
+			"s3": {Key: "attachments/oggs/s3", Length: 4},
+		}
+	}
+	dir := t.TempDir()
+
+	// s3 has no audio in the archive, and the stray entry matches no stem; neither stops the rest
+	tarPath := filepath.Join(dir, "good.tar")
+	writeTestTar(t, tarPath, map[string]string{"jam/s/s1": "s1 audio", "jam/s/s2": "s2 ogg", "jam/x/stray": "?"}, []string{"jam/s/s1", "jam/x/stray", "jam/s/s2"})
+	stemUploads, err := uploadImportStems(stemStore, tarPath, newStemKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stemUploads != 2 {
+		t.Errorf("uploaded %d stems, want 2", stemUploads)
+	}
+	for key, want := range map[string]string{"attachments/oggs/s1": "s1 audio", "attachments/oggs/s2": "s2 ogg"} {
+		if contents, err := os.ReadFile(filepath.Join(store.objectRoot, filepath.FromSlash(key))); err != nil || string(contents) != want {
+			t.Errorf("%s: %q, %v", key, contents, err)
+		}
+	}
+
+	// audio that isn't the length LORE recorded is refused before it goes anywhere
+	tarPath = filepath.Join(dir, "short.tar")
+	writeTestTar(t, tarPath, map[string]string{"jam/s/s3": "s3"}, []string{"jam/s/s3"})
+	if _, err = uploadImportStems(stemStore, tarPath, newStemKeys()); err == nil || !strings.Contains(err.Error(), "size mismatch") {
+		t.Errorf("expected a size mismatch, got %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(store.objectRoot, "attachments", "oggs", "s3")); !os.IsNotExist(err) {
+		t.Error("mismatched stem was uploaded")
+	}
+
+	// and a store that won't take it fails the import
+	stemStore.secretKey = "wrong"
+	tarPath = filepath.Join(dir, "good.tar")
+	if _, err = uploadImportStems(stemStore, tarPath, newStemKeys()); err == nil {
+		t.Error("expected an error when the upload is refused")
+	}
+}
@@ -0,0 +1,297 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	kivik "github.com/go-kivik/kivik/v4"
+	"go.uber.org/zap"
+)
+
+// what to do with riffs that point at loops we can't play
+type JamCheckRepair string
+
+const (
+	JamCheckRepairNone       JamCheckRepair = ""           // report only
+	JamCheckRepairMark       JamCheckRepair = "mark"       // tag the riff document with what's wrong, leave it where it is
+	JamCheckRepairQuarantine JamCheckRepair = "quarantine" // tag it and change its type so it drops out of every view
+)
+
+const (
+	cJamCheckMarkField      string = "ocosm_integrity"
+	cJamCheckQuarantineType string = "RifffQuarantined" // set "type" back to "Rifff" to restore one
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// knobs for checkJamIntegrity
+type JamCheckOptions struct {
+	StemS3Server string         // where to HEAD loop audio; defaults to the s3 store in the server config
+	SkipAudio    bool           // only check document references, don't touch S3
+	Workers      int            // loops to check at once; 0 for the default
+	Repair       JamCheckRepair // what to do with broken riffs
+}
+
+type JamCheckBrokenLoop struct {
+	ID     string `json:"id"`
+	Key    string `json:"key,omitempty"`
+	Reason string `json:"reason"`
+}
+
+type JamCheckBrokenRiff struct {
+	ID      string   `json:"id"`
+	Created int64    `json:"created"` // unix milliseconds
+	Loops   []string `json:"loops"`   // the loops it uses that are missing or broken
+}
+
+// the findings for one jam; it's healthy if there's nothing in the lists
+type JamCheckReport struct {
+	Jam          string               `json:"jam"` // COSMID or username, as asked for
+	CouchID      string               `json:"couch_id"`
+	Riffs        int                  `json:"riffs"`
+	Loops        int                  `json:"loops"`
+	AudioChecked int                  `json:"audio_checked"`
+	MissingLoops []string             `json:"missing_loops,omitempty"`   // referenced by riffs but no Loop document
+	BrokenLoops  []JamCheckBrokenLoop `json:"broken_loops,omitempty"`    // Loop documents whose audio is missing or the wrong length
+	Unchecked    []JamCheckBrokenLoop `json:"unchecked_loops,omitempty"` // the store kept failing rather than answering for these
+	BrokenRiffs  []JamCheckBrokenRiff `json:"broken_riffs,omitempty"`
+	Repair       JamCheckRepair       `json:"repair,omitempty"`
+	Repaired     int                  `json:"repaired,omitempty"`
+	Error        string               `json:"error,omitempty"` // set if the check couldn't run at all
+}
+
+func (report *JamCheckReport) OK() bool {
+	return len(report.Error) == 0 &&
+		len(report.MissingLoops) == 0 &&
+		len(report.BrokenLoops) == 0 &&
+		len(report.Unchecked) == 0 &&
+		len(report.BrokenRiffs) == 0
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// only a definite answer from the store says a loop is broken; anything else is the store having trouble
+func isLoopAudioBroken(err error) bool {
+	var statusErr *stemDownloadStatusError
+	return errors.Is(err, errStemSizeMismatch) || (errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound)
+}
+
+// HEAD the audio for every loop, returning the ones that aren't there or aren't the length their document says, and
+// separately the ones the store still wouldn't answer for after retrying
+func findBrokenLoopAudio(stemStore *StemStore, loops []JamStemData, workers int, retries int) ([]JamCheckBrokenLoop, []JamCheckBrokenLoop) {
+
+	if workers <= 0 {
+		workers = cStemDownloadDefaultWorkers
+	}
+
+	reasons := make([]string, len(loops))
+	uncheckedReasons := make([]string, len(loops))
+	loopIndices := make(chan int)
+
+	var workerGroup sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		workerGroup.Add(1)
+		go func() {
+			defer workerGroup.Done()
+			for i := range loopIndices {
+				endpoint := getActiveEndpoint(loops[i])
+				if len(endpoint.Key) == 0 {
+					reasons[i] = "no audio attachment"
+					continue
+				}
+
+				var err error
+				for attempt := 0; ; attempt++ {
+					err = checkStemAvailable(stemStore, endpoint)
+					if err == nil || isLoopAudioBroken(err) || attempt >= retries {
+						break
+					}
+					time.Sleep(cStemDownloadBaseBackoff * time.Duration(1<<attempt))
+				}
+				switch {
+				case err == nil:
+				case isLoopAudioBroken(err):
+					reasons[i] = err.Error()
+				default:
+					uncheckedReasons[i] = err.Error()
+				}
+			}
+		}()
+	}
+	for i := range loops {
+		loopIndices <- i
+	}
+	close(loopIndices)
+	workerGroup.Wait()
+
+	collect := func(reasons []string) []JamCheckBrokenLoop {
+		collected := []JamCheckBrokenLoop{}
+		for i, reason := range reasons {
+			if len(reason) > 0 {
+				collected = append(collected, JamCheckBrokenLoop{
+					ID:     loops[i].ID,
+					Key:    getActiveEndpoint(loops[i]).Key,
+					Reason: reason,
+				})
+			}
+		}
+		return collected
+	}
+	return collect(reasons), collect(uncheckedReasons)
+}
+
+// tag a riff document with the loops it can't play and, if quarantining, take it out of the Rifff views
+func repairBrokenRiff(jamDb *kivik.DB, brokenRiff JamCheckBrokenRiff, repair JamCheckRepair) error {
+
+	var riffDoc map[string]interface{}
+	if err := jamDb.Get(context.TODO(), brokenRiff.ID).ScanDoc(&riffDoc); err != nil {
+		return err
+	}
+	riffDoc[cJamCheckMarkField] = map[string]interface{}{
+		"checked":      time.Now().Unix(),
+		"broken_loops": brokenRiff.Loops,
+	}
+	if repair == JamCheckRepairQuarantine {
+		riffDoc["type"] = cJamCheckQuarantineType
+	}
+	_, err := jamDb.Put(context.TODO(), brokenRiff.ID, riffDoc)
+	return err
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// cross-check every riff's loop references against the Loop documents in the jam, and those against the audio in S3.
+// jamName is a COSMID or a solo username
+func checkJamIntegrity(couchClient *kivik.Client, jamName string, options JamCheckOptions) (*JamCheckReport, error) {
+
+	couchID, _, err := resolveJamCouchID(jamName)
+	if err != nil {
+		return nil, err
+	}
+	report := &JamCheckReport{Jam: jamName, CouchID: couchID, Repair: options.Repair}
+
+	jamExists, err := doesJamDatabaseExist(couchClient, couchID)
+	if err != nil {
+		return nil, err
+	}
+	if !jamExists {
+		return nil, fmt.Errorf("no jam database for [%s]", jamName)
+	}
+	jamDb := couchClient.DB(fmt.Sprintf("user_appdata$%s", couchID))
+
+	loops := []JamStemData{}
+	loopsByID := map[string]bool{}
+	err = forEachJamDocumentByCreateTime(jamDb, "loopsByCreateTime", func(stemData JamStemData) error {
+		loops = append(loops, stemData)
+		loopsByID[stemData.ID] = true
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to read loops"), err)
+	}
+	report.Loops = len(loops)
+
+	brokenLoopsByID := map[string]bool{}
+	if !options.SkipAudio {
+		stemStore, err := resolveStemStore(options.StemS3Server)
+		if err != nil {
+			return nil, err
+		}
+		if stemStore == nil {
+			SysLog.Warn("No S3 store configured or given, skipping audio checks", zap.String("Jam", jamName))
+		} else {
+			report.BrokenLoops, report.Unchecked = findBrokenLoopAudio(stemStore, loops, options.Workers, cStemDownloadDefaultRetries)
+			report.AudioChecked = len(loops) - len(report.Unchecked)
+			for _, brokenLoop := range report.BrokenLoops {
+				brokenLoopsByID[brokenLoop.ID] = true
+			}
+		}
+	}
+
+	// the riff -> loop lists come straight out of the view, no need to pull every riff document
+	resultSet := jamDb.Query(context.TODO(), "types", "rifffLoopsByCreateTime", kivik.Params(map[string]interface{}{
+		"descending": false,
+	}))
+	defer resultSet.Close()
+
+	missingLoops := map[string]bool{}
+	for resultSet.Next() {
+		riffID, err := resultSet.ID()
+		if err != nil {
+			return nil, err
+		}
+		var riffCreated int64
+		if err = resultSet.ScanKey(&riffCreated); err != nil {
+			return nil, err
+		}
+		var riffLoops []string
+		if err = resultSet.ScanValue(&riffLoops); err != nil {
+			return nil, err
+		}
+		report.Riffs++
+
+		brokenRiff := JamCheckBrokenRiff{ID: riffID, Created: riffCreated}
+		for _, loopID := range riffLoops {
+			switch {
+			case !loopsByID[loopID]:
+				missingLoops[loopID] = true
+			case !brokenLoopsByID[loopID]:
+				continue
+			}
+			brokenRiff.Loops = append(brokenRiff.Loops, loopID)
+		}
+		if len(brokenRiff.Loops) > 0 {
+			report.BrokenRiffs = append(report.BrokenRiffs, brokenRiff)
+		}
+	}
+	if resultSet.Err() != nil {
+		return nil, resultSet.Err()
+	}
+	for loopID := range missingLoops {
+		report.MissingLoops = append(report.MissingLoops, loopID)
+	}
+	sort.Strings(report.MissingLoops)
+
+	// with the store failing, we can't be sure what else it would have said was broken; better to repair nothing than
+	// to act on half an answer
+	if options.Repair != JamCheckRepairNone && len(report.Unchecked) > 0 {
+		SysLog.Warn("Not repairing, some loop audio couldn't be checked", zap.String("Jam", jamName), zap.Int("Unchecked", len(report.Unchecked)))
+	} else if options.Repair != JamCheckRepairNone {
+		for _, brokenRiff := range report.BrokenRiffs {
+			if err := repairBrokenRiff(jamDb, brokenRiff, options.Repair); err != nil {
+				SysLog.Error("Unable to repair riff", zap.String("Jam", jamName), zap.String("Riff", brokenRiff.ID), zap.Error(err))
+				continue
+			}
+			report.Repaired++
+		}
+	}
+
+	return report, nil
+}
+
+// run checkJamIntegrity over several jams; a jam that can't be checked gets a report with Error set rather than stopping the rest
+func checkJamsIntegrity(jamNames []string, options JamCheckOptions) ([]*JamCheckReport, error) {
+
+	couchClient, err := connectToCouchDB()
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Connection to CouchDB failed"), err)
+	}
+	defer couchClient.Close()
+
+	reports := make([]*JamCheckReport, 0, len(jamNames))
+	for _, jamName := range jamNames {
+		report, err := checkJamIntegrity(couchClient, jamName, options)
+		if err != nil {
+			report = &JamCheckReport{Jam: jamName, Error: err.Error()}
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
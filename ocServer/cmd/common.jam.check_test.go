@@ -0,0 +1,100 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func newTestCheckLoop(loopID string, key string, length int) JamStemData {
+	var loop JamStemData
+	loop.ID = loopID
+	loop.CdnAttachments.OggAudio = EndpointAudio{Key: key, Length: length}
+	return loop
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func TestFindBrokenLoopAudio(t *testing.T) {
+
+	// objects answer with their name's length; "flaky" fails once before answering, "down" never does
+	var attemptsLock sync.Mutex
+	attempts := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := path.Base(r.URL.Path)
+		attemptsLock.Lock()
+		attempts[key]++
+		attempt := attempts[key]
+		attemptsLock.Unlock()
+
+		switch {
+		case key == "missing":
+			w.WriteHeader(http.StatusNotFound)
+		case key == "forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case key == "down", key == "flaky" && attempt == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("Content-Length", strconv.Itoa(len(key)))
+		}
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	stemStore := &StemStore{httpClient: server.Client(), scheme: "http", host: serverURL.Host, bucket: "stems", pathStyle: true}
+
+	loops := []JamStemData{
+		newTestCheckLoop("fine", "attachments/fine", 4),
+		newTestCheckLoop("short", "attachments/short", 10),
+		newTestCheckLoop("missing", "attachments/missing", 7),
+		newTestCheckLoop("no-audio", "", 0),
+		newTestCheckLoop("flaky", "attachments/flaky", 5),
+		newTestCheckLoop("down", "attachments/down", 4),
+		newTestCheckLoop("forbidden", "attachments/forbidden", 9),
+	}
+	brokenLoops, uncheckedLoops := findBrokenLoopAudio(stemStore, loops, 2, 1)
+
+	loopIDs := func(checkLoops []JamCheckBrokenLoop) map[string]bool {
+		ids := map[string]bool{}
+		for _, loop := range checkLoops {
+			ids[loop.ID] = true
+		}
+		return ids
+	}
+	broken, unchecked := loopIDs(brokenLoops), loopIDs(uncheckedLoops)
+
+	// only a 404, a wrong length or no attachment at all say the loop is broken
+	if len(broken) != 3 || !broken["short"] || !broken["missing"] || !broken["no-audio"] {
+		t.Errorf("broken: %+v", brokenLoops)
+	}
+	// an outage, or a store refusing us, isn't the loop's fault
+	if len(unchecked) != 2 || !unchecked["down"] || !unchecked["forbidden"] {
+		t.Errorf("unchecked: %+v", uncheckedLoops)
+	}
+
+	attemptsLock.Lock()
+	defer attemptsLock.Unlock()
+	if attempts["flaky"] != 2 || attempts["down"] != 2 {
+		t.Errorf("retries: flaky %d, down %d", attempts["flaky"], attempts["down"])
+	}
+	if attempts["missing"] != 1 || attempts["short"] != 1 {
+		t.Errorf("definite answers were retried: missing %d, short %d", attempts["missing"], attempts["short"])
+	}
+}
+
+func TestJamCheckReportOK(t *testing.T) {
+	if report := (&JamCheckReport{}); !report.OK() {
+		t.Error("empty report isn't OK")
+	}
+	if report := (&JamCheckReport{Unchecked: []JamCheckBrokenLoop{{ID: "down"}}}); report.OK() {
+		t.Error("report with unchecked loops is OK")
+	}
+}
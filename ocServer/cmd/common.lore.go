@@ -7,61 +7,12 @@ package cmd
 
 import (
 	"archive/tar"
-	"fmt"
 	"io"
-	"math"
-	"net/http"
 	"os"
 	"strings"
 	"unicode/utf8"
 )
 
-// matching lookup from LORE / Endlesss
-func getRootName(n int) string {
-	return [...]string{
-		/*  0 */ "C",
-		/*  1 */ "Db", // c#
-		/*  2 */ "D",
-		/*  3 */ "Eb", // d#
-		/*  4 */ "E",
-		/*  5 */ "F",
-		/*  6 */ "F#", // g flat
-		/*  7 */ "G",
-		/*  8 */ "Ab", // g sharp
-		/*  9 */ "A",
-		/* 10 */ "Bb", // a#
-		/* 11 */ "B",
-	}[n]
-}
-
-// matching lookup from LORE / Endlesss
-func getScaleName(n int) string {
-	return [...]string{
-		"major",
-		"dorian",
-		"phrygian",
-		"lydian",
-		"mixoly",
-		"minor",
-		"locrian",
-		"minor_pent",
-		"major_pent",
-		"susp_pent",
-		"blues_mnr_p",
-		"blues_mjr_p",
-		"harmonic_mnr",
-		"melodic_mnr",
-		"dbl_harmonic",
-		"blues",
-		"whole",
-		"chromatic",
-	}[n]
-}
-
-func bpsToRoundedBPM(bps float64) float64 {
-	return (math.Ceil((bps*60.0)*100.0) / 100.0)
-}
-
 // ported version of what we do in LORE; recreate the same pathname sanitiser output
 func sanitiseNameForPath(source string, replacementChar rune, allowWhitespace bool) string {
 	var dest strings.Builder
@@ -122,31 +73,6 @@ type LOREPublic struct {
 	} `json:"jams"`
 }
 
-// fetch a stem from somewhere, failing if we don't get the size the database told us to expect, write to given filepath
-func downloadStem(httpClient *http.Client, expectedLength int, filepath string, url string) error {
-
-	resp, err := httpClient.Get(url)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("error while downloading: %v", resp.StatusCode)
-	}
-	defer resp.Body.Close()
-
-	out, err := os.Create(filepath)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	bytesWritten, err := io.Copy(out, resp.Body)
-	if int64(expectedLength) != bytesWritten {
-		return fmt.Errorf("stem file size mismatch, got %d, expected %d", bytesWritten, expectedLength)
-	}
-	return err
-}
-
 // based on https://www.arthurkoziel.com/writing-tar-gz-files-in-go/
 func createTarArchive(files []string, baseRelativePath, outputFile string) error {
 
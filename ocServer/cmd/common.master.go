@@ -0,0 +1,116 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// heartbeats signed more than this far either side of the master's clock are turned away
+const cMasterHeartbeatSkew = 5 * time.Minute
+
+// header carrying the base64 ed25519 signature of the heartbeat body
+const cMasterSignatureHeader = "X-Ourocosm-Signature"
+
+// where a listed server publishes its heartbeat key, so the master can check a heartbeat really came from that address
+const cMasterListingKeyPath = "/cosm/v1/listing-key"
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// one server as ocConnect lists it; the first seven fields are exactly its `servers:` YAML entries, the rest are extras
+// from the master that older clients ignore
+type MasterServerListing struct {
+	DisplayName string `json:"display-name" yaml:"display-name"`
+	DisplayBio  string `json:"display-bio" yaml:"display-bio"`
+	DisplayGeo  string `json:"display-geo" yaml:"display-geo"`
+	Scheme      string `json:"scheme" yaml:"scheme"`
+	Host        string `json:"host" yaml:"host"`
+	ApiPort     int    `json:"api-port" yaml:"api-port"`
+	DbPort      int    `json:"db-port" yaml:"db-port"`
+
+	Awake                     bool   `json:"awake" yaml:"awake"`
+	MostRecentPublicJamChange int64  `json:"most-recent-public-jam-change" yaml:"most-recent-public-jam-change"` // unix ms, as per /cosm/v1/status
+	MostRecentPublicJamName   string `json:"most-recent-public-jam-name,omitempty" yaml:"most-recent-public-jam-name,omitempty"`
+	LastSeen                  int64  `json:"last-seen" yaml:"last-seen"` // unix time the master last heard from it
+}
+
+type MasterServerList struct {
+	Servers []MasterServerListing `json:"servers" yaml:"servers"`
+}
+
+// what a server POSTs to the master; the body is signed as-is with the key given inside it
+type MasterHeartbeat struct {
+	Timestamp int64               `json:"timestamp"` // unix time
+	PublicKey string              `json:"key"`       // base64 ed25519 public key
+	Server    MasterServerListing `json:"server"`
+	Status    StatusResponse      `json:"status"`
+}
+
+type MasterListingKey struct {
+	PublicKey string `json:"key"` // base64 ed25519 public key, as in MasterHeartbeat
+}
+
+// servers are known to the master by where clients connect to them
+func (l MasterServerListing) Address() string {
+	return fmt.Sprintf("%s:%d", strings.ToLower(l.Host), l.ApiPort)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// read the server's heartbeat signing key, making a new one on first use
+func loadOrCreateMasterKey(keyPath string) (ed25519.PrivateKey, error) {
+
+	keyText, err := os.ReadFile(keyPath)
+	if err == nil {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(keyText)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("heartbeat key [%s] is not a base64 ed25519 seed", keyPath)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Join(fmt.Errorf("Unable to read heartbeat key [%s]", keyPath), err)
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(keyPath, []byte(base64.StdEncoding.EncodeToString(privateKey.Seed())+"\n"), 0600); err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to write heartbeat key [%s]", keyPath), err)
+	}
+	SysLog.Info("Created heartbeat key", zap.String("PublicKey", encodeMasterPublicKey(privateKey)))
+	return privateKey, nil
+}
+
+func encodeMasterPublicKey(privateKey ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey))
+}
+
+// check a heartbeat body against its signature header and the key it carries, and that it was signed recently
+func verifyMasterHeartbeat(heartbeat *MasterHeartbeat, body []byte, signature string, now time.Time) error {
+
+	publicKey, err := base64.StdEncoding.DecodeString(heartbeat.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("heartbeat key is not a base64 ed25519 public key")
+	}
+	signatureBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(publicKey), body, signatureBytes) {
+		return fmt.Errorf("heartbeat signature does not match")
+	}
+	signedAt := time.Unix(heartbeat.Timestamp, 0)
+	if signedAt.Before(now.Add(-cMasterHeartbeatSkew)) || signedAt.After(now.Add(cMasterHeartbeatSkew)) {
+		return fmt.Errorf("heartbeat timestamp is too far from the master's clock")
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestMasterKey(t *testing.T, seedByte byte) ed25519.PrivateKey {
+	t.Helper()
+	seed := make([]byte, ed25519.SeedSize)
+	for i := range seed {
+		seed[i] = seedByte
+	}
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+// a heartbeat as sendMasterHeartbeat would build it, returning the body and its signature header
+func signTestHeartbeat(t *testing.T, privateKey ed25519.PrivateKey, heartbeat MasterHeartbeat) ([]byte, string) {
+	t.Helper()
+	heartbeat.PublicKey = encodeMasterPublicKey(privateKey)
+	body, err := json.Marshal(heartbeat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body, base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, body))
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func TestVerifyMasterHeartbeat(t *testing.T) {
+
+	now := time.Unix(1700000000, 0)
+	serverKey := newTestMasterKey(t, 1)
+	otherKey := newTestMasterKey(t, 2)
+
+	cases := []struct {
+		name  string
+		build func() (*MasterHeartbeat, []byte, string)
+		valid bool
+	}{
+		{"valid", func() (*MasterHeartbeat, []byte, string) {
+			body, signature := signTestHeartbeat(t, serverKey, MasterHeartbeat{Timestamp: now.Unix()})
+			return &MasterHeartbeat{Timestamp: now.Unix(), PublicKey: encodeMasterPublicKey(serverKey)}, body, signature
+		}, true},
+		{"at the edge of the skew", func() (*MasterHeartbeat, []byte, string) {
+			timestamp := now.Add(-cMasterHeartbeatSkew).Unix()
+			body, signature := signTestHeartbeat(t, serverKey, MasterHeartbeat{Timestamp: timestamp})
+			return &MasterHeartbeat{Timestamp: timestamp, PublicKey: encodeMasterPublicKey(serverKey)}, body, signature
+		}, true},
+		{"too old", func() (*MasterHeartbeat, []byte, string) {
+			timestamp := now.Add(-cMasterHeartbeatSkew - time.Second).Unix()
+			body, signature := signTestHeartbeat(t, serverKey, MasterHeartbeat{Timestamp: timestamp})
+			return &MasterHeartbeat{Timestamp: timestamp, PublicKey: encodeMasterPublicKey(serverKey)}, body, signature
+		}, false},
+		{"from the future", func() (*MasterHeartbeat, []byte, string) {
+			timestamp := now.Add(cMasterHeartbeatSkew + time.Second).Unix()
+			body, signature := signTestHeartbeat(t, serverKey, MasterHeartbeat{Timestamp: timestamp})
+			return &MasterHeartbeat{Timestamp: timestamp, PublicKey: encodeMasterPublicKey(serverKey)}, body, signature
+		}, false},
+		{"signed by another key", func() (*MasterHeartbeat, []byte, string) {
+			body, signature := signTestHeartbeat(t, otherKey, MasterHeartbeat{Timestamp: now.Unix()})
+			return &MasterHeartbeat{Timestamp: now.Unix(), PublicKey: encodeMasterPublicKey(serverKey)}, body, signature
+		}, false},
+		{"body changed after signing", func() (*MasterHeartbeat, []byte, string) {
+			body, signature := signTestHeartbeat(t, serverKey, MasterHeartbeat{Timestamp: now.Unix()})
+			body = append(body, ' ')
+			return &MasterHeartbeat{Timestamp: now.Unix(), PublicKey: encodeMasterPublicKey(serverKey)}, body, signature
+		}, false},
+		{"no signature", func() (*MasterHeartbeat, []byte, string) {
+			body, _ := signTestHeartbeat(t, serverKey, MasterHeartbeat{Timestamp: now.Unix()})
+			return &MasterHeartbeat{Timestamp: now.Unix(), PublicKey: encodeMasterPublicKey(serverKey)}, body, ""
+		}, false},
+		{"signature not base64", func() (*MasterHeartbeat, []byte, string) {
+			body, _ := signTestHeartbeat(t, serverKey, MasterHeartbeat{Timestamp: now.Unix()})
+			return &MasterHeartbeat{Timestamp: now.Unix(), PublicKey: encodeMasterPublicKey(serverKey)}, body, "!!!"
+		}, false},
+		{"key not base64", func() (*MasterHeartbeat, []byte, string) {
+			body, signature := signTestHeartbeat(t, serverKey, MasterHeartbeat{Timestamp: now.Unix()})
+			return &MasterHeartbeat{Timestamp: now.Unix(), PublicKey: "not a key"}, body, signature
+		}, false},
+		{"key too short", func() (*MasterHeartbeat, []byte, string) {
+			body, signature := signTestHeartbeat(t, serverKey, MasterHeartbeat{Timestamp: now.Unix()})
+			return &MasterHeartbeat{Timestamp: now.Unix(), PublicKey: base64.StdEncoding.EncodeToString([]byte("short"))}, body, signature
+		}, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			heartbeat, body, signature := tc.build()
+			err := verifyMasterHeartbeat(heartbeat, body, signature, now)
+			if tc.valid && err != nil {
+				t.Errorf("expected valid, got %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestLoadOrCreateMasterKey(t *testing.T) {
+
+	keyPath := filepath.Join(t.TempDir(), "heartbeat.key")
+	created, err := loadOrCreateMasterKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadOrCreateMasterKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created.Equal(loaded) {
+		t.Error("reloaded key differs from the one created")
+	}
+
+	if err = os.WriteFile(keyPath, []byte("not a seed\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadOrCreateMasterKey(keyPath); err == nil {
+		t.Error("expected an error loading a damaged key")
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// a stand-in for a listed server, answering status and publishing whichever key it's currently using
+type testMasterListedServer struct {
+	listing    MasterServerListing
+	listingKey atomic.Value // ed25519.PrivateKey
+	status     StatusResponse
+}
+
+func newTestMasterListing(t *testing.T, name string, privateKey ed25519.PrivateKey) *testMasterListedServer {
+	t.Helper()
+
+	server := &testMasterListedServer{status: StatusResponse{Version: 1, Awake: true, MostRecentPublicJamChange: 1700000000000, MostRecentPublicJamName: "from status"}}
+	server.listingKey.Store(privateKey)
+
+	router := http.NewServeMux()
+	router.HandleFunc("/cosm/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		handlerEmitJson(w, server.status)
+	})
+	router.HandleFunc(cMasterListingKeyPath, func(w http.ResponseWriter, r *http.Request) {
+		newListingKeyHandler(server.listingKey.Load().(ed25519.PrivateKey))(w, r)
+	})
+	statusServer := httptest.NewServer(router)
+	t.Cleanup(statusServer.Close)
+
+	statusURL, _ := url.Parse(statusServer.URL)
+	port, _ := strconv.Atoi(statusURL.Port())
+	server.listing = MasterServerListing{DisplayName: name, Scheme: "http", Host: statusURL.Hostname(), ApiPort: port, DbPort: 5984}
+	return server
+}
+
+func newTestMasterState() *masterServerState {
+	return &masterServerState{
+		Owners:        map[string]string{},
+		listings:      map[string]MasterServerListing{},
+		lastTimestamp: map[string]int64{},
+		expiry:        cMasterDefaultExpiry,
+	}
+}
+
+func TestMasterAcceptHeartbeat(t *testing.T) {
+
+	state := newTestMasterState()
+	serverKey := newTestMasterKey(t, 1)
+	otherKey := newTestMasterKey(t, 2)
+	server := newTestMasterListing(t, "test server", serverKey)
+	listing := server.listing
+	timestamp := time.Now().Unix()
+
+	accept := func(privateKey ed25519.PrivateKey, heartbeat MasterHeartbeat) int {
+		body, signature := signTestHeartbeat(t, privateKey, heartbeat)
+		var received MasterHeartbeat
+		if err := json.Unmarshal(body, &received); err != nil {
+			t.Fatal(err)
+		}
+		status, _ := state.acceptHeartbeat(&received, body, signature)
+		return status
+	}
+
+	// what the server says about itself in the heartbeat is ignored in favour of its status endpoint
+	if status := accept(serverKey, MasterHeartbeat{Timestamp: timestamp, Server: listing, Status: StatusResponse{Awake: false, MostRecentPublicJamName: "from heartbeat"}}); status != http.StatusOK {
+		t.Fatalf("first heartbeat: %d", status)
+	}
+	live := state.liveServers()
+	if len(live.Servers) != 1 || live.Servers[0].DisplayName != "test server" {
+		t.Fatalf("live list: %+v", live)
+	}
+	if !live.Servers[0].Awake || live.Servers[0].MostRecentPublicJamName != "from status" || live.Servers[0].MostRecentPublicJamChange != 1700000000000 {
+		t.Errorf("activity not taken from the status endpoint: %+v", live.Servers[0])
+	}
+	if state.Owners[listing.Address()] != encodeMasterPublicKey(serverKey) {
+		t.Errorf("owner: %s", state.Owners[listing.Address()])
+	}
+
+	// the same heartbeat again is a replay
+	if status := accept(serverKey, MasterHeartbeat{Timestamp: timestamp, Server: listing}); status != http.StatusConflict {
+		t.Errorf("replayed heartbeat: %d", status)
+	}
+	// someone else can't take over the address, as the server there doesn't publish their key
+	hijack := listing
+	hijack.DisplayName = "not the test server"
+	if status := accept(otherKey, MasterHeartbeat{Timestamp: timestamp + 1, Server: hijack}); status != http.StatusForbidden {
+		t.Errorf("heartbeat from another key: %d", status)
+	}
+	// but the owner can keep updating it
+	server.status.MostRecentPublicJamName = "newer jam"
+	if status := accept(serverKey, MasterHeartbeat{Timestamp: timestamp + 1, Server: listing}); status != http.StatusOK {
+		t.Errorf("second heartbeat: %d", status)
+	}
+	if live := state.liveServers(); len(live.Servers) != 1 || live.Servers[0].DisplayName != "test server" || live.Servers[0].MostRecentPublicJamName != "newer jam" {
+		t.Errorf("live list after hijack attempt: %+v", live)
+	}
+
+	// a server that changes key moves its listing over, and the old key loses it
+	server.listingKey.Store(otherKey)
+	moved := listing
+	moved.DisplayName = "test server, new key"
+	if status := accept(otherKey, MasterHeartbeat{Timestamp: timestamp + 2, Server: moved}); status != http.StatusOK {
+		t.Errorf("heartbeat from the new key: %d", status)
+	}
+	if status := accept(serverKey, MasterHeartbeat{Timestamp: timestamp + 3, Server: listing}); status != http.StatusForbidden {
+		t.Errorf("heartbeat from the old key: %d", status)
+	}
+	if live := state.liveServers(); len(live.Servers) != 1 || live.Servers[0].DisplayName != "test server, new key" || state.Owners[listing.Address()] != encodeMasterPublicKey(otherKey) {
+		t.Errorf("live list after key change: %+v", live)
+	}
+
+	badListing := listing
+	badListing.Scheme = "ftp"
+	if status := accept(otherKey, MasterHeartbeat{Timestamp: timestamp + 4, Server: badListing}); status != http.StatusBadRequest {
+		t.Errorf("bad scheme: %d", status)
+	}
+	unreachable := listing
+	unreachable.ApiPort = 1
+	if status := accept(otherKey, MasterHeartbeat{Timestamp: timestamp + 4, Server: unreachable}); status != http.StatusBadRequest {
+		t.Errorf("unreachable server: %d", status)
+	}
+
+	// with an allowlist, unknown keys are turned away before anything else
+	state.allowedKeys = []string{encodeMasterPublicKey(serverKey)}
+	elsewhereKey := newTestMasterKey(t, 3)
+	elsewhere := newTestMasterListing(t, "elsewhere", elsewhereKey)
+	if status := accept(elsewhereKey, MasterHeartbeat{Timestamp: timestamp + 5, Server: elsewhere.listing}); status != http.StatusForbidden {
+		t.Errorf("key outside the allowlist: %d", status)
+	}
+}
+
+func TestMasterStateSave(t *testing.T) {
+
+	state := newTestMasterState()
+	state.statePath = filepath.Join(t.TempDir(), "master.json")
+	state.Owners["server.example.org:23000"] = "key"
+	state.save()
+
+	state.Owners["other.example.org:23000"] = "other key"
+	state.save()
+
+	stateJson, err := os.ReadFile(state.statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved masterServerState
+	if err = json.Unmarshal(stateJson, &saved); err != nil || len(saved.Owners) != 2 {
+		t.Errorf("saved state: %s, %v", stateJson, err)
+	}
+	if leftovers, _ := os.ReadDir(filepath.Dir(state.statePath)); len(leftovers) != 1 {
+		t.Errorf("save left %d files behind", len(leftovers))
+	}
+}
+
+func TestMasterHeartbeatHandler(t *testing.T) {
+
+	state := newTestMasterState()
+	serverKey := newTestMasterKey(t, 1)
+	body, signature := signTestHeartbeat(t, serverKey, MasterHeartbeat{Timestamp: time.Now().Unix(), Server: newTestMasterListing(t, "handler", serverKey).listing})
+
+	post := func(body []byte, signature string) int {
+		req := httptest.NewRequest(http.MethodPost, "/master/v1/heartbeat", bytes.NewReader(body))
+		req.Header.Set(cMasterSignatureHeader, signature)
+		recorder := httptest.NewRecorder()
+		state.HandlerHeartbeat(recorder, req)
+		return recorder.Code
+	}
+
+	if status := post([]byte("{"), signature); status != http.StatusBadRequest {
+		t.Errorf("broken json: %d", status)
+	}
+	if status := post(make([]byte, cMasterMaxHeartbeatSize+1), signature); status != http.StatusBadRequest {
+		t.Errorf("oversized heartbeat: %d", status)
+	}
+	if status := post(body, ""); status != http.StatusUnauthorized {
+		t.Errorf("unsigned heartbeat: %d", status)
+	}
+	if status := post(body, signature); status != http.StatusOK {
+		t.Errorf("signed heartbeat: %d", status)
+	}
+}
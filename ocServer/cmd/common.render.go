@@ -0,0 +1,366 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Unbundlesss/OUROCOSM/ocServer/cmd/internal/audio"
+	"github.com/Unbundlesss/OUROCOSM/ocServer/cmd/internal/lore"
+	"go.uber.org/zap"
+)
+
+const cRenderDefaultSampleRate int = 44100
+
+// leave a little headroom when normalising
+const cRenderNormalisePeak float32 = 0.98
+
+// how many decoded stems to hold onto between riffs; neighbouring riffs mostly share stems, and a riff has at most 8
+const cRenderStemCacheSize int = 32
+
+// stems further than this (as a fraction) from their riff's tempo were recorded at a different BPM and get varispeeded to fit
+const cRenderTempoTolerance float64 = 0.001
+
+type RiffRenderOptions struct {
+	OutputDir           string       // root to write _renders into; also used as the _stems cache, shared with export
+	StemS3Server        string       // where to fetch stems that aren't already cached
+	StemDownloadWorkers int          //
+	StemDownloadRetries int          //
+	Format              audio.Format // wav or flac
+	SampleRate          int          // output rate; 0 to use the rate of the first stem encountered
+	Repeats             int          // how many times to play the riff through
+	Normalise           bool         // scale each render so its peak sits just under full scale
+	RiffIDs             []string     // specific riffs to render, or ...
+	From                time.Time    // ... everything created in this range
+	To                  time.Time    //
+	Session             *JamSession  // or everything in this session, rendered into its own folder
+}
+
+// decoded stem audio plus the loop length and tempo it should play at, shared between all the riffs that use it
+type renderStem struct {
+	id          string
+	audio       *audio.Buffer
+	length16ths int
+	bps         float64
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// a slot that's switched on and has something in it
+type riffPlayingSlot struct {
+	Index  int
+	StemID string
+	Gain   float64
+}
+
+func getRiffPlayingSlots(riff *JamRiffData) []riffPlayingSlot {
+	slots := []riffPlayingSlot{}
+	for i := range riff.State.Playback {
+		slot := &riff.State.Playback[i].Slot.Current
+		if slot.On && len(slot.CurrentLoop) > 0 {
+			slots = append(slots, riffPlayingSlot{i, slot.CurrentLoop, slot.Gain})
+		}
+	}
+	return slots
+}
+
+// a riff plays for as long as the longest stem in it, rounded up to a whole bar (bar length is counted in 16ths)
+func getRiffLength16ths(riff *JamRiffData, stemLength16ths map[string]int) (int, error) {
+
+	riffLength16ths := 0
+	for _, slot := range getRiffPlayingSlots(riff) {
+		riffLength16ths = max(riffLength16ths, stemLength16ths[slot.StemID])
+	}
+	if riffLength16ths == 0 {
+		return 0, fmt.Errorf("riff [%s] has nothing playing", riff.ID)
+	}
+	if barLength := riff.State.BarLength; barLength > 0 && riffLength16ths%barLength != 0 {
+		riffLength16ths += barLength - (riffLength16ths % barLength)
+	}
+	return riffLength16ths, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// mix one riff down. each playing slot's stem is looped to the riff length at the riff tempo; Endlesss records stems at the tempo
+// of the riff they were made in, so one recorded at some other tempo is sped up or slowed down to fit, as Studio plays it
+func mixRiff(riff *JamRiffData, stems map[string]*renderStem, sampleRate int, repeats int) (*audio.Buffer, error) {
+
+	if riff.State.Bps <= 0 {
+		return nil, fmt.Errorf("riff [%s] has no tempo", riff.ID)
+	}
+	sixteenthsPerSecond := riff.State.Bps * 4
+
+	type slotMix struct {
+		stem  *renderStem
+		audio *audio.Buffer
+		gain  float32
+	}
+	slots := []slotMix{}
+
+	stemLengths := map[string]int{}
+	for _, slot := range getRiffPlayingSlots(riff) {
+		stem, ok := stems[slot.StemID]
+		if !ok {
+			return nil, fmt.Errorf("riff [%s] slot %d stem [%s] unavailable", riff.ID, slot.Index, slot.StemID)
+		}
+		stemAudio := stem.audio
+		if stem.bps > 0 && math.Abs(stem.bps-riff.State.Bps) > riff.State.Bps*cRenderTempoTolerance {
+			SysLog.Info("Varispeeding stem recorded at a different tempo",
+				zap.String("Riff", riff.ID),
+				zap.String("Stem", slot.StemID),
+				zap.Float64("RiffBPM", lore.BPSToRoundedBPM(riff.State.Bps)),
+				zap.Float64("StemBPM", lore.BPSToRoundedBPM(stem.bps)))
+			stemAudio = stemAudio.Varispeed(riff.State.Bps / stem.bps)
+		}
+		slots = append(slots, slotMix{stem, stemAudio, float32(slot.Gain)})
+		stemLengths[slot.StemID] = stem.length16ths
+	}
+	riffLength16ths, err := getRiffLength16ths(riff, stemLengths)
+	if err != nil {
+		return nil, err
+	}
+
+	framesFor16ths := func(length16ths int) int {
+		return int(math.Round(float64(length16ths) / sixteenthsPerSecond * float64(sampleRate)))
+	}
+
+	mixdown := audio.NewBuffer(sampleRate, framesFor16ths(riffLength16ths)*max(repeats, 1))
+	for _, slot := range slots {
+		mixdown.MixLooped(slot.audio, framesFor16ths(slot.stem.length16ths), slot.gain)
+	}
+	return mixdown, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func renderRiffsToDisk(jamToRender string, options RiffRenderOptions) ([]string, error) {
+
+	if len(jamToRender) == 0 {
+		return nil, fmt.Errorf("Jam to render cannot be null")
+	}
+	if len(options.RiffIDs) > 0 && options.Session != nil {
+		return nil, fmt.Errorf("specific riffs and a session can't both be rendered at once")
+	}
+	if options.StemDownloadWorkers <= 0 {
+		options.StemDownloadWorkers = cStemDownloadDefaultWorkers
+	}
+
+	stemStore, err := resolveStemStore(options.StemS3Server)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to configure stem storage"), err)
+	}
+
+	renderCouchID, renderLOREID, _ := deduceOutputParametersForJam(jamToRender)
+
+	couchClient, err := connectToCouchDB()
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Connection to CouchDB failed"), err)
+	}
+	defer couchClient.Close()
+
+	jamDb := couchClient.DB(fmt.Sprintf("user_appdata$%s", renderCouchID))
+
+	renderDir := filepath.Join(options.OutputDir, "_renders", renderLOREID)
+	if options.Session != nil {
+		options.From = options.Session.Start
+		options.To = options.Session.End
+		renderDir = filepath.Join(renderDir, options.Session.Label())
+	}
+
+	// gather up the riffs, either by ID or by creation time
+	riffs := []JamRiffData{}
+	if len(options.RiffIDs) > 0 {
+		for _, riffID := range options.RiffIDs {
+			var riffData JamRiffData
+			if err := jamDb.Get(context.TODO(), riffID).ScanDoc(&riffData); err != nil {
+				return nil, errors.Join(fmt.Errorf("Unable to fetch riff [%s]", riffID), err)
+			}
+			riffs = append(riffs, riffData)
+		}
+	} else {
+		err = forEachJamDocumentCreatedBetween(jamDb, "rifffsByCreateTime", options.From.UnixMilli(), options.To.UnixMilli(), func(resultData JamRiffData) error {
+			riffs = append(riffs, resultData)
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("Failed to query riffs"), err)
+		}
+	}
+	if len(riffs) == 0 {
+		SysLog.Warn("No riffs to render", zap.String("Jam", jamToRender))
+		return nil, nil
+	}
+
+	// everything gets downloaded up front, but only decoded as the riffs come to need it
+	cachedStems, err := cacheRiffStems(jamDb, stemStore, riffs, options.OutputDir, renderLOREID, options.StemDownloadWorkers, options.StemDownloadRetries)
+	if err != nil {
+		return nil, err
+	}
+	stemCache := newRenderStemCache(cachedStems, options.SampleRate, cRenderStemCacheSize)
+
+	os.MkdirAll(renderDir, os.ModePerm)
+
+	resultingFiles := []string{}
+	for i := range riffs {
+		riff := &riffs[i]
+
+		// decoding the riff's stems can settle the output rate, so fetch them first
+		riffStems := stemCache.stemsForRiff(riff)
+		mixdown, err := mixRiff(riff, riffStems, stemCache.outputSampleRate(), options.Repeats)
+		if err != nil {
+			SysLog.Warn("Skipping riff", zap.Error(err))
+			continue
+		}
+
+		peak := mixdown.Peak()
+		if options.Normalise && peak > 0 {
+			mixdown.Scale(cRenderNormalisePeak / peak)
+		} else if peak > 1 {
+			SysLog.Warn("Riff mixdown clips, consider --normalise", zap.String("Riff", riff.ID), zap.Float32("Peak", peak))
+		}
+
+		renderFile := filepath.Join(renderDir, fmt.Sprintf("%s.%s.%s.%s",
+			time.UnixMilli(riff.Created).UTC().Format("20060102_150405"),
+			sanitiseNameForPath(riff.UserName, '_', false),
+			riff.ID,
+			options.Format,
+		))
+		if err = writeRenderFile(renderFile, mixdown, options.Format); err != nil {
+			return resultingFiles, errors.Join(fmt.Errorf("Failed to write [%s]", renderFile), err)
+		}
+
+		SysLog.Info("Rendered riff", zap.String("Riff", riff.ID), zap.String("File", renderFile), zap.Float64("Seconds", mixdown.Duration()))
+		resultingFiles = append(resultingFiles, renderFile)
+	}
+	return resultingFiles, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// decoded stems, resampled to the output rate, for the most recently rendered riffs; a whole jam's worth won't fit in memory
+type renderStemCache struct {
+	cachedStems map[string]CachedStem    // every stem downloaded for the render, by ID
+	failed      map[string]bool          // stems that wouldn't decode, so they're only tried (and reported) once
+	entries     map[string]*list.Element // stem ID -> element in lru, holding a *renderStem
+	lru         *list.List               // most recently used at the front
+	capacity    int
+	sampleRate  int // 0 until the first stem decoded decides it, if it wasn't specified
+}
+
+func newRenderStemCache(cachedStems []CachedStem, sampleRate int, capacity int) *renderStemCache {
+	cache := &renderStemCache{
+		cachedStems: make(map[string]CachedStem, len(cachedStems)),
+		failed:      make(map[string]bool),
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		capacity:    max(capacity, 1),
+		sampleRate:  max(sampleRate, 0),
+	}
+	for _, cachedStem := range cachedStems {
+		cache.cachedStems[cachedStem.Data.ID] = cachedStem
+	}
+	return cache
+}
+
+func (cache *renderStemCache) outputSampleRate() int {
+	if cache.sampleRate <= 0 {
+		return cRenderDefaultSampleRate
+	}
+	return cache.sampleRate
+}
+
+// the stems playing in a riff; any that can't be loaded are logged and left out, which mixRiff then reports
+func (cache *renderStemCache) stemsForRiff(riff *JamRiffData) map[string]*renderStem {
+	stems := map[string]*renderStem{}
+	for _, slot := range getRiffPlayingSlots(riff) {
+		if stem := cache.get(slot.StemID); stem != nil {
+			stems[slot.StemID] = stem
+		}
+	}
+	return stems
+}
+
+func (cache *renderStemCache) get(stemID string) *renderStem {
+
+	if element, ok := cache.entries[stemID]; ok {
+		cache.lru.MoveToFront(element)
+		return element.Value.(*renderStem)
+	}
+	cachedStem, ok := cache.cachedStems[stemID]
+	if !ok || cache.failed[stemID] {
+		return nil
+	}
+	stem, err := cache.decode(cachedStem)
+	if err != nil {
+		SysLog.Warn("Unable to load stem", zap.String("Stem", stemID), zap.Error(err))
+		cache.failed[stemID] = true
+		return nil
+	}
+
+	cache.entries[stemID] = cache.lru.PushFront(stem)
+	for cache.lru.Len() > cache.capacity {
+		evicted := cache.lru.Remove(cache.lru.Back()).(*renderStem)
+		delete(cache.entries, evicted.id)
+	}
+	return stem
+}
+
+func (cache *renderStemCache) decode(cachedStem CachedStem) (*renderStem, error) {
+
+	stemBytes, err := os.ReadFile(cachedStem.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	stemAudio, err := audio.Decode(stemBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// first one through decides the output rate if it wasn't specified
+	if cache.sampleRate <= 0 {
+		cache.sampleRate = stemAudio.SampleRate
+	}
+
+	length16ths := cachedStem.Data.Length16Ths
+	if length16ths <= 0 && cachedStem.Data.Bps > 0 {
+		length16ths = int(math.Round(stemAudio.Duration() * cachedStem.Data.Bps * 4))
+	}
+
+	return &renderStem{
+		id:          cachedStem.Data.ID,
+		audio:       stemAudio.Resample(cache.sampleRate),
+		length16ths: length16ths,
+		bps:         cachedStem.Data.Bps,
+	}, nil
+}
+
+func writeRenderFile(renderFile string, mixdown *audio.Buffer, format audio.Format) error {
+
+	renderOut, err := os.Create(renderFile)
+	if err != nil {
+		return err
+	}
+	// the FLAC encoder closes the file itself once it has gone back to fill in the stream info
+	if format == audio.FormatFLAC {
+		if err = audio.WriteFLAC(renderOut, mixdown); err != nil {
+			renderOut.Close()
+			os.Remove(renderFile)
+		}
+		return err
+	}
+	err = audio.Write(renderOut, mixdown, format)
+	if closeErr := renderOut.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(renderFile)
+	}
+	return err
+}
@@ -0,0 +1,188 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Unbundlesss/OUROCOSM/ocServer/cmd/internal/audio"
+)
+
+// a riff with the given stems switched on in its first slots, all at full gain
+func newTestRenderRiff(t *testing.T, riffID string, bps float64, barLength int, stemIDs ...string) *JamRiffData {
+	t.Helper()
+
+	playback := []string{}
+	for _, stemID := range stemIDs {
+		playback = append(playback, fmt.Sprintf(`{"slot":{"current":{"on":true,"type":"Loop","currentLoop":%q,"gain":1}}}`, stemID))
+	}
+	riffJson := fmt.Sprintf(`{"_id":%q,"state":{"bps":%v,"barLength":%d,"playback":[%s]}}`, riffID, bps, barLength, strings.Join(playback, ","))
+
+	var riff JamRiffData
+	if err := json.Unmarshal([]byte(riffJson), &riff); err != nil {
+		t.Fatal(err)
+	}
+	return &riff
+}
+
+func newConstantBuffer(sampleRate int, frames int, value float32) *audio.Buffer {
+	buf := audio.NewBuffer(sampleRate, frames)
+	for i := range buf.Left {
+		buf.Left[i], buf.Right[i] = value, value
+	}
+	return buf
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func TestMixRiffFitsStemsToTempo(t *testing.T) {
+
+	// 4 16ths at 2 bps (120 BPM) is half a second
+	const sampleRate = 1000
+	stems := map[string]*renderStem{
+		"on-tempo":    {id: "on-tempo", audio: newConstantBuffer(sampleRate, 500, 0.5), length16ths: 4, bps: 2},
+		"near-tempo":  {id: "near-tempo", audio: newConstantBuffer(sampleRate, 500, 0.25), length16ths: 4, bps: 2.0000001},
+		"faster":      {id: "faster", audio: newConstantBuffer(sampleRate, 400, 0.125), length16ths: 4, bps: 2.5},
+		"slower":      {id: "slower", audio: newConstantBuffer(sampleRate, 1000, 0.03125), length16ths: 4, bps: 1},
+		"tempo-unset": {id: "tempo-unset", audio: newConstantBuffer(sampleRate, 500, 0.0625), length16ths: 4},
+	}
+
+	cases := []struct {
+		name     string
+		stemIDs  []string
+		wantPeak float32
+		wantFail bool
+	}{
+		{"matching tempo", []string{"on-tempo"}, 0.5, false},
+		{"within rounding", []string{"on-tempo", "near-tempo"}, 0.75, false},
+		{"faster stem slowed down", []string{"on-tempo", "faster"}, 0.625, false},
+		{"slower stem sped up", []string{"on-tempo", "slower"}, 0.53125, false},
+		{"no recorded tempo kept", []string{"on-tempo", "tempo-unset"}, 0.5625, false},
+		{"missing stem", []string{"on-tempo", "not-loaded"}, 0, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mixdown, err := mixRiff(newTestRenderRiff(t, "riff", 2, 4, tc.stemIDs...), stems, sampleRate, 2)
+			if tc.wantFail {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mixdown.Len() != 1000 {
+				t.Errorf("two repeats of half a second gave %d frames", mixdown.Len())
+			}
+			if peak := mixdown.Peak(); peak != tc.wantPeak {
+				t.Errorf("peak: got %v, want %v", peak, tc.wantPeak)
+			}
+			// every stem stretched or squeezed to fill the whole loop, no gaps
+			for _, frame := range []int{0, 450, 499, 999} {
+				if mixdown.Left[frame] != tc.wantPeak {
+					t.Errorf("frame %d: got %v, want %v", frame, mixdown.Left[frame], tc.wantPeak)
+				}
+			}
+		})
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func writeTestRenderStem(t *testing.T, dir string, stemID string, sampleRate int, value float32) CachedStem {
+	t.Helper()
+
+	stemPath := filepath.Join(dir, stemID)
+	stemFile, err := os.Create(stemPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = audio.WriteFLAC(stemFile, newConstantBuffer(sampleRate, 800, value)); err != nil {
+		t.Fatal(err)
+	}
+	stemFile.Close()
+
+	cachedStem := CachedStem{FilePath: stemPath}
+	cachedStem.Data.ID = stemID
+	cachedStem.Data.Bps = 2
+	return cachedStem
+}
+
+func TestRenderStemCache(t *testing.T) {
+
+	dir := t.TempDir()
+	cachedStems := []CachedStem{
+		writeTestRenderStem(t, dir, "a", 8000, 0.5),
+		writeTestRenderStem(t, dir, "b", 16000, 0.25),
+		writeTestRenderStem(t, dir, "c", 8000, 0.125),
+	}
+	cache := newRenderStemCache(cachedStems, 0, 2)
+
+	if cache.outputSampleRate() != cRenderDefaultSampleRate {
+		t.Errorf("rate before anything is decoded: %d", cache.outputSampleRate())
+	}
+	stemA := cache.get("a")
+	if stemA == nil {
+		t.Fatal("stem a didn't load")
+	}
+	// the first stem decoded sets the rate, and everything after is resampled to it
+	if cache.outputSampleRate() != 8000 || stemA.audio.SampleRate != 8000 {
+		t.Errorf("rate after first stem: %d / %d", cache.outputSampleRate(), stemA.audio.SampleRate)
+	}
+	// length comes from the duration and tempo when the stem doesn't record it: 0.1s at 8 16ths a second
+	if stemA.length16ths != 1 {
+		t.Errorf("derived length: %d 16ths", stemA.length16ths)
+	}
+	if stemB := cache.get("b"); stemB == nil || stemB.audio.SampleRate != 8000 {
+		t.Errorf("stem b not resampled: %+v", stemB)
+	}
+
+	// a is used again, so c pushes b out rather than a
+	cache.get("a")
+	cache.get("c")
+	if _, ok := cache.entries["b"]; ok || len(cache.entries) != 2 || cache.lru.Len() != 2 {
+		t.Errorf("expected b to be evicted, holding %d", len(cache.entries))
+	}
+
+	// with the files gone, only what's still held can be returned
+	for _, cachedStem := range cachedStems {
+		os.Remove(cachedStem.FilePath)
+	}
+	if cache.get("a") != stemA {
+		t.Error("stem a wasn't served from the cache")
+	}
+	if cache.get("b") != nil {
+		t.Error("evicted stem b came back without its file")
+	}
+	if !cache.failed["b"] {
+		t.Error("stem b's failure wasn't remembered")
+	}
+
+	riffStems := cache.stemsForRiff(newTestRenderRiff(t, "riff", 2, 4, "a", "b", "unknown"))
+	if len(riffStems) != 1 || riffStems["a"] != stemA {
+		t.Errorf("stems for riff: %v", riffStems)
+	}
+}
+
+func TestRenderStemCacheFixedRate(t *testing.T) {
+
+	cache := newRenderStemCache([]CachedStem{writeTestRenderStem(t, t.TempDir(), "a", 8000, 0.5)}, 22050, cRenderStemCacheSize)
+	if stem := cache.get("a"); stem == nil || stem.audio.SampleRate != 22050 || cache.outputSampleRate() != 22050 {
+		t.Errorf("stem not resampled to the requested rate: %+v", stem)
+	}
+}
+
+func TestRenderRejectsRiffsWithSession(t *testing.T) {
+
+	_, err := renderRiffsToDisk("jam", RiffRenderOptions{RiffIDs: []string{"riff"}, Session: &JamSession{Index: 1}})
+	if err == nil {
+		t.Error("expected an error rendering riffs and a session together")
+	}
+}
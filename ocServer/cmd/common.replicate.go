@@ -0,0 +1,398 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	kivik "github.com/go-kivik/kivik/v4"
+	"github.com/go-kivik/kivik/v4/couchdb"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// per ourocosm.server.yaml
+const cConfigReplicateTarget string = "replicate.target" // standby Couch, eg. "http://192.168.8.1:5984"; as seen from the primary Couch and ocServer both
+const cConfigReplicateUser string = "replicate.user"     // admin on the standby
+const cConfigReplicatePwd string = "replicate.pwd"       //
+const cConfigReplicateSource string = "replicate.source" // primary Couch as its own replicator sees it; defaults to the couchDB internal address
+
+// all jobs we manage in _replicator are named this plus the database name, so we never touch anyone else's
+const cReplicationJobPrefix = "ocosm:"
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// _replicator document layout, see https://docs.couchdb.org/en/stable/replication/replicator.html
+type replicationBasicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+type replicationAuth struct {
+	Basic replicationBasicAuth `json:"basic"`
+}
+type replicationEndpoint struct {
+	URL  string          `json:"url"`
+	Auth replicationAuth `json:"auth"`
+}
+type replicationJobDoc struct {
+	ID           string              `json:"_id"`
+	Rev          string              `json:"_rev,omitempty"`
+	Source       replicationEndpoint `json:"source"`
+	Target       replicationEndpoint `json:"target"`
+	CreateTarget bool                `json:"create_target"`
+	Continuous   bool                `json:"continuous"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func isReplicationEnabled() bool {
+	return len(viper.GetString(cConfigReplicateTarget)) > 0
+}
+
+// databases that need to exist on the standby for it to take over; same set as a backup
+func isReplicatedDatabase(databaseName string) bool {
+	return isBackupDatabase(databaseName)
+}
+
+func getReplicationJobID(databaseName string) string {
+	return cReplicationJobPrefix + databaseName
+}
+
+// database names carry a '$', which needs escaping inside a replication URL
+func getReplicationDatabaseURL(baseURL string, databaseName string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/" + url.QueryEscape(databaseName)
+}
+
+func getReplicationLocalURL() string {
+	if source := viper.GetString(cConfigReplicateSource); len(source) > 0 {
+		return source
+	}
+	return CouchConnectionURI.Value()
+}
+
+func buildReplicationJob(databaseName string) replicationJobDoc {
+	return replicationJobDoc{
+		ID: getReplicationJobID(databaseName),
+		Source: replicationEndpoint{
+			URL:  getReplicationDatabaseURL(getReplicationLocalURL(), databaseName),
+			Auth: replicationAuth{replicationBasicAuth{viper.GetString(cConfigCouchUser), viper.GetString(cConfigCouchPwd)}},
+		},
+		Target: replicationEndpoint{
+			URL:  getReplicationDatabaseURL(viper.GetString(cConfigReplicateTarget), databaseName),
+			Auth: replicationAuth{replicationBasicAuth{viper.GetString(cConfigReplicateUser), viper.GetString(cConfigReplicatePwd)}},
+		},
+		CreateTarget: true,
+		Continuous:   true,
+	}
+}
+
+func connectToStandbyCouchDB() (*kivik.Client, error) {
+	return kivik.New("couch", viper.GetString(cConfigReplicateTarget), couchdb.BasicAuth(viper.GetString(cConfigReplicateUser), viper.GetString(cConfigReplicatePwd)))
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// make sure databaseName has an up to date continuous replication job to the standby. _security isn't replicated, so
+// that gets copied across by hand; run this again after changing a database's members
+func ensureReplicationJob(couchClient *kivik.Client, standbyClient *kivik.Client, databaseName string) (bool, error) {
+
+	if err := ensureDatabaseExists(standbyClient, databaseName); err != nil {
+		return false, errors.Join(fmt.Errorf("Unable to create standby database"), err)
+	}
+	security, err := couchClient.DB(databaseName).Security(context.TODO())
+	if err != nil {
+		return false, errors.Join(fmt.Errorf("Unable to read database security"), err)
+	}
+	if err = standbyClient.DB(databaseName).SetSecurity(context.TODO(), security); err != nil {
+		return false, errors.Join(fmt.Errorf("Unable to copy database security to standby"), err)
+	}
+
+	replicatorDb := couchClient.DB("_replicator")
+	wantJob := buildReplicationJob(databaseName)
+
+	var currentJob replicationJobDoc
+	err = replicatorDb.Get(context.TODO(), wantJob.ID).ScanDoc(&currentJob)
+	if err != nil && kivik.HTTPStatus(err) != http.StatusNotFound {
+		return false, err
+	}
+	if err == nil {
+		wantJob.Rev = currentJob.Rev
+		if currentJob == wantJob {
+			return false, nil
+		}
+	}
+
+	if _, err = replicatorDb.Put(context.TODO(), wantJob.ID, wantJob); err != nil {
+		return false, errors.Join(fmt.Errorf("Unable to write replication job"), err)
+	}
+	return true, nil
+}
+
+// called after ocServer creates a database; doesn't fail the creation if the standby is unhappy, 'replicate sync' will
+// pick it up later
+func addReplicationForNewDatabase(couchClient *kivik.Client, databaseName string) {
+
+	if !isReplicationEnabled() {
+		return
+	}
+	standbyClient, err := connectToStandbyCouchDB()
+	if err == nil {
+		defer standbyClient.Close()
+		err = ensureDatabaseExists(couchClient, "_replicator")
+	}
+	if err == nil {
+		_, err = ensureReplicationJob(couchClient, standbyClient, databaseName)
+	}
+	if err != nil {
+		SysLog.Warn("Unable to set up replication, run 'replicate sync' later", zap.String("Database", databaseName), zap.Error(err))
+		return
+	}
+	SysLog.Info("Replication added", zap.String("Database", databaseName))
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+type ReplicationSyncReport struct {
+	Databases int      `json:"databases"`
+	Created   []string `json:"created,omitempty"` // jobs added or rewritten
+	Removed   []string `json:"removed,omitempty"` // jobs for databases that no longer exist
+	Failed    []string `json:"failed,omitempty"`  // "database: reason"
+}
+
+// bring the _replicator jobs in line with the databases on the primary; with prune, jobs for databases that have gone
+// are deleted too
+func syncReplicationJobs(couchClient *kivik.Client, prune bool) (*ReplicationSyncReport, error) {
+
+	if !isReplicationEnabled() {
+		return nil, fmt.Errorf("%s is not configured", cConfigReplicateTarget)
+	}
+	standbyClient, err := connectToStandbyCouchDB()
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Connection to standby CouchDB failed"), err)
+	}
+	defer standbyClient.Close()
+
+	if err = ensureDatabaseExists(couchClient, "_replicator"); err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to create _replicator database"), err)
+	}
+
+	allDatabases, err := couchClient.AllDBs(context.TODO())
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to list Couch databases"), err)
+	}
+
+	report := &ReplicationSyncReport{}
+	replicatedDatabases := map[string]bool{}
+	for _, databaseName := range allDatabases {
+		if !isReplicatedDatabase(databaseName) {
+			continue
+		}
+		replicatedDatabases[databaseName] = true
+		report.Databases++
+
+		changed, err := ensureReplicationJob(couchClient, standbyClient, databaseName)
+		if err != nil {
+			SysLog.Warn("Unable to set up replication", zap.String("Database", databaseName), zap.Error(err))
+			report.Failed = append(report.Failed, fmt.Sprintf("%s: %s", databaseName, err.Error()))
+			continue
+		}
+		if changed {
+			report.Created = append(report.Created, databaseName)
+		}
+	}
+
+	if prune {
+		jobIDs, err := listReplicationJobIDs(couchClient)
+		if err != nil {
+			return nil, err
+		}
+		for jobID, rev := range jobIDs {
+			databaseName := strings.TrimPrefix(jobID, cReplicationJobPrefix)
+			if replicatedDatabases[databaseName] {
+				continue
+			}
+			if _, err = couchClient.DB("_replicator").Delete(context.TODO(), jobID, rev); err != nil {
+				report.Failed = append(report.Failed, fmt.Sprintf("%s: %s", databaseName, err.Error()))
+				continue
+			}
+			report.Removed = append(report.Removed, databaseName)
+		}
+		sort.Strings(report.Removed)
+	}
+	return report, nil
+}
+
+// id -> rev of every job we manage
+func listReplicationJobIDs(couchClient *kivik.Client) (map[string]string, error) {
+
+	resultSet := couchClient.DB("_replicator").AllDocs(context.TODO(), kivik.Params(map[string]interface{}{
+		"startkey": cReplicationJobPrefix,
+		"endkey":   cReplicationJobPrefix + "\ufff0",
+	}))
+	defer resultSet.Close()
+
+	jobIDs := map[string]string{}
+	for resultSet.Next() {
+		var row struct {
+			Rev string `json:"rev"`
+		}
+		if err := resultSet.ScanValue(&row); err != nil {
+			return nil, err
+		}
+		jobID, _ := resultSet.ID()
+		jobIDs[jobID] = row.Rev
+	}
+	if resultSet.Err() != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to list replication jobs"), resultSet.Err())
+	}
+	return jobIDs, nil
+}
+
+// delete every job we manage, leaving the standby databases where they are
+func removeReplicationJobs(couchClient *kivik.Client) (int, error) {
+
+	jobIDs, err := listReplicationJobIDs(couchClient)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for jobID, rev := range jobIDs {
+		if _, err = couchClient.DB("_replicator").Delete(context.TODO(), jobID, rev); err != nil {
+			return removed, errors.Join(fmt.Errorf("Unable to remove replication job [%s]", jobID), err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// what the replication scheduler says about one of our jobs
+type ReplicationJobStatus struct {
+	Database       string `json:"database"`
+	State          string `json:"state"` // initializing, running, pending, crashing, failed, error .. or missing if there's no job at all
+	ChangesPending int64  `json:"changes_pending"`
+	DocsWritten    int64  `json:"docs_written"`
+	WriteFailures  int64  `json:"doc_write_failures"`
+	Error          string `json:"error,omitempty"`
+	LastUpdated    string `json:"last_updated,omitempty"`
+}
+
+// summary of all of the above, safe to hand out publicly
+type ReplicationSummary struct {
+	Checked        int64 `json:"checked"`         // unix time
+	Databases      int   `json:"databases"`       // that should be replicated
+	Running        int   `json:"running"`         //
+	Missing        int   `json:"missing"`         // databases with no job
+	Failing        int   `json:"failing"`         // jobs crashing or failed
+	ChangesPending int64 `json:"changes_pending"` // total changes the standby is behind by
+}
+
+func (s ReplicationSummary) OK() bool {
+	return s.Missing == 0 && s.Failing == 0
+}
+
+// response from /_scheduler/docs/_replicator
+type couchSchedulerDocs struct {
+	TotalRows int `json:"total_rows"`
+	Docs      []struct {
+		DocID       string `json:"doc_id"`
+		State       string `json:"state"`
+		LastUpdated string `json:"last_updated"`
+		Info        *struct {
+			ChangesPending   *int64 `json:"changes_pending"`
+			DocsWritten      int64  `json:"docs_written"`
+			DocWriteFailures int64  `json:"doc_write_failures"`
+			Error            string `json:"error"`
+		} `json:"info"`
+	} `json:"docs"`
+}
+
+// ask the primary's replication scheduler how each job is doing, with a "missing" entry for any database that should
+// be replicated but has no job
+func fetchReplicationStatus(couchClient *kivik.Client) ([]ReplicationJobStatus, *ReplicationSummary, error) {
+
+	allDatabases, err := couchClient.AllDBs(context.TODO())
+	if err != nil {
+		return nil, nil, errors.Join(fmt.Errorf("Unable to list Couch databases"), err)
+	}
+
+	jobsByDatabase := map[string]ReplicationJobStatus{}
+	const pageSize = 500
+	for skip := 0; ; skip += pageSize {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/_scheduler/docs/_replicator?limit=%d&skip=%d", CouchConnectionURI.Value(), pageSize, skip), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.SetBasicAuth(viper.GetString(cConfigCouchUser), viper.GetString(cConfigCouchPwd))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, nil, errors.Join(fmt.Errorf("Unable to query replication scheduler"), err)
+		}
+		var page couchSchedulerDocs
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		} else if resp.StatusCode != http.StatusNotFound { // no _replicator database yet
+			err = fmt.Errorf("replication scheduler returned %s", resp.Status)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, errors.Join(fmt.Errorf("Unable to query replication scheduler"), err)
+		}
+
+		for _, doc := range page.Docs {
+			if !strings.HasPrefix(doc.DocID, cReplicationJobPrefix) {
+				continue
+			}
+			job := ReplicationJobStatus{
+				Database:    strings.TrimPrefix(doc.DocID, cReplicationJobPrefix),
+				State:       doc.State,
+				LastUpdated: doc.LastUpdated,
+			}
+			if doc.Info != nil {
+				if doc.Info.ChangesPending != nil {
+					job.ChangesPending = *doc.Info.ChangesPending
+				}
+				job.DocsWritten = doc.Info.DocsWritten
+				job.WriteFailures = doc.Info.DocWriteFailures
+				job.Error = doc.Info.Error
+			}
+			jobsByDatabase[job.Database] = job
+		}
+		if len(page.Docs) < pageSize {
+			break
+		}
+	}
+
+	summary := &ReplicationSummary{Checked: time.Now().Unix()}
+	jobs := []ReplicationJobStatus{}
+	for _, databaseName := range allDatabases {
+		if !isReplicatedDatabase(databaseName) {
+			continue
+		}
+		summary.Databases++
+
+		job, ok := jobsByDatabase[databaseName]
+		if !ok {
+			job = ReplicationJobStatus{Database: databaseName, State: "missing"}
+		}
+		switch job.State {
+		case "missing":
+			summary.Missing++
+		case "running", "initializing", "pending":
+			summary.Running++
+		case "crashing", "failed", "error":
+			summary.Failing++
+		}
+		summary.ChangesPending += job.ChangesPending
+		jobs = append(jobs, job)
+	}
+	return jobs, summary, nil
+}
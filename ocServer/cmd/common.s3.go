@@ -0,0 +1,427 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// per ourocosm.server.yaml; all optional. without them the stem tools fall back to anonymous GET / PUT against whatever
+// server is given on the command line, which only works for public buckets
+const cConfigS3Endpoint string = "s3.endpoint"                       // host[:port] of the S3-compatible store
+const cConfigS3Scheme string = "s3.scheme"                           // https (default) or http, eg. for a local MinIO
+const cConfigS3Region string = "s3.region"                           // signing region, defaults to us-east-1
+const cConfigS3Bucket string = "s3.bucket"                           // bucket the stem keys live in
+const cConfigS3PathStyle string = "s3.path-style"                    // address as endpoint/bucket/key rather than bucket.endpoint/key
+const cConfigS3AccessKey string = "s3.access-key"                    //
+const cConfigS3SecretKey string = "s3.secret-key"                    //
+const cConfigS3CAFile string = "s3.ca-file"                          // PEM bundle trusted in addition to the system roots
+const cConfigS3InsecureSkipVerify string = "s3.insecure-skip-verify" // last resort for self-signed stores with no CA to hand
+
+const cS3DefaultRegion string = "us-east-1"
+const cS3SigningAlgorithm string = "AWS4-HMAC-SHA256"
+const cS3UnsignedPayload string = "UNSIGNED-PAYLOAD"
+
+// sha256 of nothing at all, for bodiless requests
+const cS3EmptyPayloadHash string = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// somewhere we can GET / PUT stems by key; either a configured S3 store with signed requests or a plain anonymous server
+type StemStore struct {
+	httpClient *http.Client
+	scheme     string
+	host       string
+	pathPrefix string // anonymous stores only, keys live under this path on the host
+	bucket     string
+	pathStyle  bool
+	region     string
+	accessKey  string
+	secretKey  string
+}
+
+// the http client used for all stem traffic; trusts the system roots plus anything in s3.ca-file
+func newStemHttpClient() (*http.Client, error) {
+
+	tlsConfig := &tls.Config{}
+
+	if caFile := viper.GetString(cConfigS3CAFile); len(caFile) > 0 {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s [%s]: %w", cConfigS3CAFile, caFile, err)
+		}
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s [%s]", cConfigS3CAFile, caFile)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if viper.GetBool(cConfigS3InsecureSkipVerify) {
+		SysLog.Warn("TLS verification disabled for stem storage by " + cConfigS3InsecureSkipVerify)
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	httpTransport := http.DefaultTransport.(*http.Transport).Clone()
+	httpTransport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: httpTransport}, nil
+}
+
+// work out how to talk to the given stem server. if it names the store configured in ourocosm.server.yaml (or is empty and one
+// is configured) we use that, credentials and all; anything else is treated as an anonymous https host. returns nil if there's
+// nowhere to go
+func resolveStemStore(stemServer string) (*StemStore, error) {
+
+	configuredEndpoint := viper.GetString(cConfigS3Endpoint)
+	if len(stemServer) == 0 {
+		if len(configuredEndpoint) == 0 {
+			return nil, nil
+		}
+		stemServer = configuredEndpoint
+	}
+
+	httpClient, err := newStemHttpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if stemServer != configuredEndpoint {
+		anonymousStore := &StemStore{
+			httpClient: httpClient,
+			scheme:     "https",
+			host:       stemServer,
+		}
+		// a full URL picks the scheme and can carry a path, eg. http://localhost:27000/stems for serve's stem cache
+		if serverURL, err := url.Parse(stemServer); err == nil && (serverURL.Scheme == "http" || serverURL.Scheme == "https") {
+			anonymousStore.scheme = serverURL.Scheme
+			anonymousStore.host = serverURL.Host
+			anonymousStore.pathPrefix = strings.TrimSuffix(serverURL.Path, "/")
+		}
+		return anonymousStore, nil
+	}
+
+	stemStore := &StemStore{
+		httpClient: httpClient,
+		scheme:     viper.GetString(cConfigS3Scheme),
+		host:       configuredEndpoint,
+		bucket:     viper.GetString(cConfigS3Bucket),
+		pathStyle:  viper.GetBool(cConfigS3PathStyle),
+		region:     viper.GetString(cConfigS3Region),
+		accessKey:  viper.GetString(cConfigS3AccessKey),
+		secretKey:  viper.GetString(cConfigS3SecretKey),
+	}
+	if len(stemStore.scheme) == 0 {
+		stemStore.scheme = "https"
+	}
+	if len(stemStore.region) == 0 {
+		stemStore.region = cS3DefaultRegion
+	}
+	if (len(stemStore.accessKey) == 0) != (len(stemStore.secretKey) == 0) {
+		return nil, fmt.Errorf("%s and %s must be set together", cConfigS3AccessKey, cConfigS3SecretKey)
+	}
+	return stemStore, nil
+}
+
+func (store *StemStore) isSigned() bool {
+	return len(store.accessKey) > 0
+}
+
+// where a key lives, for requests and for logging
+func (store *StemStore) ObjectURL(key string) string {
+
+	objectPath := store.pathPrefix + "/" + strings.TrimPrefix(key, "/")
+	host := store.host
+	if len(store.bucket) > 0 {
+		if store.pathStyle {
+			objectPath = "/" + store.bucket + objectPath
+		} else {
+			host = store.bucket + "." + host
+		}
+	}
+	return fmt.Sprintf("%s://%s%s", store.scheme, host, s3EscapePath(objectPath))
+}
+
+// build a request against a key; signing happens in Do so callers are free to add headers first
+func (store *StemStore) NewRequest(method string, key string, query url.Values, body io.Reader) (*http.Request, error) {
+
+	objectURL := store.ObjectURL(key)
+	if len(query) > 0 {
+		objectURL += "?" + s3CanonicalQuery(query)
+	}
+	return http.NewRequest(method, objectURL, body)
+}
+
+// sign (if we have credentials) and send. bodies are sent as UNSIGNED-PAYLOAD so they can be streamed
+func (store *StemStore) Do(req *http.Request) (*http.Response, error) {
+	if store.isSigned() {
+		payloadHash := cS3EmptyPayloadHash
+		if req.Body != nil && req.Body != http.NoBody {
+			payloadHash = cS3UnsignedPayload
+		}
+		store.signRequest(req, payloadHash, time.Now().UTC())
+	}
+	return store.httpClient.Do(req)
+}
+
+// push stem data of a known size up to the store, the reverse of downloadStem
+func (store *StemStore) Put(key string, source io.Reader, length int64) error {
+
+	req, err := store.NewRequest(http.MethodPut, key, nil, source)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = length
+
+	resp, err := store.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("error while uploading: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// one entry from a bucket listing
+type StemObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// ListObjectsV2 response, just the parts we use
+type s3ListBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+// walk every object in the bucket under the given prefix, a page at a time; needs a configured bucket
+func (store *StemStore) List(prefix string, fn func(StemObject) error) error {
+
+	if len(store.bucket) == 0 {
+		return fmt.Errorf("listing needs a bucket, set %s", cConfigS3Bucket)
+	}
+
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if len(prefix) > 0 {
+			query.Set("prefix", prefix)
+		}
+		if len(continuationToken) > 0 {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		req, err := store.NewRequest(http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := store.Do(req)
+		if err != nil {
+			return err
+		}
+		var listing s3ListBucketResult
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("error while listing: %v", resp.StatusCode)
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&listing)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, content := range listing.Contents {
+			if err = fn(StemObject{Key: content.Key, Size: content.Size, LastModified: content.LastModified}); err != nil {
+				return err
+			}
+		}
+		if !listing.IsTruncated || len(listing.NextContinuationToken) == 0 {
+			return nil
+		}
+		continuationToken = listing.NextContinuationToken
+	}
+}
+
+func (store *StemStore) Delete(key string) error {
+
+	req, err := store.NewRequest(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := store.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error while deleting: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// server-side copy within the bucket
+func (store *StemStore) Copy(sourceKey string, destinationKey string) error {
+
+	if len(store.bucket) == 0 {
+		return fmt.Errorf("copying needs a bucket, set %s", cConfigS3Bucket)
+	}
+
+	req, err := store.NewRequest(http.MethodPut, destinationKey, nil, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-amz-copy-source", s3EscapePath("/"+store.bucket+"/"+strings.TrimPrefix(sourceKey, "/")))
+
+	resp, err := store.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// a copy can fail after the 200 has gone out, in which case the body is an <Error> rather than a <CopyObjectResult>
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || strings.Contains(string(responseBody), "<Error>") {
+		return fmt.Errorf("error while copying: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// AWS signature version 4, as per https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (store *StemStore) signRequest(req *http.Request, payloadHash string, now time.Time) {
+
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	host := req.Host
+	if len(host) == 0 {
+		host = req.URL.Host
+	}
+
+	// host plus every x-amz-* header the caller set, eg. x-amz-copy-source; S3 rejects requests that carry any unsigned
+	amzHeaders := []string{}
+	for name := range req.Header {
+		if lowerName := strings.ToLower(name); strings.HasPrefix(lowerName, "x-amz-") {
+			amzHeaders = append(amzHeaders, lowerName)
+		}
+	}
+	sort.Strings(amzHeaders)
+
+	signedHeaders := "host;" + strings.Join(amzHeaders, ";")
+	canonicalHeaders := "host:" + host + "\n"
+	for _, name := range amzHeaders {
+		canonicalHeaders += name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	credentialScope := shortDate + "/" + store.region + "/s3/aws4_request"
+	stringToSign := s3StringToSign(amzDate, credentialScope, canonicalRequest)
+	signature := hex.EncodeToString(s3HMAC(s3SigningKey(store.secretKey, shortDate, store.region), stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cS3SigningAlgorithm,
+		store.accessKey,
+		credentialScope,
+		signedHeaders,
+		signature,
+	))
+}
+
+// shared with the built-in stem store, which has to work the same signature out to check it
+func s3StringToSign(amzDate string, credentialScope string, canonicalRequest string) string {
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	return cS3SigningAlgorithm + "\n" + amzDate + "\n" + credentialScope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+}
+
+func s3SigningKey(secretKey string, shortDate string, region string) []byte {
+	signingKey := s3HMAC([]byte("AWS4"+secretKey), shortDate)
+	signingKey = s3HMAC(signingKey, region)
+	signingKey = s3HMAC(signingKey, "s3")
+	return s3HMAC(signingKey, "aws4_request")
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// SigV4 wants everything but the RFC 3986 unreserved characters percent-encoded, which is stricter than net/url
+func s3Escape(s string, keepSlash bool) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			escaped.WriteByte(c)
+		} else {
+			escaped.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return escaped.String()
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
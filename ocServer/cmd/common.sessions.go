@@ -0,0 +1,147 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/Unbundlesss/OUROCOSM/ocServer/cmd/internal/lore"
+)
+
+// riffs further apart than this are considered to be in different sessions, unless told otherwise
+const cSessionDefaultGap time.Duration = 2 * time.Hour
+
+// a run of riffs with no gap between them longer than the inactivity threshold; ie. "the session from Saturday night"
+type JamSession struct {
+	Index        int       // 1-based, in creation order
+	Start        time.Time // creation time of the first riff
+	End          time.Time // .. and the last
+	RiffCount    int
+	Participants []string // everyone who committed a riff, sorted
+	MinBPM       float64
+	MaxBPM       float64
+	Keys         []string // "root scale" for each distinct key used, in order of first appearance
+}
+
+func (session *JamSession) Duration() time.Duration {
+	return session.End.Sub(session.Start)
+}
+
+// short label used to tell session exports and renders apart on disk
+func (session *JamSession) Label() string {
+	return fmt.Sprintf("session_%s", session.Start.UTC().Format("20060102_1504"))
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// builds sessions from riffs fed to it in creation order
+type jamSessionBuilder struct {
+	inactivityGap time.Duration
+	sessions      []JamSession
+	current       *JamSession
+	participants  map[string]bool
+}
+
+func newJamSessionBuilder(inactivityGap time.Duration) *jamSessionBuilder {
+	if inactivityGap <= 0 {
+		inactivityGap = cSessionDefaultGap
+	}
+	return &jamSessionBuilder{
+		inactivityGap: inactivityGap,
+		sessions:      []JamSession{},
+		participants:  map[string]bool{},
+	}
+}
+
+func (builder *jamSessionBuilder) closeSession() {
+	if builder.current == nil {
+		return
+	}
+	for participant := range builder.participants {
+		builder.current.Participants = append(builder.current.Participants, participant)
+	}
+	slices.Sort(builder.current.Participants)
+	builder.sessions = append(builder.sessions, *builder.current)
+	builder.current = nil
+	clear(builder.participants)
+}
+
+func (builder *jamSessionBuilder) addRiff(riff *JamRiffData) {
+
+	created := time.UnixMilli(riff.Created)
+	if builder.current != nil && created.Sub(builder.current.End) > builder.inactivityGap {
+		builder.closeSession()
+	}
+	if builder.current == nil {
+		builder.current = &JamSession{
+			Index:  len(builder.sessions) + 1,
+			Start:  created,
+			MinBPM: math.MaxFloat64,
+		}
+	}
+	current := builder.current
+
+	current.End = created
+	current.RiffCount++
+	builder.participants[riff.UserName] = true
+
+	bpm := lore.BPSToRoundedBPM(riff.State.Bps)
+	current.MinBPM = min(current.MinBPM, bpm)
+	current.MaxBPM = max(current.MaxBPM, bpm)
+
+	riffKey := fmt.Sprintf("%s %s", lore.RootName(riff.Root), lore.ScaleName(riff.Scale))
+	if !slices.Contains(current.Keys, riffKey) {
+		current.Keys = append(current.Keys, riffKey)
+	}
+}
+
+func (builder *jamSessionBuilder) finish() []JamSession {
+	builder.closeSession()
+	return builder.sessions
+}
+
+// group a jam's riffs into sessions, splitting wherever there's more than inactivityGap between consecutive riffs
+func detectJamSessions(jamToScan string, inactivityGap time.Duration) ([]JamSession, error) {
+
+	scanCouchID, _, err := resolveJamCouchID(jamToScan)
+	if err != nil {
+		return nil, err
+	}
+
+	couchClient, err := connectToCouchDB()
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Connection to CouchDB failed"), err)
+	}
+	defer couchClient.Close()
+
+	jamDb := couchClient.DB(fmt.Sprintf("user_appdata$%s", scanCouchID))
+
+	builder := newJamSessionBuilder(inactivityGap)
+	err = forEachJamDocumentByCreateTime(jamDb, "rifffsByCreateTime", func(resultData JamRiffData) error {
+		builder.addRiff(&resultData)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Failed while reading riff documents"), err)
+	}
+	return builder.finish(), nil
+}
+
+// detect sessions and pick out one by index
+func findJamSession(jamToScan string, inactivityGap time.Duration, sessionIndex int) (*JamSession, error) {
+
+	sessions, err := detectJamSessions(jamToScan, inactivityGap)
+	if err != nil {
+		return nil, err
+	}
+	if sessionIndex < 1 || sessionIndex > len(sessions) {
+		return nil, fmt.Errorf("jam [%s] has %d sessions at a %v gap, no session %d", jamToScan, len(sessions), inactivityGap, sessionIndex)
+	}
+	return &sessions[sessionIndex-1], nil
+}
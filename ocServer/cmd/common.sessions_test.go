@@ -0,0 +1,163 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testSessionRiff struct {
+	at    time.Duration // after the first riff
+	user  string
+	bps   float64
+	root  int
+	scale int
+}
+
+func buildTestSessions(inactivityGap time.Duration, riffs []testSessionRiff) []JamSession {
+	builder := newJamSessionBuilder(inactivityGap)
+	for _, riff := range riffs {
+		riffData := JamRiffData{UserName: riff.user, Created: sessionTestStart.Add(riff.at).UnixMilli(), Root: riff.root, Scale: riff.scale}
+		riffData.State.Bps = riff.bps
+		builder.addRiff(&riffData)
+	}
+	return builder.finish()
+}
+
+var sessionTestStart = time.Date(2024, time.March, 2, 21, 0, 0, 0, time.UTC)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func TestJamSessionBuilder(t *testing.T) {
+
+	type wantSession struct {
+		start        time.Duration
+		end          time.Duration
+		riffCount    int
+		participants []string
+		minBPM       float64
+		maxBPM       float64
+		keys         []string
+	}
+
+	cases := []struct {
+		name  string
+		gap   time.Duration
+		riffs []testSessionRiff
+		want  []wantSession
+	}{
+		{
+			name: "no riffs",
+			gap:  time.Hour,
+			want: []wantSession{},
+		},
+		{
+			name:  "one riff",
+			gap:   time.Hour,
+			riffs: []testSessionRiff{{0, "alice", 2, 0, 0}},
+			want:  []wantSession{{0, 0, 1, []string{"alice"}, 120, 120, []string{"C major"}}},
+		},
+		{
+			name: "gap exactly at the threshold stays together",
+			gap:  time.Hour,
+			riffs: []testSessionRiff{
+				{0, "bob", 2, 0, 0},
+				{time.Hour, "alice", 2.5, 1, 1},
+				{2 * time.Hour, "bob", 2, 0, 0},
+			},
+			want: []wantSession{{0, 2 * time.Hour, 3, []string{"alice", "bob"}, 120, 150, []string{"C major", "Db dorian"}}},
+		},
+		{
+			name: "longer gaps split",
+			gap:  time.Hour,
+			riffs: []testSessionRiff{
+				{0, "alice", 2, 0, 0},
+				{10 * time.Minute, "alice", 2, 0, 0},
+				{time.Hour + 10*time.Minute + time.Millisecond, "carol", 1.5, 2, 0},
+				{48 * time.Hour, "bob", 2, 0, 0},
+				{48*time.Hour + time.Minute, "alice", 2, 0, 0},
+			},
+			want: []wantSession{
+				{0, 10 * time.Minute, 2, []string{"alice"}, 120, 120, []string{"C major"}},
+				{time.Hour + 10*time.Minute + time.Millisecond, time.Hour + 10*time.Minute + time.Millisecond, 1, []string{"carol"}, 90, 90, []string{"D major"}},
+				{48 * time.Hour, 48*time.Hour + time.Minute, 2, []string{"alice", "bob"}, 120, 120, []string{"C major"}},
+			},
+		},
+		{
+			// the gap is measured from the previous riff, not the start of the session
+			name: "slow trickle stays one session",
+			gap:  time.Hour,
+			riffs: []testSessionRiff{
+				{0, "alice", 2, 0, 0},
+				{50 * time.Minute, "alice", 2, 0, 0},
+				{100 * time.Minute, "alice", 2, 0, 0},
+				{150 * time.Minute, "alice", 2, 0, 0},
+			},
+			want: []wantSession{{0, 150 * time.Minute, 4, []string{"alice"}, 120, 120, []string{"C major"}}},
+		},
+		{
+			name: "zero gap uses the default",
+			gap:  0,
+			riffs: []testSessionRiff{
+				{0, "alice", 2, 0, 0},
+				{cSessionDefaultGap, "alice", 2, 0, 0},
+				{2*cSessionDefaultGap + time.Second, "alice", 2, 0, 0},
+			},
+			want: []wantSession{
+				{0, cSessionDefaultGap, 2, []string{"alice"}, 120, 120, []string{"C major"}},
+				{2*cSessionDefaultGap + time.Second, 2*cSessionDefaultGap + time.Second, 1, []string{"alice"}, 120, 120, []string{"C major"}},
+			},
+		},
+		{
+			// riffs from broken clients can carry a root or scale we have no name for
+			name:  "out of range key",
+			gap:   time.Hour,
+			riffs: []testSessionRiff{{0, "alice", 2, 99, -1}},
+			want:  []wantSession{{0, 0, 1, []string{"alice"}, 120, 120, []string{"? ?"}}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sessions := buildTestSessions(tc.gap, tc.riffs)
+			if len(sessions) != len(tc.want) {
+				t.Fatalf("got %d sessions, want %d: %+v", len(sessions), len(tc.want), sessions)
+			}
+			for i, want := range tc.want {
+				got := sessions[i]
+				if got.Index != i+1 {
+					t.Errorf("session %d: index %d", i, got.Index)
+				}
+				if !got.Start.Equal(sessionTestStart.Add(want.start)) || !got.End.Equal(sessionTestStart.Add(want.end)) {
+					t.Errorf("session %d: runs %v to %v", i, got.Start, got.End)
+				}
+				if got.Duration() != want.end-want.start {
+					t.Errorf("session %d: duration %v", i, got.Duration())
+				}
+				if got.RiffCount != want.riffCount {
+					t.Errorf("session %d: %d riffs, want %d", i, got.RiffCount, want.riffCount)
+				}
+				if !reflect.DeepEqual(got.Participants, want.participants) {
+					t.Errorf("session %d: participants %v, want %v", i, got.Participants, want.participants)
+				}
+				if got.MinBPM != want.minBPM || got.MaxBPM != want.maxBPM {
+					t.Errorf("session %d: bpm %v-%v, want %v-%v", i, got.MinBPM, got.MaxBPM, want.minBPM, want.maxBPM)
+				}
+				if !reflect.DeepEqual(got.Keys, want.keys) {
+					t.Errorf("session %d: keys %v, want %v", i, got.Keys, want.keys)
+				}
+			}
+		})
+	}
+}
+
+func TestJamSessionLabel(t *testing.T) {
+	session := JamSession{Start: time.Date(2024, time.March, 2, 21, 5, 59, 0, time.FixedZone("UTC+2", 2*60*60))}
+	if got := session.Label(); got != "session_20240302_1905" {
+		t.Errorf("label: got %s", got)
+	}
+}
@@ -0,0 +1,232 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	kivik "github.com/go-kivik/kivik/v4"
+	"go.uber.org/zap"
+)
+
+// what to do with stems nothing references
+type StemGCAction string
+
+const (
+	StemGCActionReport StemGCAction = ""       // dry run, just list them
+	StemGCActionDelete StemGCAction = "delete" //
+	StemGCActionMove   StemGCAction = "move"   // copy under MoveTo then delete, so they can be recovered if we got it wrong
+)
+
+const cStemGCDefaultGrace = 7 * 24 * time.Hour
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// knobs for collectOrphanedStems
+type StemGCOptions struct {
+	StemS3Server string        // store to collect from; must be the configured one, as we need the bucket and credentials
+	Prefix       string        // only consider objects under this key prefix
+	GracePeriod  time.Duration // leave anything modified more recently than this, it may be a stem Studio hasn't written a Loop for yet
+	Action       StemGCAction  //
+	MoveTo       string        // key prefix orphans are moved under for StemGCActionMove
+	Workers      int           // objects to delete / move at once; 0 for the default
+}
+
+type StemGCOrphan struct {
+	Key          string `json:"key"`
+	Size         int64  `json:"size"`
+	LastModified int64  `json:"last_modified"` // unix time
+}
+
+type StemGCReport struct {
+	StartTime      int64          `json:"start_time"` // unix time
+	EndTime        int64          `json:"end_time"`   //
+	Databases      int            `json:"databases"`  // jam databases scanned for Loop documents
+	ReferencedKeys int            `json:"referenced_keys"`
+	ObjectsListed  int            `json:"objects_listed"`
+	WithinGrace    int            `json:"within_grace"` // unreferenced, but too new to touch
+	Orphans        []StemGCOrphan `json:"orphans"`
+	OrphanBytes    int64          `json:"orphan_bytes"`
+	Action         StemGCAction   `json:"action,omitempty"`
+	Collected      int            `json:"collected"`        // orphans deleted or moved
+	Failed         []string       `json:"failed,omitempty"` // "key: reason"
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// every audio key any Loop document in any jam database points at, ogg and flac both
+func collectReferencedStemKeys(couchClient *kivik.Client) (map[string]bool, int, error) {
+
+	allDatabases, err := couchClient.AllDBs(context.TODO())
+	if err != nil {
+		return nil, 0, errors.Join(fmt.Errorf("Unable to list Couch databases"), err)
+	}
+
+	referencedKeys := map[string]bool{}
+	jamDatabases := 0
+	for _, databaseName := range allDatabases {
+		if !strings.HasPrefix(databaseName, "user_appdata$") {
+			continue
+		}
+		// a database we can't read could be holding references to anything, so the whole run stops rather than guessing
+		err = forEachJamDocumentByCreateTime(couchClient.DB(databaseName), "loopsByCreateTime", func(stemData JamStemData) error {
+			for _, endpoint := range []EndpointAudio{stemData.CdnAttachments.OggAudio, stemData.CdnAttachments.FlacAudio} {
+				if len(endpoint.Key) > 0 {
+					referencedKeys[strings.TrimPrefix(endpoint.Key, "/")] = true
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, 0, errors.Join(fmt.Errorf("Unable to read loops from [%s]", databaseName), err)
+		}
+		jamDatabases++
+	}
+	return referencedKeys, jamDatabases, nil
+}
+
+// delete or move each orphan, returning the ones that failed
+func collectStemObjects(stemStore *StemStore, orphans []StemGCOrphan, options StemGCOptions) []string {
+
+	workers := options.Workers
+	if workers <= 0 {
+		workers = cStemDownloadDefaultWorkers
+	}
+
+	failures := make([]string, len(orphans))
+	orphanIndices := make(chan int)
+
+	var workerGroup sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		workerGroup.Add(1)
+		go func() {
+			defer workerGroup.Done()
+			for i := range orphanIndices {
+				key := orphans[i].Key
+				var err error
+				if options.Action == StemGCActionMove {
+					err = stemStore.Copy(key, path.Join(options.MoveTo, key))
+				}
+				if err == nil {
+					err = stemStore.Delete(key)
+				}
+				if err != nil {
+					SysLog.Warn("Unable to collect stem", zap.String("Key", key), zap.Error(err))
+					failures[i] = fmt.Sprintf("%s: %s", key, err.Error())
+				}
+			}
+		}()
+	}
+	for i := range orphans {
+		orphanIndices <- i
+	}
+	close(orphanIndices)
+	workerGroup.Wait()
+
+	failed := []string{}
+	for _, failure := range failures {
+		if len(failure) > 0 {
+			failed = append(failed, failure)
+		}
+	}
+	return failed
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// find the objects in the stem bucket that no Loop document references and, unless this is a dry run, delete or move them
+func collectOrphanedStems(options StemGCOptions) (*StemGCReport, error) {
+
+	switch options.Action {
+	case StemGCActionReport, StemGCActionDelete:
+	case StemGCActionMove:
+		options.MoveTo = strings.Trim(options.MoveTo, "/")
+		if len(options.MoveTo) == 0 {
+			return nil, fmt.Errorf("moving orphans needs somewhere to move them to")
+		}
+	default:
+		return nil, fmt.Errorf("unknown action [%s], expected delete or move", options.Action)
+	}
+
+	stemStore, err := resolveStemStore(options.StemS3Server)
+	if err != nil {
+		return nil, err
+	}
+	if stemStore == nil || !stemStore.isSigned() || len(stemStore.bucket) == 0 {
+		return nil, fmt.Errorf("collecting stems needs the s3 store configured with a bucket and credentials")
+	}
+
+	couchClient, err := connectToCouchDB()
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Connection to CouchDB failed"), err)
+	}
+	defer couchClient.Close()
+
+	report := &StemGCReport{StartTime: time.Now().Unix(), Action: options.Action}
+	graceCutoff := time.Now().Add(-options.GracePeriod)
+
+	// list before reading the references; anything uploaded and used after the listing starts is either not in it or
+	// will be seen as referenced, so there's no window where a fresh stem looks orphaned
+	candidates := []StemObject{}
+	err = stemStore.List(options.Prefix, func(object StemObject) error {
+		report.ObjectsListed++
+		if options.Action == StemGCActionMove && strings.HasPrefix(object.Key, options.MoveTo+"/") {
+			return nil
+		}
+		candidates = append(candidates, object)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to list stem bucket"), err)
+	}
+
+	referencedKeys, jamDatabases, err := collectReferencedStemKeys(couchClient)
+	if err != nil {
+		return nil, err
+	}
+	report.Databases = jamDatabases
+	report.ReferencedKeys = len(referencedKeys)
+	if len(referencedKeys) == 0 && len(candidates) > 0 {
+		return nil, fmt.Errorf("no Loop documents found in %d jam databases, refusing to treat the whole bucket as orphaned", jamDatabases)
+	}
+
+	for _, object := range candidates {
+		if referencedKeys[object.Key] {
+			continue
+		}
+		if object.LastModified.After(graceCutoff) {
+			report.WithinGrace++
+			continue
+		}
+		report.Orphans = append(report.Orphans, StemGCOrphan{
+			Key:          object.Key,
+			Size:         object.Size,
+			LastModified: object.LastModified.Unix(),
+		})
+		report.OrphanBytes += object.Size
+	}
+	sort.Slice(report.Orphans, func(i, j int) bool { return report.Orphans[i].Key < report.Orphans[j].Key })
+
+	SysLog.Info("Stem collection",
+		zap.Int("Databases", report.Databases),
+		zap.Int("Referenced", report.ReferencedKeys),
+		zap.Int("Listed", report.ObjectsListed),
+		zap.Int("WithinGrace", report.WithinGrace),
+		zap.Int("Orphans", len(report.Orphans)),
+		zap.Int64("OrphanBytes", report.OrphanBytes),
+	)
+
+	if options.Action != StemGCActionReport {
+		report.Failed = collectStemObjects(stemStore, report.Orphans, options)
+		report.Collected = len(report.Orphans) - len(report.Failed)
+	}
+	report.EndTime = time.Now().Unix()
+	return report, nil
+}
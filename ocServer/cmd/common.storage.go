@@ -0,0 +1,238 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	kivik "github.com/go-kivik/kivik/v4"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// per ourocosm.server.yaml
+const cConfigQuotaSoft string = "quota.soft"          // eg. "2GB"; users above this get warned
+const cConfigQuotaHard string = "quota.hard"          // eg. "5GB"; users above this get warned louder, and maybe locked out
+const cConfigQuotaReadOnly string = "quota.read-only" // flip the solo jam of anyone over the hard quota to read-only
+const cConfigQuotaInterval string = "quota.interval"  // how often 'serve' rebuilds the storage report
+
+const cStorageDefaultInterval = time.Hour
+
+// attributed to stems whose Loop document has no creator
+const cStorageUnknownUser = "(unknown)"
+
+// design doc that makes a solo read-only, see setJamDatabaseReadOnly
+const cStorageQuotaDesignDocID = "_design/ocosm_quota"
+
+type StorageQuotaLevel string
+
+const (
+	StorageQuotaOK   StorageQuotaLevel = "ok"
+	StorageQuotaSoft StorageQuotaLevel = "soft"
+	StorageQuotaHard StorageQuotaLevel = "hard"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+type UserStorageUsage struct {
+	User         string            `json:"user"`
+	Stems        int               `json:"stems"`
+	Bytes        int64             `json:"bytes"`
+	Jams         int               `json:"jams"` // databases holding at least one of their stems
+	Quota        StorageQuotaLevel `json:"quota"`
+	HasSolo      bool              `json:"has_solo"`
+	SoloReadOnly bool              `json:"solo_read_only"`
+}
+
+type StorageReport struct {
+	Generated int64              `json:"generated"` // unix time
+	Databases int                `json:"databases"`
+	Stems     int                `json:"stems"` // unique audio objects, ogg and flac counted separately
+	Bytes     int64              `json:"bytes"`
+	SoftQuota int64              `json:"soft_quota,omitempty"`
+	HardQuota int64              `json:"hard_quota,omitempty"`
+	Enforced  bool               `json:"enforced"` // solos over the hard quota are being made read-only
+	Users     []UserStorageUsage `json:"users"`    // biggest first
+	Warnings  []string           `json:"warnings,omitempty"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// quota sizes from config, 0 where unset
+func getStorageQuotas() (soft int64, hard int64) {
+	if viper.IsSet(cConfigQuotaSoft) {
+		soft = int64(viper.GetSizeInBytes(cConfigQuotaSoft))
+	}
+	if viper.IsSet(cConfigQuotaHard) {
+		hard = int64(viper.GetSizeInBytes(cConfigQuotaHard))
+	}
+	return
+}
+
+func getStorageReportInterval() time.Duration {
+	if interval := viper.GetDuration(cConfigQuotaInterval); interval > 0 {
+		return interval
+	}
+	return cStorageDefaultInterval
+}
+
+func getStorageQuotaLevel(bytes int64, soft int64, hard int64) StorageQuotaLevel {
+	switch {
+	case hard > 0 && bytes > hard:
+		return StorageQuotaHard
+	case soft > 0 && bytes > soft:
+		return StorageQuotaSoft
+	}
+	return StorageQuotaOK
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// add up the audio every Loop document in every jam database points at, per creator. a key referenced more than once (a
+// loop shared between riffs, or imported into several jams) only counts towards the first creator it is seen with
+func buildStorageReport(couchClient *kivik.Client) (*StorageReport, error) {
+
+	allDatabases, err := couchClient.AllDBs(context.TODO())
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to list Couch databases"), err)
+	}
+
+	report := &StorageReport{Generated: time.Now().Unix()}
+	report.SoftQuota, report.HardQuota = getStorageQuotas()
+
+	countedKeys := map[string]bool{}
+	usageByUser := map[string]*UserStorageUsage{}
+	solos := map[string]bool{}
+
+	for _, databaseName := range allDatabases {
+		if !strings.HasPrefix(databaseName, "user_appdata$") {
+			continue
+		}
+		solos[strings.TrimPrefix(databaseName, "user_appdata$")] = true
+
+		usersInJam := map[string]bool{}
+		err = forEachJamDocumentByCreateTime(couchClient.DB(databaseName), "loopsByCreateTime", func(stemData JamStemData) error {
+			creator := stemData.CreatorUserName
+			if len(creator) == 0 {
+				creator = cStorageUnknownUser
+			}
+			for _, endpoint := range []EndpointAudio{stemData.CdnAttachments.OggAudio, stemData.CdnAttachments.FlacAudio} {
+				key := strings.TrimPrefix(endpoint.Key, "/")
+				if len(key) == 0 || countedKeys[key] {
+					continue
+				}
+				countedKeys[key] = true
+
+				usage, ok := usageByUser[creator]
+				if !ok {
+					usage = &UserStorageUsage{User: creator}
+					usageByUser[creator] = usage
+				}
+				usage.Stems++
+				usage.Bytes += int64(endpoint.Length)
+				if !usersInJam[creator] {
+					usersInJam[creator] = true
+					usage.Jams++
+				}
+				report.Stems++
+				report.Bytes += int64(endpoint.Length)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("Unable to read loops from [%s]", databaseName), err)
+		}
+		report.Databases++
+	}
+
+	for _, usage := range usageByUser {
+		usage.Quota = getStorageQuotaLevel(usage.Bytes, report.SoftQuota, report.HardQuota)
+		usage.HasSolo = solos[usage.User]
+		if usage.HasSolo {
+			usage.SoloReadOnly, err = isSoloReadOnly(couchClient, usage.User)
+			if err != nil {
+				return nil, errors.Join(fmt.Errorf("Unable to check solo of [%s]", usage.User), err)
+			}
+		}
+		report.Users = append(report.Users, *usage)
+	}
+	sort.Slice(report.Users, func(i, j int) bool {
+		if report.Users[i].Bytes != report.Users[j].Bytes {
+			return report.Users[i].Bytes > report.Users[j].Bytes
+		}
+		return report.Users[i].User < report.Users[j].User
+	})
+
+	report.Warnings = describeStorageWarnings(report)
+	return report, nil
+}
+
+// one line per user over a quota, for logs, the admin API and Discord
+func describeStorageWarnings(report *StorageReport) []string {
+
+	warnings := []string{}
+	for _, usage := range report.Users {
+		switch usage.Quota {
+		case StorageQuotaSoft:
+			warnings = append(warnings, fmt.Sprintf("%s is over the soft quota, using %s of %s",
+				usage.User, humanize.Bytes(uint64(usage.Bytes)), humanize.Bytes(uint64(report.SoftQuota))))
+		case StorageQuotaHard:
+			readOnly := ""
+			if usage.SoloReadOnly {
+				readOnly = ", solo is read-only"
+			}
+			warnings = append(warnings, fmt.Sprintf("%s is over the hard quota, using %s of %s%s",
+				usage.User, humanize.Bytes(uint64(usage.Bytes)), humanize.Bytes(uint64(report.HardQuota)), readOnly))
+		}
+	}
+	return warnings
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// a solo is read-only while it holds our quota design doc
+func isSoloReadOnly(couchClient *kivik.Client, username string) (bool, error) {
+	return isJamDatabaseReadOnly(couchClient.DB(fmt.Sprintf("user_appdata$%s", username)), cStorageQuotaDesignDocID)
+}
+
+func setSoloReadOnly(couchClient *kivik.Client, username string, readOnly bool) error {
+	return setJamDatabaseReadOnly(couchClient.DB(fmt.Sprintf("user_appdata$%s", username)), cStorageQuotaDesignDocID, "storage quota exceeded, this jam is read-only", readOnly)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// make solos of users over the hard quota read-only, and give them back once they are under it again. the report is
+// updated to match what was done
+func enforceStorageQuotas(couchClient *kivik.Client, report *StorageReport) error {
+
+	if report.HardQuota <= 0 {
+		return fmt.Errorf("enforcing quotas needs %s to be set", cConfigQuotaHard)
+	}
+
+	var failures []error
+	for i := range report.Users {
+		usage := &report.Users[i]
+		wantReadOnly := usage.Quota == StorageQuotaHard
+		if !usage.HasSolo || usage.SoloReadOnly == wantReadOnly {
+			continue
+		}
+		if err := setSoloReadOnly(couchClient, usage.User, wantReadOnly); err != nil {
+			SysLog.Error("Unable to change solo write access", zap.String("User", usage.User), zap.Bool("ReadOnly", wantReadOnly), zap.Error(err))
+			failures = append(failures, err)
+			continue
+		}
+		usage.SoloReadOnly = wantReadOnly
+		SysLog.Info("Solo write access changed", zap.String("User", usage.User), zap.Bool("ReadOnly", wantReadOnly), zap.Int64("Bytes", usage.Bytes))
+	}
+	report.Enforced = true
+	report.Warnings = describeStorageWarnings(report)
+
+	if len(failures) > 0 {
+		return errors.Join(append([]error{fmt.Errorf("Unable to update %d solos", len(failures))}, failures...)...)
+	}
+	return nil
+}
@@ -90,3 +90,15 @@ func getActiveEndpoint(stemData JamStemData) *EndpointAudio {
 	}
 	return &stemData.CdnAttachments.OggAudio
 }
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// chat message as per couch
+type JamChatData struct {
+	ID         string `json:"_id"`
+	Rev        string `json:"_rev"`
+	AppVersion int    `json:"app_version"`
+	Type       string `json:"type"`
+	Created    int64  `json:"created"`
+	UserName   string `json:"userName"`
+	Message    string `json:"message"`
+}
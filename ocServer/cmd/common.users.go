@@ -0,0 +1,124 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	kivik "github.com/go-kivik/kivik/v4"
+	"go.uber.org/zap"
+)
+
+var (
+	usernameInvalidCharacterRegExp = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// the rules 'newuser' has always applied to names and logins
+func validateNewUser(username string, login string) error {
+
+	// stop trying to add empty things or long things
+	if len(username) == 0 || len(username) > 16 {
+		return fmt.Errorf("username cannot be blank, nor longer than 16 letters")
+	}
+	// stop trying to make usernames with emoji in or whatever
+	if usernameInvalidCharacterRegExp.MatchString(username) {
+		return fmt.Errorf("username contains invalid symbols - alphanumeric only and underlines only, please")
+	}
+	if len(login) == 0 {
+		return fmt.Errorf("login password cannot be blank")
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// add a _users record and a solo jam for a new user; a name that is already taken comes back as a 409 from Couch
+func createNewUser(couchClient *kivik.Client, username string, login string, bio string) error {
+
+	if err := validateNewUser(username, login); err != nil {
+		return err
+	}
+
+	newUserId := getCouchRecordIDForUser(username)
+
+	// add our new pal to the users db
+	// note the password is generated and internal to the database permissions - it's what Endlesss will use
+	// to talk to the users' own solo jam database. i'm mostly just making up how to hand out those token/pwd combos, this will do for now
+	// (it's about as leaky as the Endlesss setup was, you could sniff the couchbase password from an auth request and log into Fauxton there too)
+	userDB := couchClient.DB("_users")
+	_, err := userDB.Put(context.TODO(), newUserId, map[string]interface{}{
+		"name":     username,
+		"type":     "user",
+		"roles":    []string{"jammers"},
+		"password": generateInternalCouchUserPassword(username),
+		"login":    login,
+		"bio":      bio,
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("Failed to insert new _users record [%s]", newUserId), err)
+	}
+
+	// database name requires only lowercase characters (a-z), digits (0-9), underline
+	usernameForDatabase := strings.ToLower(username)
+
+	// build our user a new solo jam <3
+	soloDB, err := createNewJamDatabase(couchClient, usernameForDatabase)
+	if err != nil {
+		return errors.Join(fmt.Errorf("Failed to create user database"), err)
+	}
+
+	// snag the security block so we can add the user to the members list
+	soloSecurity, err := soloDB.Security(context.TODO())
+	if err != nil {
+		return errors.Join(fmt.Errorf("Failed to acquire user database security"), err)
+	}
+
+	// .. add the username to the members-permissions pile
+	soloSecurity.Members.Names = append(soloSecurity.Members.Names, username)
+
+	// write it back
+	err = soloDB.SetSecurity(context.TODO(), soloSecurity)
+	if err != nil {
+		return errors.Join(fmt.Errorf("Failed to reconfigure user database security"), err)
+	}
+
+	// keep the standby in step, if we have one; _users is replicated as a whole so the record itself is already covered
+	addReplicationForNewDatabase(couchClient, soloDB.Name())
+
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// remove a user's _users record, so they can no longer log in; their riffs stay where they are. with purgeSolo their solo
+// jam database goes too
+func deleteUser(couchClient *kivik.Client, username string, purgeSolo bool) error {
+
+	userDB := couchClient.DB("_users")
+	userId := getCouchRecordIDForUser(username)
+
+	rev, err := userDB.GetRev(context.TODO(), userId)
+	if err != nil {
+		return err
+	}
+	if _, err = userDB.Delete(context.TODO(), userId, rev); err != nil {
+		return errors.Join(fmt.Errorf("Failed to delete _users record [%s]", userId), err)
+	}
+
+	if purgeSolo {
+		err = couchClient.DestroyDB(context.TODO(), fmt.Sprintf("user_appdata$%s", strings.ToLower(username)))
+		if err != nil && kivik.HTTPStatus(err) != http.StatusNotFound {
+			return errors.Join(fmt.Errorf("Failed to delete user database"), err)
+		}
+	}
+
+	SysLog.Info("Deleted user", zap.String("User", username), zap.Bool("PurgedSolo", purgeSolo))
+	return nil
+}
@@ -0,0 +1,122 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+// -----------------------------------------------------------------------------------------------------------------------------------
+//
+// Just enough audio handling to turn a riff into a single shareable file without shelling out to anything. Stems come off the
+// CDN as FLAC or Ogg Vorbis; both are decoded here into a plain stereo float Buffer, which can be resampled, sped up or slowed
+// down, mixed into and finally written back out as 16-bit WAV or FLAC.
+//
+// Everything is held in memory - a riff is at most a handful of bars of 8 stems, so that's never very much.
+//
+
+package audio
+
+import (
+	"math"
+)
+
+// stereo float32 audio, nominally in -1..1
+type Buffer struct {
+	SampleRate int
+	Left       []float32
+	Right      []float32
+}
+
+func NewBuffer(sampleRate int, frames int) *Buffer {
+	return &Buffer{
+		SampleRate: sampleRate,
+		Left:       make([]float32, frames),
+		Right:      make([]float32, frames),
+	}
+}
+
+// number of sample frames (ie. samples per channel)
+func (buf *Buffer) Len() int {
+	return len(buf.Left)
+}
+
+// length in seconds
+func (buf *Buffer) Duration() float64 {
+	if buf.SampleRate <= 0 {
+		return 0
+	}
+	return float64(buf.Len()) / float64(buf.SampleRate)
+}
+
+// largest absolute sample value across both channels
+func (buf *Buffer) Peak() float32 {
+	var peak float32
+	for i := range buf.Left {
+		peak = max(peak, float32(math.Abs(float64(buf.Left[i]))), float32(math.Abs(float64(buf.Right[i]))))
+	}
+	return peak
+}
+
+func (buf *Buffer) Scale(gain float32) {
+	for i := range buf.Left {
+		buf.Left[i] *= gain
+		buf.Right[i] *= gain
+	}
+}
+
+// return a copy at a different sample rate, using linear interpolation; stems are all recorded at 44.1 or 48kHz so this
+// only ever has to bridge small ratios and doesn't need to be any fancier
+func (buf *Buffer) Resample(sampleRate int) *Buffer {
+
+	if sampleRate == buf.SampleRate || buf.Len() == 0 {
+		return buf
+	}
+	return buf.interpolate(sampleRate, float64(buf.SampleRate)/float64(sampleRate))
+}
+
+// return a copy played 'speed' times as fast, pitch moving with it as it would on a tape machine; how a stem recorded at one
+// tempo is fitted to a riff at another
+func (buf *Buffer) Varispeed(speed float64) *Buffer {
+
+	if speed == 1 || speed <= 0 || buf.Len() == 0 {
+		return buf
+	}
+	return buf.interpolate(buf.SampleRate, speed)
+}
+
+// linear interpolation, stepping through buf 'step' frames for every frame written
+func (buf *Buffer) interpolate(sampleRate int, step float64) *Buffer {
+
+	frames := int(math.Round(float64(buf.Len()) / step))
+	out := NewBuffer(sampleRate, frames)
+
+	last := buf.Len() - 1
+	for i := 0; i < frames; i++ {
+		position := float64(i) * step
+		index := int(position)
+		if index >= last {
+			out.Left[i] = buf.Left[last]
+			out.Right[i] = buf.Right[last]
+			continue
+		}
+		fraction := float32(position - float64(index))
+		out.Left[i] = buf.Left[index] + (buf.Left[index+1]-buf.Left[index])*fraction
+		out.Right[i] = buf.Right[index] + (buf.Right[index+1]-buf.Right[index])*fraction
+	}
+	return out
+}
+
+// add source into buf from frame 0 to the end of buf, with gain, treating source as a loop 'loopFrames' long; if the source
+// is shorter than the loop the remainder of each repeat is silence, if it's longer the tail is ignored
+func (buf *Buffer) MixLooped(source *Buffer, loopFrames int, gain float32) {
+
+	if loopFrames <= 0 || source.Len() == 0 {
+		return
+	}
+	playable := min(loopFrames, source.Len())
+
+	for start := 0; start < buf.Len(); start += loopFrames {
+		count := min(playable, buf.Len()-start)
+		for i := 0; i < count; i++ {
+			buf.Left[start+i] += source.Left[i] * gain
+			buf.Right[start+i] += source.Right[i] * gain
+		}
+	}
+}
@@ -0,0 +1,222 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a stereo ramp, left rising and right falling, so channels and ordering both show up if they're mixed up
+func newRampBuffer(sampleRate int, frames int) *Buffer {
+	buf := NewBuffer(sampleRate, frames)
+	for i := range buf.Left {
+		buf.Left[i] = float32(i)/float32(frames)*2 - 1
+		buf.Right[i] = -buf.Left[i] * 0.5
+	}
+	return buf
+}
+
+// one 16-bit step; writing rounds to the nearest, and FLAC reads back scaling by 1/32768 where we wrote with 32767, so a
+// round trip can be out by up to two
+const int16Step = 1.0 / math.MaxInt16
+
+func compareBuffers(t *testing.T, got *Buffer, want *Buffer, tolerance float64) {
+	t.Helper()
+	if got.SampleRate != want.SampleRate || got.Len() != want.Len() {
+		t.Fatalf("got %d frames at %d, want %d at %d", got.Len(), got.SampleRate, want.Len(), want.SampleRate)
+	}
+	for i := range want.Left {
+		if math.Abs(float64(got.Left[i]-want.Left[i])) > tolerance || math.Abs(float64(got.Right[i]-want.Right[i])) > tolerance {
+			t.Fatalf("frame %d: got %v/%v, want %v/%v", i, got.Left[i], got.Right[i], want.Left[i], want.Right[i])
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func TestFLACRoundTrip(t *testing.T) {
+
+	cases := []struct {
+		name string
+		buf  *Buffer
+	}{
+		{"ramp over several blocks", newRampBuffer(44100, flacBlockSize*2+100)},
+		{"silence", NewBuffer(48000, 1000)},
+		{"shorter than the predictor", newRampBuffer(22050, 2)},
+		{"clipped", func() *Buffer {
+			buf := newRampBuffer(44100, 100)
+			buf.Scale(3)
+			return buf
+		}()},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var encoded bytes.Buffer
+			if err := WriteFLAC(&encoded, tc.buf); err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := Decode(encoded.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// anything past full scale comes back clipped to it
+			want := NewBuffer(tc.buf.SampleRate, tc.buf.Len())
+			for i := range want.Left {
+				want.Left[i] = max(-1, min(1, tc.buf.Left[i]))
+				want.Right[i] = max(-1, min(1, tc.buf.Right[i]))
+			}
+			compareBuffers(t, decoded, want, 2*int16Step)
+		})
+	}
+}
+
+// seekable output gets its stream info patched; check that still decodes
+func TestFLACRoundTripToFile(t *testing.T) {
+
+	flacPath := filepath.Join(t.TempDir(), "ramp.flac")
+	flacFile, err := os.Create(flacPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := newRampBuffer(44100, 5000)
+	if err = Write(flacFile, buf, FormatFLAC); err != nil {
+		t.Fatal(err)
+	}
+	flacFile.Close()
+
+	data, err := os.ReadFile(flacPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareBuffers(t, decoded, buf, 2*int16Step)
+}
+
+func TestWriteWAV(t *testing.T) {
+
+	buf := newRampBuffer(48000, 300)
+	var encoded bytes.Buffer
+	if err := Write(&encoded, buf, FormatWAV); err != nil {
+		t.Fatal(err)
+	}
+
+	data := encoded.Bytes()
+	if len(data) != 44+300*4 {
+		t.Fatalf("wrote %d bytes", len(data))
+	}
+	if string(data[0:4]) != "RIFF" || string(data[8:16]) != "WAVEfmt " || string(data[36:40]) != "data" {
+		t.Errorf("chunk ids: %q", data[0:40])
+	}
+	if size := binary.LittleEndian.Uint32(data[4:]); size != uint32(len(data)-8) {
+		t.Errorf("RIFF size %d", size)
+	}
+	if channels, rate := binary.LittleEndian.Uint16(data[22:]), binary.LittleEndian.Uint32(data[24:]); channels != 2 || rate != 48000 {
+		t.Errorf("%d channels at %d", channels, rate)
+	}
+
+	// read the samples back by hand, Decode only takes the formats stems come in
+	decoded := NewBuffer(48000, 300)
+	for i := range decoded.Left {
+		decoded.Left[i] = float32(int16(binary.LittleEndian.Uint16(data[44+i*4:]))) / math.MaxInt16
+		decoded.Right[i] = float32(int16(binary.LittleEndian.Uint16(data[46+i*4:]))) / math.MaxInt16
+	}
+	compareBuffers(t, decoded, buf, int16Step)
+}
+
+func TestDecodeRejectsUnknownData(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("RIFF....WAVE"), []byte("ID3")} {
+		if _, err := Decode(data); !errors.Is(err, ErrUnknownFormat) {
+			t.Errorf("%q: %v", data, err)
+		}
+	}
+	if _, err := Decode([]byte("fLaC but not really")); err == nil {
+		t.Error("expected an error for a damaged FLAC")
+	}
+	if _, err := ParseFormat("mp3"); err == nil {
+		t.Error("expected an error for an unknown output format")
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func TestResample(t *testing.T) {
+
+	buf := newRampBuffer(48000, 4800)
+	if buf.Resample(48000) != buf {
+		t.Error("resampling to the same rate made a copy")
+	}
+
+	resampled := buf.Resample(44100)
+	if resampled.SampleRate != 44100 || resampled.Len() != 4410 {
+		t.Fatalf("got %d frames at %d", resampled.Len(), resampled.SampleRate)
+	}
+	if math.Abs(resampled.Duration()-buf.Duration()) > 1.0/44100 {
+		t.Errorf("duration changed: %v to %v", buf.Duration(), resampled.Duration())
+	}
+	// a straight line stays a straight line under linear interpolation
+	for _, i := range []int{0, 1000, 4409} {
+		position := float64(i) * 48000 / 44100
+		want := float32(position/4800*2 - 1)
+		if math.Abs(float64(resampled.Left[i]-want)) > 1e-5 {
+			t.Errorf("frame %d: got %v, want %v", i, resampled.Left[i], want)
+		}
+	}
+}
+
+func TestVarispeed(t *testing.T) {
+
+	buf := newRampBuffer(1000, 1000)
+	if buf.Varispeed(1) != buf || buf.Varispeed(0) != buf {
+		t.Error("no-op varispeed made a copy")
+	}
+
+	faster := buf.Varispeed(1.25)
+	slower := buf.Varispeed(0.8)
+	if faster.SampleRate != 1000 || faster.Len() != 800 || slower.Len() != 1250 {
+		t.Fatalf("faster %d frames, slower %d", faster.Len(), slower.Len())
+	}
+	// both still cover the whole of the original, start to end
+	for _, sped := range []*Buffer{faster, slower} {
+		if sped.Left[0] != buf.Left[0] || math.Abs(float64(sped.Left[sped.Len()-1]-buf.Left[buf.Len()-1])) > 0.01 {
+			t.Errorf("ends: %v .. %v", sped.Left[0], sped.Left[sped.Len()-1])
+		}
+	}
+}
+
+func TestMixLooped(t *testing.T) {
+
+	source := NewBuffer(1000, 3)
+	copy(source.Left, []float32{1, 2, 3})
+	copy(source.Right, []float32{-1, -2, -3})
+
+	buf := NewBuffer(1000, 10)
+	buf.MixLooped(source, 4, 0.5)
+	buf.MixLooped(source, 0, 1) // nothing to loop
+	want := []float32{0.5, 1, 1.5, 0, 0.5, 1, 1.5, 0, 0.5, 1}
+	for i := range want {
+		if buf.Left[i] != want[i] || buf.Right[i] != -want[i] {
+			t.Fatalf("frame %d: got %v/%v, want %v", i, buf.Left[i], buf.Right[i], want[i])
+		}
+	}
+
+	// a loop shorter than the source cuts its tail off
+	buf = NewBuffer(1000, 4)
+	buf.MixLooped(source, 2, 1)
+	if buf.Left[2] != 1 || buf.Left[3] != 2 {
+		t.Errorf("short loop: %v", buf.Left)
+	}
+	if peak := buf.Peak(); peak != 2 {
+		t.Errorf("peak %v", peak)
+	}
+}
@@ -0,0 +1,89 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package audio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jfreymuth/oggvorbis"
+	"github.com/mewkiz/flac"
+)
+
+var ErrUnknownFormat = errors.New("unrecognised audio format")
+
+// decode a whole FLAC or Ogg Vorbis file; which one is worked out from the data itself, as the recorded MIME types can't be trusted
+func Decode(data []byte) (*Buffer, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("fLaC")):
+		return decodeFLAC(bytes.NewReader(data))
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return decodeOggVorbis(bytes.NewReader(data))
+	}
+	return nil, ErrUnknownFormat
+}
+
+func decodeFLAC(r io.Reader) (*Buffer, error) {
+
+	stream, err := flac.New(r)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	channels := int(stream.Info.NChannels)
+	if channels < 1 || channels > 2 {
+		return nil, fmt.Errorf("unsupported FLAC channel count %d", channels)
+	}
+	scale := 1.0 / float32(int64(1)<<(stream.Info.BitsPerSample-1))
+
+	buf := &Buffer{SampleRate: int(stream.Info.SampleRate)}
+	if stream.Info.NSamples > 0 {
+		buf.Left = make([]float32, 0, stream.Info.NSamples)
+		buf.Right = make([]float32, 0, stream.Info.NSamples)
+	}
+
+	for {
+		frame, err := stream.ParseNext()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		left := frame.Subframes[0].Samples
+		right := left
+		if channels == 2 {
+			right = frame.Subframes[1].Samples
+		}
+		for i := range left {
+			buf.Left = append(buf.Left, float32(left[i])*scale)
+			buf.Right = append(buf.Right, float32(right[i])*scale)
+		}
+	}
+	return buf, nil
+}
+
+func decodeOggVorbis(r io.Reader) (*Buffer, error) {
+
+	interleaved, format, err := oggvorbis.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if format.Channels < 1 || format.Channels > 2 {
+		return nil, fmt.Errorf("unsupported Vorbis channel count %d", format.Channels)
+	}
+
+	frames := len(interleaved) / format.Channels
+	buf := NewBuffer(format.SampleRate, frames)
+	for i := 0; i < frames; i++ {
+		buf.Left[i] = interleaved[i*format.Channels]
+		buf.Right[i] = interleaved[i*format.Channels+format.Channels-1]
+	}
+	return buf, nil
+}
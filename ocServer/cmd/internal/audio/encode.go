@@ -0,0 +1,189 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package audio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+)
+
+const bitsPerSample = 16
+const flacBlockSize = 4096
+
+type Format string
+
+const (
+	FormatWAV  Format = "wav"
+	FormatFLAC Format = "flac"
+)
+
+func ParseFormat(name string) (Format, error) {
+	switch Format(name) {
+	case FormatWAV, FormatFLAC:
+		return Format(name), nil
+	}
+	return "", fmt.Errorf("unknown audio format [%s], expected wav or flac", name)
+}
+
+func Write(w io.Writer, buf *Buffer, format Format) error {
+	switch format {
+	case FormatWAV:
+		return WriteWAV(w, buf)
+	case FormatFLAC:
+		return WriteFLAC(w, buf)
+	}
+	return fmt.Errorf("unknown audio format [%s]", format)
+}
+
+// clamp and convert to 16-bit, no dither
+func toInt16(sample float32) int32 {
+	return int32(math.Round(float64(max(-1, min(1, sample))) * math.MaxInt16))
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// plain 16-bit stereo PCM .wav
+func WriteWAV(w io.Writer, buf *Buffer) error {
+
+	const channels = 2
+	const blockAlign = channels * bitsPerSample / 8
+	dataSize := uint32(buf.Len() * blockAlign)
+
+	bw := bufio.NewWriter(w)
+
+	header := []any{
+		[4]byte{'R', 'I', 'F', 'F'},
+		uint32(36 + dataSize),
+		[4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '},
+		uint32(16),                          // fmt chunk size
+		uint16(1),                           // PCM
+		uint16(channels),                    //
+		uint32(buf.SampleRate),              //
+		uint32(buf.SampleRate * blockAlign), // bytes per second
+		uint16(blockAlign),                  //
+		uint16(bitsPerSample),               //
+		[4]byte{'d', 'a', 't', 'a'},
+		dataSize,
+	}
+	for _, field := range header {
+		if err := binary.Write(bw, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+
+	var frameBytes [blockAlign]byte
+	for i := 0; i < buf.Len(); i++ {
+		binary.LittleEndian.PutUint16(frameBytes[0:], uint16(toInt16(buf.Left[i])))
+		binary.LittleEndian.PutUint16(frameBytes[2:], uint16(toInt16(buf.Right[i])))
+		if _, err := bw.Write(frameBytes[:]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// 16-bit stereo FLAC. if w is seekable (eg. an *os.File) the stream info is patched afterwards with the sample count and MD5;
+// note that the encoder also closes w if it can
+func WriteFLAC(w io.Writer, buf *Buffer) error {
+
+	info := &meta.StreamInfo{
+		BlockSizeMin:  flacBlockSize,
+		BlockSizeMax:  flacBlockSize,
+		SampleRate:    uint32(buf.SampleRate),
+		NChannels:     2,
+		BitsPerSample: bitsPerSample,
+		NSamples:      uint64(buf.Len()),
+	}
+	encoder, err := flac.NewEncoder(w, info)
+	if err != nil {
+		return err
+	}
+
+	channels := [2][]float32{buf.Left, buf.Right}
+	for start := 0; start < buf.Len(); start += flacBlockSize {
+		count := min(flacBlockSize, buf.Len()-start)
+
+		audioFrame := &frame.Frame{
+			Header: frame.Header{
+				HasFixedBlockSize: true,
+				BlockSize:         uint16(count),
+				SampleRate:        uint32(buf.SampleRate),
+				Channels:          frame.ChannelsLR,
+				BitsPerSample:     bitsPerSample,
+			},
+			Subframes: make([]*frame.Subframe, 2),
+		}
+		for channel := range channels {
+			samples := make([]int32, count)
+			for i := range samples {
+				samples[i] = toInt16(channels[channel][start+i])
+			}
+			audioFrame.Subframes[channel] = newFLACSubframe(samples)
+		}
+		if err = encoder.WriteFrame(audioFrame); err != nil {
+			return err
+		}
+	}
+	return encoder.Close()
+}
+
+// pick a cheap-but-decent encoding for a block; silence and near-silence are common in stems so constant blocks get special
+// treatment, everything else uses the fixed 2nd order predictor with a single Rice partition
+func newFLACSubframe(samples []int32) *frame.Subframe {
+
+	subframe := &frame.Subframe{
+		Samples:  samples,
+		NSamples: len(samples),
+	}
+
+	isConstant := true
+	for _, sample := range samples {
+		if sample != samples[0] {
+			isConstant = false
+			break
+		}
+	}
+	if isConstant {
+		subframe.Pred = frame.PredConstant
+		return subframe
+	}
+
+	const order = 2
+	if len(samples) <= order {
+		subframe.Pred = frame.PredVerbatim
+		return subframe
+	}
+
+	// mean of the zig-zag folded residuals gives a good enough estimate of the best Rice parameter
+	var folded uint64
+	for i := order; i < len(samples); i++ {
+		residual := samples[i] - 2*samples[i-1] + samples[i-2]
+		folded += uint64((residual << 1) ^ (residual >> 31))
+	}
+	mean := folded / uint64(len(samples)-order)
+	riceParam := uint(0)
+	if mean > 0 {
+		riceParam = uint(min(bits.Len64(mean)-1, 30)) // 31 is the escape code
+	}
+
+	subframe.Pred = frame.PredFixed
+	subframe.Order = order
+	subframe.ResidualCodingMethod = frame.ResidualCodingMethodRice2
+	subframe.RiceSubframe = &frame.RiceSubframe{
+		PartOrder:  0,
+		Partitions: []frame.RicePartition{{Param: riceParam}},
+	}
+	return subframe
+}
@@ -0,0 +1,161 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+// -----------------------------------------------------------------------------------------------------------------------------------
+//
+// OUROVEON LORE can import whole jams from a pair of files - a YAML document describing every riff and stem, plus a TAR of the
+// stem audio laid out like LORE's own stem cache. This package owns the YAML half of that; typed records for the riff and stem
+// rows, a streaming Writer that produces exactly what LORE 1.1.4 expects, and a Parse function that reads it all back.
+//
+// The rows themselves are positional flow sequences, one per line, keyed by couch ID:
+//
+//	riffs:
+//	 "<couch ID>": [ user, creation unix time, root index, root name, scale index, scale name, BPS, BPS (hex), BPM, BPM (hex),
+//	                 bar length, app version, 8x [ stem couch ID, gain, gain (hex), enabled ], magnitude ]
+//	stems:
+//	 "<couch ID>": [ endpoint, bucket, key, MIME, length in bytes, sample rate, creation unix time, preset, user, colour hex,
+//	                 BPS, BPS (hex), BPM, BPM (hex), length 16ths, original pitch, bar length, is-drum, is-note, is-bass, is-mic ]
+//	chat:
+//	 "<couch ID>": [ user, creation unix time in milliseconds, message ]
+//
+// The chat section is our own addition and only written when a jam has any; LORE reads the riffs and stems and leaves it be.
+//
+// Floats are written twice; once in plain decimal for humans, once as a hex float that survives the round trip exactly. The
+// reader always prefers the hex form.
+//
+
+package lore
+
+import (
+	"math"
+)
+
+// the version of OUROVEON whose archive format we're compliant with
+const OuroveonVersion string = "1.1.4"
+
+// the couch ID LORE uses for empty slots in a riff
+const EmptyStemID string = ""
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// top-of-file metadata
+type Header struct {
+	ServerName      string // only written into the leading comment
+	ExportTimeUnix  int64
+	OuroveonVersion string
+	JamName         string
+	JamCouchID      string
+}
+
+// one of the 8 playback slots in a riff
+type RiffSlot struct {
+	StemID string // empty if the slot was off
+	Gain   float64
+	On     bool
+}
+
+type Riff struct {
+	ID          string
+	User        string
+	CreatedUnix int64
+	Root        int
+	Scale       int
+	BPS         float64
+	BarLength   int
+	AppVersion  int
+	Slots       [8]RiffSlot
+	Magnitude   float64
+}
+
+type Stem struct {
+	ID            string
+	Endpoint      string
+	Bucket        string
+	Key           string
+	Mime          string
+	Length        int64
+	SampleRate    int
+	CreatedUnix   int64
+	Preset        string
+	User          string
+	Colour        string
+	BPS           float64
+	Length16ths   int
+	OriginalPitch int
+	BarLength     int
+	IsDrum        bool
+	IsNote        bool
+	IsBass        bool
+	IsMic         bool
+}
+
+// chat keeps millisecond timestamps, as messages often land within the same second of each other
+type Chat struct {
+	ID               string
+	User             string
+	CreatedUnixMilli int64
+	Message          string
+}
+
+// a whole archive, as returned by Parse; riffs, stems and chat are in file order
+type Archive struct {
+	Header Header
+	Riffs  []Riff
+	Stems  []Stem
+	Chat   []Chat
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// matching lookup from LORE / Endlesss; anything out of range comes back as "?"
+func RootName(n int) string {
+	names := [...]string{
+		/*  0 */ "C",
+		/*  1 */ "Db", // c#
+		/*  2 */ "D",
+		/*  3 */ "Eb", // d#
+		/*  4 */ "E",
+		/*  5 */ "F",
+		/*  6 */ "F#", // g flat
+		/*  7 */ "G",
+		/*  8 */ "Ab", // g sharp
+		/*  9 */ "A",
+		/* 10 */ "Bb", // a#
+		/* 11 */ "B",
+	}
+	if n < 0 || n >= len(names) {
+		return "?"
+	}
+	return names[n]
+}
+
+// matching lookup from LORE / Endlesss; anything out of range comes back as "?"
+func ScaleName(n int) string {
+	names := [...]string{
+		"major",
+		"dorian",
+		"phrygian",
+		"lydian",
+		"mixoly",
+		"minor",
+		"locrian",
+		"minor_pent",
+		"major_pent",
+		"susp_pent",
+		"blues_mnr_p",
+		"blues_mjr_p",
+		"harmonic_mnr",
+		"melodic_mnr",
+		"dbl_harmonic",
+		"blues",
+		"whole",
+		"chromatic",
+	}
+	if n < 0 || n >= len(names) {
+		return "?"
+	}
+	return names[n]
+}
+
+func BPSToRoundedBPM(bps float64) float64 {
+	return (math.Ceil((bps*60.0)*100.0) / 100.0)
+}
@@ -0,0 +1,282 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package lore
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const riffRowLength int = 21 // 12 riff fields, 8 slots, magnitude
+const stemRowLength int = 21
+const chatRowLength int = 3
+
+const serverNameCommentPrefix string = "# export from OUROCOSM private server '"
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// rowReader pulls typed values out of a positional flow sequence, remembering the first failure
+type rowReader struct {
+	rowID string
+	nodes []*yaml.Node
+	err   error
+}
+
+func (rr *rowReader) fail(index int, expected string) {
+	if rr.err == nil {
+		rr.err = fmt.Errorf("lore: [%s] column %d is not %s (%q)", rr.rowID, index, expected, rr.nodes[index].Value)
+	}
+}
+
+func (rr *rowReader) scalar(index int) *yaml.Node {
+	node := rr.nodes[index]
+	if node.Kind != yaml.ScalarNode {
+		if rr.err == nil {
+			rr.err = fmt.Errorf("lore: [%s] column %d should be a scalar value", rr.rowID, index)
+		}
+		return nil
+	}
+	return node
+}
+
+func (rr *rowReader) str(index int) string {
+	if node := rr.scalar(index); node != nil {
+		return node.Value
+	}
+	return ""
+}
+
+func (rr *rowReader) int64(index int) int64 {
+	node := rr.scalar(index)
+	if node == nil {
+		return 0
+	}
+	value, err := strconv.ParseInt(node.Value, 10, 64)
+	if err != nil {
+		rr.fail(index, "an integer")
+	}
+	return value
+}
+
+func (rr *rowReader) int(index int) int {
+	return int(rr.int64(index))
+}
+
+// strconv reads both the plain decimal and hex float columns, the latter parsing back exactly
+func (rr *rowReader) float(index int) float64 {
+	node := rr.scalar(index)
+	if node == nil {
+		return 0
+	}
+	value, err := strconv.ParseFloat(node.Value, 64)
+	if err != nil {
+		rr.fail(index, "a float")
+	}
+	return value
+}
+
+func (rr *rowReader) bool(index int) bool {
+	node := rr.scalar(index)
+	if node == nil {
+		return false
+	}
+	value, err := strconv.ParseBool(node.Value)
+	if err != nil {
+		rr.fail(index, "a boolean")
+	}
+	return value
+}
+
+func newRowReader(rowID string, row *yaml.Node, expectedLength int) (*rowReader, error) {
+	if row.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("lore: [%s] is not a sequence (line %d)", rowID, row.Line)
+	}
+	if len(row.Content) != expectedLength {
+		return nil, fmt.Errorf("lore: [%s] has %d columns, expected %d (line %d)", rowID, len(row.Content), expectedLength, row.Line)
+	}
+	return &rowReader{rowID: rowID, nodes: row.Content}, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func parseRiff(rowID string, row *yaml.Node) (*Riff, error) {
+
+	rr, err := newRowReader(rowID, row, riffRowLength)
+	if err != nil {
+		return nil, err
+	}
+
+	riff := &Riff{
+		ID:          rowID,
+		User:        rr.str(0),
+		CreatedUnix: rr.int64(1),
+		Root:        rr.int(2),
+		Scale:       rr.int(4),
+		BPS:         rr.float(7),
+		BarLength:   rr.int(10),
+		AppVersion:  rr.int(11),
+		Magnitude:   rr.float(20),
+	}
+	for i := range riff.Slots {
+		slotID := fmt.Sprintf("%s slot %d", rowID, i)
+		slotRow, err := newRowReader(slotID, rr.nodes[12+i], 4)
+		if err != nil {
+			return nil, err
+		}
+		riff.Slots[i] = RiffSlot{
+			StemID: slotRow.str(0),
+			Gain:   slotRow.float(2),
+			On:     slotRow.bool(3),
+		}
+		if slotRow.err != nil {
+			return nil, slotRow.err
+		}
+	}
+	return riff, rr.err
+}
+
+func parseStem(rowID string, row *yaml.Node) (*Stem, error) {
+
+	rr, err := newRowReader(rowID, row, stemRowLength)
+	if err != nil {
+		return nil, err
+	}
+
+	stem := &Stem{
+		ID:            rowID,
+		Endpoint:      rr.str(0),
+		Bucket:        rr.str(1),
+		Key:           rr.str(2),
+		Mime:          rr.str(3),
+		Length:        rr.int64(4),
+		SampleRate:    rr.int(5),
+		CreatedUnix:   rr.int64(6),
+		Preset:        rr.str(7),
+		User:          rr.str(8),
+		Colour:        rr.str(9),
+		BPS:           rr.float(11),
+		Length16ths:   rr.int(14),
+		OriginalPitch: rr.int(15),
+		BarLength:     rr.int(16),
+		IsDrum:        rr.bool(17),
+		IsNote:        rr.bool(18),
+		IsBass:        rr.bool(19),
+		IsMic:         rr.bool(20),
+	}
+	return stem, rr.err
+}
+
+func parseChat(rowID string, row *yaml.Node) (*Chat, error) {
+
+	rr, err := newRowReader(rowID, row, chatRowLength)
+	if err != nil {
+		return nil, err
+	}
+
+	chat := &Chat{
+		ID:               rowID,
+		User:             rr.str(0),
+		CreatedUnixMilli: rr.int64(1),
+		Message:          rr.str(2),
+	}
+	return chat, rr.err
+}
+
+// walk the key/value pairs of a riffs:, stems: or chat: block in file order
+func forEachRow(section *yaml.Node, fn func(rowID string, row *yaml.Node) error) error {
+	// an empty section is null rather than an empty mapping
+	if section.Kind == yaml.ScalarNode && section.Tag == "!!null" {
+		return nil
+	}
+	if section.Kind != yaml.MappingNode {
+		return fmt.Errorf("lore: expected a mapping of rows (line %d)", section.Line)
+	}
+	for i := 0; i+1 < len(section.Content); i += 2 {
+		if err := fn(section.Content[i].Value, section.Content[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// Parse reads a whole LORE archive. Keys we don't recognise are skipped, so newer archives with extra sections still load.
+func Parse(r io.Reader) (*Archive, error) {
+
+	var document yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&document); err != nil {
+		return nil, fmt.Errorf("lore: %w", err)
+	}
+	if document.Kind != yaml.DocumentNode || len(document.Content) != 1 || document.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("lore: archive is not a YAML mapping")
+	}
+	root := document.Content[0]
+
+	archive := &Archive{}
+
+	// the server name only lives in the leading comment, which yaml.v3 hangs off whichever node comes first
+	comments := []string{document.HeadComment, root.HeadComment}
+	if len(root.Content) > 0 {
+		comments = append(comments, root.Content[0].HeadComment)
+	}
+	for _, comment := range comments {
+		if nameStart := strings.Index(comment, serverNameCommentPrefix); nameStart >= 0 {
+			serverName := comment[nameStart+len(serverNameCommentPrefix):]
+			if nameEnd := strings.Index(serverName, "\n"); nameEnd >= 0 {
+				serverName = serverName[:nameEnd]
+			}
+			archive.Header.ServerName = strings.TrimSuffix(serverName, "'")
+			break
+		}
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i].Value, root.Content[i+1]
+
+		var err error
+		switch key {
+		case "export_time_unix":
+			err = value.Decode(&archive.Header.ExportTimeUnix)
+		case "export_ouroveon_version":
+			err = value.Decode(&archive.Header.OuroveonVersion)
+		case "jam_name":
+			err = value.Decode(&archive.Header.JamName)
+		case "jam_couch_id":
+			err = value.Decode(&archive.Header.JamCouchID)
+		case "riffs":
+			err = forEachRow(value, func(rowID string, row *yaml.Node) error {
+				riff, err := parseRiff(rowID, row)
+				if err == nil {
+					archive.Riffs = append(archive.Riffs, *riff)
+				}
+				return err
+			})
+		case "stems":
+			err = forEachRow(value, func(rowID string, row *yaml.Node) error {
+				stem, err := parseStem(rowID, row)
+				if err == nil {
+					archive.Stems = append(archive.Stems, *stem)
+				}
+				return err
+			})
+		case "chat":
+			err = forEachRow(value, func(rowID string, row *yaml.Node) error {
+				chat, err := parseChat(rowID, row)
+				if err == nil {
+					archive.Chat = append(archive.Chat, *chat)
+				}
+				return err
+			})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("lore: bad [%s]: %w", key, err)
+		}
+	}
+
+	return archive, nil
+}
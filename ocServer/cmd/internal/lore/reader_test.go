@@ -0,0 +1,201 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package lore
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// comments can't carry line breaks or control characters, so the server name comes back with them turned into spaces
+func expectedServerName(name string) string {
+	return commentSafe(name)
+}
+
+func roundTrip(t *testing.T, archive *Archive) *Archive {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	lw := NewWriter(&buffer)
+	lw.WriteHeader(&archive.Header)
+	for i := range archive.Riffs {
+		lw.WriteRiff(&archive.Riffs[i])
+	}
+	for i := range archive.Stems {
+		lw.WriteStem(&archive.Stems[i])
+	}
+	for i := range archive.Chat {
+		lw.WriteChat(&archive.Chat[i])
+	}
+	if err := lw.Close(); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	parsed, err := Parse(&buffer)
+	if err != nil {
+		t.Fatalf("parse failed: %v\n%s", err, buffer.String())
+	}
+	return parsed
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func TestRoundTripAwkwardNames(t *testing.T) {
+
+	for i, name := range awkwardNames {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+
+			archive := &Archive{
+				Header: Header{
+					ServerName:      name,
+					ExportTimeUnix:  1700000000,
+					OuroveonVersion: OuroveonVersion,
+					JamName:         name,
+					JamCouchID:      "band" + name,
+				},
+				Riffs: []Riff{{
+					ID:          "riff " + name,
+					User:        name,
+					CreatedUnix: 1700000001,
+					Root:        11,
+					Scale:       17,
+					BPS:         2.0 / 3.0,
+					BarLength:   16,
+					AppVersion:  1,
+					Magnitude:   0.125,
+				}},
+				Stems: []Stem{{
+					ID:          "stem " + name,
+					Endpoint:    name,
+					Bucket:      name,
+					Key:         "attachments/oggs/" + name,
+					Mime:        "audio/ogg",
+					Length:      1 << 40,
+					SampleRate:  48000,
+					CreatedUnix: 1700000002,
+					Preset:      name,
+					User:        name,
+					Colour:      name,
+					BPS:         1.0 / 3.0,
+					Length16ths: 64,
+					IsNote:      true,
+				}},
+				Chat: []Chat{{
+					ID:               "chat " + name,
+					User:             name,
+					CreatedUnixMilli: 1700000003456,
+					Message:          name,
+				}},
+			}
+			archive.Riffs[0].Slots[0] = RiffSlot{StemID: "stem " + name, Gain: 1.0 / 7.0, On: true}
+			archive.Riffs[0].Slots[7] = RiffSlot{StemID: name, Gain: 0.1, On: false}
+
+			parsed := roundTrip(t, archive)
+
+			wantHeader := archive.Header
+			wantHeader.ServerName = expectedServerName(name)
+			if parsed.Header != wantHeader {
+				t.Errorf("header: got %+v, want %+v", parsed.Header, wantHeader)
+			}
+			if !reflect.DeepEqual(parsed.Riffs, archive.Riffs) {
+				t.Errorf("riffs: got %+v, want %+v", parsed.Riffs, archive.Riffs)
+			}
+			if !reflect.DeepEqual(parsed.Stems, archive.Stems) {
+				t.Errorf("stems: got %+v, want %+v", parsed.Stems, archive.Stems)
+			}
+			if !reflect.DeepEqual(parsed.Chat, archive.Chat) {
+				t.Errorf("chat: got %+v, want %+v", parsed.Chat, archive.Chat)
+			}
+		})
+	}
+}
+
+func TestRoundTripKeepsFileOrder(t *testing.T) {
+
+	archive := &Archive{Header: Header{JamName: "order", OuroveonVersion: OuroveonVersion}}
+	for i := 0; i < 20; i++ {
+		// ids that would sort differently to the order they were written in
+		archive.Riffs = append(archive.Riffs, Riff{ID: fmt.Sprintf("r%02d", (i*7)%20), CreatedUnix: int64(i)})
+		archive.Stems = append(archive.Stems, Stem{ID: fmt.Sprintf("s%02d", (i*3)%20), CreatedUnix: int64(i)})
+		archive.Chat = append(archive.Chat, Chat{ID: fmt.Sprintf("c%02d", (i*11)%20), CreatedUnixMilli: int64(i)})
+	}
+	parsed := roundTrip(t, archive)
+	if !reflect.DeepEqual(parsed.Riffs, archive.Riffs) || !reflect.DeepEqual(parsed.Stems, archive.Stems) || !reflect.DeepEqual(parsed.Chat, archive.Chat) {
+		t.Error("rows came back in a different order")
+	}
+}
+
+func TestRoundTripEmptyArchive(t *testing.T) {
+
+	archive := &Archive{Header: Header{ServerName: "empty", ExportTimeUnix: 1, OuroveonVersion: OuroveonVersion, JamName: "nothing here"}}
+	parsed := roundTrip(t, archive)
+	if parsed.Header != archive.Header {
+		t.Errorf("header: got %+v, want %+v", parsed.Header, archive.Header)
+	}
+	if len(parsed.Riffs) != 0 || len(parsed.Stems) != 0 || len(parsed.Chat) != 0 {
+		t.Errorf("empty archive came back with rows: %+v", parsed)
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func TestParseEmptyMapping(t *testing.T) {
+
+	archive, err := Parse(strings.NewReader("{}\n"))
+	if err != nil {
+		t.Fatalf("empty mapping should parse: %v", err)
+	}
+	if archive.Header != (Header{}) || len(archive.Riffs) != 0 || len(archive.Stems) != 0 || len(archive.Chat) != 0 {
+		t.Errorf("empty mapping produced data: %+v", archive)
+	}
+
+	if _, err = Parse(strings.NewReader("# just a comment\n{}\n")); err != nil {
+		t.Errorf("commented empty mapping should parse: %v", err)
+	}
+}
+
+func TestParseRejectsBadDocuments(t *testing.T) {
+
+	cases := map[string]string{
+		"empty file":         "",
+		"not a mapping":      "- one\n- two\n",
+		"scalar":             "hello\n",
+		"broken yaml":        "riffs: [\n",
+		"short stem row":     "stems:\n \"s1\": [ \"a\", \"b\" ]\n",
+		"stem row not list":  "stems:\n \"s1\": \"nope\"\n",
+		"bad stem integer":   "stems:\n \"s1\": [ \"\", \"\", \"\", \"\", \"lots\", 0, 0, \"\", \"\", \"\", 0, \"0x0p+00\", 0, \"0x0p+00\", 0, 0, 0, false, false, false, false ]\n",
+		"bad chat timestamp": "chat:\n \"c1\": [ \"u\", \"yesterday\", \"m\" ]\n",
+		"rows not mapping":   "riffs:\n - 1\n",
+		"nested slot value":  "stems:\n \"s1\": [ [1], \"\", \"\", \"\", 0, 0, 0, \"\", \"\", \"\", 0, \"0x0p+00\", 0, \"0x0p+00\", 0, 0, 0, false, false, false, false ]\n",
+	}
+	for name, document := range cases {
+		if _, err := Parse(strings.NewReader(document)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParseSkipsUnknownSections(t *testing.T) {
+
+	archive, err := Parse(strings.NewReader("jam_name: \"known\"\nsomething_new:\n  a: [1, 2, 3]\nstems:\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archive.Header.JamName != "known" {
+		t.Errorf("jam name: got %q", archive.Header.JamName)
+	}
+}
+
+// the hex float columns are what make floats survive exactly; the decimal ones are only 6 places
+func TestParsePrefersHexFloats(t *testing.T) {
+
+	stem := Stem{ID: "s", BPS: 1.0 / 3.0}
+	parsed := roundTrip(t, &Archive{Stems: []Stem{stem}})
+	if parsed.Stems[0].BPS != stem.BPS {
+		t.Errorf("BPS drifted: got %v, want %v", parsed.Stems[0].BPS, stem.BPS)
+	}
+}
@@ -0,0 +1,264 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package lore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const RiffsSchema string = "couch ID, user, creation unix time, root index, root name, scale index, scale name, BPS (float), BPS (hex float), BPM (float), BPM (hex float), bar length, app version, 8x [ stem couch ID, stem gain (float), stem gain (hex float), stem enabled ]"
+const StemsSchema string = "couch ID, file endpoint, file bucket, file key, file MIME, file length in bytes, sample rate, creation unix time, preset, user, colour hex, BPS (float), BPS (hex float), BPM (float), BPM (hex float), length 16ths, original pitch, bar length, is-drum, is-note, is-bass, is-mic"
+const ChatSchema string = "couch ID, user, creation unix time (ms), message"
+
+type writerSection int
+
+const (
+	sectionNone writerSection = iota
+	sectionHeader
+	sectionRiffs
+	sectionStems
+	sectionChat
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// streams a LORE archive out row by row; sections go in order - header, riffs, stems, chat - with headings written as they're
+// reached, riffs and stems always and chat only if there is any. the first error sticks and is returned from then on
+type Writer struct {
+	w       *bufio.Writer
+	section writerSection
+	err     error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+func (lw *Writer) Err() error {
+	return lw.err
+}
+
+func (lw *Writer) writeString(s string) {
+	if lw.err != nil {
+		return
+	}
+	_, lw.err = lw.w.WriteString(s)
+}
+
+// step forward to the given section, writing out any headings we skipped past
+func (lw *Writer) advanceTo(section writerSection) error {
+	if lw.err != nil {
+		return lw.err
+	}
+	if section < lw.section || (section == lw.section && section == sectionHeader) {
+		lw.err = errors.New("lore: archive sections written out of order")
+		return lw.err
+	}
+	for lw.section < section {
+		lw.section++
+		switch lw.section {
+		case sectionHeader:
+			if section != sectionHeader {
+				lw.err = errors.New("lore: header must be written first")
+				return lw.err
+			}
+		case sectionRiffs:
+			lw.writeString("# riffs schema\n# " + RiffsSchema + "\nriffs:\n")
+		case sectionStems:
+			lw.writeString("# stems schema\n# " + StemsSchema + "\nstems:\n")
+		case sectionChat:
+			lw.writeString("# chat schema\n# " + ChatSchema + "\nchat:\n")
+		}
+	}
+	return lw.err
+}
+
+func (lw *Writer) WriteHeader(header *Header) error {
+	if err := lw.advanceTo(sectionHeader); err != nil {
+		return err
+	}
+
+	ouroveonVersion := header.OuroveonVersion
+	if len(ouroveonVersion) == 0 {
+		ouroveonVersion = OuroveonVersion
+	}
+
+	lw.writeString(fmt.Sprintf("# export from OUROCOSM private server '%s'\n", commentSafe(header.ServerName)))
+	lw.writeString(fmt.Sprintf("export_time_unix: %d\n", header.ExportTimeUnix))
+	lw.writeString(fmt.Sprintf("export_ouroveon_version: %s\n", Quote(ouroveonVersion)))
+	lw.writeString(fmt.Sprintf("jam_name: %s\n", Quote(header.JamName)))
+	lw.writeString(fmt.Sprintf("jam_couch_id: %s\n", Quote(header.JamCouchID)))
+	return lw.err
+}
+
+// a root or scale outside the lookup tables is written as it is, named "?"; one odd riff shouldn't sink the whole export
+func (lw *Writer) WriteRiff(riff *Riff) error {
+	if err := lw.advanceTo(sectionRiffs); err != nil {
+		return err
+	}
+
+	var row strings.Builder
+	row.WriteString(fmt.Sprintf(` %s: [`, Quote(riff.ID)))
+	row.WriteString(fmt.Sprintf(`%s, %d, %d, "%s", %d, "%s", %f, "%s", %f, "%s", %d, %d, `,
+		Quote(riff.User),
+		riff.CreatedUnix,
+		riff.Root,
+		RootName(riff.Root),
+		riff.Scale,
+		ScaleName(riff.Scale),
+		riff.BPS,
+		hexFloat(riff.BPS),
+		BPSToRoundedBPM(riff.BPS),
+		hexFloat(BPSToRoundedBPM(riff.BPS)),
+		riff.BarLength,
+		riff.AppVersion,
+	))
+	for _, slot := range riff.Slots {
+		row.WriteString(fmt.Sprintf(`[ %s, %f, "%s", %s ], `,
+			Quote(slot.StemID),
+			slot.Gain,
+			hexFloat(slot.Gain),
+			strconv.FormatBool(slot.On),
+		))
+	}
+	row.WriteString(fmt.Sprintf(" %f ]\n", riff.Magnitude))
+
+	lw.writeString(row.String())
+	return lw.err
+}
+
+func (lw *Writer) WriteStem(stem *Stem) error {
+	if err := lw.advanceTo(sectionStems); err != nil {
+		return err
+	}
+
+	var row strings.Builder
+	row.WriteString(fmt.Sprintf(` %s: [`, Quote(stem.ID)))
+	row.WriteString(fmt.Sprintf(`%s, %s, %s, %s, %d, %d, %d, %s, %s, %s, %f, "%s", %f, "%s", %d, %d, %d, %s, %s, %s, %s ]`,
+		Quote(stem.Endpoint),
+		Quote(stem.Bucket),
+		Quote(stem.Key),
+		Quote(stem.Mime),
+		stem.Length,
+		stem.SampleRate,
+		stem.CreatedUnix,
+		Quote(stem.Preset),
+		Quote(stem.User),
+		Quote(stem.Colour),
+		stem.BPS,
+		hexFloat(stem.BPS),
+		BPSToRoundedBPM(stem.BPS),
+		hexFloat(BPSToRoundedBPM(stem.BPS)),
+		stem.Length16ths,
+		stem.OriginalPitch,
+		stem.BarLength,
+		strconv.FormatBool(stem.IsDrum),
+		strconv.FormatBool(stem.IsNote),
+		strconv.FormatBool(stem.IsBass),
+		strconv.FormatBool(stem.IsMic),
+	))
+	row.WriteString("\n")
+
+	lw.writeString(row.String())
+	return lw.err
+}
+
+func (lw *Writer) WriteChat(chat *Chat) error {
+	if err := lw.advanceTo(sectionChat); err != nil {
+		return err
+	}
+
+	lw.writeString(fmt.Sprintf(" %s: [%s, %d, %s ]\n",
+		Quote(chat.ID),
+		Quote(chat.User),
+		chat.CreatedUnixMilli,
+		Quote(chat.Message),
+	))
+	return lw.err
+}
+
+// emit any section headings that haven't been written yet and flush everything through to the underlying writer
+func (lw *Writer) Close() error {
+	if lw.section == sectionNone {
+		lw.err = errors.New("lore: archive closed without a header")
+	}
+	if lw.section < sectionStems {
+		lw.advanceTo(sectionStems)
+	}
+	if lw.err != nil {
+		return lw.err
+	}
+	lw.err = lw.w.Flush()
+	return lw.err
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func hexFloat(f float64) string {
+	return strconv.FormatFloat(f, 'x', -1, 64)
+}
+
+// comments run to the end of the line, so what can hurt us there is a line break, or a control character the YAML parser
+// refuses outright
+func commentSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' || r >= 0x7f && r <= 0x9f || r == 0x2028 || r == 0x2029 || r == 0xFEFF {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// Quote produces a YAML double-quoted scalar; backslashes, quotes and anything unprintable are escaped, invalid UTF-8 is
+// replaced so the document stays readable
+func Quote(s string) string {
+	var quoted strings.Builder
+	quoted.Grow(len(s) + 2)
+	quoted.WriteByte('"')
+
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+
+		switch r {
+		case '"':
+			quoted.WriteString(`\"`)
+		case '\\':
+			quoted.WriteString(`\\`)
+		case '\n':
+			quoted.WriteString(`\n`)
+		case '\r':
+			quoted.WriteString(`\r`)
+		case '\t':
+			quoted.WriteString(`\t`)
+		case 0:
+			quoted.WriteString(`\0`)
+		default:
+			switch {
+			case r == utf8.RuneError && size == 1:
+				quoted.WriteRune(utf8.RuneError)
+			case r < 0x20 || r == 0x7f:
+				quoted.WriteString(fmt.Sprintf(`\x%02X`, r))
+			case r == 0x85 || r == 0x2028 || r == 0x2029 || r == 0xFEFF || !unicode.IsPrint(r) && r != ' ':
+				if r > 0xFFFF {
+					quoted.WriteString(fmt.Sprintf(`\U%08X`, r))
+				} else {
+					quoted.WriteString(fmt.Sprintf(`\u%04X`, r))
+				}
+			default:
+				quoted.WriteRune(r)
+			}
+		}
+	}
+
+	quoted.WriteByte('"')
+	return quoted.String()
+}
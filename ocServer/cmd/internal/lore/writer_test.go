@@ -0,0 +1,419 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package lore
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// names that broke the old fmt.Sprintf export one way or another
+var awkwardNames = []string{
+	`plain`,
+	`say "hello"`,
+	`back\slash`,
+	`C:\path\"quoted"\`,
+	"two\nlines",
+	"carriage\r\nreturn",
+	`# not a comment`,
+	`trailing #hash`,
+	`key: value`,
+	`- dash`,
+	`[flow, seq]`,
+	`{flow: map}`,
+	`'single'`,
+	"tab\there",
+	"nul\x00byte",
+	"bell\x07",
+	"unicode ✓ jam 🎹",
+	"line\u2028separator",
+	"",
+}
+
+// split a schema comment into its column names; the riff slot group comes back as one entry per slot column, prefixed
+// with "slot "
+func splitSchema(t *testing.T, schema string) []string {
+	t.Helper()
+
+	var columns []string
+	if groupStart := strings.Index(schema, "8x ["); groupStart >= 0 {
+		groupEnd := strings.LastIndex(schema, "]")
+		if groupEnd < groupStart {
+			t.Fatalf("unbalanced slot group in schema %q", schema)
+		}
+		columns = splitSchema(t, strings.TrimSuffix(strings.TrimSpace(schema[:groupStart]), ","))
+		for _, slotColumn := range strings.Split(strings.TrimSpace(schema[groupStart+len("8x ["):groupEnd]), ", ") {
+			columns = append(columns, "slot "+slotColumn)
+		}
+		return columns
+	}
+	for _, column := range strings.Split(schema, ", ") {
+		columns = append(columns, strings.TrimSpace(column))
+	}
+	return columns
+}
+
+// decode the single row written under a section heading into its key and raw column values
+func decodeSingleRow(t *testing.T, document []byte, section string) (string, []interface{}) {
+	t.Helper()
+
+	var decoded map[string]yaml.Node
+	if err := yaml.Unmarshal(document, &decoded); err != nil {
+		t.Fatalf("writer produced invalid YAML: %v\n%s", err, document)
+	}
+	sectionNode, ok := decoded[section]
+	if !ok {
+		t.Fatalf("no [%s] section in:\n%s", section, document)
+	}
+	var rows map[string][]interface{}
+	if err := sectionNode.Decode(&rows); err != nil {
+		t.Fatalf("[%s] section is not a mapping of rows: %v", section, err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("expected one row in [%s], got %d", section, len(rows))
+	}
+	for key, row := range rows {
+		return key, row
+	}
+	return "", nil
+}
+
+func writeSingle(t *testing.T, write func(lw *Writer) error) []byte {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	lw := NewWriter(&buffer)
+	if err := lw.WriteHeader(&Header{ServerName: "test", JamName: "schema", JamCouchID: "band0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(lw); err != nil {
+		t.Fatal(err)
+	}
+	if err := lw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func schemaComment(document []byte, section string) string {
+	prefix := "# " + section + " schema\n# "
+	start := bytes.Index(document, []byte(prefix))
+	if start < 0 {
+		return ""
+	}
+	line := document[start+len(prefix):]
+	return string(line[:bytes.IndexByte(line, '\n')])
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func TestRiffColumnsMatchSchema(t *testing.T) {
+
+	riff := Riff{
+		ID:          "riffcouchid",
+		User:        "riffuser",
+		CreatedUnix: 1700000001,
+		Root:        3,
+		Scale:       5,
+		BPS:         2.125,
+		BarLength:   16,
+		AppVersion:  4321,
+		Magnitude:   0.75,
+	}
+	for i := range riff.Slots {
+		riff.Slots[i] = RiffSlot{StemID: "stem" + strconv.Itoa(i), Gain: 0.5 + float64(i)/16, On: i%2 == 0}
+	}
+	document := writeSingle(t, func(lw *Writer) error { return lw.WriteRiff(&riff) })
+
+	if comment := schemaComment(document, "riffs"); comment != RiffsSchema {
+		t.Fatalf("riffs schema comment is %q, want %q", comment, RiffsSchema)
+	}
+
+	key, row := decodeSingleRow(t, document, "riffs")
+	columns := splitSchema(t, RiffsSchema)
+	if columns[0] != "couch ID" || key != riff.ID {
+		t.Fatalf("row key should be the couch ID, got %q", key)
+	}
+	columns = columns[1:]
+
+	expected := map[string]interface{}{
+		"user":               riff.User,
+		"creation unix time": riff.CreatedUnix,
+		"root index":         riff.Root,
+		"root name":          "Eb",
+		"scale index":        riff.Scale,
+		"scale name":         "minor",
+		"BPS (float)":        riff.BPS,
+		"BPS (hex float)":    strconv.FormatFloat(riff.BPS, 'x', -1, 64),
+		"BPM (float)":        BPSToRoundedBPM(riff.BPS),
+		"BPM (hex float)":    strconv.FormatFloat(BPSToRoundedBPM(riff.BPS), 'x', -1, 64),
+		"bar length":         riff.BarLength,
+		"app version":        riff.AppVersion,
+	}
+
+	// the flat columns, then one nested row per slot, then magnitude on the end; LORE's schema line stops before it
+	slotColumns := []string{}
+	column := 0
+	for _, name := range columns {
+		if strings.HasPrefix(name, "slot ") {
+			slotColumns = append(slotColumns, strings.TrimPrefix(name, "slot "))
+			continue
+		}
+		want, ok := expected[name]
+		if !ok {
+			t.Fatalf("schema column %q has no expectation", name)
+		}
+		assertColumn(t, "riff", name, row[column], want)
+		column++
+	}
+	if len(row) != column+len(riff.Slots)+1 {
+		t.Fatalf("riff row has %d columns, want %d + 8 slots + magnitude", len(row), column)
+	}
+	for i, slot := range riff.Slots {
+		slotRow, ok := row[column+i].([]interface{})
+		if !ok || len(slotRow) != len(slotColumns) {
+			t.Fatalf("slot %d is %v, want %d columns", i, row[column+i], len(slotColumns))
+		}
+		slotExpected := map[string]interface{}{
+			"stem couch ID":         slot.StemID,
+			"stem gain (float)":     slot.Gain,
+			"stem gain (hex float)": strconv.FormatFloat(slot.Gain, 'x', -1, 64),
+			"stem enabled":          slot.On,
+		}
+		for j, name := range slotColumns {
+			want, ok := slotExpected[name]
+			if !ok {
+				t.Fatalf("slot schema column %q has no expectation", name)
+			}
+			assertColumn(t, "slot", name, slotRow[j], want)
+		}
+	}
+	assertColumn(t, "riff", "magnitude", row[len(row)-1], riff.Magnitude)
+}
+
+func TestStemColumnsMatchSchema(t *testing.T) {
+
+	stem := Stem{
+		ID:            "stemcouchid",
+		Endpoint:      "s3.example.com",
+		Bucket:        "bucket",
+		Key:           "attachments/oggs/stemcouchid",
+		Mime:          "audio/ogg",
+		Length:        123456,
+		SampleRate:    44100,
+		CreatedUnix:   1700000002,
+		Preset:        "preset",
+		User:          "stemuser",
+		Colour:        "ff112233",
+		BPS:           1.875,
+		Length16ths:   32,
+		OriginalPitch: 7,
+		BarLength:     8,
+		IsDrum:        true,
+		IsNote:        false,
+		IsBass:        true,
+		IsMic:         false,
+	}
+	document := writeSingle(t, func(lw *Writer) error { return lw.WriteStem(&stem) })
+
+	if comment := schemaComment(document, "stems"); comment != StemsSchema {
+		t.Fatalf("stems schema comment is %q, want %q", comment, StemsSchema)
+	}
+
+	key, row := decodeSingleRow(t, document, "stems")
+	columns := splitSchema(t, StemsSchema)
+	if columns[0] != "couch ID" || key != stem.ID {
+		t.Fatalf("row key should be the couch ID, got %q", key)
+	}
+	columns = columns[1:]
+	if len(row) != len(columns) {
+		t.Fatalf("stem row has %d columns, schema has %d", len(row), len(columns))
+	}
+
+	expected := map[string]interface{}{
+		"file endpoint":        stem.Endpoint,
+		"file bucket":          stem.Bucket,
+		"file key":             stem.Key,
+		"file MIME":            stem.Mime,
+		"file length in bytes": stem.Length,
+		"sample rate":          stem.SampleRate,
+		"creation unix time":   stem.CreatedUnix,
+		"preset":               stem.Preset,
+		"user":                 stem.User,
+		"colour hex":           stem.Colour,
+		"BPS (float)":          stem.BPS,
+		"BPS (hex float)":      strconv.FormatFloat(stem.BPS, 'x', -1, 64),
+		"BPM (float)":          BPSToRoundedBPM(stem.BPS),
+		"BPM (hex float)":      strconv.FormatFloat(BPSToRoundedBPM(stem.BPS), 'x', -1, 64),
+		"length 16ths":         stem.Length16ths,
+		"original pitch":       stem.OriginalPitch,
+		"bar length":           stem.BarLength,
+		"is-drum":              stem.IsDrum,
+		"is-note":              stem.IsNote,
+		"is-bass":              stem.IsBass,
+		"is-mic":               stem.IsMic,
+	}
+	for i, name := range columns {
+		want, ok := expected[name]
+		if !ok {
+			t.Fatalf("schema column %q has no expectation", name)
+		}
+		assertColumn(t, "stem", name, row[i], want)
+	}
+}
+
+func TestChatColumnsMatchSchema(t *testing.T) {
+
+	chat := Chat{ID: "chatcouchid", User: "chatuser", CreatedUnixMilli: 1700000003123, Message: "chat message"}
+	document := writeSingle(t, func(lw *Writer) error { return lw.WriteChat(&chat) })
+
+	if comment := schemaComment(document, "chat"); comment != ChatSchema {
+		t.Fatalf("chat schema comment is %q, want %q", comment, ChatSchema)
+	}
+
+	key, row := decodeSingleRow(t, document, "chat")
+	columns := splitSchema(t, ChatSchema)
+	if columns[0] != "couch ID" || key != chat.ID {
+		t.Fatalf("row key should be the couch ID, got %q", key)
+	}
+	columns = columns[1:]
+	if len(row) != len(columns) {
+		t.Fatalf("chat row has %d columns, schema has %d", len(row), len(columns))
+	}
+
+	expected := map[string]interface{}{
+		"user":                    chat.User,
+		"creation unix time (ms)": chat.CreatedUnixMilli,
+		"message":                 chat.Message,
+	}
+	for i, name := range columns {
+		want, ok := expected[name]
+		if !ok {
+			t.Fatalf("schema column %q has no expectation", name)
+		}
+		assertColumn(t, "chat", name, row[i], want)
+	}
+}
+
+// yaml decodes into int / float64 / bool / string, so bring the expectation round to match before comparing
+func assertColumn(t *testing.T, rowKind string, name string, got interface{}, want interface{}) {
+	t.Helper()
+
+	switch w := want.(type) {
+	case int64:
+		want = int(w)
+	case float64:
+		if g, ok := got.(int); ok {
+			got = float64(g)
+		}
+		if g, ok := got.(float64); ok && strconv.FormatFloat(g, 'f', 6, 64) == strconv.FormatFloat(w, 'f', 6, 64) {
+			return
+		}
+	}
+	if got != want {
+		t.Errorf("%s column %q: got %v (%T), want %v (%T)", rowKind, name, got, got, want, want)
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func TestQuoteDecodesBack(t *testing.T) {
+
+	for _, name := range awkwardNames {
+		var decoded struct {
+			Value string `yaml:"value"`
+		}
+		if err := yaml.Unmarshal([]byte("value: "+Quote(name)+"\n"), &decoded); err != nil {
+			t.Errorf("Quote(%q) produced invalid YAML: %v", name, err)
+			continue
+		}
+		if decoded.Value != name {
+			t.Errorf("Quote(%q) decoded back as %q", name, decoded.Value)
+		}
+	}
+}
+
+func TestWriterNamesOutOfRangeRiff(t *testing.T) {
+
+	for _, riff := range []Riff{{ID: "low root", Root: -1}, {ID: "high root", Root: 12}, {ID: "low scale", Scale: -1}, {ID: "high scale", Scale: 18}} {
+		var buffer bytes.Buffer
+		lw := NewWriter(&buffer)
+		lw.WriteHeader(&Header{})
+		if err := lw.WriteRiff(&riff); err != nil {
+			t.Errorf("riff [%s] was refused: %v", riff.ID, err)
+		}
+		lw.WriteRiff(&Riff{ID: "after"})
+		if err := lw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// written as it came, with a placeholder name, and the rows after it still go out
+		archive, err := Parse(&buffer)
+		if err != nil {
+			t.Fatalf("riff [%s]: %v", riff.ID, err)
+		}
+		if len(archive.Riffs) != 2 || archive.Riffs[0].Root != riff.Root || archive.Riffs[0].Scale != riff.Scale {
+			t.Errorf("riff [%s] read back as %+v", riff.ID, archive.Riffs)
+		}
+	}
+
+	var buffer bytes.Buffer
+	lw := NewWriter(&buffer)
+	lw.WriteHeader(&Header{})
+	lw.WriteRiff(&Riff{ID: "r", Root: 12, Scale: 18})
+	lw.Close()
+	if !strings.Contains(buffer.String(), `12, "?", 18, "?"`) {
+		t.Errorf("expected placeholder names:\n%s", buffer.String())
+	}
+}
+
+func TestWriterSectionOrder(t *testing.T) {
+
+	var buffer bytes.Buffer
+	lw := NewWriter(&buffer)
+	if err := lw.WriteStem(&Stem{ID: "s"}); err == nil {
+		t.Error("writing a stem before the header should fail")
+	}
+
+	buffer.Reset()
+	lw = NewWriter(&buffer)
+	lw.WriteHeader(&Header{})
+	lw.WriteStem(&Stem{ID: "s"})
+	if err := lw.WriteRiff(&Riff{ID: "r"}); err == nil {
+		t.Error("writing a riff after stems should fail")
+	}
+
+	// an archive with nothing in it still gets its riffs and stems headings, but no chat
+	buffer.Reset()
+	lw = NewWriter(&buffer)
+	lw.WriteHeader(&Header{})
+	if err := lw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	document := buffer.String()
+	if !strings.Contains(document, "\nriffs:\n") || !strings.Contains(document, "\nstems:\n") || strings.Contains(document, "chat:") {
+		t.Errorf("unexpected headings in empty archive:\n%s", document)
+	}
+}
+
+func TestRootAndScaleNamesOutOfRange(t *testing.T) {
+
+	if RootName(0) != "C" || RootName(11) != "B" || ScaleName(0) != "major" || ScaleName(17) != "chromatic" {
+		t.Error("in-range names changed")
+	}
+	for _, n := range []int{-1, 12, 1 << 20} {
+		if RootName(n) != "?" {
+			t.Errorf("RootName(%d) = %q", n, RootName(n))
+		}
+	}
+	for _, n := range []int{-1, 18, 1 << 20} {
+		if ScaleName(n) != "?" {
+			t.Errorf("ScaleName(%d) = %q", n, ScaleName(n))
+		}
+	}
+}
@@ -0,0 +1,198 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+// -----------------------------------------------------------------------------------------------------------------------------------
+//
+// Minimal writer for Reaper's plain-text .rpp project format; tracks of looped media items, regions and a tempo map, which is all
+// we need to lay a run of riffs out on a timeline. The format is a tree of angle-bracketed blocks with one property per line:
+//
+//	<REAPER_PROJECT 0.1 "7.0" 1700000000
+//	  TEMPO 120 4 4
+//	  <TRACK
+//	    NAME "Slot 1"
+//	    <ITEM
+//	      POSITION 0
+//	      ...
+//	    >
+//	  >
+//	>
+//
+// Reaper fills in anything left out with its defaults, so only what matters is written.
+//
+
+package reaper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the project version we claim to be; anything 6.x or later will open it
+const projectVersion = "6.0"
+
+// source block types, as Reaper names them
+const (
+	SourceFLAC   = "FLAC"
+	SourceVorbis = "VORBIS"
+	SourceWave   = "WAVE"
+)
+
+type TempoPoint struct {
+	Position float64 // seconds
+	BPM      float64
+}
+
+type Region struct {
+	Name  string
+	Start float64 // seconds
+	End   float64 //
+}
+
+type Source struct {
+	Type       string  // one of the Source* constants
+	File       string  // relative paths are resolved against the project file
+	LoopLength float64 // seconds; if non-zero only this much of the file is looped, otherwise the whole thing
+}
+
+type Item struct {
+	Name     string
+	Position float64 // seconds
+	Length   float64 // seconds; the source loops to fill it
+	Volume   float64 // linear
+	Colour   string  // RRGGBB hex, optional
+	Source   Source
+}
+
+type Track struct {
+	Name  string
+	Items []Item
+}
+
+type Project struct {
+	SampleRate int
+	Tempo      float64 // initial BPM
+	TempoMap   []TempoPoint
+	Regions    []Region
+	Tracks     []*Track
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// writes nested blocks with Reaper's two-space indentation, remembering the first error
+type blockWriter struct {
+	w      *bufio.Writer
+	indent int
+	err    error
+}
+
+func (bw *blockWriter) line(format string, args ...any) {
+	if bw.err != nil {
+		return
+	}
+	_, bw.err = fmt.Fprintf(bw.w, "%s%s\n", strings.Repeat("  ", bw.indent), fmt.Sprintf(format, args...))
+}
+
+func (bw *blockWriter) open(format string, args ...any) {
+	bw.line("<"+format, args...)
+	bw.indent++
+}
+
+func (bw *blockWriter) close() {
+	bw.indent--
+	bw.line(">")
+}
+
+// Reaper strings go in double quotes, or single quotes / backticks if they contain them; there's no escaping
+func Quote(s string) string {
+	switch {
+	case !strings.Contains(s, `"`):
+		return `"` + s + `"`
+	case !strings.Contains(s, `'`):
+		return `'` + s + `'`
+	}
+	return "`" + strings.ReplaceAll(s, "`", "'") + "`"
+}
+
+func number(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// RRGGBB into Reaper's custom colour value; 0x1000000 flags it as set, the rest is Windows-style BGR
+func colour(hex string) (int, bool) {
+	if len(hex) > 6 {
+		hex = hex[len(hex)-6:] // drop any alpha
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 6 {
+		return 0, false
+	}
+	r, g, b := (rgb>>16)&0xff, (rgb>>8)&0xff, rgb&0xff
+	return int(0x1000000 | (b << 16) | (g << 8) | r), true
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func (project *Project) Write(w io.Writer) error {
+
+	bw := &blockWriter{w: bufio.NewWriter(w)}
+
+	bw.open("REAPER_PROJECT 0.1 %s %d", Quote(projectVersion), time.Now().Unix())
+	bw.line("TEMPO %s 4 4", number(project.Tempo))
+	if project.SampleRate > 0 {
+		bw.line("SAMPLERATE %d 0 0", project.SampleRate)
+	}
+
+	// regions are pairs of markers sharing an index, the second one marking the end
+	for i, region := range project.Regions {
+		bw.line("MARKER %d %s %s 1", i+1, number(region.Start), Quote(region.Name))
+		bw.line("MARKER %d %s \"\" 1", i+1, number(region.End))
+	}
+
+	if len(project.TempoMap) > 0 {
+		bw.open("TEMPOENVEX")
+		bw.line("ACT 1 -1")
+		for _, point := range project.TempoMap {
+			bw.line("PT %s %s 1", number(point.Position), number(point.BPM)) // 1 = square, ie. jump straight to the new tempo
+		}
+		bw.close()
+	}
+
+	for _, track := range project.Tracks {
+		bw.open("TRACK")
+		bw.line("NAME %s", Quote(track.Name))
+		for _, item := range track.Items {
+			bw.open("ITEM")
+			bw.line("POSITION %s", number(item.Position))
+			bw.line("LENGTH %s", number(item.Length))
+			bw.line("LOOP 1")
+			bw.line("NAME %s", Quote(item.Name))
+			bw.line("VOLPAN %s 0 1 -1", number(item.Volume))
+			if itemColour, ok := colour(item.Colour); ok {
+				bw.line("COLOR %d B", itemColour)
+			}
+			if item.Source.LoopLength > 0 {
+				bw.open("SOURCE SECTION")
+				bw.line("LENGTH %s", number(item.Source.LoopLength))
+				bw.line("STARTPOS 0")
+				bw.line("OVERLAP 0")
+			}
+			bw.open("SOURCE %s", item.Source.Type)
+			bw.line("FILE %s", Quote(item.Source.File))
+			bw.close()
+			if item.Source.LoopLength > 0 {
+				bw.close()
+			}
+			bw.close()
+		}
+		bw.close()
+	}
+	bw.close()
+
+	if bw.err != nil {
+		return bw.err
+	}
+	return bw.w.Flush()
+}
@@ -0,0 +1,108 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package tables
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+type csvTable struct {
+	table  *Table
+	file   *os.File
+	buffer *bufio.Writer
+	writer *csv.Writer
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// CSVWriter writes each table to [name].csv in a directory, with a header row of column names
+type CSVWriter struct {
+	outputDir string
+	tables    map[string]*csvTable
+}
+
+func NewCSVWriter(outputDir string) (*CSVWriter, error) {
+	if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &CSVWriter{
+		outputDir: outputDir,
+		tables:    map[string]*csvTable{},
+	}, nil
+}
+
+func (cw *CSVWriter) Create(table *Table) error {
+	file, err := os.Create(filepath.Join(cw.outputDir, fmt.Sprintf("%s.csv", table.Name)))
+	if err != nil {
+		return errors.Join(fmt.Errorf("unable to create table [%s]", table.Name), err)
+	}
+	buffer := bufio.NewWriter(file)
+	writer := csv.NewWriter(buffer)
+
+	header := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		header[i] = column.Name
+	}
+	if err := writer.Write(header); err != nil {
+		file.Close()
+		return err
+	}
+	cw.tables[table.Name] = &csvTable{
+		table:  table,
+		file:   file,
+		buffer: buffer,
+		writer: writer,
+	}
+	return nil
+}
+
+func (cw *CSVWriter) Insert(table string, values ...any) error {
+	target, ok := cw.tables[table]
+	if !ok {
+		return checkRow(nil, values)
+	}
+	if err := checkRow(target.table, values); err != nil {
+		return err
+	}
+	record := make([]string, len(values))
+	for i, value := range values {
+		record[i] = formatCSVValue(value)
+	}
+	return target.writer.Write(record)
+}
+
+func (cw *CSVWriter) Close() error {
+	var err error
+	for _, target := range cw.tables {
+		target.writer.Flush()
+		err = errors.Join(err, target.writer.Error(), target.buffer.Flush(), target.file.Close())
+	}
+	return err
+}
+
+func formatCSVValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,82 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package tables
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	_ "modernc.org/sqlite"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// SQLiteWriter fills a fresh database file inside a single transaction, so a half-written export never looks complete
+type SQLiteWriter struct {
+	db         *sql.DB
+	tx         *sql.Tx
+	tables     map[string]*Table
+	statements map[string]*sql.Stmt
+}
+
+// any existing file at databasePath is replaced
+func NewSQLiteWriter(databasePath string) (*SQLiteWriter, error) {
+
+	if err := os.Remove(databasePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", databasePath)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteWriter{
+		db:         db,
+		tx:         tx,
+		tables:     map[string]*Table{},
+		statements: map[string]*sql.Stmt{},
+	}, nil
+}
+
+func (sw *SQLiteWriter) Create(table *Table) error {
+	for _, statement := range table.createStatements() {
+		if _, err := sw.tx.Exec(statement); err != nil {
+			return errors.Join(fmt.Errorf("unable to create table [%s]", table.Name), err)
+		}
+	}
+	insert, err := sw.tx.Prepare(table.insertStatement())
+	if err != nil {
+		return errors.Join(fmt.Errorf("unable to prepare insert for table [%s]", table.Name), err)
+	}
+	sw.tables[table.Name] = table
+	sw.statements[table.Name] = insert
+	return nil
+}
+
+func (sw *SQLiteWriter) Insert(table string, values ...any) error {
+	if err := checkRow(sw.tables[table], values); err != nil {
+		return err
+	}
+	_, err := sw.statements[table].Exec(values...)
+	return err
+}
+
+// commits everything written so far
+func (sw *SQLiteWriter) Close() error {
+	for _, statement := range sw.statements {
+		statement.Close()
+	}
+	err := sw.tx.Commit()
+	if closeErr := sw.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+// -----------------------------------------------------------------------------------------------------------------------------------
+//
+// Flat relational output for jam metadata; a set of named tables with typed columns, written out either as a single SQLite
+// database or as one .csv file per table. Callers declare every table up front, then append rows in any order.
+//
+
+package tables
+
+import (
+	"fmt"
+	"strings"
+)
+
+type ColumnType int
+
+const (
+	Text ColumnType = iota
+	Integer
+	Real
+	Boolean // stored as 0/1 in SQLite, true/false in CSV
+)
+
+type Column struct {
+	Name       string
+	Type       ColumnType
+	PrimaryKey bool
+}
+
+type Table struct {
+	Name    string
+	Columns []Column
+	Indices [][]string // column sets to index, where the format supports it
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// Writer takes rows for tables previously passed to Create; values are given in column order and must match the column types
+type Writer interface {
+	Create(table *Table) error
+	Insert(table string, values ...any) error
+	Close() error
+}
+
+// shared arity check so both formats complain the same way
+func checkRow(table *Table, values []any) error {
+	if table == nil {
+		return fmt.Errorf("table was not created")
+	}
+	if len(values) != len(table.Columns) {
+		return fmt.Errorf("table [%s] expects %d values, got %d", table.Name, len(table.Columns), len(values))
+	}
+	return nil
+}
+
+func (ct ColumnType) sqlType() string {
+	switch ct {
+	case Integer, Boolean:
+		return "INTEGER"
+	case Real:
+		return "REAL"
+	default:
+		return "TEXT"
+	}
+}
+
+func (t *Table) createStatements() []string {
+	columnDefs := make([]string, len(t.Columns))
+	primaryKeys := []string{}
+	for i, column := range t.Columns {
+		columnDefs[i] = fmt.Sprintf("%s %s", column.Name, column.Type.sqlType())
+		if column.PrimaryKey {
+			primaryKeys = append(primaryKeys, column.Name)
+		}
+	}
+	if len(primaryKeys) > 0 {
+		columnDefs = append(columnDefs, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(primaryKeys, ", ")))
+	}
+
+	statements := []string{fmt.Sprintf("CREATE TABLE %s (%s)", t.Name, strings.Join(columnDefs, ", "))}
+	for _, index := range t.Indices {
+		statements = append(statements, fmt.Sprintf("CREATE INDEX idx_%s_%s ON %s (%s)", t.Name, strings.Join(index, "_"), t.Name, strings.Join(index, ", ")))
+	}
+	return statements
+}
+
+func (t *Table) insertStatement() string {
+	columnNames := make([]string, len(t.Columns))
+	for i, column := range t.Columns {
+		columnNames[i] = column.Name
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", t.Name, strings.Join(columnNames, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(t.Columns)), ", "))
+}
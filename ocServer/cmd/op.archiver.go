@@ -0,0 +1,331 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	kivik "github.com/go-kivik/kivik/v4"
+	"github.com/homedepot/flop"
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// the archiver keeps a rolling set of exports under its output root, split by who is allowed to see them
+//
+//	<out>/_cache/                                  working directory for exportJamToDisk; stems cache is shared across runs
+//	<out>/public/<cosmid>/<generation>/            plain LORE .yaml + .tar, anyone with access to the folder can have these
+//	<out>/private/<member>/<cosmid>/<generation>.zip    one copy per jam member, encrypted with that member's login
+//	<out>/solo/<user>/<generation>.solo_encrypted.zip   personal jams, encrypted with the owner's login
+//	<out>/archiver.state.json                      last riff timestamp we exported for each jam, so unchanged jams are skipped
+//
+// generations are named by UTC timestamp so they sort lexically; only the newest N are kept
+
+var (
+	cmdArchiverRootPath = ""
+	cmdArchiverSchedule = "@daily"
+	cmdArchiverKeep     = 7
+	cmdArchiverOnce     = false
+)
+
+const cArchiverGenerationFormat string = "20060102-150405"
+
+type ArchiverState struct {
+	LastRiffCreated map[string]int64 `json:"last_riff_created"` // keyed by COSMID or username
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func loadArchiverState(outputDir string) ArchiverState {
+
+	state := ArchiverState{LastRiffCreated: make(map[string]int64)}
+
+	stateJson, err := os.ReadFile(path.Join(outputDir, "archiver.state.json"))
+	if err != nil {
+		return state
+	}
+	if err = json.Unmarshal(stateJson, &state); err != nil {
+		SysLog.Warn("[Archiver] Ignoring unreadable state file", zap.Error(err))
+		return ArchiverState{LastRiffCreated: make(map[string]int64)}
+	}
+	if state.LastRiffCreated == nil {
+		state.LastRiffCreated = make(map[string]int64)
+	}
+	return state
+}
+
+func saveArchiverState(outputDir string, state ArchiverState) {
+
+	stateJson, _ := json.MarshalIndent(state, "", "  ")
+	if err := os.WriteFile(path.Join(outputDir, "archiver.state.json"), stateJson, 0644); err != nil {
+		SysLog.Error("[Archiver] Unable to write state file", zap.Error(err))
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// remove all but the newest N entries (files or directories) inside a generation folder
+func pruneArchiverGenerations(generationRoot string, keep int) {
+
+	entries, err := os.ReadDir(generationRoot)
+	if err != nil {
+		return
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	for len(names) > keep {
+		oldest := filepath.Join(generationRoot, names[0])
+		SysLog.Info("[Archiver] Pruning generation", zap.String("Path", oldest))
+		if err := os.RemoveAll(oldest); err != nil {
+			SysLog.Error("[Archiver] Failed to prune generation", zap.String("Path", oldest), zap.Error(err))
+		}
+		names = names[1:]
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// check the head riff of a jam against what we last exported; returns the new head timestamp and whether it moved
+func hasJamChangedSinceArchive(couchClient *kivik.Client, couchID string, stateKey string, state ArchiverState) (int64, bool) {
+
+	headRiff, err := getRiffHeadDataFromJam(couchID, couchClient)
+	if err != nil {
+		SysLog.Error("[Archiver] Unable to read head riff", zap.String("Jam", stateKey), zap.Error(err))
+		return 0, false
+	}
+	// empty jams have nothing to archive
+	if headRiff.Created == 0 {
+		return 0, false
+	}
+	return headRiff.Created, headRiff.Created != state.LastRiffCreated[stateKey]
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// one full pass over every jam the server knows about
+func runArchiverPass(outputDir string, serverRootPath string, exportOptions JamExportOptions, keep int) {
+
+	SysLog.Info("[Archiver] Starting pass")
+
+	jamData, err := loadJamManifestData(serverRootPath)
+	if err != nil {
+		SysLog.Error("[Archiver] Unable to load jam manifest", zap.Error(err))
+		return
+	}
+
+	couchClient, err := connectToCouchDB()
+	if err != nil {
+		SysLog.Error("[Archiver] Connection to CouchDB failed", zap.Error(err))
+		return
+	}
+	defer couchClient.Close()
+
+	state := loadArchiverState(outputDir)
+	generation := time.Now().UTC().Format(cArchiverGenerationFormat)
+	exportOptions.OutputDir = path.Join(outputDir, "_cache")
+
+	idBank := SysBankIDs.Bank()
+
+	// public jams; plain copies into a shared folder
+	for _, jamDecl := range jamData.Public {
+
+		lutID, ok := idBank.Entries[jamDecl.COSMID]
+		if !ok {
+			SysLog.Error("[Archiver] Unable to resolve COSMID", zap.String("COSMID", jamDecl.COSMID))
+			continue
+		}
+		headCreated, changed := hasJamChangedSinceArchive(couchClient, lutID.CouchID, jamDecl.COSMID, state)
+		if !changed {
+			continue
+		}
+
+		generatedFiles, err := exportJamToDisk(jamDecl.COSMID, exportOptions)
+		if err != nil {
+			SysLog.Error("[Archiver] Export failed", zap.String("COSMID", jamDecl.COSMID), zap.Error(err))
+			continue
+		}
+
+		jamRoot := path.Join(outputDir, "public", jamDecl.COSMID)
+		generationDir := path.Join(jamRoot, generation)
+		os.MkdirAll(generationDir, os.ModePerm)
+
+		copiedOK := true
+		for _, generatedFile := range generatedFiles {
+			if err := flop.SimpleCopy(generatedFile, path.Join(generationDir, filepath.Base(generatedFile))); err != nil {
+				SysLog.Error("[Archiver] Copy failed", zap.String("COSMID", jamDecl.COSMID), zap.String("File", generatedFile), zap.Error(err))
+				copiedOK = false
+			}
+		}
+		if !copiedOK {
+			os.RemoveAll(generationDir)
+			continue
+		}
+
+		pruneArchiverGenerations(jamRoot, keep)
+		state.LastRiffCreated[jamDecl.COSMID] = headCreated
+		SysLog.Info("[Archiver] Archived public jam", zap.String("COSMID", jamDecl.COSMID), zap.String("Generation", generation))
+	}
+
+	// private jams; one encrypted copy per member so nobody outside the jam can open it
+	for _, jamDecl := range jamData.Private {
+
+		lutID, ok := idBank.Entries[jamDecl.COSMID]
+		if !ok {
+			SysLog.Error("[Archiver] Unable to resolve COSMID", zap.String("COSMID", jamDecl.COSMID))
+			continue
+		}
+		headCreated, changed := hasJamChangedSinceArchive(couchClient, lutID.CouchID, jamDecl.COSMID, state)
+		if !changed {
+			continue
+		}
+
+		generatedFiles, err := exportJamToDisk(jamDecl.COSMID, exportOptions)
+		if err != nil {
+			SysLog.Error("[Archiver] Export failed", zap.String("COSMID", jamDecl.COSMID), zap.Error(err))
+			continue
+		}
+
+		allMembersOK := true
+		for _, member := range jamDecl.Members {
+
+			userExtras, err := fetchUserExtrasFromCouch(couchClient, member)
+			if err != nil {
+				SysLog.Error("[Archiver] Unable to fetch member login", zap.String("COSMID", jamDecl.COSMID), zap.String("Username", member), zap.Error(err))
+				allMembersOK = false
+				continue
+			}
+
+			memberRoot := path.Join(outputDir, "private", member, jamDecl.COSMID)
+			os.MkdirAll(memberRoot, os.ModePerm)
+
+			encFilePath := path.Join(memberRoot, fmt.Sprintf("%s.zip", generation))
+			if err = compressWithPassword(generatedFiles, userExtras.Login, encFilePath); err != nil {
+				SysLog.Error("[Archiver] Compression failed", zap.String("COSMID", jamDecl.COSMID), zap.String("Username", member), zap.Error(err))
+				os.Remove(encFilePath)
+				allMembersOK = false
+				continue
+			}
+			pruneArchiverGenerations(memberRoot, keep)
+		}
+
+		// leave the state alone if anyone missed out, so we try again next time
+		if allMembersOK {
+			state.LastRiffCreated[jamDecl.COSMID] = headCreated
+		}
+		SysLog.Info("[Archiver] Archived private jam", zap.String("COSMID", jamDecl.COSMID), zap.String("Generation", generation))
+	}
+
+	// solo jams; encrypted with the owner's login
+	users, err := fetchAllUsersFromCouch(couchClient)
+	if err != nil {
+		SysLog.Error("[Archiver] Unable to list users", zap.Error(err))
+	}
+	for _, user := range users {
+
+		headCreated, changed := hasJamChangedSinceArchive(couchClient, user.UserName, user.UserName, state)
+		if !changed {
+			continue
+		}
+
+		generatedFiles, err := exportJamToDisk(user.UserName, exportOptions)
+		if err != nil {
+			SysLog.Error("[Archiver] Export failed", zap.String("Username", user.UserName), zap.Error(err))
+			continue
+		}
+
+		userRoot := path.Join(outputDir, "solo", user.UserName)
+		os.MkdirAll(userRoot, os.ModePerm)
+
+		encFilePath := path.Join(userRoot, fmt.Sprintf("%s.solo_encrypted.zip", generation))
+		if err = compressWithPassword(generatedFiles, user.LoginPass, encFilePath); err != nil {
+			SysLog.Error("[Archiver] Compression failed", zap.String("Username", user.UserName), zap.Error(err))
+			os.Remove(encFilePath)
+			continue
+		}
+
+		pruneArchiverGenerations(userRoot, keep)
+		state.LastRiffCreated[user.UserName] = headCreated
+		SysLog.Info("[Archiver] Archived solo jam", zap.String("Username", user.UserName), zap.String("Generation", generation))
+	}
+
+	saveArchiverState(outputDir, state)
+	SysLog.Info("[Archiver] Pass complete")
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+var archiverCmd = &cobra.Command{
+	Use:   "archiver",
+	Short: "Run scheduled exports of changed jams, keeping a number of generations",
+	Long:  `Run scheduled exports of changed jams, keeping a number of generations; public jams go to a shared folder, private jams are encrypted per-member and solo jams per-user`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if cmdArchiverKeep < 1 {
+			SysLog.Fatal("Must keep at least one generation", zap.Int("Keep", cmdArchiverKeep))
+		}
+
+		archiverPass := func() {
+			runArchiverPass(cmdOutputDir, cmdArchiverRootPath, JamExportOptions{
+				ServerNamePrefix:    cmdServerNamePrefix,
+				StemS3Server:        cmdStemS3Server,
+				IgnoreMissingStems:  cmdIgnoreMissingStems,
+				StemDownloadWorkers: cmdStemWorkers,
+				StemDownloadRetries: cmdStemRetries,
+			}, cmdArchiverKeep)
+		}
+
+		if cmdArchiverOnce {
+			archiverPass()
+			return
+		}
+
+		// don't let a slow pass overlap with the next scheduled one
+		scheduler := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
+		_, err := scheduler.AddFunc(cmdArchiverSchedule, archiverPass)
+		if err != nil {
+			SysLog.Fatal("Invalid archiver schedule", zap.String("Schedule", cmdArchiverSchedule), zap.Error(err))
+		}
+
+		scheduler.Start()
+		SysLog.Info("Archiver scheduled", zap.String("Schedule", cmdArchiverSchedule), zap.Time("Next", scheduler.Entries()[0].Next))
+
+		sigch := make(chan os.Signal, 1)
+		signal.Notify(sigch, os.Interrupt)
+		<-sigch
+
+		// wait for any in-flight pass to finish before leaving
+		<-scheduler.Stop().Done()
+		SysLog.Info("Archiver stopped")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(archiverCmd)
+
+	archiverCmd.Flags().StringVarP(&cmdOutputDir, "out", "o", "", "(required) archive root to write generations into")
+	archiverCmd.MarkFlagRequired("out")
+	archiverCmd.Flags().StringVarP(&cmdArchiverRootPath, "root", "r", "", "(required) server root path containing jams.json")
+	archiverCmd.MarkFlagRequired("root")
+
+	archiverCmd.Flags().StringVarP(&cmdServerNamePrefix, "prefix", "p", "", "(required) Server name prefix applied to each jam export")
+	archiverCmd.MarkFlagRequired("prefix")
+	archiverCmd.Flags().StringVarP(&cmdStemS3Server, "stem", "s", "", "if given, talk to this S3 server to fetch the stems and bake them into a .tar; defaults to the s3 store in the server config")
+	archiverCmd.Flags().BoolVarP(&cmdIgnoreMissingStems, "ignore-missing", "i", false, "ignore any 404 responses when downloading stem data")
+	archiverCmd.Flags().IntVarP(&cmdStemWorkers, "workers", "w", cmdStemWorkers, "number of stems to download at once")
+	archiverCmd.Flags().IntVar(&cmdStemRetries, "retries", cmdStemRetries, "times to retry a failing stem download before giving up on it")
+
+	archiverCmd.Flags().StringVar(&cmdArchiverSchedule, "schedule", cmdArchiverSchedule, "cron-style schedule for export passes, eg. '0 4 * * *' or '@every 6h'")
+	archiverCmd.Flags().IntVarP(&cmdArchiverKeep, "keep", "k", cmdArchiverKeep, "number of generations to keep for each jam")
+	archiverCmd.Flags().BoolVar(&cmdArchiverOnce, "once", false, "run a single pass immediately and exit")
+}
@@ -0,0 +1,84 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+var (
+	cmdBackupRootPath    = ""
+	cmdBackupArchive     = ""
+	cmdBackupIncludeStem = false
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Back up the whole server to a single versioned archive",
+	Long:  `Back up every Couch database (users, client config, jams and solos) plus jams.json, avatars and static assets into one versioned archive`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		stemStore, err := resolveStemStore(cmdStemS3Server)
+		if err != nil {
+			SysLog.Fatal("Unable to configure stem storage", zap.Error(err))
+		}
+
+		archivePath, err := backupServerToDisk(cmdOutputDir, cmdBackupRootPath, viper.GetString(cConfigCosmFourCC), stemStore, cmdIgnoreMissingStems)
+		if err != nil {
+			SysLog.Fatal("Backup failed", zap.Error(err))
+		}
+
+		SysLog.Info("Backup complete", zap.String("Archive", archivePath))
+	},
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Rebuild a server from a backup archive",
+	Long:  `Rebuild a fresh Couch instance, server root and (optionally) S3 stem store from an archive written by 'backup'`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		var stemStore *StemStore
+		if cmdBackupIncludeStem {
+			var err error
+			stemStore, err = resolveStemStore(cmdStemS3Server)
+			if err != nil {
+				SysLog.Fatal("Unable to configure stem storage", zap.Error(err))
+			}
+			if stemStore == nil {
+				SysLog.Fatal("Restoring stems requires a --stem server (or s3 configuration) to upload to")
+			}
+		}
+
+		err := restoreServerFromDisk(cmdBackupArchive, cmdBackupRootPath, stemStore)
+		if err != nil {
+			SysLog.Fatal("Restore failed", zap.Error(err))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(restoreCmd)
+
+	{
+		backupCmd.Flags().StringVarP(&cmdOutputDir, "out", "o", "", "output directory to write the backup archive to")
+		backupCmd.Flags().StringVarP(&cmdBackupRootPath, "root", "r", "", "server root path to collect jams.json, avatars and static assets from")
+		backupCmd.Flags().StringVarP(&cmdStemS3Server, "stem", "s", "", "if given, talk to this S3 server to fetch the stems and bake them into the backup; defaults to the s3 store in the server config")
+
+		backupCmd.Flags().BoolVarP(&cmdIgnoreMissingStems, "ignore-missing", "i", false, "ignore any 404 responses when downloading stem data")
+	}
+	{
+		restoreCmd.Flags().StringVarP(&cmdBackupArchive, "archive", "a", "", "(required) backup archive to restore from")
+		restoreCmd.MarkFlagRequired("archive")
+		restoreCmd.Flags().StringVarP(&cmdBackupRootPath, "root", "r", "", "server root path to restore jams.json, avatars and static assets into")
+		restoreCmd.Flags().StringVarP(&cmdStemS3Server, "stem", "s", "", "S3 server to upload stems back into; defaults to the s3 store in the server config")
+
+		restoreCmd.Flags().BoolVar(&cmdBackupIncludeStem, "include-stems", false, "upload any stems found in the archive to the --stem server")
+	}
+}
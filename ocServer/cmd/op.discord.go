@@ -13,8 +13,10 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
+	"github.com/dustin/go-humanize"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -24,12 +26,19 @@ import (
 var cmdDiscordBotToken = ""
 var cmdDiscordApp = ""
 var cmdDiscordGuild = ""
+var cmdDiscordApiUser = ""
+var cmdDiscordWarnChannel = ""
+var cmdDiscordWarnInterval = 15 * time.Minute
 
 var commands = []*discordgo.ApplicationCommand{
 	{
 		Name:        "anyonejamming",
 		Description: "Check the OUROCOSM server and report recent activity",
 	},
+	{
+		Name:        "storage",
+		Description: "Show who is using the most stem storage, and anyone over quota",
+	},
 }
 
 func fetchServerStatus() (*StatusResponse, error) {
@@ -55,6 +64,119 @@ func fetchServerStatus() (*StatusResponse, error) {
 	return &status, nil
 }
 
+// the storage report lives behind the secured API, so we log in as one of the cosm.api-auth users
+func fetchStorageReport() (*StorageReport, error) {
+
+	if len(cmdDiscordApiUser) == 0 {
+		return nil, errors.New("no --api-user given")
+	}
+	apiPassword, ok := viper.GetStringMapString(cConfigCosmAPIAuth)[cmdDiscordApiUser]
+	if !ok {
+		return nil, errors.Errorf("api user '%s' not found in %s", cmdDiscordApiUser, cConfigCosmAPIAuth)
+	}
+
+	cosmStorage := fmt.Sprintf("http://%s:%s/cosm/v1/%s/storage", viper.GetString(cConfigCosmInternalHost), viper.GetString(cConfigCosmInternalPort), viper.GetString(cConfigCosmAPIPrefix))
+	req, err := http.NewRequest("GET", cosmStorage, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	req.SetBasicAuth(cmdDiscordApiUser, apiPassword)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to make GET request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("storage request failed, %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read response body")
+	}
+
+	var report StorageReport
+	err = json.Unmarshal(body, &report)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal JSON")
+	}
+	return &report, nil
+}
+
+func handleStorageQueryCmd(s *discordgo.Session, i *discordgo.InteractionCreate) {
+
+	builder := new(strings.Builder)
+
+	report, err := fetchStorageReport()
+	if err != nil {
+		SysLog.Warn("Failed to fetch storage report", zap.Error(err))
+		builder.WriteString("Failed to fetch the storage report, sorry.")
+	} else {
+		builder.WriteString(fmt.Sprintf("**%s** of stems across %d jams.\n", humanize.Bytes(uint64(report.Bytes)), report.Databases))
+		for index, usage := range report.Users {
+			if index == 5 {
+				break
+			}
+			builder.WriteString(fmt.Sprintf("`%s` %s\n", usage.User, humanize.Bytes(uint64(usage.Bytes))))
+		}
+		for _, warning := range report.Warnings {
+			builder.WriteString(":warning: ")
+			builder.WriteString(warning)
+			builder.WriteString("\n")
+		}
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: builder.String(),
+		},
+	})
+
+	if err != nil {
+		SysLog.Warn("InteractionRespond failed", zap.Error(err))
+	}
+}
+
+// poll the storage report and post to the warning channel whenever someone crosses into a new quota level; only
+// changes get posted, so a user sat over quota isn't announced every interval
+func watchStorageQuotas(s *discordgo.Session, chanStopWork <-chan struct{}) {
+
+	warnedLevels := map[string]StorageQuotaLevel{}
+	for {
+		report, err := fetchStorageReport()
+		if err != nil {
+			SysLog.Warn("Failed to fetch storage report", zap.Error(err))
+		} else {
+			for index, usage := range report.Users {
+				if warnedLevels[usage.User] == usage.Quota || (usage.Quota == StorageQuotaOK && len(warnedLevels[usage.User]) == 0) {
+					continue
+				}
+				message := fmt.Sprintf("`%s` is back under quota, using %s", usage.User, humanize.Bytes(uint64(usage.Bytes)))
+				if usage.Quota != StorageQuotaOK {
+					message = ":warning: " + describeStorageWarnings(&StorageReport{
+						SoftQuota: report.SoftQuota,
+						HardQuota: report.HardQuota,
+						Users:     report.Users[index : index+1],
+					})[0]
+				}
+				if _, err = s.ChannelMessageSend(cmdDiscordWarnChannel, message); err != nil {
+					SysLog.Warn("ChannelMessageSend failed", zap.Error(err))
+					continue
+				}
+				warnedLevels[usage.User] = usage.Quota
+			}
+		}
+
+		select {
+		case <-chanStopWork:
+			return
+		case <-time.After(cmdDiscordWarnInterval):
+		}
+	}
+}
+
 func handleJamQueryCmd(s *discordgo.Session, i *discordgo.InteractionCreate) {
 
 	builder := new(strings.Builder)
@@ -91,6 +213,10 @@ var discordCmd = &cobra.Command{
 	Long:  `Run a utility Discord bot that can talk to an OUROCOSM server`,
 	Run: func(cmd *cobra.Command, args []string) {
 
+		if len(cmdDiscordWarnChannel) > 0 && len(cmdDiscordApiUser) == 0 {
+			SysLog.Fatal("--warn-channel needs --api-user to fetch the storage report")
+		}
+
 		discord, err := discordgo.New("Bot " + cmdDiscordBotToken)
 		if err != nil {
 			SysLog.Fatal("Unable to create Discord session", zap.Error(err))
@@ -102,11 +228,12 @@ var discordCmd = &cobra.Command{
 			}
 
 			data := i.ApplicationCommandData()
-			if data.Name != "anyonejamming" {
-				return
+			switch data.Name {
+			case "anyonejamming":
+				handleJamQueryCmd(s, i)
+			case "storage":
+				handleStorageQueryCmd(s, i)
 			}
-
-			handleJamQueryCmd(s, i)
 		})
 
 		discord.AddHandler(func(s *discordgo.Session, r *discordgo.Ready) {
@@ -123,6 +250,12 @@ var discordCmd = &cobra.Command{
 			SysLog.Fatal("Unable to connect to Discord", zap.Error(err))
 		}
 
+		if len(cmdDiscordWarnChannel) > 0 {
+			storageWatcher := make(chan struct{})
+			go watchStorageQuotas(discord, storageWatcher)
+			defer close(storageWatcher)
+		}
+
 		sigch := make(chan os.Signal, 1)
 		signal.Notify(sigch, os.Interrupt)
 		<-sigch
@@ -144,4 +277,7 @@ func init() {
 	discordCmd.MarkFlagRequired("app")
 	discordCmd.Flags().StringVarP(&cmdDiscordGuild, "guild", "g", "", "Guild ID")
 	discordCmd.MarkFlagRequired("guild")
+	discordCmd.Flags().StringVar(&cmdDiscordApiUser, "api-user", "", "user from the server's cosm.api-auth table, needed for /storage and quota warnings")
+	discordCmd.Flags().StringVar(&cmdDiscordWarnChannel, "warn-channel", "", "channel ID to post storage quota warnings to")
+	discordCmd.Flags().DurationVar(&cmdDiscordWarnInterval, "warn-interval", cmdDiscordWarnInterval, "how often to check for new quota warnings")
 }
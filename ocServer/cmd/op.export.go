@@ -7,16 +7,12 @@ package cmd
 
 import (
 	"bufio"
-	"bytes"
-	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path"
 	"path/filepath"
 
-	kivik "github.com/go-kivik/kivik/v4"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 
@@ -29,21 +25,149 @@ var (
 	cmdServerNamePrefix   = ""
 	cmdStemS3Server       = ""
 	cmdIgnoreMissingStems = false
+	cmdIncrementalExport  = false
+	cmdStemWorkers        = cStemDownloadDefaultWorkers
+	cmdStemRetries        = cStemDownloadDefaultRetries
+	cmdArchiveFormat      = ""
+	cmdArchivePassword    = ""
+	cmdStreamSolos        = false
+	cmdSoloUsers          = []string{}
+	cmdSoloActiveSince    = ""
+	cmdSoloSkipEmpty      = false
+	cmdSoloParallel       = 1
+	cmdVerifyManifest     = ""
+	cmdExportFormat       = cExportFormatLORE
 )
 
+// what export produces; LORE archives are the default, the rest are for taking a jam elsewhere
+const (
+	cExportFormatLORE   = "lore"
+	cExportFormatReaper = "reaper"
+	cExportFormatSQLite = "sqlite"
+	cExportFormatCSV    = "csv"
+)
+
+// gather up the common export flags
+func getJamExportOptionsFromFlags() JamExportOptions {
+	return JamExportOptions{
+		OutputDir:           cmdOutputDir,
+		ServerNamePrefix:    cmdServerNamePrefix,
+		StemS3Server:        cmdStemS3Server,
+		IgnoreMissingStems:  cmdIgnoreMissingStems,
+		StemDownloadWorkers: cmdStemWorkers,
+		StemDownloadRetries: cmdStemRetries,
+		Incremental:         cmdIncrementalExport,
+	}
+}
+
+// .. and the same again for streamed exports
+func getJamStreamOptionsFromFlags(format JamArchiveFormat, password string) JamStreamOptions {
+	return JamStreamOptions{
+		ServerNamePrefix:    cmdServerNamePrefix,
+		StemS3Server:        cmdStemS3Server,
+		IgnoreMissingStems:  cmdIgnoreMissingStems,
+		StemDownloadWorkers: cmdStemWorkers,
+		StemDownloadRetries: cmdStemRetries,
+		Format:              format,
+		Password:            password,
+	}
+}
+
 var exportCmd = &cobra.Command{
 	Use:   "export",
 	Short: "Export a jam to LORE jam archival format",
 	Long:  `Export a jam to LORE jam archival format`,
 	Run: func(cmd *cobra.Command, args []string) {
-		exportJamToDisk(cmdOutputDir, cmdJamToExport, cmdServerNamePrefix, cmdStemS3Server, cmdIgnoreMissingStems)
+
+		// stream everything into a single archive rather than building up _stems and a loose .yaml / .tar
+		if len(cmdArchiveFormat) > 0 {
+			archiveFormat, err := parseJamArchiveFormat(cmdArchiveFormat)
+			if err != nil {
+				SysLog.Fatal("Invalid archive format", zap.Error(err))
+			}
+			if cmdIncrementalExport || cmdSessionIndex != 0 || cmdExportFormat != cExportFormatLORE {
+				SysLog.Fatal("--archive only streams full LORE exports, it can't be combined with --incremental, --session or --format")
+			}
+			archiveFile, err := exportJamToArchive(cmdJamToExport, cmdOutputDir, getJamStreamOptionsFromFlags(archiveFormat, cmdArchivePassword))
+			if err != nil {
+				SysLog.Fatal("Export failed", zap.Error(err))
+			}
+			SysLog.Info("Exported archive", zap.String("File", archiveFile))
+			return
+		}
+
+		exportOptions := getJamExportOptionsFromFlags()
+		exportOptions.Session = getJamSessionFromFlags(cmdJamToExport)
+
+		switch cmdExportFormat {
+		case cExportFormatLORE:
+			if _, err := exportJamToDisk(cmdJamToExport, exportOptions); err != nil {
+				SysLog.Fatal("Export failed", zap.Error(err))
+			}
+		case cExportFormatReaper:
+			if _, err := exportJamToReaper(cmdJamToExport, exportOptions); err != nil {
+				SysLog.Fatal("Export failed", zap.Error(err))
+			}
+		case cExportFormatSQLite, cExportFormatCSV:
+			if _, err := exportJamToTables(cmdJamToExport, cmdExportFormat, exportOptions); err != nil {
+				SysLog.Fatal("Export failed", zap.Error(err))
+			}
+		default:
+			SysLog.Fatal("Unknown export format", zap.String("Format", cmdExportFormat))
+		}
+	},
+}
+
+var exportConsolidateCmd = &cobra.Command{
+	Use:   "consolidate",
+	Short: "Fold incremental delta exports back into a single full LORE archive",
+	Long:  `Fold incremental delta exports back into a single full LORE archive`,
+	Run: func(cmd *cobra.Command, args []string) {
+		resultingFiles, err := consolidateJamExport(cmdOutputDir, cmdJamToExport)
+		if err != nil {
+			SysLog.Fatal("Consolidation failed", zap.Error(err))
+		}
+		SysLog.Info("Consolidated export", zap.Strings("Files", resultingFiles))
 	},
 }
 
-type UserExportData struct {
-	ID        string `json:"_id"`
-	UserName  string `json:"name"`
-	LoginPass string `json:"login"`
+var exportVerifyCmd = &cobra.Command{
+	Use:   "verify <export .yaml | .manifest.json | _stems/<id> directory>",
+	Short: "Check a LORE export, or a stem cache, against its manifest",
+	Long:  `Check a LORE export, or a stem cache, against its manifest; reports corrupt or missing files and riffs that reference missing stems`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		report, err := verifyJamExport(args[0], cmdVerifyManifest)
+		if err != nil {
+			SysLog.Fatal("Verification failed", zap.Error(err))
+		}
+
+		for _, problem := range report.CorruptFiles {
+			SysLog.Error("Corrupt", zap.String("File", problem))
+		}
+		for _, missing := range report.MissingFiles {
+			SysLog.Error("Missing", zap.String("File", missing))
+		}
+		for _, stemID := range report.MissingStems {
+			SysLog.Warn("No audio for stem", zap.String("Stem", stemID))
+		}
+		for _, dangling := range report.DanglingRiffs {
+			SysLog.Warn("Riff references missing stem", zap.String("Reference", dangling))
+		}
+		for _, mismatch := range report.Mismatches {
+			SysLog.Error("Count mismatch", zap.String("Detail", mismatch))
+		}
+
+		summary := []zap.Field{
+			zap.String("Manifest", report.Manifest),
+			zap.Int("FilesChecked", report.FilesChecked),
+			zap.Int("StemsChecked", report.StemsChecked),
+		}
+		if !report.OK() {
+			SysLog.Fatal("Export has problems", summary...)
+		}
+		SysLog.Info("Export verified", summary...)
+	},
 }
 
 func compressWithPassword(inputFiles []string, password, outputZipPath string) error {
@@ -64,16 +188,18 @@ func compressWithPassword(inputFiles []string, password, outputZipPath string) e
 	for _, filePath := range inputFiles {
 		filenameRelative := filepath.Base(filePath)
 
-		fileContents, err := os.ReadFile(filePath)
+		fileContents, err := os.Open(filePath)
 		if err != nil {
 			return errors.Join(fmt.Errorf("unable to load [%s] for zip file", filePath), err)
 		}
 
 		w, err := fileOutZip.Encrypt(filenameRelative, password, zip2.AES256Encryption)
 		if err != nil {
+			fileContents.Close()
 			return errors.Join(fmt.Errorf("failed to create encrypted entry [%s] in zip file", filenameRelative), err)
 		}
-		_, err = io.Copy(w, bytes.NewReader(fileContents))
+		_, err = io.Copy(w, fileContents)
+		fileContents.Close()
 		if err != nil {
 			return errors.Join(fmt.Errorf("failed to encrypt [%s] into zip file", filenameRelative), err)
 		}
@@ -84,62 +210,49 @@ func compressWithPassword(inputFiles []string, password, outputZipPath string) e
 var exportSolosCmd = &cobra.Command{
 	Use:   "exportsolo",
 	Short: "Export all solo jams to compressed LORE archives",
-	Long:  `Export all solo jams to compressed LORE archives`,
+	Long:  `Export all solo jams to compressed LORE archives, optionally filtered by user name or recent activity`,
 	Run: func(cmd *cobra.Command, args []string) {
 
-		couchClient, err := connectToCouchDB()
-		if err != nil {
-			SysLog.Fatal("Connection to CouchDB failed", zap.Error(err))
-		}
-		defer couchClient.Close()
-
-		// create a special output root for all the encrypted results
-		soloEncFileRoot := path.Join(cmdOutputDir, "_solos")
-		os.MkdirAll(soloEncFileRoot, os.ModePerm)
-
-		userDb := couchClient.DB("_users")
-		resultSet := userDb.AllDocs(context.TODO(), kivik.Params(map[string]interface{}{
-			"include_docs": true,
-		}))
-		defer resultSet.Close()
-
-		// walk the full list of users
-		for resultSet.Next() {
-			var doc UserExportData
-			if err := resultSet.ScanDoc(&doc); err != nil {
-				SysLog.Error("[ExportSolo] ResultSet ScanDoc failure", zap.Error(err))
-			} else {
-				// grab the solo data from Couch and S3, should produce a .yaml and .tar file
-				generatedFiles, err := exportJamToDisk(cmdOutputDir, doc.UserName, cmdServerNamePrefix, cmdStemS3Server, cmdIgnoreMissingStems)
-				if err != nil {
-					SysLog.Error("[ExportSolo] Export process failed", zap.Error(err))
-				}
-
-				if len(generatedFiles) >= 2 {
-
-					encFilePath := path.Join(soloEncFileRoot, fmt.Sprintf("%s.solo_encrypted.zip", doc.UserName))
-
-					// compress those .yaml and .tar files into an encrypted .zip with the users' password
-					// so it's easy to archive these but with enough protection to stop idle snooping
-					err = compressWithPassword(generatedFiles, doc.LoginPass, encFilePath)
-					if err != nil {
-						SysLog.Error("[ExportSolo] Compression failed", zap.Error(err))
-					} else {
-						SysLog.Info("Exporting user ["+doc.UserName+"]", zap.Strings("Files", generatedFiles))
-					}
-				} else {
-					SysLog.Warn("Ignoring user [" + doc.UserName + "] - no files to compress")
-				}
+		options := SoloExportOptions{
+			Export:       getJamExportOptionsFromFlags(),
+			UserPatterns: cmdSoloUsers,
+			SkipEmpty:    cmdSoloSkipEmpty,
+			Parallel:     cmdSoloParallel,
+		}
+		if cmdStreamSolos {
+			streamOptions := getJamStreamOptionsFromFlags(JamArchiveZip, "")
+			options.Stream = &streamOptions
+		}
+		if len(cmdSoloActiveSince) > 0 {
+			activeSince, err := parseRenderTime(cmdSoloActiveSince, false)
+			if err != nil {
+				SysLog.Fatal("Invalid --since", zap.Error(err))
 			}
+			options.ActiveSince = activeSince
 		}
-		if resultSet.Err() != nil {
-			SysLog.Error("[ExportSolo] ResultSet general failure", zap.Error(resultSet.Err()))
+
+		report, err := exportSoloJams(options)
+		if err != nil {
+			SysLog.Fatal("Solo export failed", zap.Error(err))
+		}
+
+		for _, result := range report.Results {
+			if result.Status != SoloExportStatusExported {
+				SysLog.Warn("Not exported ["+result.User+"]", zap.String("Status", string(result.Status)), zap.String("Reason", result.Reason))
+			}
 		}
+		SysLog.Info("Solo export complete",
+			zap.Int("Exported", report.Count(SoloExportStatusExported)),
+			zap.Int("Skipped", report.Count(SoloExportStatusSkipped)),
+			zap.Int("Failed", report.Count(SoloExportStatusFailed)),
+		)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(exportCmd)
+	exportCmd.AddCommand(exportConsolidateCmd)
+	exportCmd.AddCommand(exportVerifyCmd)
 	rootCmd.AddCommand(exportSolosCmd)
 
 	// tool for exporting a single jam by ID
@@ -150,9 +263,26 @@ func init() {
 		exportCmd.MarkFlagRequired("jam")
 		exportCmd.Flags().StringVarP(&cmdServerNamePrefix, "prefix", "p", "", "(required) Server name prefix applied to each jam export")
 		exportCmd.MarkFlagRequired("prefix")
-		exportCmd.Flags().StringVarP(&cmdStemS3Server, "stem", "s", "", "if given, talk to this S3 server to fetch the stems and bake them into a .tar")
+		exportCmd.Flags().StringVarP(&cmdStemS3Server, "stem", "s", "", "if given, talk to this S3 server to fetch the stems and bake them into a .tar, or give a URL such as http://host:port/stems to fetch through serve's stem cache; defaults to the s3 store in the server config")
 
 		exportCmd.Flags().BoolVarP(&cmdIgnoreMissingStems, "ignore-missing", "i", false, "ignore any 404 responses when downloading stem data")
+		exportCmd.Flags().IntVarP(&cmdStemWorkers, "workers", "w", cmdStemWorkers, "number of stems to download at once")
+		exportCmd.Flags().IntVar(&cmdStemRetries, "retries", cmdStemRetries, "times to retry a failing stem download before giving up on it")
+		exportCmd.Flags().BoolVar(&cmdIncrementalExport, "incremental", false, "only export what changed since the last incremental export, as a delta archive")
+		exportCmd.Flags().StringVarP(&cmdArchiveFormat, "archive", "a", "", "stream the export into a single tar.zst, tar.gz or (encrypted) zip archive instead")
+		exportCmd.Flags().StringVar(&cmdArchivePassword, "password", "", "password for --archive zip")
+		exportCmd.Flags().StringVarP(&cmdExportFormat, "format", "f", cmdExportFormat, "what to export; lore (archive), reaper (.rpp project referencing the _stems cache), sqlite or csv (metadata tables for analysis)")
+	}
+	// fold deltas from --incremental back into the base archive
+	{
+		exportConsolidateCmd.Flags().StringVarP(&cmdOutputDir, "out", "o", "", "output directory used for the incremental exports")
+
+		exportConsolidateCmd.Flags().StringVarP(&cmdJamToExport, "jam", "j", "", "(required) COSMID jam ID to consolidate")
+		exportConsolidateCmd.MarkFlagRequired("jam")
+	}
+	// re-check an export against its manifest
+	{
+		exportVerifyCmd.Flags().StringVarP(&cmdVerifyManifest, "manifest", "m", "", "manifest to check against; found next to the .yaml, or in the neighbouring _archives for a _stems directory, if not given")
 	}
 	// export tool for all solo jams at once, with per-archive encryption
 	{
@@ -160,8 +290,16 @@ func init() {
 
 		exportSolosCmd.Flags().StringVarP(&cmdServerNamePrefix, "prefix", "p", "", "(required) Server name prefix applied to each jam export")
 		exportSolosCmd.MarkFlagRequired("prefix")
-		exportSolosCmd.Flags().StringVarP(&cmdStemS3Server, "stem", "s", "", "if given, talk to this S3 server to fetch the stems and bake them into a .tar")
+		exportSolosCmd.Flags().StringVarP(&cmdStemS3Server, "stem", "s", "", "if given, talk to this S3 server to fetch the stems and bake them into a .tar, or give a URL such as http://host:port/stems to fetch through serve's stem cache; defaults to the s3 store in the server config")
 
 		exportSolosCmd.Flags().BoolVarP(&cmdIgnoreMissingStems, "ignore-missing", "i", false, "ignore any 404 responses when downloading stem data")
+		exportSolosCmd.Flags().IntVarP(&cmdStemWorkers, "workers", "w", cmdStemWorkers, "number of stems to download at once")
+		exportSolosCmd.Flags().IntVar(&cmdStemRetries, "retries", cmdStemRetries, "times to retry a failing stem download before giving up on it")
+		exportSolosCmd.Flags().BoolVar(&cmdStreamSolos, "stream", false, "stream each solo straight into its encrypted zip without writing loose files")
+
+		exportSolosCmd.Flags().StringSliceVarP(&cmdSoloUsers, "user", "u", nil, "only export users matching these names or globs, eg. 'ish*'; can be repeated")
+		exportSolosCmd.Flags().StringVar(&cmdSoloActiveSince, "since", "", "only export users with a riff since this date (YYYY-MM-DD or RFC3339)")
+		exportSolosCmd.Flags().BoolVar(&cmdSoloSkipEmpty, "skip-empty", false, "skip solo jams with no riffs")
+		exportSolosCmd.Flags().IntVar(&cmdSoloParallel, "parallel", cmdSoloParallel, "number of solos to export at once")
 	}
 }
@@ -0,0 +1,44 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var cmdImportOptions JamImportOptions
+var cmdJamToImport = ""
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import a LORE jam archive into a jam database",
+	Long:  `Import a LORE jam archive (orx.*.yaml plus its stem .tar) into a new or existing jam database, optionally re-uploading the stems to S3`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		err := importJamFromDisk(cmdJamToImport, cmdImportOptions)
+		if err != nil {
+			SysLog.Fatal("Import failed", zap.String("Jam", cmdJamToImport), zap.Error(err))
+		}
+		SysLog.Info("Import complete", zap.String("Jam", cmdJamToImport))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+
+	importCmd.Flags().StringVarP(&cmdImportOptions.ImportYamlPath, "yaml", "y", "", "(required) LORE orx.*.yaml archive to import")
+	importCmd.MarkFlagRequired("yaml")
+	importCmd.Flags().StringVarP(&cmdImportOptions.ImportTarPath, "tar", "t", "", "stem .tar to upload from, defaults to the .yaml path with a .tar extension")
+
+	importCmd.Flags().StringVarP(&cmdJamToImport, "jam", "j", "", "(required) COSMID jam ID or username of the solo jam to import into")
+	importCmd.MarkFlagRequired("jam")
+	importCmd.Flags().BoolVarP(&cmdImportOptions.CreateJam, "create", "c", false, "create the jam database if it doesn't exist yet")
+	importCmd.Flags().StringVarP(&cmdImportOptions.ServerRootPath, "root", "r", "", "server root holding jams.json; needed with --create so the jam is set up as declared there")
+
+	importCmd.Flags().StringVarP(&cmdImportOptions.StemS3Server, "stem", "s", "", "if given, upload the stems from the .tar to this S3 server")
+	importCmd.Flags().StringVarP(&cmdImportOptions.StemEndpoint, "endpoint", "e", "", "S3 endpoint to record against imported stems, defaults to --stem or the archive's original endpoint")
+}
@@ -0,0 +1,149 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	cmdJamRootPath    = ""
+	cmdJamCheckSolos  = false
+	cmdJamCheckAudio  = true
+	cmdJamCheckRepair = ""
+	cmdJamCheckReport = ""
+)
+
+var jamCmd = &cobra.Command{
+	Use:   "jam",
+	Short: "Maintenance tools for jam databases",
+	Long:  `Maintenance tools for jam databases`,
+}
+
+// "all" means every jam in jams.json, plus every solo if asked for
+func getJamNamesFromArgs(jamArg string) []string {
+
+	if jamArg != "all" {
+		return []string{jamArg}
+	}
+	if len(cmdJamRootPath) == 0 {
+		SysLog.Fatal("Checking all jams needs --root to find jams.json")
+	}
+	jamData, err := loadJamManifestData(cmdJamRootPath)
+	if err != nil {
+		SysLog.Fatal("Unable to load jam manifest", zap.Error(err))
+	}
+
+	jamNames := []string{}
+	for _, jamDecl := range append(jamData.Public, jamData.Private...) {
+		jamNames = append(jamNames, jamDecl.COSMID)
+	}
+	if cmdJamCheckSolos {
+		couchClient, err := connectToCouchDB()
+		if err != nil {
+			SysLog.Fatal("Connection to CouchDB failed", zap.Error(err))
+		}
+		defer couchClient.Close()
+
+		users, err := fetchAllUsersFromCouch(couchClient)
+		if err != nil {
+			SysLog.Fatal("Unable to list users", zap.Error(err))
+		}
+		for _, user := range users {
+			// admin and service accounts don't have a solo to check
+			if hasSolo, err := doesJamDatabaseExist(couchClient, user.UserName); err == nil && hasSolo {
+				jamNames = append(jamNames, user.UserName)
+			}
+		}
+	}
+	return jamNames
+}
+
+var jamCheckCmd = &cobra.Command{
+	Use:   "check <cosmid | username | all>",
+	Short: "Find riffs that reference missing or broken loops",
+	Long:  `Cross-check the loops every riff uses against the jam's Loop documents and their audio in S3, optionally marking or quarantining riffs that can't be played`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		checkOptions := JamCheckOptions{
+			StemS3Server: cmdStemS3Server,
+			SkipAudio:    !cmdJamCheckAudio,
+			Workers:      cmdStemWorkers,
+			Repair:       JamCheckRepair(cmdJamCheckRepair),
+		}
+		switch checkOptions.Repair {
+		case JamCheckRepairNone, JamCheckRepairMark, JamCheckRepairQuarantine:
+		default:
+			SysLog.Fatal("Unknown --repair option, expected mark or quarantine", zap.String("Repair", cmdJamCheckRepair))
+		}
+
+		reports, err := checkJamsIntegrity(getJamNamesFromArgs(args[0]), checkOptions)
+		if err != nil {
+			SysLog.Fatal("Jam check failed", zap.Error(err))
+		}
+
+		unresolved := 0
+		for _, report := range reports {
+			if len(report.Error) > 0 {
+				SysLog.Error("Unable to check jam", zap.String("Jam", report.Jam), zap.String("Reason", report.Error))
+				unresolved++
+				continue
+			}
+			for _, loopID := range report.MissingLoops {
+				SysLog.Warn("Loop referenced but not found", zap.String("Jam", report.Jam), zap.String("Loop", loopID))
+			}
+			for _, brokenLoop := range report.BrokenLoops {
+				SysLog.Warn("Loop audio broken", zap.String("Jam", report.Jam), zap.String("Loop", brokenLoop.ID), zap.String("Reason", brokenLoop.Reason))
+			}
+			for _, uncheckedLoop := range report.Unchecked {
+				SysLog.Warn("Loop audio couldn't be checked", zap.String("Jam", report.Jam), zap.String("Loop", uncheckedLoop.ID), zap.String("Reason", uncheckedLoop.Reason))
+			}
+			for _, brokenRiff := range report.BrokenRiffs {
+				SysLog.Warn("Riff references broken loops", zap.String("Jam", report.Jam), zap.String("Riff", brokenRiff.ID), zap.Strings("Loops", brokenRiff.Loops))
+			}
+			SysLog.Info("Checked jam",
+				zap.String("Jam", report.Jam),
+				zap.Int("Riffs", report.Riffs),
+				zap.Int("Loops", report.Loops),
+				zap.Int("AudioChecked", report.AudioChecked),
+				zap.Int("AudioUnchecked", len(report.Unchecked)),
+				zap.Int("BrokenRiffs", len(report.BrokenRiffs)),
+				zap.Int("Repaired", report.Repaired),
+			)
+			if !report.OK() && (checkOptions.Repair == JamCheckRepairNone || report.Repaired < len(report.BrokenRiffs) || len(report.Unchecked) > 0) {
+				unresolved++
+			}
+		}
+
+		if len(cmdJamCheckReport) > 0 {
+			reportJson, _ := json.MarshalIndent(reports, "", "  ")
+			if err = os.WriteFile(cmdJamCheckReport, reportJson, 0644); err != nil {
+				SysLog.Error("Unable to write report", zap.String("File", cmdJamCheckReport), zap.Error(err))
+			}
+		}
+		if unresolved > 0 {
+			SysLog.Fatal("Jams have unresolved problems", zap.Int("Jams", unresolved))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(jamCmd)
+	jamCmd.AddCommand(jamCheckCmd)
+
+	jamCheckCmd.Flags().StringVarP(&cmdJamRootPath, "root", "r", "", "server root path containing jams.json; needed to check 'all'")
+	jamCheckCmd.Flags().BoolVar(&cmdJamCheckSolos, "solos", false, "when checking 'all', include every user's solo jam too")
+	jamCheckCmd.Flags().StringVarP(&cmdStemS3Server, "stem", "s", "", "S3 server to check loop audio against; defaults to the s3 store in the server config")
+	jamCheckCmd.Flags().BoolVar(&cmdJamCheckAudio, "audio", cmdJamCheckAudio, "check each loop's audio exists in S3 at the right length; --audio=false to only check document references")
+	jamCheckCmd.Flags().IntVarP(&cmdStemWorkers, "workers", "w", cmdStemWorkers, "number of loops to check at once")
+	jamCheckCmd.Flags().StringVar(&cmdJamCheckRepair, "repair", "", "what to do with broken riffs; 'mark' tags the riff document, 'quarantine' also hides it from Studio and exports")
+	jamCheckCmd.Flags().StringVarP(&cmdJamCheckReport, "out", "o", "", "write the full report to this JSON file")
+}
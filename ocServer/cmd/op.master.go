@@ -0,0 +1,326 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sollniss/graceful"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/urfave/negroni"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// per ourocosm.server.yaml
+const cConfigMasterInternalHost string = "master.internal-host" //
+const cConfigMasterInternalPort string = "master.internal-port" //
+const cConfigMasterKeys string = "master.keys"                  // heartbeat public keys allowed to register; empty lets anyone in
+const cConfigMasterExpiry string = "master.expiry"              // drop servers from the list after this long without a heartbeat
+const cConfigMasterState string = "master.state"                // file remembering which key owns which server address
+
+const cMasterDefaultExpiry = 15 * time.Minute
+const cMasterMaxHeartbeatSize = 64 * 1024
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// the live list; an address belongs to the key the server there publishes at /cosm/v1/listing-key, checked on every
+// heartbeat, so nobody can overwrite someone else's listing by signing heartbeats that name it. an allowlist, if
+// configured, further limits which keys can register at all
+type masterServerState struct {
+	Owners map[string]string `json:"owners"` // address -> public key
+
+	listings      map[string]MasterServerListing
+	lastTimestamp map[string]int64 // address -> newest heartbeat timestamp accepted, so old ones can't be replayed
+	allowedKeys   []string
+	expiry        time.Duration
+	statePath     string
+	mu            sync.Mutex
+}
+
+func newMasterServerState() (*masterServerState, error) {
+
+	state := &masterServerState{
+		Owners:        map[string]string{},
+		listings:      map[string]MasterServerListing{},
+		lastTimestamp: map[string]int64{},
+		allowedKeys:   viper.GetStringSlice(cConfigMasterKeys),
+		expiry:        viper.GetDuration(cConfigMasterExpiry),
+		statePath:     viper.GetString(cConfigMasterState),
+	}
+	if state.expiry <= 0 {
+		state.expiry = cMasterDefaultExpiry
+	}
+
+	if len(state.statePath) > 0 {
+		stateJson, err := os.ReadFile(state.statePath)
+		if err == nil {
+			err = json.Unmarshal(stateJson, state)
+		} else if os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("Unable to load master state [%s]", state.statePath), err)
+		}
+	}
+	return state, nil
+}
+
+// call with mu held; swaps the new file in whole so a failed write can't leave the owners half-forgotten
+func (state *masterServerState) save() {
+	if len(state.statePath) == 0 {
+		return
+	}
+	err := func() error {
+		stateJson, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			return err
+		}
+		stateFile, err := os.CreateTemp(filepath.Dir(state.statePath), filepath.Base(state.statePath)+".*.partial")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(stateFile.Name())
+
+		_, err = stateFile.Write(stateJson)
+		if err == nil {
+			err = stateFile.Chmod(0644)
+		}
+		if closeErr := stateFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		return os.Rename(stateFile.Name(), state.statePath)
+	}()
+	if err != nil {
+		SysLog.Error("Unable to write master state", zap.String("File", state.statePath), zap.Error(err))
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+var errMasterListingKeyMismatch = errors.New("server does not publish the key the heartbeat was signed with")
+
+func fetchListedServerJson(url string, target any) error {
+
+	resp, err := federationHttpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, cMasterMaxHeartbeatSize)).Decode(target)
+}
+
+// the server at the listing's address has to publish the key the heartbeat was signed with, and then its own status
+// endpoint, rather than anything the heartbeat says about itself, is what goes in front of clients
+func fetchListedServerStatus(listing MasterServerListing, publicKey string) (*StatusResponse, error) {
+
+	serverURL := fmt.Sprintf("%s://%s:%d", listing.Scheme, listing.Host, listing.ApiPort)
+
+	var listingKey MasterListingKey
+	if err := fetchListedServerJson(serverURL+cMasterListingKeyPath, &listingKey); err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to fetch listing key"), err)
+	}
+	if listingKey.PublicKey != publicKey {
+		return nil, errMasterListingKeyMismatch
+	}
+
+	var status StatusResponse
+	if err := fetchListedServerJson(serverURL+"/cosm/v1/status", &status); err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to fetch status"), err)
+	}
+	return &status, nil
+}
+
+func (state *masterServerState) acceptHeartbeat(heartbeat *MasterHeartbeat, body []byte, signature string) (int, error) {
+
+	if err := verifyMasterHeartbeat(heartbeat, body, signature, time.Now()); err != nil {
+		return http.StatusUnauthorized, err
+	}
+	if len(state.allowedKeys) > 0 && !slices.Contains(state.allowedKeys, heartbeat.PublicKey) {
+		return http.StatusForbidden, fmt.Errorf("key is not allowed to register")
+	}
+
+	listing := heartbeat.Server
+	switch {
+	case len(listing.DisplayName) == 0 || len(listing.Host) == 0:
+		return http.StatusBadRequest, fmt.Errorf("display-name and host are required")
+	case listing.Scheme != "http" && listing.Scheme != "https":
+		return http.StatusBadRequest, fmt.Errorf("scheme must be http or https")
+	case listing.ApiPort <= 0 || listing.ApiPort > 65535 || listing.DbPort <= 0 || listing.DbPort > 65535:
+		return http.StatusBadRequest, fmt.Errorf("api-port and db-port must be port numbers")
+	}
+	address := listing.Address()
+
+	state.mu.Lock()
+	lastTimestamp := state.lastTimestamp[address]
+	state.mu.Unlock()
+
+	if heartbeat.Timestamp <= lastTimestamp {
+		return http.StatusConflict, fmt.Errorf("heartbeat is older than the last one accepted")
+	}
+
+	status, err := fetchListedServerStatus(listing, heartbeat.PublicKey)
+	if errors.Is(err, errMasterListingKeyMismatch) {
+		return http.StatusForbidden, errors.Join(fmt.Errorf("%s is not registered to this key", address), err)
+	}
+	if err != nil {
+		return http.StatusBadRequest, errors.Join(fmt.Errorf("Unable to reach %s", address), err)
+	}
+
+	listing.Awake = status.Awake
+	listing.MostRecentPublicJamChange = status.MostRecentPublicJamChange
+	listing.MostRecentPublicJamName = status.MostRecentPublicJamName
+	listing.LastSeen = time.Now().Unix()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	// another heartbeat for the same address may have been accepted while we were checking this one
+	if heartbeat.Timestamp <= state.lastTimestamp[address] {
+		return http.StatusConflict, fmt.Errorf("heartbeat is older than the last one accepted")
+	}
+	if owner, owned := state.Owners[address]; owner != heartbeat.PublicKey {
+		state.Owners[address] = heartbeat.PublicKey
+		state.save()
+		if owned {
+			SysLog.Info("Server key changed", zap.String("Address", address), zap.String("Name", listing.DisplayName), zap.String("PublicKey", heartbeat.PublicKey))
+		} else {
+			SysLog.Info("Server registered", zap.String("Address", address), zap.String("Name", listing.DisplayName), zap.String("PublicKey", heartbeat.PublicKey))
+		}
+	}
+	state.lastTimestamp[address] = heartbeat.Timestamp
+	state.listings[address] = listing
+	return http.StatusOK, nil
+}
+
+// every server heard from within the expiry time, by name
+func (state *masterServerState) liveServers() MasterServerList {
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	cutoff := time.Now().Add(-state.expiry).Unix()
+	live := MasterServerList{Servers: []MasterServerListing{}}
+	for _, listing := range state.listings {
+		if listing.LastSeen >= cutoff {
+			live.Servers = append(live.Servers, listing)
+		}
+	}
+	sort.Slice(live.Servers, func(i, j int) bool {
+		if live.Servers[i].DisplayName != live.Servers[j].DisplayName {
+			return live.Servers[i].DisplayName < live.Servers[j].DisplayName
+		}
+		return live.Servers[i].Address() < live.Servers[j].Address()
+	})
+	return live
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func (state *masterServerState) HandlerHeartbeat(httpResponse http.ResponseWriter, r *http.Request) {
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, cMasterMaxHeartbeatSize+1))
+	if err != nil || len(body) > cMasterMaxHeartbeatSize {
+		http.Error(httpResponse, "Heartbeat unreadable or too large", http.StatusBadRequest)
+		return
+	}
+	var heartbeat MasterHeartbeat
+	if err = json.Unmarshal(body, &heartbeat); err != nil {
+		http.Error(httpResponse, "Heartbeat is not valid JSON", http.StatusBadRequest)
+		return
+	}
+
+	status, err := state.acceptHeartbeat(&heartbeat, body, r.Header.Get(cMasterSignatureHeader))
+	if err != nil {
+		SysLog.Warn("Heartbeat refused", zap.String("RemoteAddr", r.RemoteAddr), zap.String("Address", heartbeat.Server.Address()), zap.Error(err))
+		http.Error(httpResponse, err.Error(), status)
+		return
+	}
+	handlerEmitJson(httpResponse, map[string]bool{"ok": true})
+}
+
+func (state *masterServerState) HandlerServersJson(httpResponse http.ResponseWriter, r *http.Request) {
+	handlerEmitJson(httpResponse, state.liveServers())
+}
+
+// same shape as ocConnect's own server list YAML, so it can be used as-is
+func (state *masterServerState) HandlerServersYaml(httpResponse http.ResponseWriter, r *http.Request) {
+	httpResponse.Header().Set(HeaderNameContentType, "application/yaml")
+	httpResponse.WriteHeader(http.StatusOK)
+	yamlEncoder := yaml.NewEncoder(httpResponse)
+	yamlEncoder.SetIndent(2)
+	yamlEncoder.Encode(state.liveServers())
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+var masterCmd = &cobra.Command{
+	Use:   "master",
+	Short: "Run a master server that lists live OUROCOSM servers",
+	Long:  `Accept signed heartbeats from OUROCOSM servers (see the listing config) and serve the live list at /master/v1/servers.yaml in ocConnect's server list format, or as JSON from /master/v1/servers.json`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		for _, v := range []string{cConfigMasterInternalHost, cConfigMasterInternalPort} {
+			if len(viper.GetString(v)) == 0 {
+				SysLog.Fatal(fmt.Sprintf("configuration key '%s' missing or empty", v))
+			}
+		}
+
+		state, err := newMasterServerState()
+		if err != nil {
+			SysLog.Fatal("Unable to set up master server", zap.Error(err))
+		}
+		if len(state.allowedKeys) == 0 {
+			SysLog.Info("No master.keys set, any server can register")
+		}
+
+		router := mux.NewRouter()
+		router.HandleFunc("/master/v1/heartbeat", state.HandlerHeartbeat).Methods("POST")
+		router.HandleFunc("/master/v1/servers.json", state.HandlerServersJson).Methods("GET")
+		router.HandleFunc("/master/v1/servers.yaml", state.HandlerServersYaml).Methods("GET")
+		router.PathPrefix("/").HandlerFunc(HandlerDefault)
+
+		n := negroni.New()
+		n.Use(negroni.NewRecovery())
+		n.Use(NewServerIdent())
+		n.UseHandler(router)
+
+		masterAddressInternal := fmt.Sprintf("%s:%s", viper.GetString(cConfigMasterInternalHost), viper.GetString(cConfigMasterInternalPort))
+		var httpServer = &http.Server{
+			Handler:      n,
+			WriteTimeout: time.Second * 30, // heartbeats are checked by calling back to the server, allow for that
+			ReadTimeout:  time.Second * 5,
+			IdleTimeout:  time.Second * 10,
+			Addr:         masterAddressInternal,
+		}
+
+		SysLog.Info(fmt.Sprintf("Launching master server on %s", masterAddressInternal), zap.Duration("Expiry", state.expiry))
+		if err = graceful.ListenAndServe(graceful.NotifyShutdown(), httpServer, 10*time.Second); err != nil {
+			SysLog.Error("error during shutdown", zap.Error(err))
+			return
+		}
+		SysLog.Info("Master server shut down")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(masterCmd)
+}
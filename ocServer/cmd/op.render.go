@@ -0,0 +1,101 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Unbundlesss/OUROCOSM/ocServer/cmd/internal/audio"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var cmdRenderOptions = RiffRenderOptions{
+	StemDownloadWorkers: cStemDownloadDefaultWorkers,
+	StemDownloadRetries: cStemDownloadDefaultRetries,
+	Repeats:             1,
+}
+var cmdJamToRender = ""
+var cmdRenderFormat = string(audio.FormatWAV)
+var cmdRenderFrom = ""
+var cmdRenderTo = ""
+
+// dates on the command line can be a plain day or a full RFC3339 timestamp
+func parseRenderTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("couldn't understand date [%s], expected YYYY-MM-DD or RFC3339", value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Millisecond)
+	}
+	return t, nil
+}
+
+var renderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "Render riffs to mixed-down WAV or FLAC audio",
+	Long:  `Render riffs to mixed-down WAV or FLAC audio, either by riff ID or every riff in a jam created within a date range`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		var err error
+		cmdRenderOptions.Format, err = audio.ParseFormat(cmdRenderFormat)
+		if err != nil {
+			SysLog.Fatal("Invalid render format", zap.Error(err))
+		}
+
+		if len(cmdRenderOptions.RiffIDs) > 0 && cmdSessionIndex != 0 {
+			SysLog.Fatal("--riff and --session can't be used together")
+		}
+		cmdRenderOptions.Session = getJamSessionFromFlags(cmdJamToRender)
+
+		if len(cmdRenderOptions.RiffIDs) == 0 && cmdRenderOptions.Session == nil {
+			if len(cmdRenderFrom) == 0 {
+				SysLog.Fatal("One of --riff, --from or --session is required")
+			}
+			if cmdRenderOptions.From, err = parseRenderTime(cmdRenderFrom, false); err != nil {
+				SysLog.Fatal("Invalid --from", zap.Error(err))
+			}
+			cmdRenderOptions.To = time.Now()
+			if len(cmdRenderTo) > 0 {
+				if cmdRenderOptions.To, err = parseRenderTime(cmdRenderTo, true); err != nil {
+					SysLog.Fatal("Invalid --to", zap.Error(err))
+				}
+			}
+		}
+
+		renderedFiles, err := renderRiffsToDisk(cmdJamToRender, cmdRenderOptions)
+		if err != nil {
+			SysLog.Fatal("Render failed", zap.Error(err))
+		}
+		SysLog.Info("Render complete", zap.Int("Riffs", len(renderedFiles)))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(renderCmd)
+
+	renderCmd.Flags().StringVarP(&cmdRenderOptions.OutputDir, "out", "o", "", "output directory to write _renders to; stems are cached in _stems, shared with export")
+
+	renderCmd.Flags().StringVarP(&cmdJamToRender, "jam", "j", "", "(required) COSMID jam ID or username of the solo jam to render from")
+	renderCmd.MarkFlagRequired("jam")
+	renderCmd.Flags().StringSliceVarP(&cmdRenderOptions.RiffIDs, "riff", "r", nil, "riff ID(s) to render; not with --session")
+	renderCmd.Flags().StringVar(&cmdRenderFrom, "from", "", "render every riff created from this date (YYYY-MM-DD or RFC3339)")
+	renderCmd.Flags().StringVar(&cmdRenderTo, "to", "", "... up to and including this date, defaults to now")
+
+	renderCmd.Flags().StringVarP(&cmdRenderFormat, "format", "f", cmdRenderFormat, "output format, wav or flac")
+	renderCmd.Flags().IntVar(&cmdRenderOptions.SampleRate, "rate", 0, "output sample rate, defaults to the rate of the stems")
+	renderCmd.Flags().IntVar(&cmdRenderOptions.Repeats, "repeats", cmdRenderOptions.Repeats, "number of times to play each riff through")
+	renderCmd.Flags().BoolVarP(&cmdRenderOptions.Normalise, "normalise", "n", false, "scale each render so it peaks just under full scale")
+
+	renderCmd.Flags().StringVarP(&cmdRenderOptions.StemS3Server, "stem", "s", "", "S3 server to fetch uncached stems from; defaults to the s3 store in the server config")
+	renderCmd.Flags().IntVarP(&cmdRenderOptions.StemDownloadWorkers, "workers", "w", cmdRenderOptions.StemDownloadWorkers, "number of stems to download at once")
+	renderCmd.Flags().IntVar(&cmdRenderOptions.StemDownloadRetries, "retries", cmdRenderOptions.StemDownloadRetries, "times to retry a failing stem download before giving up on it")
+}
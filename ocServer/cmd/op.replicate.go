@@ -0,0 +1,131 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var cmdReplicatePrune = false
+var cmdReplicateWatch time.Duration = 0
+
+var replicateCmd = &cobra.Command{
+	Use:   "replicate",
+	Short: "Keep a standby CouchDB in step with this one",
+	Long:  `Manage continuous CouchDB replication of _users, app_client_config and every jam database to the standby given in the replicate config`,
+}
+
+var replicateSyncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Create or update replication jobs for every database",
+	Long:  `Write a _replicator job for every database that should be on the standby and copy each database's _security across; safe to run repeatedly, and needed after restores or membership changes`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		couchClient, err := connectToCouchDB()
+		if err != nil {
+			SysLog.Fatal("Connection to CouchDB failed", zap.Error(err))
+		}
+		defer couchClient.Close()
+
+		report, err := syncReplicationJobs(couchClient, cmdReplicatePrune)
+		if err != nil {
+			SysLog.Fatal("Replication sync failed", zap.Error(err))
+		}
+		for _, databaseName := range report.Created {
+			SysLog.Info("Replication job written", zap.String("Database", databaseName))
+		}
+		for _, databaseName := range report.Removed {
+			SysLog.Info("Replication job removed", zap.String("Database", databaseName))
+		}
+		if len(report.Failed) > 0 {
+			SysLog.Fatal("Some databases could not be set up for replication", zap.Strings("Failed", report.Failed))
+		}
+		SysLog.Info("Replication in sync", zap.Int("Databases", report.Databases), zap.Int("Written", len(report.Created)), zap.Int("Removed", len(report.Removed)))
+	},
+}
+
+var replicateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show how far behind the standby is",
+	Long:  `List each replicated database with its job state and pending changes, as reported by the CouchDB replication scheduler`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		couchClient, err := connectToCouchDB()
+		if err != nil {
+			SysLog.Fatal("Connection to CouchDB failed", zap.Error(err))
+		}
+		defer couchClient.Close()
+
+		for {
+			jobs, summary, err := fetchReplicationStatus(couchClient)
+			if err != nil {
+				SysLog.Fatal("Unable to fetch replication status", zap.Error(err))
+			}
+
+			table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(table, "DATABASE\tSTATE\tPENDING\tWRITTEN\tFAILURES\tUPDATED\tERROR")
+			for _, job := range jobs {
+				fmt.Fprintf(table, "%s\t%s\t%d\t%d\t%d\t%s\t%s\n",
+					job.Database,
+					job.State,
+					job.ChangesPending,
+					job.DocsWritten,
+					job.WriteFailures,
+					job.LastUpdated,
+					job.Error,
+				)
+			}
+			table.Flush()
+			fmt.Printf("\n%d databases, %d running, %d missing, %d failing, %d changes pending\n",
+				summary.Databases, summary.Running, summary.Missing, summary.Failing, summary.ChangesPending)
+
+			if cmdReplicateWatch <= 0 {
+				if !summary.OK() {
+					os.Exit(1)
+				}
+				return
+			}
+			time.Sleep(cmdReplicateWatch)
+			fmt.Println()
+		}
+	},
+}
+
+var replicateRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "Stop replicating to the standby",
+	Long:  `Delete every replication job ocServer manages; the standby keeps the data it already has`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		couchClient, err := connectToCouchDB()
+		if err != nil {
+			SysLog.Fatal("Connection to CouchDB failed", zap.Error(err))
+		}
+		defer couchClient.Close()
+
+		removed, err := removeReplicationJobs(couchClient)
+		if err != nil {
+			SysLog.Fatal("Unable to remove replication jobs", zap.Int("Removed", removed), zap.Error(err))
+		}
+		SysLog.Info("Replication jobs removed", zap.Int("Removed", removed))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(replicateCmd)
+	replicateCmd.AddCommand(replicateSyncCmd)
+	replicateCmd.AddCommand(replicateStatusCmd)
+	replicateCmd.AddCommand(replicateRemoveCmd)
+
+	replicateSyncCmd.Flags().BoolVar(&cmdReplicatePrune, "prune", false, "also remove jobs for databases that no longer exist")
+	replicateStatusCmd.Flags().DurationVarP(&cmdReplicateWatch, "watch", "w", 0, "keep refreshing the status at this interval")
+}
@@ -0,0 +1,85 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var cmdJamForSessions = ""
+var cmdSessionGap = cSessionDefaultGap
+var cmdSessionIndex = 0
+
+// resolve --session / --gap into a session for export and render, nil if no session was asked for
+func getJamSessionFromFlags(jam string) *JamSession {
+	if cmdSessionIndex == 0 {
+		return nil
+	}
+	session, err := findJamSession(jam, cmdSessionGap, cmdSessionIndex)
+	if err != nil {
+		SysLog.Fatal("Unable to find session", zap.Error(err))
+	}
+	SysLog.Info("Using session",
+		zap.Int("Session", session.Index),
+		zap.Time("Start", session.Start),
+		zap.Time("End", session.End),
+		zap.Int("Riffs", session.RiffCount),
+	)
+	return session
+}
+
+var sessionsCmd = &cobra.Command{
+	Use:   "sessions",
+	Short: "List the jamming sessions in a jam",
+	Long:  `Group a jam's riffs into sessions separated by periods of inactivity and list them; use the session number with export or render --session`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		sessions, err := detectJamSessions(cmdJamForSessions, cmdSessionGap)
+		if err != nil {
+			SysLog.Fatal("Session detection failed", zap.Error(err))
+		}
+
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "#\tSTART\tLENGTH\tRIFFS\tBPM\tKEYS\tPARTICIPANTS")
+		for _, session := range sessions {
+			bpmRange := fmt.Sprintf("%.0f", session.MinBPM)
+			if session.MaxBPM != session.MinBPM {
+				bpmRange = fmt.Sprintf("%.0f-%.0f", session.MinBPM, session.MaxBPM)
+			}
+			fmt.Fprintf(table, "%d\t%s\t%s\t%d\t%s\t%s\t%s\n",
+				session.Index,
+				session.Start.Local().Format("2006-01-02 15:04"),
+				session.Duration().Round(time.Minute),
+				session.RiffCount,
+				bpmRange,
+				strings.Join(session.Keys, ", "),
+				strings.Join(session.Participants, ", "),
+			)
+		}
+		table.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sessionsCmd)
+
+	sessionsCmd.Flags().StringVarP(&cmdJamForSessions, "jam", "j", "", "(required) COSMID jam ID or username of the solo jam to scan")
+	sessionsCmd.MarkFlagRequired("jam")
+	sessionsCmd.Flags().DurationVarP(&cmdSessionGap, "gap", "g", cmdSessionGap, "inactivity between riffs that splits one session from the next")
+
+	// export and render can both work on a single session
+	for _, sessionCmd := range []*cobra.Command{exportCmd, renderCmd} {
+		sessionCmd.Flags().IntVar(&cmdSessionIndex, "session", 0, "only use riffs from this session, as numbered by the sessions command")
+		sessionCmd.Flags().DurationVar(&cmdSessionGap, "gap", cmdSessionGap, "inactivity gap used to find --session")
+	}
+}
@@ -0,0 +1,90 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	cmdStemGCPrefix = ""
+	cmdStemGCGrace  = cStemGCDefaultGrace
+	cmdStemGCDelete = false
+	cmdStemGCMoveTo = ""
+	cmdStemGCReport = ""
+)
+
+var stemsCmd = &cobra.Command{
+	Use:   "stems",
+	Short: "Maintenance tools for the stem store",
+	Long:  `Maintenance tools for the stem store`,
+}
+
+var stemsGCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Find, and optionally remove, stems no jam uses",
+	Long:  `List the stem bucket and every Loop document across all jam databases, reporting objects nothing references that are older than the grace period; a dry run unless --delete or --move-to is given`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		gcOptions := StemGCOptions{
+			StemS3Server: cmdStemS3Server,
+			Prefix:       cmdStemGCPrefix,
+			GracePeriod:  cmdStemGCGrace,
+			Workers:      cmdStemWorkers,
+		}
+		switch {
+		case cmdStemGCDelete && len(cmdStemGCMoveTo) > 0:
+			SysLog.Fatal("Pick one of --delete or --move-to")
+		case cmdStemGCDelete:
+			gcOptions.Action = StemGCActionDelete
+		case len(cmdStemGCMoveTo) > 0:
+			gcOptions.Action, gcOptions.MoveTo = StemGCActionMove, cmdStemGCMoveTo
+		}
+
+		report, err := collectOrphanedStems(gcOptions)
+		if err != nil {
+			SysLog.Fatal("Stem collection failed", zap.Error(err))
+		}
+
+		if gcOptions.Action == StemGCActionReport {
+			for _, orphan := range report.Orphans {
+				SysLog.Info("Orphaned", zap.String("Key", orphan.Key), zap.Int64("Size", orphan.Size))
+			}
+		}
+		if len(cmdStemGCReport) > 0 {
+			reportJson, _ := json.MarshalIndent(report, "", "  ")
+			if err = os.WriteFile(cmdStemGCReport, reportJson, 0644); err != nil {
+				SysLog.Error("Unable to write report", zap.String("File", cmdStemGCReport), zap.Error(err))
+			}
+		}
+
+		if gcOptions.Action == StemGCActionReport {
+			SysLog.Info("Dry run, nothing removed; use --delete or --move-to to collect", zap.Int("Orphans", len(report.Orphans)))
+			return
+		}
+		if len(report.Failed) > 0 {
+			SysLog.Fatal("Some stems could not be collected", zap.Int("Collected", report.Collected), zap.Int("Failed", len(report.Failed)))
+		}
+		SysLog.Info("Stems collected", zap.Int("Collected", report.Collected), zap.Int64("Bytes", report.OrphanBytes))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(stemsCmd)
+	stemsCmd.AddCommand(stemsGCCmd)
+
+	stemsGCCmd.Flags().StringVarP(&cmdStemS3Server, "stem", "s", "", "S3 server to collect from; must be the s3 store in the server config, which is the default")
+	stemsGCCmd.Flags().StringVar(&cmdStemGCPrefix, "prefix", "", "only consider objects whose key starts with this")
+	stemsGCCmd.Flags().DurationVarP(&cmdStemGCGrace, "grace", "g", cmdStemGCGrace, "leave unreferenced objects modified more recently than this")
+	stemsGCCmd.Flags().BoolVar(&cmdStemGCDelete, "delete", false, "delete orphaned stems")
+	stemsGCCmd.Flags().StringVar(&cmdStemGCMoveTo, "move-to", "", "move orphaned stems under this key prefix instead of deleting them")
+	stemsGCCmd.Flags().IntVarP(&cmdStemWorkers, "workers", "w", cmdStemWorkers, "number of stems to delete or move at once")
+	stemsGCCmd.Flags().StringVarP(&cmdStemGCReport, "out", "o", "", "write the full report to this JSON file")
+}
@@ -0,0 +1,92 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var cmdStorageEnforce = false
+var cmdStorageReport = ""
+
+var storageCmd = &cobra.Command{
+	Use:   "storage",
+	Short: "Report how much stem storage each user is using",
+	Long:  `Add up the audio referenced by every Loop document across all jams per creator and list it against the configured quotas; --enforce makes the solos of users over the hard quota read-only, and writable again once they are back under it`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		couchClient, err := connectToCouchDB()
+		if err != nil {
+			SysLog.Fatal("Connection to CouchDB failed", zap.Error(err))
+		}
+		defer couchClient.Close()
+
+		report, err := buildStorageReport(couchClient)
+		if err != nil {
+			SysLog.Fatal("Storage report failed", zap.Error(err))
+		}
+		if cmdStorageEnforce {
+			if err = enforceStorageQuotas(couchClient, report); err != nil {
+				SysLog.Error("Quota enforcement incomplete", zap.Error(err))
+			}
+		}
+
+		quotaText := func(quota int64) string {
+			if quota <= 0 {
+				return "-"
+			}
+			return humanize.Bytes(uint64(quota))
+		}
+
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "USER\tSTEMS\tSIZE\tJAMS\tQUOTA\tSOLO")
+		for _, usage := range report.Users {
+			soloState := "-"
+			if usage.HasSolo {
+				soloState = "writable"
+				if usage.SoloReadOnly {
+					soloState = "read-only"
+				}
+			}
+			fmt.Fprintf(table, "%s\t%d\t%s\t%d\t%s\t%s\n",
+				usage.User,
+				usage.Stems,
+				humanize.Bytes(uint64(usage.Bytes)),
+				usage.Jams,
+				usage.Quota,
+				soloState,
+			)
+		}
+		fmt.Fprintf(table, "\t%d\t%s\t%d\t\t\n", report.Stems, humanize.Bytes(uint64(report.Bytes)), report.Databases)
+		table.Flush()
+
+		fmt.Printf("\nsoft quota %s, hard quota %s\n", quotaText(report.SoftQuota), quotaText(report.HardQuota))
+		for _, warning := range report.Warnings {
+			fmt.Println(warning)
+		}
+
+		if len(cmdStorageReport) > 0 {
+			reportJson, _ := json.MarshalIndent(report, "", "  ")
+			if err = os.WriteFile(cmdStorageReport, reportJson, 0644); err != nil {
+				SysLog.Error("Unable to write report", zap.String("File", cmdStorageReport), zap.Error(err))
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(storageCmd)
+
+	storageCmd.Flags().BoolVar(&cmdStorageEnforce, "enforce", false, "make solos over the hard quota read-only, and lift that from solos back under it")
+	storageCmd.Flags().StringVarP(&cmdStorageReport, "out", "o", "", "write the full report to this JSON file")
+}
@@ -0,0 +1,84 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	_ "embed"
+	"net/http"
+	"sort"
+
+	"go.uber.org/zap"
+)
+
+// single-page admin UI that drives the admin API from a browser; it rides on the same basic auth, which the browser
+// asks for and then sends along with every call the page makes
+//
+//go:embed serve.admin.dashboard.html
+var adminDashboardPage []byte
+
+const cAdminDefaultActivityLimit = 25
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func HandlerAdminDashboard(httpResponse http.ResponseWriter, r *http.Request) {
+	httpResponse.Header().Set(HeaderNameContentType, "text/html; charset=utf-8")
+	httpResponse.Header().Set("Cache-Control", "no-store")
+	httpResponse.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'; img-src 'self'; frame-ancestors 'none'")
+	httpResponse.WriteHeader(http.StatusOK)
+	httpResponse.Write(adminDashboardPage)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+type AdminActivity struct {
+	COSMID  string `json:"cosmid"`
+	JamName string `json:"jam"`
+	AdminRiff
+}
+
+// newest riffs across every jam in jams.json; ?limit= picks how many
+func HandlerAdminActivity(httpResponse http.ResponseWriter, r *http.Request) {
+
+	limit, err := parseAdminLimit(r, cAdminDefaultActivityLimit)
+	if err != nil {
+		http.Error(httpResponse, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jamData, err := loadJamManifestData(cmdServeRootPath)
+	if err != nil {
+		http.Error(httpResponse, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	couchClient := connectToCouchDBForAdmin(httpResponse)
+	if couchClient == nil {
+		return
+	}
+	defer couchClient.Close()
+
+	// the newest <limit> from each jam is enough to find the newest <limit> overall
+	activity := []AdminActivity{}
+	for _, jamDecl := range append(jamData.Public, jamData.Private...) {
+		lutID, ok := SysBankIDs.Bank().Entries[jamDecl.COSMID]
+		if !ok {
+			continue
+		}
+		riffs, err := getRecentRiffsFromJam(couchClient, lutID.CouchID, limit)
+		if err != nil {
+			// a jam added moments ago may not have its database yet
+			SysLog.Warn("[Admin] Unable to read recent riffs", zap.String("COSMID", jamDecl.COSMID), zap.Error(err))
+			continue
+		}
+		for _, riff := range riffs {
+			activity = append(activity, AdminActivity{COSMID: jamDecl.COSMID, JamName: jamDecl.Name, AdminRiff: riff})
+		}
+	}
+
+	sort.Slice(activity, func(i, j int) bool { return activity[i].Created > activity[j].Created })
+	if len(activity) > limit {
+		activity = activity[:limit]
+	}
+	handlerEmitJson(httpResponse, activity)
+}
@@ -0,0 +1,235 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// per ourocosm.server.yaml
+const cConfigAdminExportDir string = "admin.export-dir" // where exports started through the admin API are written; defaults to <root>/exports
+
+// finished jobs beyond this many are forgotten, oldest first
+const cAdminExportJobsKept = 50
+
+type AdminExportState string
+
+const (
+	AdminExportRunning AdminExportState = "running"
+	AdminExportDone    AdminExportState = "done"
+	AdminExportFailed  AdminExportState = "failed"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// an 'export' run started through the admin API; these only live in memory, a restart forgets them (and cuts short any
+// still running - incremental exports pick up where they got to)
+type AdminExportJob struct {
+	ID       string           `json:"id"`
+	Jam      string           `json:"jam"`
+	State    AdminExportState `json:"state"`
+	Started  int64            `json:"started"` // unix time
+	Finished int64            `json:"finished,omitempty"`
+	Files    []string         `json:"files,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+type AdminExportRequest struct {
+	Jam           string `json:"jam"`    // COSMID or solo username
+	Prefix        string `json:"prefix"` // defaults to the server fourcc
+	IgnoreMissing bool   `json:"ignore_missing"`
+	Incremental   bool   `json:"incremental"`
+}
+
+var adminExportJobs = struct {
+	jobs   map[string]*AdminExportJob
+	nextID int
+	export func(jamToExport string, options JamExportOptions) ([]string, error) // exportJamToDisk, unless under test
+	mu     sync.Mutex
+}{jobs: map[string]*AdminExportJob{}, export: exportJamToDisk}
+
+func getAdminExportDir() string {
+	if exportDir := viper.GetString(cConfigAdminExportDir); len(exportDir) > 0 {
+		return exportDir
+	}
+	return path.Join(cmdServeRootPath, "exports")
+}
+
+// call with mu held
+func listAdminExportJobs() []AdminExportJob {
+
+	jobs := make([]AdminExportJob, 0, len(adminExportJobs.jobs))
+	for _, job := range adminExportJobs.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].Started != jobs[j].Started {
+			return jobs[i].Started > jobs[j].Started
+		}
+		return jobs[i].ID > jobs[j].ID
+	})
+	return jobs
+}
+
+// call with mu held
+func pruneAdminExportJobs() {
+
+	finished := 0
+	for _, job := range listAdminExportJobs() {
+		if job.State == AdminExportRunning {
+			continue
+		}
+		finished++
+		if finished > cAdminExportJobsKept {
+			delete(adminExportJobs.jobs, job.ID)
+		}
+	}
+}
+
+func runAdminExportJob(job *AdminExportJob, options JamExportOptions) {
+
+	SysLog.Info("[Admin] Export started", zap.String("ID", job.ID), zap.String("Jam", job.Jam), zap.String("OutputDir", options.OutputDir))
+
+	// a panic in here would otherwise take the whole server down with it; catch it and fail the job instead
+	resultingFiles, err := func() (resultingFiles []string, err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				SysLog.Error("[Admin] Export panicked", zap.String("ID", job.ID), zap.Any("Panic", recovered), zap.Stack("Stack"))
+				err = fmt.Errorf("export panicked: %v", recovered)
+			}
+		}()
+		return adminExportJobs.export(job.Jam, options)
+	}()
+
+	adminExportJobs.mu.Lock()
+	defer adminExportJobs.mu.Unlock()
+
+	job.Finished = time.Now().Unix()
+	if err != nil {
+		job.State = AdminExportFailed
+		job.Error = err.Error()
+		SysLog.Error("[Admin] Export failed", zap.String("ID", job.ID), zap.String("Jam", job.Jam), zap.Error(err))
+	} else {
+		job.State = AdminExportDone
+		job.Files = resultingFiles
+		SysLog.Info("[Admin] Export finished", zap.String("ID", job.ID), zap.String("Jam", job.Jam), zap.Strings("Files", resultingFiles))
+	}
+	pruneAdminExportJobs()
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func HandlerAdminExportList(httpResponse http.ResponseWriter, r *http.Request) {
+
+	adminExportJobs.mu.Lock()
+	jobs := listAdminExportJobs()
+	adminExportJobs.mu.Unlock()
+
+	handlerEmitJson(httpResponse, jobs)
+}
+
+func HandlerAdminExportGet(httpResponse http.ResponseWriter, r *http.Request) {
+
+	jobID := mux.Vars(r)["id"]
+
+	adminExportJobs.mu.Lock()
+	job, ok := adminExportJobs.jobs[jobID]
+	var jobCopy AdminExportJob
+	if ok {
+		jobCopy = *job
+	}
+	adminExportJobs.mu.Unlock()
+
+	if !ok {
+		http.Error(httpResponse, fmt.Sprintf("export job [%s] not found", jobID), http.StatusNotFound)
+		return
+	}
+	handlerEmitJson(httpResponse, jobCopy)
+}
+
+// run an export to disk in the background, as 'export' would; poll the job to see how it went
+func HandlerAdminExportStart(httpResponse http.ResponseWriter, r *http.Request) {
+
+	var request AdminExportRequest
+	if !decodeAdminRequest(httpResponse, r, &request) {
+		return
+	}
+
+	serverPrefix := request.Prefix
+	if len(serverPrefix) == 0 {
+		serverPrefix = viper.GetString(cConfigCosmFourCC)
+	}
+	if err := validateServerNamePrefix(serverPrefix); err != nil {
+		http.Error(httpResponse, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the export path bails out hard on a COSMID it doesn't know, so check everything resolves before we get there
+	exportCouchID, _, err := resolveJamCouchID(request.Jam)
+	if err != nil {
+		http.Error(httpResponse, err.Error(), http.StatusNotFound)
+		return
+	}
+	couchClient := connectToCouchDBForAdmin(httpResponse)
+	if couchClient == nil {
+		return
+	}
+	jamExists, err := doesJamDatabaseExist(couchClient, exportCouchID)
+	couchClient.Close()
+	if err != nil || !jamExists {
+		http.Error(httpResponse, fmt.Sprintf("jam [%s] not found", request.Jam), http.StatusNotFound)
+		return
+	}
+
+	outputDir := getAdminExportDir()
+	if err = os.MkdirAll(outputDir, 0755); err != nil {
+		SysLog.Error("[Admin] Unable to create export directory", zap.String("OutputDir", outputDir), zap.Error(err))
+		http.Error(httpResponse, "Unable to create export directory", http.StatusInternalServerError)
+		return
+	}
+
+	adminExportJobs.mu.Lock()
+	defer adminExportJobs.mu.Unlock()
+
+	// two exports of the same jam would trip over each other's files
+	for _, job := range adminExportJobs.jobs {
+		if job.Jam == request.Jam && job.State == AdminExportRunning {
+			http.Error(httpResponse, fmt.Sprintf("jam [%s] is already being exported by job [%s]", request.Jam, job.ID), http.StatusConflict)
+			return
+		}
+	}
+
+	adminExportJobs.nextID++
+	job := &AdminExportJob{
+		ID:      fmt.Sprintf("exp%04d", adminExportJobs.nextID),
+		Jam:     request.Jam,
+		State:   AdminExportRunning,
+		Started: time.Now().Unix(),
+	}
+	adminExportJobs.jobs[job.ID] = job
+
+	go runAdminExportJob(job, JamExportOptions{
+		OutputDir:           outputDir,
+		ServerNamePrefix:    serverPrefix,
+		IgnoreMissingStems:  request.IgnoreMissing,
+		StemDownloadWorkers: cStemDownloadDefaultWorkers,
+		StemDownloadRetries: cStemDownloadDefaultRetries,
+		Incremental:         request.Incremental,
+	})
+
+	httpResponse.Header().Set(HeaderNameContentType, ContentTypeApplicationJson)
+	httpResponse.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(httpResponse).Encode(*job)
+}
@@ -0,0 +1,377 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	kivik "github.com/go-kivik/kivik/v4"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// the admin API, described for tooling in OpenAPI form
+//
+//go:embed serve.admin.openapi.yaml
+var adminOpenApiSpec []byte
+
+const cAdminMaxRequestSize = 64 * 1024
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// JSON admin API, for doing what the CLI commands do without needing a shell on the server; hung off the secured prefix
+// so it sits behind SecuredApiAuth along with everything else there
+func registerAdminApi(securedApi *mux.Router) {
+
+	securedApi.HandleFunc("/openapi.yaml", HandlerAdminOpenApi).Methods("GET")
+	securedApi.Handle("/admin", http.RedirectHandler("admin/", http.StatusMovedPermanently)).Methods("GET")
+	securedApi.HandleFunc("/admin/", HandlerAdminDashboard).Methods("GET")
+	securedApi.HandleFunc("/activity", HandlerAdminActivity).Methods("GET")
+
+	securedApi.HandleFunc("/users", HandlerAdminUserList).Methods("GET")
+	securedApi.HandleFunc("/users", HandlerAdminUserCreate).Methods("POST")
+	securedApi.HandleFunc("/users/{user}", HandlerAdminUserGet).Methods("GET")
+	securedApi.HandleFunc("/users/{user}", HandlerAdminUserUpdate).Methods("PATCH")
+	securedApi.HandleFunc("/users/{user}", HandlerAdminUserDelete).Methods("DELETE")
+
+	securedApi.HandleFunc("/jams", HandlerAdminJamList).Methods("GET")
+	securedApi.HandleFunc("/jams", HandlerAdminJamCreate).Methods("POST")
+	securedApi.HandleFunc("/jams/{cosmid}", HandlerAdminJamGet).Methods("GET")
+	securedApi.HandleFunc("/jams/{cosmid}", HandlerAdminJamUpdate).Methods("PATCH")
+	securedApi.HandleFunc("/jams/{cosmid}", HandlerAdminJamDelete).Methods("DELETE")
+	securedApi.HandleFunc("/jams/{cosmid}/avatar", HandlerAdminJamAvatar).Methods("PUT")
+	securedApi.HandleFunc("/jams/{cosmid}/members", HandlerAdminMemberList).Methods("GET")
+	securedApi.HandleFunc("/jams/{cosmid}/members/{user}", HandlerAdminMemberAdd).Methods("PUT")
+	securedApi.HandleFunc("/jams/{cosmid}/members/{user}", HandlerAdminMemberRemove).Methods("DELETE")
+	securedApi.HandleFunc("/jams/{jam}/riffs", HandlerAdminRiffList).Methods("GET")
+	securedApi.HandleFunc("/jams/{jam}/riffs/{riff}", HandlerAdminRiffDelete).Methods("DELETE")
+
+	securedApi.HandleFunc("/shadowban", HandlerAdminShadowbanList).Methods("GET")
+	securedApi.HandleFunc("/shadowban/{user}", HandlerAdminShadowbanAdd).Methods("PUT")
+	securedApi.HandleFunc("/shadowban/{user}", HandlerAdminShadowbanRemove).Methods("DELETE")
+
+	securedApi.HandleFunc("/exports", HandlerAdminExportList).Methods("GET")
+	securedApi.HandleFunc("/exports", HandlerAdminExportStart).Methods("POST")
+	securedApi.HandleFunc("/exports/{id}", HandlerAdminExportGet).Methods("GET")
+}
+
+func HandlerAdminOpenApi(httpResponse http.ResponseWriter, r *http.Request) {
+	httpResponse.Header().Set(HeaderNameContentType, "application/yaml")
+	httpResponse.WriteHeader(http.StatusOK)
+	httpResponse.Write(adminOpenApiSpec)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// read a JSON request body, refusing anything oversized or carrying fields we don't know about. the content type has
+// to say JSON too; a browser won't send that cross-site without asking first, so another page open in the same browser
+// as the dashboard can't post a form at us riding on its basic auth
+func decodeAdminRequest(httpResponse http.ResponseWriter, r *http.Request, target any) bool {
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get(HeaderNameContentType)); mediaType != ContentTypeApplicationJson {
+		http.Error(httpResponse, "Request body must be "+ContentTypeApplicationJson, http.StatusUnsupportedMediaType)
+		return false
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(httpResponse, r.Body, cAdminMaxRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(target); err != nil {
+		http.Error(httpResponse, fmt.Sprintf("Invalid request body, %s", err.Error()), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// pass on Couch's not-found and conflict answers as they are, anything else is our problem
+func handlerEmitCouchError(httpResponse http.ResponseWriter, err error) {
+
+	status := kivik.HTTPStatus(err)
+	switch status {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusConflict:
+	default:
+		SysLog.Error("Admin API Couch request failed", zap.Error(err))
+		status = http.StatusInternalServerError
+	}
+	http.Error(httpResponse, err.Error(), status)
+}
+
+func connectToCouchDBForAdmin(httpResponse http.ResponseWriter) *kivik.Client {
+
+	couchClient, err := connectToCouchDB()
+	if err != nil {
+		SysLog.Error("[Admin] Connection to CouchDB failed", zap.Error(err))
+		http.Error(httpResponse, "Database unavailable", http.StatusServiceUnavailable)
+		return nil
+	}
+	return couchClient
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+type AdminUser struct {
+	Name         string   `json:"name"`
+	Bio          string   `json:"bio"`
+	Roles        []string `json:"roles"`
+	HasSolo      bool     `json:"has_solo"`
+	Shadowbanned bool     `json:"shadowbanned"`
+	Jams         []string `json:"jams"` // COSMIDs listing them as a member in jams.json
+}
+
+type AdminUserCreate struct {
+	Name  string `json:"name"`
+	Login string `json:"login"`
+	Bio   string `json:"bio"`
+}
+
+type AdminUserUpdate struct {
+	Login *string `json:"login"`
+	Bio   *string `json:"bio"`
+}
+
+type adminUserRecord struct {
+	ID    string   `json:"_id"`
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+	Bio   string   `json:"bio"`
+}
+
+func buildAdminUser(record adminUserRecord, solos map[string]bool, jamData *CosmServerJamData) AdminUser {
+
+	user := AdminUser{
+		Name:         record.Name,
+		Bio:          record.Bio,
+		Roles:        record.Roles,
+		HasSolo:      solos[strings.ToLower(record.Name)],
+		Shadowbanned: isUserShadowbanned(record.Name),
+		Jams:         []string{},
+	}
+	if user.Roles == nil {
+		user.Roles = []string{}
+	}
+	if jamData != nil {
+		for _, jamDecl := range append(jamData.Public, jamData.Private...) {
+			if slices.Contains(jamDecl.Members, record.Name) {
+				user.Jams = append(user.Jams, jamDecl.COSMID)
+			}
+		}
+	}
+	return user
+}
+
+// which solo databases exist, by the name they're stored under
+func listSoloDatabases(couchClient *kivik.Client) (map[string]bool, error) {
+
+	allDatabases, err := couchClient.AllDBs(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	solos := map[string]bool{}
+	for _, databaseName := range allDatabases {
+		if strings.HasPrefix(databaseName, "user_appdata$") {
+			solos[strings.TrimPrefix(databaseName, "user_appdata$")] = true
+		}
+	}
+	return solos, nil
+}
+
+func HandlerAdminUserList(httpResponse http.ResponseWriter, r *http.Request) {
+
+	couchClient := connectToCouchDBForAdmin(httpResponse)
+	if couchClient == nil {
+		return
+	}
+	defer couchClient.Close()
+
+	solos, err := listSoloDatabases(couchClient)
+	if err != nil {
+		handlerEmitCouchError(httpResponse, err)
+		return
+	}
+	jamData, _ := loadJamManifestData(cmdServeRootPath)
+
+	resultSet := couchClient.DB("_users").AllDocs(context.TODO(), kivik.Params(map[string]interface{}{
+		"include_docs": true,
+	}))
+	defer resultSet.Close()
+
+	users := []AdminUser{}
+	for resultSet.Next() {
+		var record adminUserRecord
+		if err := resultSet.ScanDoc(&record); err != nil {
+			handlerEmitCouchError(httpResponse, err)
+			return
+		}
+		if strings.HasPrefix(record.ID, "_design/") || len(record.Name) == 0 {
+			continue
+		}
+		users = append(users, buildAdminUser(record, solos, jamData))
+	}
+	if resultSet.Err() != nil {
+		handlerEmitCouchError(httpResponse, resultSet.Err())
+		return
+	}
+	handlerEmitJson(httpResponse, users)
+}
+
+func HandlerAdminUserGet(httpResponse http.ResponseWriter, r *http.Request) {
+
+	username := mux.Vars(r)["user"]
+
+	couchClient := connectToCouchDBForAdmin(httpResponse)
+	if couchClient == nil {
+		return
+	}
+	defer couchClient.Close()
+
+	var record adminUserRecord
+	if err := couchClient.DB("_users").Get(context.TODO(), getCouchRecordIDForUser(username)).ScanDoc(&record); err != nil {
+		handlerEmitCouchError(httpResponse, err)
+		return
+	}
+	hasSolo, err := doesJamDatabaseExist(couchClient, strings.ToLower(username))
+	if err != nil {
+		handlerEmitCouchError(httpResponse, err)
+		return
+	}
+	jamData, _ := loadJamManifestData(cmdServeRootPath)
+
+	handlerEmitJson(httpResponse, buildAdminUser(record, map[string]bool{strings.ToLower(username): hasSolo}, jamData))
+}
+
+func HandlerAdminUserCreate(httpResponse http.ResponseWriter, r *http.Request) {
+
+	var request AdminUserCreate
+	if !decodeAdminRequest(httpResponse, r, &request) {
+		return
+	}
+	if err := validateNewUser(request.Name, request.Login); err != nil {
+		http.Error(httpResponse, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(request.Bio) == 0 {
+		request.Bio = "No bio supplied"
+	}
+
+	couchClient := connectToCouchDBForAdmin(httpResponse)
+	if couchClient == nil {
+		return
+	}
+	defer couchClient.Close()
+
+	if err := createNewUser(couchClient, request.Name, request.Login, request.Bio); err != nil {
+		handlerEmitCouchError(httpResponse, err)
+		return
+	}
+	SysLog.Info("[Admin] Added new user", zap.String("User", request.Name), zap.String("RemoteAddr", r.RemoteAddr))
+
+	httpResponse.Header().Set(HeaderNameContentType, ContentTypeApplicationJson)
+	httpResponse.WriteHeader(http.StatusCreated)
+	json.NewEncoder(httpResponse).Encode(AdminUser{Name: request.Name, Bio: request.Bio, Roles: []string{"jammers"}, HasSolo: true, Jams: []string{}})
+}
+
+// the generated Couch password is left alone, only our extra fields change
+func HandlerAdminUserUpdate(httpResponse http.ResponseWriter, r *http.Request) {
+
+	username := mux.Vars(r)["user"]
+
+	var request AdminUserUpdate
+	if !decodeAdminRequest(httpResponse, r, &request) {
+		return
+	}
+	if request.Login != nil && len(*request.Login) == 0 {
+		http.Error(httpResponse, "login password cannot be blank", http.StatusBadRequest)
+		return
+	}
+
+	couchClient := connectToCouchDBForAdmin(httpResponse)
+	if couchClient == nil {
+		return
+	}
+	defer couchClient.Close()
+
+	userDb := couchClient.DB("_users")
+	userId := getCouchRecordIDForUser(username)
+
+	var userDoc map[string]interface{}
+	if err := userDb.Get(context.TODO(), userId).ScanDoc(&userDoc); err != nil {
+		handlerEmitCouchError(httpResponse, err)
+		return
+	}
+	if request.Login != nil {
+		userDoc["login"] = *request.Login
+	}
+	if request.Bio != nil {
+		userDoc["bio"] = *request.Bio
+	}
+	if _, err := userDb.Put(context.TODO(), userId, userDoc); err != nil {
+		handlerEmitCouchError(httpResponse, err)
+		return
+	}
+	SysLog.Info("[Admin] Updated user", zap.String("User", username), zap.String("RemoteAddr", r.RemoteAddr))
+
+	HandlerAdminUserGet(httpResponse, r)
+}
+
+// ?purge=true drops their solo jam as well
+func HandlerAdminUserDelete(httpResponse http.ResponseWriter, r *http.Request) {
+
+	username := mux.Vars(r)["user"]
+
+	couchClient := connectToCouchDBForAdmin(httpResponse)
+	if couchClient == nil {
+		return
+	}
+	defer couchClient.Close()
+
+	if err := deleteUser(couchClient, username, r.URL.Query().Get("purge") == "true"); err != nil {
+		handlerEmitCouchError(httpResponse, err)
+		return
+	}
+	SysLog.Info("[Admin] Deleted user", zap.String("User", username), zap.String("RemoteAddr", r.RemoteAddr))
+
+	httpResponse.WriteHeader(http.StatusNoContent)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func HandlerAdminShadowbanList(httpResponse http.ResponseWriter, r *http.Request) {
+	handlerEmitJson(httpResponse, listShadowbans())
+}
+
+func HandlerAdminShadowbanAdd(httpResponse http.ResponseWriter, r *http.Request) {
+
+	username := mux.Vars(r)["user"]
+	added, err := addShadowban(username)
+	if err != nil {
+		SysLog.Error("[Admin] Shadowban failed", zap.String("User", username), zap.Error(err))
+		http.Error(httpResponse, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if added {
+		SysLog.Info("[Admin] Shadowbanned user", zap.String("User", username), zap.String("RemoteAddr", r.RemoteAddr))
+	}
+	handlerEmitJson(httpResponse, listShadowbans())
+}
+
+func HandlerAdminShadowbanRemove(httpResponse http.ResponseWriter, r *http.Request) {
+
+	username := mux.Vars(r)["user"]
+	if isUserShadowbanned(username) {
+		if err := removeShadowban(username); errors.Is(err, errShadowbanInConfig) {
+			http.Error(httpResponse, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			SysLog.Error("[Admin] Lifting shadowban failed", zap.String("User", username), zap.Error(err))
+			http.Error(httpResponse, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		SysLog.Info("[Admin] Lifted shadowban", zap.String("User", username), zap.String("RemoteAddr", r.RemoteAddr))
+	}
+	handlerEmitJson(httpResponse, listShadowbans())
+}
@@ -0,0 +1,657 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+
+	kivik "github.com/go-kivik/kivik/v4"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const cAdminMaxAvatarSize = 4 * 1024 * 1024
+const cAdminDefaultRiffLimit = 20
+const cAdminMaxRiffLimit = 500
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// jams are edited in jams.json, as they would be by hand, and then the running manifest is rebuilt from it in the
+// background. a rebuild that fails leaves the old manifest running, so everything it would trip over is checked here first
+var jamManifestEditMu sync.Mutex
+var jamManifestReloadMu sync.Mutex
+
+func reloadJamManifest() {
+
+	// one rebuild at a time; a later one will pick up every edit made before it started
+	jamManifestReloadMu.Lock()
+	defer jamManifestReloadMu.Unlock()
+
+	jamData, err := loadJamManifestData(cmdServeRootPath)
+	if err != nil {
+		SysLog.Error("Unable to reload jam manifest", zap.Error(err))
+		return
+	}
+
+	// the rebuild talks to Couch a good deal; if any of it fails the server keeps running on the old manifest
+	jamManifest, publicJams, err := constructJamManifestFromData(*jamData)
+	if err != nil {
+		SysLog.Error("Unable to reload jam manifest, keeping the current one", zap.Error(err))
+		return
+	}
+
+	// nobody gets to read the public jam data while it is being swapped
+	if err := jamStateSema.Acquire(context.TODO(), 1); err != nil {
+		SysLog.Error("acquiring jam state sema failed", zap.Error(err))
+		return
+	}
+	defer jamStateSema.Release(1)
+
+	CurrentJamManifest.Store(jamManifest)
+	publicJamsResponse = publicJams
+	collectPublicJamStates(false)
+
+	SysLog.Info("Jam manifest reloaded", zap.Int("COSMIDs", jamManifest.NumberOfCOSMIDs()))
+}
+
+// load jams.json, let the edit function change it, write it back and kick off a reload; a non-nil error from the edit
+// abandons the change and comes back with the status it gave
+func editJamManifest(edit func(jamData *CosmServerJamData) (int, error)) (int, error) {
+
+	jamManifestEditMu.Lock()
+	defer jamManifestEditMu.Unlock()
+
+	jamData, err := loadJamManifestData(cmdServeRootPath)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if status, err := edit(jamData); err != nil {
+		return status, err
+	}
+	if err = saveJamManifestData(cmdServeRootPath, jamData); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	go reloadJamManifest()
+	return http.StatusAccepted, nil
+}
+
+// find a jam in the manifest, returning where it lives so it can be changed in place
+func findJamDecl(jamData *CosmServerJamData, cosmid string) (*CosmServerJamDecl, bool) {
+	for i := range jamData.Public {
+		if jamData.Public[i].COSMID == cosmid {
+			return &jamData.Public[i], true
+		}
+	}
+	for i := range jamData.Private {
+		if jamData.Private[i].COSMID == cosmid {
+			return &jamData.Private[i], false
+		}
+	}
+	return nil, false
+}
+
+func removeJamDecl(jamData *CosmServerJamData, cosmid string) {
+	isCOSMID := func(jamDecl CosmServerJamDecl) bool { return jamDecl.COSMID == cosmid }
+	jamData.Public = slices.DeleteFunc(jamData.Public, isCOSMID)
+	jamData.Private = slices.DeleteFunc(jamData.Private, isCOSMID)
+}
+
+func getJamAvatarSourcePath(cosmid string) string {
+	return path.Join(path.Join(cmdServeRootPath, "avatars_source"), cosmid+".jpg")
+}
+
+// everything performJamPreflight would otherwise refuse, which at boot stops the server
+func validateJamDecl(jamDecl CosmServerJamDecl, isPublic bool) error {
+
+	if _, ok := SysBankIDs.Bank().Entries[jamDecl.COSMID]; !ok {
+		return fmt.Errorf("unable to resolve COSMID [%s] to Endlesss jam IDs", jamDecl.COSMID)
+	}
+	if len(jamDecl.Name) == 0 {
+		return fmt.Errorf("jam name cannot be blank")
+	}
+	if jamDecl.Mirror != nil {
+		if !isPublic {
+			return fmt.Errorf("only public jams can be mirrored")
+		}
+		if len(jamDecl.Mirror.Server) == 0 || len(jamDecl.Mirror.User) == 0 || len(jamDecl.Mirror.Login) == 0 {
+			return fmt.Errorf("mirrored jams need a server, user and login")
+		}
+		return nil
+	}
+	if _, err := os.Stat(getJamAvatarSourcePath(jamDecl.COSMID)); err != nil {
+		return fmt.Errorf("jam [%s] has no avatar yet, upload one first", jamDecl.COSMID)
+	}
+	return nil
+}
+
+// members need a solo for their membership records to go into
+func checkJamMembersExist(couchClient *kivik.Client, members []string) (int, error) {
+	for _, member := range members {
+		soloExists, err := doesJamDatabaseExist(couchClient, member)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if !soloExists {
+			return http.StatusBadRequest, fmt.Errorf("user [%s] does not exist", member)
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+type AdminJam struct {
+	COSMID   string   `json:"cosmid"`
+	Name     string   `json:"name"`
+	Bio      string   `json:"bio"`
+	Members  []string `json:"members"`
+	IsPublic bool     `json:"is_public"`
+	Mirror   string   `json:"mirror,omitempty"` // remote server a mirrored jam is pulled from
+	CouchID  string   `json:"couch"`
+	LongID   string   `json:"long_id"`
+	Loaded   bool     `json:"loaded"` // the running server knows about it; false until a reload after it was added
+}
+
+type AdminJamCreate struct {
+	CosmServerJamDecl
+	IsPublic bool `json:"is_public"`
+}
+
+type AdminJamUpdate struct {
+	Name     *string `json:"name"`
+	Bio      *string `json:"bio"`
+	IsPublic *bool   `json:"is_public"`
+}
+
+// jamManifest is the running manifest to check Loaded against; nil if there isn't one yet
+func buildAdminJam(jamDecl CosmServerJamDecl, isPublic bool, jamManifest *JamManifest) AdminJam {
+
+	jam := AdminJam{
+		COSMID:   jamDecl.COSMID,
+		Name:     jamDecl.Name,
+		Bio:      jamDecl.Bio,
+		Members:  jamDecl.Members,
+		IsPublic: isPublic,
+	}
+	if jam.Members == nil {
+		jam.Members = []string{}
+	}
+	if jamDecl.Mirror != nil {
+		jam.Mirror = jamDecl.Mirror.Server
+	}
+	if lutID, ok := SysBankIDs.Bank().Entries[jamDecl.COSMID]; ok {
+		jam.CouchID = lutID.CouchID
+		jam.LongID = lutID.LongID
+	}
+	if jamManifest != nil {
+		_, jam.Loaded = jamManifest.NameFromCOSMID(jamDecl.COSMID)
+	}
+	return jam
+}
+
+func emitAdminJamAccepted(httpResponse http.ResponseWriter, jam AdminJam) {
+	httpResponse.Header().Set(HeaderNameContentType, ContentTypeApplicationJson)
+	httpResponse.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(httpResponse).Encode(jam)
+}
+
+func HandlerAdminJamList(httpResponse http.ResponseWriter, r *http.Request) {
+
+	jamData, err := loadJamManifestData(cmdServeRootPath)
+	if err != nil {
+		http.Error(httpResponse, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jamManifest := CurrentJamManifest.Load()
+	jams := []AdminJam{}
+	for _, jamDecl := range jamData.Public {
+		jams = append(jams, buildAdminJam(jamDecl, true, jamManifest))
+	}
+	for _, jamDecl := range jamData.Private {
+		jams = append(jams, buildAdminJam(jamDecl, false, jamManifest))
+	}
+	handlerEmitJson(httpResponse, jams)
+}
+
+func HandlerAdminJamGet(httpResponse http.ResponseWriter, r *http.Request) {
+
+	cosmid := mux.Vars(r)["cosmid"]
+
+	jamData, err := loadJamManifestData(cmdServeRootPath)
+	if err != nil {
+		http.Error(httpResponse, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jamDecl, isPublic := findJamDecl(jamData, cosmid)
+	if jamDecl == nil {
+		http.Error(httpResponse, fmt.Sprintf("jam [%s] not found", cosmid), http.StatusNotFound)
+		return
+	}
+	handlerEmitJson(httpResponse, buildAdminJam(*jamDecl, isPublic, CurrentJamManifest.Load()))
+}
+
+// adds the jam to jams.json; the database, Profile and memberships are set up by the reload that follows
+func HandlerAdminJamCreate(httpResponse http.ResponseWriter, r *http.Request) {
+
+	var request AdminJamCreate
+	if !decodeAdminRequest(httpResponse, r, &request) {
+		return
+	}
+	if err := validateJamDecl(request.CosmServerJamDecl, request.IsPublic); err != nil {
+		http.Error(httpResponse, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	couchClient := connectToCouchDBForAdmin(httpResponse)
+	if couchClient == nil {
+		return
+	}
+	defer couchClient.Close()
+
+	if status, err := checkJamMembersExist(couchClient, request.Members); err != nil {
+		http.Error(httpResponse, err.Error(), status)
+		return
+	}
+
+	status, err := editJamManifest(func(jamData *CosmServerJamData) (int, error) {
+		if existing, _ := findJamDecl(jamData, request.COSMID); existing != nil {
+			return http.StatusConflict, fmt.Errorf("jam [%s] already exists", request.COSMID)
+		}
+		if request.IsPublic {
+			jamData.Public = append(jamData.Public, request.CosmServerJamDecl)
+		} else {
+			jamData.Private = append(jamData.Private, request.CosmServerJamDecl)
+		}
+		return http.StatusOK, nil
+	})
+	if err != nil {
+		http.Error(httpResponse, err.Error(), status)
+		return
+	}
+	SysLog.Info("[Admin] Added jam", zap.String("COSMID", request.COSMID), zap.Bool("IsPublic", request.IsPublic), zap.String("RemoteAddr", r.RemoteAddr))
+
+	emitAdminJamAccepted(httpResponse, buildAdminJam(request.CosmServerJamDecl, request.IsPublic, CurrentJamManifest.Load()))
+}
+
+func HandlerAdminJamUpdate(httpResponse http.ResponseWriter, r *http.Request) {
+
+	cosmid := mux.Vars(r)["cosmid"]
+
+	var request AdminJamUpdate
+	if !decodeAdminRequest(httpResponse, r, &request) {
+		return
+	}
+
+	var updated AdminJam
+	status, err := editJamManifest(func(jamData *CosmServerJamData) (int, error) {
+		jamDecl, isPublic := findJamDecl(jamData, cosmid)
+		if jamDecl == nil {
+			return http.StatusNotFound, fmt.Errorf("jam [%s] not found", cosmid)
+		}
+		newDecl := *jamDecl
+		if request.Name != nil {
+			newDecl.Name = *request.Name
+		}
+		if request.Bio != nil {
+			newDecl.Bio = *request.Bio
+		}
+		if request.IsPublic != nil {
+			isPublic = *request.IsPublic
+		}
+		if err := validateJamDecl(newDecl, isPublic); err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		// swap it in, moving between the public and private lists as needed
+		removeJamDecl(jamData, cosmid)
+		if isPublic {
+			jamData.Public = append(jamData.Public, newDecl)
+		} else {
+			jamData.Private = append(jamData.Private, newDecl)
+		}
+		updated = buildAdminJam(newDecl, isPublic, CurrentJamManifest.Load())
+		return http.StatusOK, nil
+	})
+	if err != nil {
+		http.Error(httpResponse, err.Error(), status)
+		return
+	}
+	SysLog.Info("[Admin] Updated jam", zap.String("COSMID", cosmid), zap.String("RemoteAddr", r.RemoteAddr))
+
+	emitAdminJamAccepted(httpResponse, updated)
+}
+
+// takes the jam out of jams.json and private jams out of their members' My Jams; the database stays unless ?purge=true.
+// either way, standby replication of it is left for 'replicate sync --prune' to tidy up
+func HandlerAdminJamDelete(httpResponse http.ResponseWriter, r *http.Request) {
+
+	cosmid := mux.Vars(r)["cosmid"]
+	purgeDatabase := r.URL.Query().Get("purge") == "true"
+
+	couchClient := connectToCouchDBForAdmin(httpResponse)
+	if couchClient == nil {
+		return
+	}
+	defer couchClient.Close()
+
+	var removed CosmServerJamDecl
+	var removedWasPublic bool
+	status, err := editJamManifest(func(jamData *CosmServerJamData) (int, error) {
+		jamDecl, isPublic := findJamDecl(jamData, cosmid)
+		if jamDecl == nil {
+			return http.StatusNotFound, fmt.Errorf("jam [%s] not found", cosmid)
+		}
+		removed, removedWasPublic = *jamDecl, isPublic
+		removeJamDecl(jamData, cosmid)
+		return http.StatusOK, nil
+	})
+	if err != nil {
+		http.Error(httpResponse, err.Error(), status)
+		return
+	}
+	SysLog.Info("[Admin] Removed jam", zap.String("COSMID", cosmid), zap.Bool("Purge", purgeDatabase), zap.String("RemoteAddr", r.RemoteAddr))
+
+	couchID := SysBankIDs.Bank().Entries[cosmid].CouchID
+	if !removedWasPublic {
+		for _, member := range removed.Members {
+			if err = removeJamMembershipRecord(couchClient, member, couchID); err != nil {
+				SysLog.Warn("Unable to remove membership document", zap.String("COSMID", cosmid), zap.String("Username", member), zap.Error(err))
+			}
+		}
+	}
+	if purgeDatabase {
+		databaseName := fmt.Sprintf("user_appdata$%s", couchID)
+		if removed.Mirror != nil {
+			replicatorDb := couchClient.DB("_replicator")
+			if rev, err := replicatorDb.GetRev(context.TODO(), cMirrorJobPrefix+databaseName); err == nil {
+				replicatorDb.Delete(context.TODO(), cMirrorJobPrefix+databaseName, rev)
+			}
+		}
+		err = couchClient.DestroyDB(context.TODO(), databaseName)
+		if err != nil && kivik.HTTPStatus(err) != http.StatusNotFound {
+			handlerEmitCouchError(httpResponse, err)
+			return
+		}
+	}
+
+	httpResponse.WriteHeader(http.StatusNoContent)
+}
+
+// body is the JPEG itself; it lands where preflight looks for it, and a listed jam gets reloaded to pick it up
+func HandlerAdminJamAvatar(httpResponse http.ResponseWriter, r *http.Request) {
+
+	cosmid := mux.Vars(r)["cosmid"]
+	if _, ok := SysBankIDs.Bank().Entries[cosmid]; !ok {
+		http.Error(httpResponse, fmt.Sprintf("unable to resolve COSMID [%s] to Endlesss jam IDs", cosmid), http.StatusNotFound)
+		return
+	}
+
+	avatarData, err := io.ReadAll(http.MaxBytesReader(httpResponse, r.Body, cAdminMaxAvatarSize))
+	if err != nil {
+		http.Error(httpResponse, "Avatar unreadable or too large", http.StatusBadRequest)
+		return
+	}
+	if http.DetectContentType(avatarData) != "image/jpeg" {
+		http.Error(httpResponse, "Avatar must be a JPEG", http.StatusBadRequest)
+		return
+	}
+
+	avatarPath := getJamAvatarSourcePath(cosmid)
+	if err = os.MkdirAll(path.Dir(avatarPath), 0755); err == nil {
+		err = os.WriteFile(avatarPath+".partial", avatarData, 0644)
+	}
+	if err == nil {
+		err = os.Rename(avatarPath+".partial", avatarPath)
+	}
+	if err != nil {
+		SysLog.Error("[Admin] Unable to write jam avatar", zap.String("COSMID", cosmid), zap.Error(err))
+		http.Error(httpResponse, "Unable to write avatar", http.StatusInternalServerError)
+		return
+	}
+	SysLog.Info("[Admin] Jam avatar uploaded", zap.String("COSMID", cosmid), zap.Int("Bytes", len(avatarData)), zap.String("RemoteAddr", r.RemoteAddr))
+
+	if jamManifest := CurrentJamManifest.Load(); jamManifest != nil {
+		if _, listed := jamManifest.NameFromCOSMID(cosmid); listed {
+			go reloadJamManifest()
+		}
+	}
+	httpResponse.WriteHeader(http.StatusNoContent)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// drop a jam from a user's My Jams; fine if it was never there
+func removeJamMembershipRecord(couchClient *kivik.Client, username string, couchID string) error {
+
+	userDb := couchClient.DB(fmt.Sprintf("user_appdata$%s", username))
+	rev, err := userDb.GetRev(context.TODO(), couchID)
+	if kivik.HTTPStatus(err) == http.StatusNotFound {
+		return nil
+	}
+	if err == nil {
+		_, err = userDb.Delete(context.TODO(), couchID, rev)
+	}
+	return err
+}
+
+func HandlerAdminMemberList(httpResponse http.ResponseWriter, r *http.Request) {
+
+	cosmid := mux.Vars(r)["cosmid"]
+
+	jamData, err := loadJamManifestData(cmdServeRootPath)
+	if err != nil {
+		http.Error(httpResponse, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jamDecl, _ := findJamDecl(jamData, cosmid)
+	if jamDecl == nil {
+		http.Error(httpResponse, fmt.Sprintf("jam [%s] not found", cosmid), http.StatusNotFound)
+		return
+	}
+	handlerEmitJson(httpResponse, buildAdminJam(*jamDecl, false, CurrentJamManifest.Load()).Members)
+}
+
+// membership records for private jams are written by the reload, as they are at boot
+func HandlerAdminMemberAdd(httpResponse http.ResponseWriter, r *http.Request) {
+
+	cosmid := mux.Vars(r)["cosmid"]
+	username := mux.Vars(r)["user"]
+
+	couchClient := connectToCouchDBForAdmin(httpResponse)
+	if couchClient == nil {
+		return
+	}
+	defer couchClient.Close()
+
+	if status, err := checkJamMembersExist(couchClient, []string{username}); err != nil {
+		if status == http.StatusBadRequest {
+			status = http.StatusNotFound
+		}
+		http.Error(httpResponse, err.Error(), status)
+		return
+	}
+
+	var updated AdminJam
+	status, err := editJamManifest(func(jamData *CosmServerJamData) (int, error) {
+		jamDecl, isPublic := findJamDecl(jamData, cosmid)
+		if jamDecl == nil {
+			return http.StatusNotFound, fmt.Errorf("jam [%s] not found", cosmid)
+		}
+		if !slices.Contains(jamDecl.Members, username) {
+			jamDecl.Members = append(jamDecl.Members, username)
+		}
+		updated = buildAdminJam(*jamDecl, isPublic, CurrentJamManifest.Load())
+		return http.StatusOK, nil
+	})
+	if err != nil {
+		http.Error(httpResponse, err.Error(), status)
+		return
+	}
+	SysLog.Info("[Admin] Added jam member", zap.String("COSMID", cosmid), zap.String("Username", username), zap.String("RemoteAddr", r.RemoteAddr))
+
+	emitAdminJamAccepted(httpResponse, updated)
+}
+
+func HandlerAdminMemberRemove(httpResponse http.ResponseWriter, r *http.Request) {
+
+	cosmid := mux.Vars(r)["cosmid"]
+	username := mux.Vars(r)["user"]
+
+	couchClient := connectToCouchDBForAdmin(httpResponse)
+	if couchClient == nil {
+		return
+	}
+	defer couchClient.Close()
+
+	var updated AdminJam
+	status, err := editJamManifest(func(jamData *CosmServerJamData) (int, error) {
+		jamDecl, isPublic := findJamDecl(jamData, cosmid)
+		if jamDecl == nil {
+			return http.StatusNotFound, fmt.Errorf("jam [%s] not found", cosmid)
+		}
+		jamDecl.Members = slices.DeleteFunc(jamDecl.Members, func(member string) bool { return member == username })
+		updated = buildAdminJam(*jamDecl, isPublic, CurrentJamManifest.Load())
+		return http.StatusOK, nil
+	})
+	if err != nil {
+		http.Error(httpResponse, err.Error(), status)
+		return
+	}
+	SysLog.Info("[Admin] Removed jam member", zap.String("COSMID", cosmid), zap.String("Username", username), zap.String("RemoteAddr", r.RemoteAddr))
+
+	if !updated.IsPublic {
+		if err = removeJamMembershipRecord(couchClient, username, updated.CouchID); err != nil {
+			handlerEmitCouchError(httpResponse, err)
+			return
+		}
+	}
+	emitAdminJamAccepted(httpResponse, updated)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+type AdminRiff struct {
+	ID       string  `json:"id"`
+	Created  int64   `json:"created"` // unix ms
+	UserName string  `json:"user"`
+	BPS      float64 `json:"bps"`
+}
+
+// ?limit= on the listing endpoints, with a default for when it isn't given
+func parseAdminLimit(r *http.Request, defaultLimit int) (int, error) {
+
+	limitParam := r.URL.Query().Get("limit")
+	if len(limitParam) == 0 {
+		return defaultLimit, nil
+	}
+	limit, err := strconv.Atoi(limitParam)
+	if err != nil || limit <= 0 || limit > cAdminMaxRiffLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", cAdminMaxRiffLimit)
+	}
+	return limit, nil
+}
+
+func getRecentRiffsFromJam(couchClient *kivik.Client, couchID string, limit int) ([]AdminRiff, error) {
+
+	resultSet := couchClient.DB(fmt.Sprintf("user_appdata$%s", couchID)).Query(context.TODO(), "types", "rifffsByCreateTime", kivik.Params(map[string]interface{}{
+		"descending":   true,
+		"limit":        limit,
+		"include_docs": true,
+	}))
+	defer resultSet.Close()
+
+	riffs := []AdminRiff{}
+	for resultSet.Next() {
+		var riffData JamRiffData
+		if err := resultSet.ScanDoc(&riffData); err != nil {
+			return nil, err
+		}
+		riffs = append(riffs, AdminRiff{ID: riffData.ID, Created: riffData.Created, UserName: riffData.UserName, BPS: riffData.State.Bps})
+	}
+	if resultSet.Err() != nil {
+		return nil, resultSet.Err()
+	}
+	return riffs, nil
+}
+
+// most recent riffs in a jam or solo, newest first
+func HandlerAdminRiffList(httpResponse http.ResponseWriter, r *http.Request) {
+
+	jamName := mux.Vars(r)["jam"]
+	couchID, _, err := resolveJamCouchID(jamName)
+	if err != nil {
+		http.Error(httpResponse, err.Error(), http.StatusNotFound)
+		return
+	}
+	limit, err := parseAdminLimit(r, cAdminDefaultRiffLimit)
+	if err != nil {
+		http.Error(httpResponse, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	couchClient := connectToCouchDBForAdmin(httpResponse)
+	if couchClient == nil {
+		return
+	}
+	defer couchClient.Close()
+
+	riffs, err := getRecentRiffsFromJam(couchClient, couchID, limit)
+	if err != nil {
+		handlerEmitCouchError(httpResponse, err)
+		return
+	}
+	handlerEmitJson(httpResponse, riffs)
+}
+
+// the stems it used are left for 'stems gc' to find
+func HandlerAdminRiffDelete(httpResponse http.ResponseWriter, r *http.Request) {
+
+	jamName := mux.Vars(r)["jam"]
+	riffID := mux.Vars(r)["riff"]
+
+	couchID, isCOSMID, err := resolveJamCouchID(jamName)
+	if err != nil {
+		http.Error(httpResponse, err.Error(), http.StatusNotFound)
+		return
+	}
+	if jamManifest := CurrentJamManifest.Load(); isCOSMID && jamManifest != nil {
+		if _, mirrored := jamManifest.MirrorFromCOSMID(jamName); mirrored {
+			http.Error(httpResponse, "mirrored jams are read-only, delete the riff on the server it comes from", http.StatusConflict)
+			return
+		}
+	}
+
+	couchClient := connectToCouchDBForAdmin(httpResponse)
+	if couchClient == nil {
+		return
+	}
+	defer couchClient.Close()
+
+	jamDb := couchClient.DB(fmt.Sprintf("user_appdata$%s", couchID))
+
+	var riffData JamRiffData
+	if err = jamDb.Get(context.TODO(), riffID).ScanDoc(&riffData); err != nil {
+		handlerEmitCouchError(httpResponse, err)
+		return
+	}
+	if riffData.Type != "Rifff" {
+		http.Error(httpResponse, fmt.Sprintf("[%s] is not a riff", riffID), http.StatusBadRequest)
+		return
+	}
+	if _, err = jamDb.Delete(context.TODO(), riffID, riffData.Rev); err != nil {
+		handlerEmitCouchError(httpResponse, err)
+		return
+	}
+	SysLog.Info("[Admin] Deleted riff", zap.String("Jam", jamName), zap.String("Riff", riffID), zap.String("User", riffData.UserName), zap.String("RemoteAddr", r.RemoteAddr))
+
+	httpResponse.WriteHeader(http.StatusNoContent)
+}
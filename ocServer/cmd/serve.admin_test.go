@@ -0,0 +1,381 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Unbundlesss/OUROCOSM/ocServer/cmd/internal/util"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// just enough of CouchDB's HTTP API for the admin handlers; databases exist or don't, and documents in them can be read,
+// checked and deleted. anything else is refused, which keeps the manifest reload the edits kick off from getting anywhere
+type testCouch struct {
+	dbs map[string]map[string]map[string]any // database -> document ID -> document
+	mu  sync.Mutex
+}
+
+// the connection URI is only worked out once per process, so every test shares the one server and swaps what's behind it
+var testCouchServer struct {
+	once    sync.Once
+	current atomic.Pointer[testCouch]
+}
+
+func useTestCouch(t *testing.T) *testCouch {
+	t.Helper()
+
+	testCouchServer.once.Do(func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			testCouchServer.current.Load().ServeHTTP(w, r)
+		}))
+		serverURL, _ := url.Parse(server.URL)
+		viper.Set(cConfigCouchScheme, "http")
+		viper.Set(cConfigCouchInternalHost, serverURL.Hostname())
+		viper.Set(cConfigCouchInternalPort, serverURL.Port())
+		viper.Set(cConfigCouchExternalHost, serverURL.Hostname())
+		viper.Set(cConfigCouchExternalPort, serverURL.Port())
+		viper.Set(cConfigCouchUser, "admin")
+		viper.Set(cConfigCouchPwd, "admin")
+	})
+	couch := &testCouch{dbs: map[string]map[string]map[string]any{}}
+	testCouchServer.current.Store(couch)
+	return couch
+}
+
+func (couch *testCouch) addDoc(database string, docID string, doc map[string]any) {
+	couch.mu.Lock()
+	defer couch.mu.Unlock()
+	if couch.dbs[database] == nil {
+		couch.dbs[database] = map[string]map[string]any{}
+	}
+	if len(docID) > 0 {
+		doc["_id"], doc["_rev"] = docID, "1-abc"
+		couch.dbs[database][docID] = doc
+	}
+}
+
+func (couch *testCouch) hasDoc(database string, docID string) bool {
+	couch.mu.Lock()
+	defer couch.mu.Unlock()
+	_, ok := couch.dbs[database][docID]
+	return ok
+}
+
+func (couch *testCouch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	couch.mu.Lock()
+	defer couch.mu.Unlock()
+
+	notFound := func(reason string) {
+		w.Header().Set(HeaderNameContentType, ContentTypeApplicationJson)
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "not_found", "reason": reason})
+	}
+
+	database, docID, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	docs, dbExists := couch.dbs[database]
+	switch {
+	case !dbExists:
+		notFound("Database does not exist.")
+	case len(docID) == 0 && r.Method == http.MethodGet:
+		handlerEmitJson(w, map[string]any{"db_name": database, "doc_count": len(docs)})
+	case docs[docID] == nil:
+		notFound("missing")
+	case r.Method == http.MethodHead:
+		w.Header().Set("ETag", fmt.Sprintf("%q", docs[docID]["_rev"]))
+	case r.Method == http.MethodGet:
+		w.Header().Set("ETag", fmt.Sprintf("%q", docs[docID]["_rev"]))
+		handlerEmitJson(w, docs[docID])
+	case r.Method == http.MethodDelete && r.URL.Query().Get("rev") == docs[docID]["_rev"]:
+		delete(docs, docID)
+		w.Header().Set("ETag", `"2-def"`)
+		handlerEmitJson(w, map[string]any{"ok": true, "id": docID, "rev": "2-def"})
+	default:
+		http.Error(w, `{"error":"method_not_allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// a server root holding the given jams.json, with the admin API routed as serve sets it up
+func newTestAdminServer(t *testing.T, jamData CosmServerJamData) *mux.Router {
+	t.Helper()
+
+	if SysBankIDs == nil {
+		bankIDs, err := util.LoadJamIDBanks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		SysBankIDs = bankIDs
+	}
+
+	previousRoot := cmdServeRootPath
+	cmdServeRootPath = t.TempDir()
+	t.Cleanup(func() { cmdServeRootPath = previousRoot })
+	if err := saveJamManifestData(cmdServeRootPath, &jamData); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	registerAdminApi(router)
+	return router
+}
+
+func serveAdmin(router *mux.Router, method string, target string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if len(body) > 0 {
+		req.Header.Set(HeaderNameContentType, ContentTypeApplicationJson)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// any COSMID from the stock bank will do, they all resolve
+func testAdminCOSMID() (string, string) {
+	cosmids := make([]string, 0, len(SysBankIDs.Bank().Entries))
+	for cosmid := range SysBankIDs.Bank().Entries {
+		cosmids = append(cosmids, cosmid)
+	}
+	sort.Strings(cosmids)
+	return cosmids[0], SysBankIDs.Bank().Entries[cosmids[0]].CouchID
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func TestAdminJamMembership(t *testing.T) {
+
+	couch := useTestCouch(t)
+	router := newTestAdminServer(t, CosmServerJamData{})
+	cosmid, couchID := testAdminCOSMID()
+	if err := saveJamManifestData(cmdServeRootPath, &CosmServerJamData{
+		Private: []CosmServerJamDecl{{COSMID: cosmid, Name: "private", Members: []string{"carol"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	couch.addDoc("user_appdata$alice", "", nil)
+	couch.addDoc("user_appdata$carol", couchID, map[string]any{"type": "Band"})
+
+	members := func() []string {
+		t.Helper()
+		jamData, err := loadJamManifestData(cmdServeRootPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jamData.Private[0].Members
+	}
+
+	if recorder := serveAdmin(router, http.MethodGet, "/jams/"+cosmid+"/members", ""); recorder.Code != http.StatusOK || strings.TrimSpace(recorder.Body.String()) != `["carol"]` {
+		t.Errorf("member list: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// adding is idempotent, and needs the user to exist
+	for range 2 {
+		if recorder := serveAdmin(router, http.MethodPut, "/jams/"+cosmid+"/members/alice", ""); recorder.Code != http.StatusAccepted {
+			t.Errorf("add member: %d %s", recorder.Code, recorder.Body.String())
+		}
+	}
+	if got := members(); !slices.Equal(got, []string{"carol", "alice"}) {
+		t.Errorf("members after add: %v", got)
+	}
+	if recorder := serveAdmin(router, http.MethodPut, "/jams/"+cosmid+"/members/bob", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("add unknown user: %d", recorder.Code)
+	}
+	if recorder := serveAdmin(router, http.MethodPut, "/jams/jam_nope/members/alice", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("add to unknown jam: %d", recorder.Code)
+	}
+
+	// removing takes the jam off their My Jams too
+	if recorder := serveAdmin(router, http.MethodDelete, "/jams/"+cosmid+"/members/carol", ""); recorder.Code != http.StatusAccepted {
+		t.Errorf("remove member: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if couch.hasDoc("user_appdata$carol", couchID) {
+		t.Error("membership record wasn't removed")
+	}
+	// which is fine if it was never there
+	if recorder := serveAdmin(router, http.MethodDelete, "/jams/"+cosmid+"/members/alice", ""); recorder.Code != http.StatusAccepted {
+		t.Errorf("remove member without a record: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if got := members(); len(got) != 0 {
+		t.Errorf("members after remove: %v", got)
+	}
+	if recorder := serveAdmin(router, http.MethodGet, "/jams/jam_nope/members", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("unknown jam's members: %d", recorder.Code)
+	}
+}
+
+func TestAdminRiffDelete(t *testing.T) {
+
+	couch := useTestCouch(t)
+	router := newTestAdminServer(t, CosmServerJamData{})
+	couch.addDoc("user_appdata$alice", "riff1", map[string]any{"type": "Rifff", "userName": "alice"})
+	couch.addDoc("user_appdata$alice", "loop1", map[string]any{"type": "Loop"})
+
+	if recorder := serveAdmin(router, http.MethodDelete, "/jams/alice/riffs/riff1", ""); recorder.Code != http.StatusNoContent {
+		t.Errorf("delete riff: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if couch.hasDoc("user_appdata$alice", "riff1") {
+		t.Error("riff wasn't deleted")
+	}
+	if recorder := serveAdmin(router, http.MethodDelete, "/jams/alice/riffs/riff1", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("delete riff again: %d", recorder.Code)
+	}
+
+	// only riffs; loops are left for 'stems gc'
+	if recorder := serveAdmin(router, http.MethodDelete, "/jams/alice/riffs/loop1", ""); recorder.Code != http.StatusBadRequest {
+		t.Errorf("delete a loop: %d", recorder.Code)
+	}
+	if !couch.hasDoc("user_appdata$alice", "loop1") {
+		t.Error("loop was deleted")
+	}
+
+	if recorder := serveAdmin(router, http.MethodDelete, "/jams/jam_nope/riffs/riff1", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("unknown jam: %d", recorder.Code)
+	}
+
+	// mirrored jams are changed on the server they come from
+	cosmid, _ := testAdminCOSMID()
+	previousManifest := CurrentJamManifest.Load()
+	CurrentJamManifest.Store(&JamManifest{cosmidMirror: map[string]string{cosmid: "https://elsewhere.test"}})
+	t.Cleanup(func() { CurrentJamManifest.Store(previousManifest) })
+	if recorder := serveAdmin(router, http.MethodDelete, "/jams/"+cosmid+"/riffs/riff1", ""); recorder.Code != http.StatusConflict {
+		t.Errorf("mirrored jam: %d", recorder.Code)
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func resetAdminExportJobs(t *testing.T, export func(string, JamExportOptions) ([]string, error)) {
+	t.Helper()
+
+	adminExportJobs.mu.Lock()
+	defer adminExportJobs.mu.Unlock()
+	clear(adminExportJobs.jobs)
+	adminExportJobs.export = export
+	t.Cleanup(func() {
+		adminExportJobs.mu.Lock()
+		defer adminExportJobs.mu.Unlock()
+		clear(adminExportJobs.jobs)
+		adminExportJobs.export = exportJamToDisk
+	})
+}
+
+func TestRunAdminExportJob(t *testing.T) {
+
+	cases := []struct {
+		name      string
+		export    func(string, JamExportOptions) ([]string, error)
+		wantState AdminExportState
+		wantError string
+	}{
+		{"finished", func(string, JamExportOptions) ([]string, error) { return []string{"a.yaml", "a.tar"}, nil }, AdminExportDone, ""},
+		{"failed", func(string, JamExportOptions) ([]string, error) { return nil, errors.New("couch went away") }, AdminExportFailed, "couch went away"},
+		{"panicked", func(string, JamExportOptions) ([]string, error) { panic("index out of range") }, AdminExportFailed, "export panicked: index out of range"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetAdminExportJobs(t, tc.export)
+			job := &AdminExportJob{ID: "exp0001", Jam: "alice", State: AdminExportRunning}
+			adminExportJobs.jobs[job.ID] = job
+
+			runAdminExportJob(job, JamExportOptions{})
+
+			if job.State != tc.wantState || job.Error != tc.wantError || job.Finished == 0 {
+				t.Errorf("job: %+v", job)
+			}
+			if tc.wantState == AdminExportDone && len(job.Files) != 2 {
+				t.Errorf("files: %v", job.Files)
+			}
+		})
+	}
+}
+
+func TestAdminExportHandlers(t *testing.T) {
+
+	couch := useTestCouch(t)
+	router := newTestAdminServer(t, CosmServerJamData{})
+	couch.addDoc("user_appdata$alice", "", nil)
+	viper.Set(cConfigAdminExportDir, t.TempDir())
+	t.Cleanup(func() { viper.Set(cConfigAdminExportDir, "") })
+
+	// exports hang until told otherwise, so the job can be seen running
+	release := make(chan struct{})
+	resetAdminExportJobs(t, func(jam string, options JamExportOptions) ([]string, error) {
+		<-release
+		return []string{filepath.Join(options.OutputDir, jam+".yaml")}, nil
+	})
+
+	recorder := serveAdmin(router, http.MethodPost, "/exports", `{"jam":"alice","prefix":"test"}`)
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("start export: %d %s", recorder.Code, recorder.Body.String())
+	}
+	var started AdminExportJob
+	if err := json.NewDecoder(recorder.Body).Decode(&started); err != nil || started.State != AdminExportRunning {
+		t.Fatalf("started job: %+v, %v", started, err)
+	}
+
+	cases := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"already running", `{"jam":"alice","prefix":"test"}`, http.StatusConflict},
+		{"unknown jam", `{"jam":"nobody","prefix":"test"}`, http.StatusNotFound},
+		{"unknown COSMID", `{"jam":"jam_nope","prefix":"test"}`, http.StatusNotFound},
+		{"bad prefix", `{"jam":"alice","prefix":"no spaces"}`, http.StatusBadRequest},
+		{"unknown field", `{"jam":"alice","everything":true}`, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if recorder := serveAdmin(router, http.MethodPost, "/exports", tc.body); recorder.Code != tc.status {
+				t.Errorf("got %d, want %d: %s", recorder.Code, tc.status, recorder.Body.String())
+			}
+		})
+	}
+	req := httptest.NewRequest(http.MethodPost, "/exports", strings.NewReader(`{"jam":"alice"}`))
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("start without a JSON content type: %d", recorder.Code)
+	}
+
+	close(release)
+	var finished AdminExportJob
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		recorder = serveAdmin(router, http.MethodGet, "/exports/"+started.ID, "")
+		if recorder.Code != http.StatusOK || json.NewDecoder(recorder.Body).Decode(&finished) != nil {
+			t.Fatalf("get job: %d %s", recorder.Code, recorder.Body.String())
+		}
+		if finished.State != AdminExportRunning {
+			break
+		}
+	}
+	if finished.State != AdminExportDone || len(finished.Files) != 1 {
+		t.Errorf("finished job: %+v", finished)
+	}
+
+	recorder = serveAdmin(router, http.MethodGet, "/exports", "")
+	var jobs []AdminExportJob
+	if err := json.NewDecoder(recorder.Body).Decode(&jobs); err != nil || len(jobs) != 1 || jobs[0].ID != started.ID {
+		t.Errorf("job list: %s", recorder.Body.String())
+	}
+	if recorder = serveAdmin(router, http.MethodGet, "/exports/exp9999", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("unknown job: %d", recorder.Code)
+	}
+}
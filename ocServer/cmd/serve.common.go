@@ -8,12 +8,15 @@ package cmd
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path"
+	"slices"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kivik/kivik/v4"
@@ -43,13 +46,61 @@ type CosmServerJamDecl struct {
 	COSMID  string   `json:"cosmid"`
 	Name    string   `json:"name"`
 	Bio     string   `json:"bio"`
-	Members []string `json:"members"`
+	Members []string `json:"members,omitempty"`
+
+	Mirror *CosmServerJamMirror `json:"mirror,omitempty"` // public jams only; hosted on another server and pulled in read-only
 }
 type CosmServerJamData struct {
 	Public  []CosmServerJamDecl `json:"public"`
 	Private []CosmServerJamDecl `json:"private"`
 }
 
+// read and decode <root>/jams.json
+func loadJamManifestData(serverRootPath string) (*CosmServerJamData, error) {
+
+	manifestPath := path.Join(serverRootPath, "jams.json")
+	manifestJsonData, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to load jam manifest JSON [%s]", manifestPath), err)
+	}
+	var jamData CosmServerJamData
+	err = json.Unmarshal(manifestJsonData, &jamData)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to parse jam manifest JSON [%s]", manifestPath), err)
+	}
+	return &jamData, nil
+}
+
+// write <root>/jams.json back out, swapping the new file in whole so a failed write can't leave half a manifest behind
+func saveJamManifestData(serverRootPath string, jamData *CosmServerJamData) error {
+
+	manifestPath := path.Join(serverRootPath, "jams.json")
+	manifestJsonData, err := json.MarshalIndent(jamData, "", "    ")
+	if err != nil {
+		return err
+	}
+	manifestFile, err := os.CreateTemp(serverRootPath, "jams.*.json.partial")
+	if err != nil {
+		return errors.Join(fmt.Errorf("Unable to write jam manifest JSON [%s]", manifestPath), err)
+	}
+	defer os.Remove(manifestFile.Name())
+
+	_, err = manifestFile.Write(append(manifestJsonData, '\n'))
+	if err == nil {
+		err = manifestFile.Chmod(0644)
+	}
+	if closeErr := manifestFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(manifestFile.Name(), manifestPath)
+	}
+	if err != nil {
+		return errors.Join(fmt.Errorf("Unable to write jam manifest JSON [%s]", manifestPath), err)
+	}
+	return nil
+}
+
 // -----------------------------------------------------------------------------------------------------------------------------------
 // document format for the Profile record, a single document of id "Profile" that is used to identify a jam database to Studio;
 // these are kept in sync with data from jams.json each time the server boots
@@ -93,6 +144,8 @@ type JamManifest struct {
 	couchToName    map[string]string
 	cosmidToName   map[string]string
 	cosmidIsPublic map[string]bool
+	cosmidMirror   map[string]string // COSMID -> remote server, for mirrored jams
+	mirrorServers  []string          // every server we mirror from, unique
 }
 
 func (jman JamManifest) NameFromCouch(couchID string) (string, bool) {
@@ -107,6 +160,10 @@ func (jman JamManifest) COSMIDJamIsPublic(cosmid string) (bool, bool) {
 	result, ok := jman.cosmidIsPublic[cosmid]
 	return result, ok
 }
+func (jman JamManifest) MirrorFromCOSMID(cosmid string) (string, bool) {
+	result, ok := jman.cosmidMirror[cosmid]
+	return result, ok
+}
 func (jman JamManifest) NumberOfCOSMIDs() int {
 	return len(jman.cosmidToName)
 }
@@ -118,8 +175,8 @@ func (jman JamManifest) GetCOSMIDS() []string {
 	return keys
 }
 
-// our current stack of known jams
-var CurrentJamManifest *JamManifest
+// our current stack of known jams; swapped whole when jams.json is reloaded, so take one Load() per request and work from that
+var CurrentJamManifest atomic.Pointer[JamManifest]
 
 // -----------------------------------------------------------------------------------------------------------------------------------
 func getCosmServerExternalHost() string {
@@ -132,14 +189,14 @@ func getCosmServerExternalHost() string {
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------
-// run each time the server boots - process data from the jams.json manifest; do boot-time checks, refresh profiles, etc
-func performJamPreflight(couchClient *kivik.Client, jamDecl CosmServerJamDecl, isPublic bool, jamManifest *JamManifest) *JamCuratedData {
+// run each time the server boots or reloads jams.json - process data from the jams.json manifest; do checks, refresh profiles, etc
+func performJamPreflight(couchClient *kivik.Client, jamDecl CosmServerJamDecl, isPublic bool, jamManifest *JamManifest) (*JamCuratedData, error) {
 
 	idBank := SysBankIDs.Bank()
 
 	lutID, ok := idBank.Entries[jamDecl.COSMID]
 	if !ok {
-		SysLog.Fatal("Unable to resolve COSMID to Endlesss jam IDs", zap.String("COSMID", jamDecl.COSMID))
+		return nil, fmt.Errorf("Unable to resolve COSMID [%s] to Endlesss jam IDs", jamDecl.COSMID)
 	}
 
 	SysLog.Info("Registering Jam",
@@ -149,15 +206,36 @@ func performJamPreflight(couchClient *kivik.Client, jamDecl CosmServerJamDecl, i
 		zap.String("CouchID", lutID.CouchID),
 	)
 
+	// mirrored jams are set up from the remote instead; name and bio in jams.json only stand in until its Profile arrives
+	if jamDecl.Mirror != nil {
+		if !isPublic {
+			return nil, fmt.Errorf("Only public jams can be mirrored [%s]", jamDecl.COSMID)
+		}
+		remoteProfile, err := performMirroredJamPreflight(couchClient, jamDecl, lutID.CouchID)
+		if err != nil {
+			return nil, err
+		}
+		if remoteProfile != nil && len(remoteProfile.DisplayName) > 0 {
+			jamDecl.Name = remoteProfile.DisplayName
+			jamDecl.Bio = remoteProfile.Bio
+		}
+
+		jamManifest.cosmidMirror[jamDecl.COSMID] = jamDecl.Mirror.Server
+		if !slices.Contains(jamManifest.mirrorServers, jamDecl.Mirror.Server) {
+			jamManifest.mirrorServers = append(jamManifest.mirrorServers, jamDecl.Mirror.Server)
+		}
+		return finishJamPreflight(jamDecl, lutID.LongID, lutID.CouchID, isPublic, jamManifest), nil
+	}
+
 	// check to see if the jam database exists yet - if not, ask for a new one
 	jamExists, err := doesJamDatabaseExist(couchClient, lutID.CouchID)
 	if err != nil {
-		SysLog.Fatal("Fatal error checking jam database state", zap.String("COSMID", jamDecl.COSMID), zap.Error(err))
+		return nil, errors.Join(fmt.Errorf("Error checking jam database state [%s]", jamDecl.COSMID), err)
 	}
 	if !jamExists {
 		err = createDefaultPublicJamDatabase(couchClient, lutID.CouchID)
 		if err != nil {
-			SysLog.Fatal("Fatal error creating new jam", zap.String("COSMID", jamDecl.COSMID), zap.Error(err))
+			return nil, errors.Join(fmt.Errorf("Error creating new jam [%s]", jamDecl.COSMID), err)
 		}
 	}
 
@@ -170,26 +248,26 @@ func performJamPreflight(couchClient *kivik.Client, jamDecl CosmServerJamDecl, i
 	avatarImageToPath := path.Join(path.Join(cmdServeRootPath, "avatars"), lutID.CouchID)
 	err = flop.SimpleCopy(avatarImageFromPath, avatarImageToPath)
 	if err != nil {
-		SysLog.Fatal("Jam avatar copy error", zap.String("COSMID", jamDecl.COSMID), zap.Error(err))
+		return nil, errors.Join(fmt.Errorf("Jam avatar copy error [%s]", jamDecl.COSMID), err)
 	}
 
 	// snag the file stat for the jam avatar, we'll use that for the creation time
 	avatarInfo, err := os.Stat(avatarImageFromPath)
 	if err != nil {
-		SysLog.Fatal("Jam avatar stat() error", zap.String("COSMID", jamDecl.COSMID), zap.Error(err))
+		return nil, errors.Join(fmt.Errorf("Jam avatar stat() error [%s]", jamDecl.COSMID), err)
 	}
 
 	// check on the database entry for this jam - and update the Profile document automatically each time with
 	// any name/bio changes .. this also checks that the database exists etc
 	jamDb := couchClient.DB(fmt.Sprintf("user_appdata$%s", lutID.CouchID))
 	if jamDb.Err() != nil {
-		SysLog.Fatal("Error checking jam database", zap.String("COSMID", jamDecl.COSMID), zap.String("CouchID", lutID.CouchID), zap.Error(jamDb.Err()))
+		return nil, errors.Join(fmt.Errorf("Error checking jam database [%s] [%s]", jamDecl.COSMID, lutID.CouchID), jamDb.Err())
 	}
 	// pull the current Profile doc
 	var currentJamProfile JamDatabaseProfileUpdate
 	err = jamDb.Get(context.TODO(), "Profile").ScanDoc(&currentJamProfile)
 	if err != nil {
-		SysLog.Fatal("Unable to fetch jam Profile document", zap.String("COSMID", jamDecl.COSMID), zap.String("CouchID", lutID.CouchID), zap.Error(err))
+		return nil, errors.Join(fmt.Errorf("Unable to fetch jam Profile document [%s] [%s]", jamDecl.COSMID, lutID.CouchID), err)
 	}
 	// if we have new data to write in, go update that document
 	if currentJamProfile.DisplayName != jamDecl.Name || currentJamProfile.Bio != jamDecl.Bio {
@@ -205,56 +283,66 @@ func performJamPreflight(couchClient *kivik.Client, jamDecl CosmServerJamDecl, i
 
 		_, err = jamDb.Put(context.TODO(), "Profile", currentJamProfile)
 		if err != nil {
-			SysLog.Fatal("Unable to update jam Profile document", zap.String("COSMID", jamDecl.COSMID), zap.Error(err))
+			return nil, errors.Join(fmt.Errorf("Unable to update jam Profile document [%s]", jamDecl.COSMID), err)
 		}
 	}
 
 	// for private jams, update member records to add them to the users' My Jams lists
 	if !isPublic {
-		for _, v := range jamDecl.Members {
-			userDb := couchClient.DB(fmt.Sprintf("user_appdata$%s", v))
+		addJamMembershipRecords(couchClient, jamDecl, lutID.CouchID)
+	}
 
-			existingMembership := &JamMembershipRecord{}
-			err = userDb.Get(context.TODO(), lutID.CouchID).ScanDoc(existingMembership)
+	return finishJamPreflight(jamDecl, lutID.LongID, lutID.CouchID, isPublic, jamManifest), nil
+}
 
-			// no error - means the document already exists, nothing for us to do
-			if err == nil {
-				continue
-			}
+// make sure each declared member of a private jam has the membership record that puts it in their My Jams list
+func addJamMembershipRecords(couchClient *kivik.Client, jamDecl CosmServerJamDecl, couchID string) {
+	for _, v := range jamDecl.Members {
+		userDb := couchClient.DB(fmt.Sprintf("user_appdata$%s", v))
+
+		existingMembership := &JamMembershipRecord{}
+		err := userDb.Get(context.TODO(), couchID).ScanDoc(existingMembership)
 
-			// kind of stupid, we have to check on strings to discover what *kind* of missing doc we fail to find?
-			if strings.Contains(err.Error(), "Not Found: missing") {
-				// user exists, membership doesn't
-				SysLog.Info("Adding membership document", zap.String("COSMID", jamDecl.COSMID), zap.String("Username", v))
-
-				newMembership := JamMembershipRecord{
-					JoinDate:    time.Now().UnixMilli(),
-					JoinDateISO: time.Now().Format(time.RFC3339),
-					Lists:       []string{"myJams"},
-					Type:        "Band",
-				}
-				_, err = userDb.Put(context.TODO(), lutID.CouchID, newMembership)
-				if err != nil {
-					SysLog.Error("Unable to insert membership document", zap.String("COSMID", jamDecl.COSMID), zap.String("Username", v), zap.Error(err))
-				}
-
-			} else if strings.Contains(err.Error(), "Not Found: Database does not exist") {
-				// user doesn't exist
-				SysLog.Error("User does not exist", zap.String("COSMID", jamDecl.COSMID), zap.String("Username", v))
+		// no error - means the document already exists, nothing for us to do
+		if err == nil {
+			continue
+		}
+
+		// kind of stupid, we have to check on strings to discover what *kind* of missing doc we fail to find?
+		if strings.Contains(err.Error(), "Not Found: missing") {
+			// user exists, membership doesn't
+			SysLog.Info("Adding membership document", zap.String("COSMID", jamDecl.COSMID), zap.String("Username", v))
+
+			newMembership := JamMembershipRecord{
+				JoinDate:    time.Now().UnixMilli(),
+				JoinDateISO: time.Now().Format(time.RFC3339),
+				Lists:       []string{"myJams"},
+				Type:        "Band",
+			}
+			_, err = userDb.Put(context.TODO(), couchID, newMembership)
+			if err != nil {
+				SysLog.Error("Unable to insert membership document", zap.String("COSMID", jamDecl.COSMID), zap.String("Username", v), zap.Error(err))
 			}
+
+		} else if strings.Contains(err.Error(), "Not Found: Database does not exist") {
+			// user doesn't exist
+			SysLog.Error("User does not exist", zap.String("COSMID", jamDecl.COSMID), zap.String("Username", v))
 		}
 	}
+}
+
+// register the jam in the manifest and produce its data block in a format for Studio, if this jam is being returned to the user
+func finishJamPreflight(jamDecl CosmServerJamDecl, longID string, couchID string, isPublic bool, jamManifest *JamManifest) *JamCuratedData {
 
-	// final data block in a format for Studio, if this jam is being returned to the user
 	entry := JamCuratedData{}
-	entry.JamLongID = lutID.LongID
-	entry.JamCouchID = lutID.CouchID
+	entry.JamLongID = longID
+	entry.JamCouchID = couchID
 	entry.Bio = jamDecl.Bio
 	entry.JamName = jamDecl.Name
-	entry.ImageURL = fmt.Sprintf("%s/api/v3/image/avatars/%s", getCosmServerExternalHost(), lutID.CouchID)
+	entry.ImageURL = fmt.Sprintf("%s/api/v3/image/avatars/%s", getCosmServerExternalHost(), couchID)
 	entry.Members = jamDecl.Members
 
-	jamManifest.couchToName[lutID.CouchID] = jamDecl.Name
+	jamManifest.couchToName[couchID] = jamDecl.Name
 	jamManifest.cosmidToName[jamDecl.COSMID] = jamDecl.Name
 	jamManifest.cosmidIsPublic[jamDecl.COSMID] = isPublic
 
@@ -262,21 +350,23 @@ func performJamPreflight(couchClient *kivik.Client, jamDecl CosmServerJamDecl, i
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------
-// take in the jams.json manifest file and process it into internal datasets
-func constructJamManifestFromData(jamData CosmServerJamData) *JamManifest {
+// take in the jams.json manifest file and process it into internal datasets; nothing global is touched, so a reload that
+// fails part way can be thrown away and the server carries on with what it had
+func constructJamManifestFromData(jamData CosmServerJamData) (*JamManifest, *JamCuratedResponse, error) {
 
 	manifestResult := JamManifest{}
 	manifestResult.couchToName = make(map[string]string)
 	manifestResult.cosmidToName = make(map[string]string)
 	manifestResult.cosmidIsPublic = make(map[string]bool)
+	manifestResult.cosmidMirror = make(map[string]string)
 
-	publicJamsResponse = new(JamCuratedResponse)
-	publicJamsResponse.Okay = true
+	publicJams := new(JamCuratedResponse)
+	publicJams.Okay = true
 
 	// ring up couch, we will do some validation of databases while we load this gunk
 	couchClient, err := connectToCouchDB()
 	if err != nil {
-		SysLog.Fatal("Connection to CouchDB failed", zap.Error(err))
+		return nil, nil, errors.Join(fmt.Errorf("Connection to CouchDB failed"), err)
 	}
 	defer couchClient.Close()
 
@@ -285,14 +375,19 @@ func constructJamManifestFromData(jamData CosmServerJamData) *JamManifest {
 
 	SysLog.Info("Preflight - Public")
 	for _, v := range jamData.Public {
-		entry := performJamPreflight(couchClient, v, true, &manifestResult)
-		publicJamsResponse.Data = append(publicJamsResponse.Data, *entry)
+		entry, err := performJamPreflight(couchClient, v, true, &manifestResult)
+		if err != nil {
+			return nil, nil, err
+		}
+		publicJams.Data = append(publicJams.Data, *entry)
 
 		joinablePublicBandIds = append(joinablePublicBandIds, entry.JamCouchID)
 	}
 	SysLog.Info("Preflight - Private")
 	for _, v := range jamData.Private {
-		performJamPreflight(couchClient, v, false, &manifestResult)
+		if _, err := performJamPreflight(couchClient, v, false, &manifestResult); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	// sort the list of public IDs to try and keep them stable across runs
@@ -302,34 +397,32 @@ func constructJamManifestFromData(jamData CosmServerJamData) *JamManifest {
 	// the public IDs returned by /jam/curated otherwise Endlesss will display the publics but not allow you to actually enter one
 	accExists, err := doesDatabaseExist(couchClient, CouchKnownDatabase_AppClientConfig)
 	if err != nil {
-		SysLog.Fatal("Failed to examine app client config database", zap.Error(err))
+		return nil, nil, errors.Join(fmt.Errorf("Failed to examine app client config database"), err)
+	}
+	if !accExists {
+		// eventually - fully build and populate the ACC
+		return nil, nil, fmt.Errorf("App client config database does not exist, Couch needs configuring")
 	}
-	if accExists {
-
-		accDb := couchClient.DB(CouchKnownDatabase_AppClientConfig)
 
-		// read out the current joinable document to see if we need to update it
-		var currentBandsJoinable AppClientConfigBandsUpdate
-		err = accDb.Get(context.TODO(), CouchKnownDocument_BandsJoinable).ScanDoc(&currentBandsJoinable)
-		if err != nil {
-			SysLog.Fatal("Unable to fetch bands:joinable document for update", zap.Error(err))
-		}
+	accDb := couchClient.DB(CouchKnownDatabase_AppClientConfig)
 
-		// embed current state
-		currentBandsJoinable.Joinable = true
-		currentBandsJoinable.BandIDs = joinablePublicBandIds
-		currentBandsJoinable.BannerImage = fmt.Sprintf("%s/static/cosm_banner_mobile.jpg", getCosmServerExternalHost())
-		currentBandsJoinable.DesktopBannerImage = fmt.Sprintf("%s/static/cosm_banner_desktop.jpg", getCosmServerExternalHost())
+	// read out the current joinable document to see if we need to update it
+	var currentBandsJoinable AppClientConfigBandsUpdate
+	err = accDb.Get(context.TODO(), CouchKnownDocument_BandsJoinable).ScanDoc(&currentBandsJoinable)
+	if err != nil {
+		return nil, nil, errors.Join(fmt.Errorf("Unable to fetch bands:joinable document for update"), err)
+	}
 
-		_, err = accDb.Put(context.TODO(), CouchKnownDocument_BandsJoinable, currentBandsJoinable)
-		if err != nil {
-			SysLog.Fatal("Unable to update bands:joinable document", zap.Error(err))
-		}
+	// embed current state
+	currentBandsJoinable.Joinable = true
+	currentBandsJoinable.BandIDs = joinablePublicBandIds
+	currentBandsJoinable.BannerImage = fmt.Sprintf("%s/static/cosm_banner_mobile.jpg", getCosmServerExternalHost())
+	currentBandsJoinable.DesktopBannerImage = fmt.Sprintf("%s/static/cosm_banner_desktop.jpg", getCosmServerExternalHost())
 
-	} else {
-		// eventually - fully build and populate the ACC
-		SysLog.Fatal("App client config database does not exist, Couch needs configuring")
+	_, err = accDb.Put(context.TODO(), CouchKnownDocument_BandsJoinable, currentBandsJoinable)
+	if err != nil {
+		return nil, nil, errors.Join(fmt.Errorf("Unable to update bands:joinable document"), err)
 	}
 
-	return &manifestResult
+	return &manifestResult, publicJams, nil
 }
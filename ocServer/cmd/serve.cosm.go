@@ -21,11 +21,13 @@ type StatusResponse struct {
 	MostRecentPublicJamChangeText string `json:"mostRecentPublicJamChangeText"` // Humanize'd version of MostRecentPublicJamChange
 	MostRecentPublicJamUser       string `json:"mostRecentPublicJamUser"`       // username from last contribution
 	MostRecentPublicJamName       string `json:"mostRecentPublicJamName"`       // name of the jam most recently updated
+
+	Replication *ReplicationSummary `json:"replication,omitempty"` // standby CouchDB health and lag, if replication is configured
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------
-// an endpoint used by the cosm client to check if a server is alive, what it thinks the time is, things of that nature
-func HandlerCosmStatus(httpResponse http.ResponseWriter, r *http.Request) {
+// current server status, as returned by /cosm/v1/status and sent along with master server heartbeats
+func buildCosmStatus() StatusResponse {
 
 	latestJamData := publicJamsLatestData{}
 	{
@@ -42,9 +44,14 @@ func HandlerCosmStatus(httpResponse http.ResponseWriter, r *http.Request) {
 		humanize.Time(time.Unix(0, latestJamData.LastChangeTimestamp*int64(1000000))),
 		latestJamData.LastChangeUser,
 		latestJamData.LastChangeJam,
+		getLatestReplicationSummary(),
 	}
+	return statusResponse
+}
 
-	handlerEmitJson(httpResponse, statusResponse)
+// an endpoint used by the cosm client to check if a server is alive, what it thinks the time is, things of that nature
+func HandlerCosmStatus(httpResponse http.ResponseWriter, r *http.Request) {
+	handlerEmitJson(httpResponse, buildCosmStatus())
 }
 
 type CosmidManifestEntry struct {
@@ -52,6 +59,7 @@ type CosmidManifestEntry struct {
 	CDB      string `json:"couch"`
 	Name     string `json:"name"`
 	IsPublic bool   `json:"is_public"`
+	Mirror   string `json:"mirror,omitempty"` // remote server a mirrored jam is pulled from
 }
 type CosmidManifestResponse struct {
 	Count int                   `json:"count"`
@@ -61,22 +69,25 @@ type CosmidManifestResponse struct {
 // -----------------------------------------------------------------------------------------------------------------------------------
 func HandlerCosmManifest(httpResponse http.ResponseWriter, r *http.Request) {
 
+	// one snapshot for the whole response, a reload may swap the manifest out underneath us
+	jamManifest := CurrentJamManifest.Load()
+
 	var manifestResponse CosmidManifestResponse
-	manifestResponse.Count = CurrentJamManifest.NumberOfCOSMIDs()
+	manifestResponse.Count = jamManifest.NumberOfCOSMIDs()
 	manifestResponse.Data = make([]CosmidManifestEntry, 0, manifestResponse.Count)
 
 	SysLog.Info("Manifest requested", zap.String("RemoteAddr", r.RemoteAddr), zap.Int("Count", manifestResponse.Count))
 
-	cosmidList := CurrentJamManifest.GetCOSMIDS()
+	cosmidList := jamManifest.GetCOSMIDS()
 	idBank := SysBankIDs.Bank()
 
 	for _, cosmid := range cosmidList {
-		cosmidName, ok := CurrentJamManifest.NameFromCOSMID(cosmid)
+		cosmidName, ok := jamManifest.NameFromCOSMID(cosmid)
 		if !ok {
 			SysLog.Info("Manifest error", zap.String("COSMID", cosmid))
 			break
 		}
-		cosmidPublic, ok := CurrentJamManifest.COSMIDJamIsPublic(cosmid)
+		cosmidPublic, ok := jamManifest.COSMIDJamIsPublic(cosmid)
 		if !ok {
 			SysLog.Info("Manifest public check error", zap.String("COSMID", cosmid))
 			break
@@ -88,7 +99,9 @@ func HandlerCosmManifest(httpResponse http.ResponseWriter, r *http.Request) {
 			break
 		}
 
-		manifestResponse.Data = append(manifestResponse.Data, CosmidManifestEntry{cosmid, couchCID.CouchID, cosmidName, cosmidPublic})
+		cosmidMirror, _ := jamManifest.MirrorFromCOSMID(cosmid)
+
+		manifestResponse.Data = append(manifestResponse.Data, CosmidManifestEntry{cosmid, couchCID.CouchID, cosmidName, cosmidPublic, cosmidMirror})
 	}
 
 	handlerEmitJson(httpResponse, manifestResponse)
@@ -0,0 +1,120 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// zip exports are encrypted with whatever is passed in this header; kept out of the query string so it doesn't end up in logs
+const cExportStreamPasswordHeader string = "X-Archive-Password"
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// stream a jam export straight down the wire as a single archive, eg.
+//
+//	GET /cosm/v1/<api-prefix>/export/jam_001?format=tar.zst&prefix=csmx&ignore-missing=true
+func HandlerCosmExportStream(httpResponse http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	jamToExport := vars["jam"]
+
+	query := r.URL.Query()
+
+	formatName := query.Get("format")
+	if len(formatName) == 0 {
+		formatName = string(JamArchiveTarZstd)
+	}
+	archiveFormat, err := parseJamArchiveFormat(formatName)
+	if err != nil {
+		http.Error(httpResponse, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	archivePassword := r.Header.Get(cExportStreamPasswordHeader)
+	if archiveFormat == JamArchiveZip && len(archivePassword) == 0 {
+		http.Error(httpResponse, "zip exports need a "+cExportStreamPasswordHeader+" header", http.StatusBadRequest)
+		return
+	}
+
+	serverPrefix := query.Get("prefix")
+	if len(serverPrefix) == 0 {
+		serverPrefix = viper.GetString(cConfigCosmFourCC)
+	}
+	if err := validateServerNamePrefix(serverPrefix); err != nil {
+		http.Error(httpResponse, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the export path bails out hard on a COSMID it doesn't know, so check everything resolves before we get there
+	exportCouchID, _, err := resolveJamCouchID(jamToExport)
+	if err != nil {
+		http.Error(httpResponse, err.Error(), http.StatusNotFound)
+		return
+	}
+	{
+		couchClient, err := connectToCouchDB()
+		if err != nil {
+			http.Error(httpResponse, "Database unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		jamExists, err := doesJamDatabaseExist(couchClient, exportCouchID)
+		couchClient.Close()
+		if err != nil || !jamExists {
+			http.Error(httpResponse, fmt.Sprintf("jam [%s] not found", jamToExport), http.StatusNotFound)
+			return
+		}
+	}
+
+	plan, err := prepareJamStream(jamToExport, JamStreamOptions{
+		ServerNamePrefix:    serverPrefix,
+		IgnoreMissingStems:  query.Get("ignore-missing") == "true",
+		StemDownloadWorkers: cStemDownloadDefaultWorkers,
+		StemDownloadRetries: cStemDownloadDefaultRetries,
+		Format:              archiveFormat,
+		Password:            archivePassword,
+	})
+	if err != nil {
+		SysLog.Error("Export stream preparation failed", zap.String("Jam", jamToExport), zap.Error(err))
+		http.Error(httpResponse, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	SysLog.Info("Export stream requested", zap.String("RemoteAddr", r.RemoteAddr), zap.String("Jam", jamToExport), zap.String("File", plan.FileName))
+
+	httpResponse.Header().Set("Content-Type", archiveFormat.ContentType())
+	httpResponse.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", plan.FileName))
+	httpResponse.Header().Set("Content-Encoding", "identity") // already compressed, stop the gzip middleware having another go
+	httpResponse.WriteHeader(http.StatusOK)
+
+	// headers are gone by now, so all we can do with a failure is cut the stream short and log it
+	if err = plan.Write(httpResponse); err != nil {
+		SysLog.Error("Export stream failed", zap.String("Jam", jamToExport), zap.Error(err))
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// the server-wide write timeout is far too short for streaming a whole jam; lift it for the export endpoint. this has to sit
+// outside negroni as its ResponseWriter wrapper hides the deadline controls from the handler
+type exportStreamDeadline struct {
+	next         http.Handler
+	exportPrefix string
+}
+
+func (h *exportStreamDeadline) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, h.exportPrefix) {
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+			SysLog.Warn("Unable to lift write deadline for export stream", zap.Error(err))
+		}
+	}
+	h.next.ServeHTTP(w, r)
+}
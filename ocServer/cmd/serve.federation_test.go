@@ -0,0 +1,301 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// the parts of a remote OUROCOSM server that mirroring talks to over HTTP; Couch replication itself is CouchDB's job
+type testMirrorRemote struct {
+	server        *httptest.Server
+	profiles      map[string]AccountsProfileData
+	avatar        []byte
+	profileHits   atomic.Int32
+	couchHomeHost string
+}
+
+func newTestMirrorRemote(t *testing.T) *testMirrorRemote {
+	t.Helper()
+
+	remote := &testMirrorRemote{
+		profiles:      map[string]AccountsProfileData{},
+		couchHomeHost: "couch.remote.test:5984",
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/auth/login", func(w http.ResponseWriter, r *http.Request) {
+		var login AuthLoginRequest
+		if json.NewDecoder(r.Body).Decode(&login) != nil || login.Username != "mirror" || login.Password != "hunter2" {
+			http.Error(w, "nope", http.StatusUnauthorized)
+			return
+		}
+		handlerEmitJson(w, AuthLoginResponse{
+			Password: "couch-token",
+			UserDBs:  AuthLoginUserDB{AppData: "http://mirror:couch-token@" + remote.couchHomeHost + "/user_appdata$mirror"},
+		})
+	}).Methods("POST")
+	router.HandleFunc("/api/v3/image/avatars/{couchID}", func(w http.ResponseWriter, r *http.Request) {
+		if remote.avatar == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(remote.avatar)
+	})
+	router.HandleFunc("/accounts/{name}/profile", func(w http.ResponseWriter, r *http.Request) {
+		remote.profileHits.Add(1)
+		profile, ok := remote.profiles[mux.Vars(r)["name"]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		handlerEmitJson(w, AccountsProfileResponse{Data: profile})
+	})
+
+	remote.server = httptest.NewServer(router)
+	t.Cleanup(remote.server.Close)
+	return remote
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func TestLoginToMirrorServer(t *testing.T) {
+
+	remote := newTestMirrorRemote(t)
+
+	cases := []struct {
+		name     string
+		mirror   CosmServerJamMirror
+		wantURL  string
+		wantFail bool
+	}{
+		{"couch from login", CosmServerJamMirror{Server: remote.server.URL + "/", User: "mirror", Login: "hunter2"}, "http://couch.remote.test:5984", false},
+		{"couch override", CosmServerJamMirror{Server: remote.server.URL, User: "mirror", Login: "hunter2", Couch: "https://couch.internal:6984"}, "https://couch.internal:6984", false},
+		{"bad login", CosmServerJamMirror{Server: remote.server.URL, User: "mirror", Login: "wrong"}, "", true},
+		{"no server", CosmServerJamMirror{Server: "http://127.0.0.1:1", User: "mirror", Login: "hunter2"}, "", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			endpoint, err := loginToMirrorServer(&tc.mirror)
+			if tc.wantFail {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", endpoint)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if endpoint.URL != tc.wantURL {
+				t.Errorf("couch URL: got %s, want %s", endpoint.URL, tc.wantURL)
+			}
+			// replication authenticates as the mirror user with the Couch password handed out at login, not the API login
+			if endpoint.Auth.Basic.Username != "mirror" || endpoint.Auth.Basic.Password != "couch-token" {
+				t.Errorf("couch auth: got %+v", endpoint.Auth.Basic)
+			}
+		})
+	}
+
+	remote.couchHomeHost = ""
+	if _, err := loginToMirrorServer(&CosmServerJamMirror{Server: remote.server.URL, User: "mirror", Login: "hunter2"}); err == nil {
+		t.Error("expected an error when the login hands out no couch address")
+	}
+}
+
+func TestFetchMirrorAvatar(t *testing.T) {
+
+	remote := newTestMirrorRemote(t)
+	mirror := &CosmServerJamMirror{Server: remote.server.URL}
+
+	previousRoot := cmdServeRootPath
+	cmdServeRootPath = t.TempDir()
+	t.Cleanup(func() { cmdServeRootPath = previousRoot })
+	if err := os.MkdirAll(path.Join(cmdServeRootPath, "avatars"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	avatarPath := path.Join(cmdServeRootPath, "avatars", "bandcsmxjam001")
+
+	remote.avatar = []byte("remote avatar")
+	if err := fetchMirrorAvatar(mirror, "bandcsmxjam001"); err != nil {
+		t.Fatal(err)
+	}
+	if avatar, err := os.ReadFile(avatarPath); err != nil || string(avatar) != "remote avatar" {
+		t.Errorf("avatar: %q, %v", avatar, err)
+	}
+
+	// a remote without one leaves ours alone
+	remote.avatar = nil
+	if err := fetchMirrorAvatar(mirror, "bandcsmxjam001"); err == nil {
+		t.Error("expected an error for a missing remote avatar")
+	}
+	if avatar, err := os.ReadFile(avatarPath); err != nil || string(avatar) != "remote avatar" {
+		t.Errorf("avatar after failed fetch: %q, %v", avatar, err)
+	}
+	if leftovers, _ := os.ReadDir(path.Dir(avatarPath)); len(leftovers) != 1 {
+		t.Errorf("fetch left %d files in avatars", len(leftovers))
+	}
+}
+
+func resetFederatedProfiles() {
+	federatedProfiles.mu.Lock()
+	defer federatedProfiles.mu.Unlock()
+	federatedProfiles.lru.Init()
+	clear(federatedProfiles.entries)
+	federatedProfiles.lookups = cFederatedProfileLookupBurst
+	federatedProfiles.lookupsAdded = time.Time{}
+}
+
+func TestFetchFederatedProfile(t *testing.T) {
+
+	deadRemote := newTestMirrorRemote(t)
+	deadRemote.server.Close()
+	firstRemote := newTestMirrorRemote(t)
+	secondRemote := newTestMirrorRemote(t)
+	secondRemote.profiles["carol"] = AccountsProfileData{Biography: "from the second server", AvatarUrl: secondRemote.server.URL + "/api/v3/image/avatars/carol"}
+
+	previousManifest := CurrentJamManifest.Load()
+	CurrentJamManifest.Store(&JamManifest{mirrorServers: []string{deadRemote.server.URL, firstRemote.server.URL, secondRemote.server.URL}})
+	t.Cleanup(func() { CurrentJamManifest.Store(previousManifest) })
+
+	resetFederatedProfiles()
+
+	// servers are asked in turn, skipping ones that are down or don't know the user
+	profile, err := fetchFederatedProfile("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Data.Biography != "from the second server" || profile.Data.AvatarUrl != secondRemote.server.URL+"/api/v3/image/avatars/carol" {
+		t.Errorf("profile: %+v", profile.Data)
+	}
+
+	// then remembered, found or not
+	if _, err = fetchFederatedProfile("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fetchFederatedProfile("nobody"); err == nil {
+		t.Error("expected an error for an unknown user")
+	}
+	if _, err = fetchFederatedProfile("nobody"); err == nil {
+		t.Error("expected an error for an unknown user")
+	}
+	if hits := secondRemote.profileHits.Load(); hits != 2 {
+		t.Errorf("second server asked %d times, want 2", hits)
+	}
+
+	CurrentJamManifest.Store(&JamManifest{})
+	if _, err = fetchFederatedProfile("carol"); err == nil {
+		t.Error("expected an error with no mirror servers")
+	}
+}
+
+// anyone can ask for any name, so what's remembered and how often the mirrors are asked are both bounded
+func TestFederatedProfileLimits(t *testing.T) {
+
+	remote := newTestMirrorRemote(t)
+	remote.profiles["carol"] = AccountsProfileData{Biography: "remote"}
+
+	previousManifest := CurrentJamManifest.Load()
+	CurrentJamManifest.Store(&JamManifest{mirrorServers: []string{remote.server.URL}})
+	t.Cleanup(func() { CurrentJamManifest.Store(previousManifest) })
+	resetFederatedProfiles()
+	t.Cleanup(resetFederatedProfiles)
+
+	if _, err := fetchFederatedProfile("carol"); err != nil {
+		t.Fatal(err)
+	}
+	// a run of made-up names uses up the lookups, then gets turned away without asking the mirror
+	for i := 1; i < cFederatedProfileLookupBurst; i++ {
+		fetchFederatedProfile(fmt.Sprintf("nobody%d", i))
+	}
+	if _, err := fetchFederatedProfile("one-too-many"); !errors.Is(err, errFederatedProfileLookupLimit) {
+		t.Errorf("expected the lookup limit, got %v", err)
+	}
+	if hits := remote.profileHits.Load(); hits != cFederatedProfileLookupBurst {
+		t.Errorf("mirror asked %d times, want %d", hits, cFederatedProfileLookupBurst)
+	}
+	// names already known are still answered
+	if _, err := fetchFederatedProfile("carol"); err != nil {
+		t.Errorf("cached profile during the limit: %v", err)
+	}
+
+	// lookups come back over time
+	federatedProfiles.mu.Lock()
+	federatedProfiles.lookupsAdded = federatedProfiles.lookupsAdded.Add(-2 * cFederatedProfileLookupInterval)
+	federatedProfiles.mu.Unlock()
+	if _, err := fetchFederatedProfile("one-too-many"); errors.Is(err, errFederatedProfileLookupLimit) {
+		t.Error("lookup still refused after the interval")
+	}
+
+	// and the least recently asked for names make way once the cache is full
+	federatedProfiles.mu.Lock()
+	for i := range cFederatedProfileCacheSize {
+		username := fmt.Sprintf("filler%d", i)
+		federatedProfiles.entries[username] = federatedProfiles.lru.PushBack(&federatedProfileEntry{username: username, fetched: time.Now()})
+	}
+	federatedProfiles.lookups = cFederatedProfileLookupBurst
+	federatedProfiles.mu.Unlock()
+	if _, err := fetchFederatedProfile("newcomer"); err == nil {
+		t.Error("expected an error for an unknown user")
+	}
+	federatedProfiles.mu.Lock()
+	defer federatedProfiles.mu.Unlock()
+	if len(federatedProfiles.entries) != cFederatedProfileCacheSize || federatedProfiles.lru.Len() != cFederatedProfileCacheSize {
+		t.Errorf("holding %d names", len(federatedProfiles.entries))
+	}
+	if _, ok := federatedProfiles.entries["newcomer"]; !ok {
+		t.Error("newest name wasn't kept")
+	}
+	if _, ok := federatedProfiles.entries[fmt.Sprintf("filler%d", cFederatedProfileCacheSize-1)]; ok {
+		t.Error("least recently used name wasn't dropped")
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// log into a second, real OUROCOSM server as a mirror would; skipped unless one is named, eg. another local 'serve' with
+//
+//	OUROCOSM_TEST_MIRROR_SERVER=http://localhost:23001 OUROCOSM_TEST_MIRROR_USER=mirror OUROCOSM_TEST_MIRROR_LOGIN=...
+//
+// the full round trip is then two servers, the second's jams.json declaring a public jam of the first's with a "mirror" block
+func TestMirrorAgainstSecondServer(t *testing.T) {
+
+	server := os.Getenv("OUROCOSM_TEST_MIRROR_SERVER")
+	if len(server) == 0 {
+		t.Skip("OUROCOSM_TEST_MIRROR_SERVER not set")
+	}
+	mirror := &CosmServerJamMirror{
+		Server: server,
+		User:   os.Getenv("OUROCOSM_TEST_MIRROR_USER"),
+		Login:  os.Getenv("OUROCOSM_TEST_MIRROR_LOGIN"),
+	}
+
+	endpoint, err := loginToMirrorServer(mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoint.URL) == 0 || len(endpoint.Auth.Basic.Password) == 0 {
+		t.Errorf("login gave no usable couch endpoint: %+v", endpoint)
+	}
+
+	resp, err := federationHttpClient.Get(server + "/cosm/v1/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status StatusResponse
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&status) != nil || !status.Awake {
+		t.Errorf("second server status: %s", resp.Status)
+	}
+}
@@ -7,7 +7,6 @@ package cmd
 
 import (
 	"crypto/subtle"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
@@ -44,7 +43,6 @@ func HandlerDefault(httpResponse http.ResponseWriter, r *http.Request) {
 
 // -----------------------------------------------------------------------------------------------------------------------------------
 var SecuredApiCredentials map[string]string
-var ShadowbannedUserMap map[string]bool
 
 // simple security gateway around chosen API endpoints, uses user/pass as given by config api-auth table
 // intention being that we might have trusted tools working with some of those endpoints, keep them tucked away from scraping/casual abuse
@@ -72,15 +70,39 @@ func SecuredApiAuth(next http.Handler) http.Handler {
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------
-func runCosmServer() {
+func runCosmServer(stemStore *BuiltinStemStore, stemCache *StemCache) {
 
 	// launch the background jam state worker routine
 	bgJamWorker := make(chan struct{}, 1)
 	go backgroundJamStateUpdater(bgJamWorker)
 	defer close(bgJamWorker)
 
+	// .. and the one that keeps the storage report and quotas up to date
+	bgStorageWorker := make(chan struct{})
+	go backgroundStorageUpdater(bgStorageWorker)
+	defer close(bgStorageWorker)
+
+	// .. and, with a standby configured, the one watching replication
+	if isReplicationEnabled() {
+		bgReplicationWorker := make(chan struct{})
+		go backgroundReplicationMonitor(bgReplicationWorker)
+		defer close(bgReplicationWorker)
+	}
+
 	router := mux.NewRouter()
 
+	// .. and, if we're to be listed on a master server, the one sending heartbeats
+	if isMasterListingEnabled() {
+		listingKey, listing, err := prepareMasterListing()
+		if err != nil {
+			SysLog.Fatal("Unable to set up master server listing", zap.Error(err))
+		}
+		router.HandleFunc(cMasterListingKeyPath, newListingKeyHandler(listingKey)).Methods("GET") // lets the master check our heartbeats are ours
+		bgListingWorker := make(chan struct{})
+		go backgroundMasterListing(listingKey, *listing, bgListingWorker)
+		defer close(bgListingWorker)
+	}
+
 	// some api functions are tucked away behind a server-side prefix with basic authentication
 	apiPrefix := viper.GetString(cConfigCosmAPIPrefix)
 	SecuredApiCredentials = viper.GetStringMapString(cConfigCosmAPIAuth)
@@ -89,11 +111,8 @@ func runCosmServer() {
 	}
 
 	// load list of users that don't get to see public jams
-	ShadowbannedUserMap = make(map[string]bool)
-	ShadowbannedUsers := viper.GetStringSlice(cConfigCosmShadowban)
-	for _, v := range ShadowbannedUsers {
-		SysLog.Info("Shadowbanned : ", zap.String("Username", v))
-		ShadowbannedUserMap[v] = true
+	if err := loadShadowbans(); err != nil {
+		SysLog.Fatal("Unable to load shadowbans", zap.Error(err))
 	}
 
 	// authentication
@@ -139,7 +158,12 @@ func runCosmServer() {
 
 	// custom bits that we want locked behind some kind of path obfuscation + user/pass visibility
 	securedApi := router.PathPrefix(fmt.Sprintf("/cosm/v1/%s", apiPrefix)).Subrouter()
-	securedApi.HandleFunc("/manifest", HandlerCosmManifest).Methods("GET") // return base details about COSMIDs in use
+	securedApi.HandleFunc("/manifest", HandlerCosmManifest).Methods("GET")         // return base details about COSMIDs in use
+	securedApi.HandleFunc("/export/{jam}", HandlerCosmExportStream).Methods("GET") // stream a jam out as a single archive
+	securedApi.HandleFunc("/storage", HandlerCosmStorage).Methods("GET")           // per-user stem storage and quota warnings
+
+	// .. and the admin API; users, jams, memberships, shadowbans, exports (see serve.admin.openapi.yaml)
+	registerAdminApi(securedApi)
 	securedApi.Use(SecuredApiAuth)
 
 	// static data handling for avatars or generic images
@@ -160,8 +184,13 @@ func runCosmServer() {
 
 	cosmAddressInternal := fmt.Sprintf("%s:%s", viper.GetString(cConfigCosmInternalHost), viper.GetString(cConfigCosmInternalPort))
 
+	var cosmHandler http.Handler = &exportStreamDeadline{next: n, exportPrefix: fmt.Sprintf("/cosm/v1/%s/export/", apiPrefix)}
+	if stemCache != nil {
+		cosmHandler = &stemCacheRoute{next: cosmHandler, cache: stemCache}
+	}
+
 	var httpServer = &http.Server{
-		Handler:      n,
+		Handler:      cosmHandler,
 		WriteTimeout: time.Second * 5,
 		ReadTimeout:  time.Second * 5,
 		IdleTimeout:  time.Second * 10,
@@ -171,6 +200,17 @@ func runCosmServer() {
 	SysLog.Info(fmt.Sprintf("Launching API server on %s", cosmAddressInternal))
 	SysLog.Info(fmt.Sprintf("External API address is %s", getCosmServerExternalHost()))
 	ctx := graceful.NotifyShutdown()
+
+	// optional built-in stem store, on its own port
+	if stemStore != nil {
+		stemStoreServer := newBuiltinStemStoreServer(stemStore)
+		go func() {
+			if err := graceful.ListenAndServe(ctx, stemStoreServer, 60*time.Second); err != nil {
+				SysLog.Error("stem store error during shutdown", zap.Error(err))
+			}
+		}()
+	}
+
 	err := graceful.ListenAndServe(ctx, httpServer, 60*time.Second)
 	if err != nil {
 		SysLog.Error("error during shutdown", zap.Error(err))
@@ -220,26 +260,52 @@ var serveCmd = &cobra.Command{
 		}
 
 		// fetch the jam mapping data from disk (also therefore checks the chosen root path out)
-		manifestPath := path.Join(cmdServeRootPath, "jams.json")
-		manifestJsonData, err := os.ReadFile(manifestPath)
+		jamData, err := loadJamManifestData(cmdServeRootPath)
 		if err != nil {
-			SysLog.Fatal("Unable to load jam manifest JSON", zap.Error(err), zap.String("Path", manifestPath))
+			SysLog.Fatal("Unable to load jam manifest", zap.Error(err))
 		}
-		var jamData CosmServerJamData
-		err = json.Unmarshal(manifestJsonData, &jamData)
+
+		// utilise that loaded jam manifest; anything wrong with it at boot is fatal
+		jamManifest, publicJams, err := constructJamManifestFromData(*jamData)
 		if err != nil {
-			SysLog.Fatal("Unable to parse jam manifest JSON", zap.Error(err), zap.String("Path", manifestPath))
+			SysLog.Fatal("Unable to process jam manifest", zap.Error(err))
 		}
-
-		// utilise that loaded jam manifest
-		CurrentJamManifest = constructJamManifestFromData(jamData)
+		CurrentJamManifest.Store(jamManifest)
+		publicJamsResponse = publicJams
 
 		// populate the jam manifest cache with the latest riff data to begin with; this can then be updated
 		// in the background every so often
 		collectPublicJamStates(true)
 
+		// bring up the built-in stem store if one is configured, and make sure Studio is told to use it
+		var stemStore *BuiltinStemStore
+		if isBuiltinStemStoreEnabled() {
+			stemStore, err = newBuiltinStemStoreFromConfig()
+			if err != nil {
+				SysLog.Fatal("Unable to configure built-in stem store", zap.Error(err))
+			}
+			couchClient, err := connectToCouchDB()
+			if err != nil {
+				SysLog.Fatal("Connection to CouchDB failed", zap.Error(err))
+			}
+			err = publishBuiltinStemStoreEndpoint(couchClient)
+			couchClient.Close()
+			if err != nil {
+				SysLog.Fatal("Unable to publish built-in stem store as the S3 endpoint", zap.Error(err))
+			}
+		}
+
+		// optional read-through cache in front of the stem store, served at /stems/
+		var stemCache *StemCache
+		if isStemCacheEnabled() {
+			stemCache, err = newStemCacheFromConfig()
+			if err != nil {
+				SysLog.Fatal("Unable to configure stem cache", zap.Error(err))
+			}
+		}
+
 		// lets go!
-		runCosmServer()
+		runCosmServer(stemStore, stemCache)
 	},
 }
 
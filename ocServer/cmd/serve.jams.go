@@ -174,8 +174,7 @@ func HandlerJamCurated(httpResponse http.ResponseWriter, r *http.Request) {
 		http.Error(httpResponse, err.Error(), http.StatusForbidden)
 		return
 	}
-	_, isUserShadowbanned := ShadowbannedUserMap[authUsername]
-	if isUserShadowbanned {
+	if isUserShadowbanned(authUsername) {
 		SysLog.Info("ShadowBanned " + authUsername)
 
 		var convertedMemberships []JamCuratedData
@@ -264,6 +263,7 @@ func HandlerJamMyJams(httpResponse http.ResponseWriter, r *http.Request) {
 	}
 
 	var convertedMemberships []JamCuratedData
+	jamManifest := CurrentJamManifest.Load()
 
 	// expand those singular couch IDs into more fully formed data to return back
 	for _, v := range memberships {
@@ -273,7 +273,7 @@ func HandlerJamMyJams(httpResponse http.ResponseWriter, r *http.Request) {
 			SysLog.Error("[MyJams] Failed to resolve long ID for couch ID", zap.String("CouchID", v.ID))
 			continue
 		}
-		jamName, nameOK := CurrentJamManifest.NameFromCouch(v.ID)
+		jamName, nameOK := jamManifest.NameFromCouch(v.ID)
 		if !nameOK {
 			SysLog.Error("[MyJams] Unknown CouchID passed to NameFromCouch()", zap.String("CouchID", v.ID))
 			continue
@@ -50,7 +50,7 @@ func HandlerListenLink(httpResponse http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jamName, nameOK := CurrentJamManifest.NameFromCouch(sourceCouchId)
+	jamName, nameOK := CurrentJamManifest.Load().NameFromCouch(sourceCouchId)
 	if !nameOK {
 		SysLog.Error("Unknown CouchID passed to NameFromCouch()", zap.String("CouchID", sourceCouchId))
 		http.Error(httpResponse, "Jam name not found", http.StatusBadRequest)
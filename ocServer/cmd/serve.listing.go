@@ -0,0 +1,150 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// per ourocosm.server.yaml
+const cConfigListingMaster string = "listing.master"            // master server to register with, eg. "https://master.example.org:27100"
+const cConfigListingKey string = "listing.key"                  // heartbeat signing key file, created on first run
+const cConfigListingDisplayName string = "listing.display-name" //
+const cConfigListingDisplayBio string = "listing.display-bio"   //
+const cConfigListingDisplayGeo string = "listing.display-geo"   //
+const cConfigListingInterval string = "listing.interval"        // time between heartbeats
+
+const cListingDefaultInterval = 5 * time.Minute
+
+func isMasterListingEnabled() bool {
+	return len(viper.GetString(cConfigListingMaster)) > 0
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// how clients should reach us, from the cosm and couchDB external settings
+func buildMasterServerListing() (*MasterServerListing, error) {
+
+	apiPort, err := strconv.Atoi(viper.GetString(cConfigCosmExternalPort))
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a port number to register with a master server", cConfigCosmExternalPort)
+	}
+	dbPort, err := strconv.Atoi(viper.GetString(cConfigCouchExternalPort))
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a port number to register with a master server", cConfigCouchExternalPort)
+	}
+	displayName := viper.GetString(cConfigListingDisplayName)
+	if len(displayName) == 0 {
+		return nil, fmt.Errorf("%s is needed to register with a master server", cConfigListingDisplayName)
+	}
+
+	return &MasterServerListing{
+		DisplayName: displayName,
+		DisplayBio:  viper.GetString(cConfigListingDisplayBio),
+		DisplayGeo:  viper.GetString(cConfigListingDisplayGeo),
+		Scheme:      viper.GetString(cConfigCosmScheme),
+		Host:        viper.GetString(cConfigCosmExternalHost),
+		ApiPort:     apiPort,
+		DbPort:      dbPort,
+	}, nil
+}
+
+// load the signing key and work out our listing, ready for backgroundMasterListing
+func prepareMasterListing() (ed25519.PrivateKey, *MasterServerListing, error) {
+
+	keyPath := viper.GetString(cConfigListingKey)
+	if len(keyPath) == 0 {
+		keyPath = path.Join(cmdServeRootPath, "listing.key")
+	}
+	privateKey, err := loadOrCreateMasterKey(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	listing, err := buildMasterServerListing()
+	if err != nil {
+		return nil, nil, err
+	}
+	return privateKey, listing, nil
+}
+
+// GET /cosm/v1/listing-key; the master fetches this from the address we claim before listing us there
+func newListingKeyHandler(privateKey ed25519.PrivateKey) http.HandlerFunc {
+	listingKey := MasterListingKey{PublicKey: encodeMasterPublicKey(privateKey)}
+	return func(httpResponse http.ResponseWriter, r *http.Request) {
+		handlerEmitJson(httpResponse, listingKey)
+	}
+}
+
+// sign and send one heartbeat
+func sendMasterHeartbeat(privateKey ed25519.PrivateKey, listing MasterServerListing) error {
+
+	heartbeatBody, err := json.Marshal(MasterHeartbeat{
+		Timestamp: time.Now().Unix(),
+		PublicKey: encodeMasterPublicKey(privateKey),
+		Server:    listing,
+		Status:    buildCosmStatus(),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(viper.GetString(cConfigListingMaster), "/")+"/master/v1/heartbeat", bytes.NewReader(heartbeatBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(HeaderNameContentType, ContentTypeApplicationJson)
+	req.Header.Set(cMasterSignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, heartbeatBody)))
+
+	resp, err := federationHttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("master server refused heartbeat, %s", resp.Status)
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// goroutine worker that keeps us on the master server's list
+func backgroundMasterListing(privateKey ed25519.PrivateKey, listing MasterServerListing, chanStopWork <-chan struct{}) {
+
+	interval := viper.GetDuration(cConfigListingInterval)
+	if interval <= 0 {
+		interval = cListingDefaultInterval
+	}
+	SysLog.Info("backgroundMasterListing launched", zap.String("Master", viper.GetString(cConfigListingMaster)), zap.Duration("Interval", interval))
+
+	registered := false
+	for {
+		err := sendMasterHeartbeat(privateKey, listing)
+		if err != nil {
+			SysLog.Warn("[Listing] heartbeat failed", zap.Error(err))
+		} else if !registered {
+			SysLog.Info("[Listing] registered with master server", zap.String("Address", listing.Address()))
+		}
+		registered = err == nil
+
+		select {
+		case <-chanStopWork:
+			SysLog.Info("closing background master listing worker")
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -7,11 +7,13 @@ package cmd
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
 
+	kivik "github.com/go-kivik/kivik/v4"
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 )
@@ -75,6 +77,18 @@ func genericProfileResponse(profileName string, httpResponse http.ResponseWriter
 	defer couchClient.Close()
 
 	userExtras, err := fetchUserExtrasFromCouch(couchClient, profileName)
+	if err != nil && kivik.HTTPStatus(err) == http.StatusNotFound {
+		// not one of ours; might be someone riffing in a jam we mirror from another server
+		federatedProfile, federatedErr := fetchFederatedProfile(profileName)
+		if federatedErr == nil {
+			handlerEmitJson(httpResponse, federatedProfile)
+			return
+		}
+		if errors.Is(federatedErr, errFederatedProfileLookupLimit) {
+			http.Error(httpResponse, federatedErr.Error(), http.StatusTooManyRequests)
+			return
+		}
+	}
 	if err != nil {
 		SysLog.Error("Unable to fetch userdata", zap.Error(err), zap.String("User", profileName))
 		http.Error(httpResponse, "Database read failure", http.StatusInternalServerError)
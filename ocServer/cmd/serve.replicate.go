@@ -0,0 +1,72 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const cReplicationMonitorInterval = 30 * time.Second
+
+// latest replication summary, handed out by the status endpoint
+type latestReplicationSummary struct {
+	summary *ReplicationSummary
+	mu      sync.Mutex
+}
+
+var replicationSummaryLatest latestReplicationSummary
+
+func getLatestReplicationSummary() *ReplicationSummary {
+	replicationSummaryLatest.mu.Lock()
+	defer replicationSummaryLatest.mu.Unlock()
+	return replicationSummaryLatest.summary
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// goroutine worker that syncs the replication jobs once on launch, to catch anything created while we weren't looking,
+// then polls the scheduler for how far behind the standby is
+func backgroundReplicationMonitor(chanStopWork <-chan struct{}) {
+
+	SysLog.Info("backgroundReplicationMonitor launched")
+
+	couchClient, err := connectToCouchDB()
+	if err != nil {
+		SysLog.Error("[Replication] Connection to CouchDB failed", zap.Error(err))
+		return
+	}
+	defer couchClient.Close()
+
+	report, err := syncReplicationJobs(couchClient, false)
+	if err != nil {
+		SysLog.Error("[Replication] sync failed", zap.Error(err))
+	} else {
+		SysLog.Info("[Replication] jobs synced", zap.Int("Databases", report.Databases), zap.Int("Written", len(report.Created)), zap.Int("Failed", len(report.Failed)))
+	}
+
+	for {
+		_, summary, err := fetchReplicationStatus(couchClient)
+		if err != nil {
+			SysLog.Error("[Replication] status check failed", zap.Error(err))
+		} else {
+			if !summary.OK() {
+				SysLog.Warn("[Replication] standby is not healthy", zap.Int("Missing", summary.Missing), zap.Int("Failing", summary.Failing), zap.Int64("ChangesPending", summary.ChangesPending))
+			}
+			replicationSummaryLatest.mu.Lock()
+			replicationSummaryLatest.summary = summary
+			replicationSummaryLatest.mu.Unlock()
+		}
+
+		select {
+		case <-chanStopWork:
+			SysLog.Info("closing background replication monitor")
+			return
+		case <-time.After(cReplicationMonitorInterval):
+		}
+	}
+}
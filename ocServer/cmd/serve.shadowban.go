@@ -0,0 +1,144 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// users that don't get to see public jams; some come from cosm.shadowban in the config, the rest are added through the
+// admin API and kept in <root>/shadowban.json so they survive a restart
+type ShadowbanEntry struct {
+	User   string `json:"user"`
+	Source string `json:"source"` // "config" or "api"
+}
+
+var shadowbans = struct {
+	fromConfig map[string]bool
+	fromApi    map[string]bool
+	mu         sync.Mutex
+}{}
+
+// bans from the config file can only be lifted by editing it
+var errShadowbanInConfig = fmt.Errorf("shadowbanned in the server config (%s), lift it there", cConfigCosmShadowban)
+
+func getShadowbanFilePath() string {
+	return path.Join(cmdServeRootPath, "shadowban.json")
+}
+
+func loadShadowbans() error {
+
+	shadowbans.mu.Lock()
+	defer shadowbans.mu.Unlock()
+
+	shadowbans.fromConfig = make(map[string]bool)
+	for _, v := range viper.GetStringSlice(cConfigCosmShadowban) {
+		SysLog.Info("Shadowbanned : ", zap.String("Username", v))
+		shadowbans.fromConfig[v] = true
+	}
+
+	shadowbans.fromApi = make(map[string]bool)
+	shadowbanJson, err := os.ReadFile(getShadowbanFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	var apiUsers []string
+	if err == nil {
+		err = json.Unmarshal(shadowbanJson, &apiUsers)
+	}
+	if err != nil {
+		return errors.Join(fmt.Errorf("Unable to load shadowban list [%s]", getShadowbanFilePath()), err)
+	}
+	for _, v := range apiUsers {
+		SysLog.Info("Shadowbanned : ", zap.String("Username", v))
+		shadowbans.fromApi[v] = true
+	}
+	return nil
+}
+
+// call with mu held
+func saveShadowbans() error {
+
+	apiUsers := make([]string, 0, len(shadowbans.fromApi))
+	for v := range shadowbans.fromApi {
+		apiUsers = append(apiUsers, v)
+	}
+	sort.Strings(apiUsers)
+
+	shadowbanJson, _ := json.MarshalIndent(apiUsers, "", "  ")
+	return os.WriteFile(getShadowbanFilePath(), shadowbanJson, 0644)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func isUserShadowbanned(username string) bool {
+	shadowbans.mu.Lock()
+	defer shadowbans.mu.Unlock()
+
+	return shadowbans.fromConfig[username] || shadowbans.fromApi[username]
+}
+
+func listShadowbans() []ShadowbanEntry {
+	shadowbans.mu.Lock()
+	defer shadowbans.mu.Unlock()
+
+	entries := []ShadowbanEntry{}
+	for v := range shadowbans.fromConfig {
+		entries = append(entries, ShadowbanEntry{User: v, Source: "config"})
+	}
+	for v := range shadowbans.fromApi {
+		if !shadowbans.fromConfig[v] {
+			entries = append(entries, ShadowbanEntry{User: v, Source: "api"})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].User < entries[j].User })
+	return entries
+}
+
+// returns false if the user was already shadowbanned
+func addShadowban(username string) (bool, error) {
+	shadowbans.mu.Lock()
+	defer shadowbans.mu.Unlock()
+
+	if shadowbans.fromConfig[username] || shadowbans.fromApi[username] {
+		return false, nil
+	}
+	shadowbans.fromApi[username] = true
+	if err := saveShadowbans(); err != nil {
+		delete(shadowbans.fromApi, username)
+		return false, errors.Join(fmt.Errorf("Unable to write shadowban list"), err)
+	}
+	SysLog.Info("Shadowbanned : ", zap.String("Username", username))
+	return true, nil
+}
+
+func removeShadowban(username string) error {
+	shadowbans.mu.Lock()
+	defer shadowbans.mu.Unlock()
+
+	if shadowbans.fromConfig[username] {
+		return errShadowbanInConfig
+	}
+	if !shadowbans.fromApi[username] {
+		return nil
+	}
+	delete(shadowbans.fromApi, username)
+	if err := saveShadowbans(); err != nil {
+		shadowbans.fromApi[username] = true
+		return errors.Join(fmt.Errorf("Unable to write shadowban list"), err)
+	}
+	SysLog.Info("Shadowban lifted", zap.String("Username", username))
+	return nil
+}
@@ -0,0 +1,470 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"container/list"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// serve can front the stem store with /stems/<key>, fetching through a size-limited disk cache so clients and tools on the
+// near side of a slow or awkwardly-named S3 host only pay for each stem once. the cache is read-only, and as /stems/ takes no
+// login it only hands out keys some Loop document's cdn_attachments points at, unless the source is public-read anyway
+//
+//	<root>/<xx>/<sha256 of key>          cached object data
+//	<root>/<xx>/<sha256 of key>.json     the key, size and ETag that go with it
+//	<root>/.partial/                     fetches in progress
+//
+// least-recently-used entries are evicted once the total goes over max-size; use order survives restarts via the data files'
+// modification times
+const cConfigStemCacheRoot string = "stemcache.root"                     // setting this turns the cache on
+const cConfigStemCacheMaxSize string = "stemcache.max-size"              // eg. "20GB"
+const cConfigStemCacheSource string = "stemcache.source"                 // stem server to fetch from, as per --stem; defaults to the s3 store
+const cConfigStemCacheMaxObjectSize string = "stemcache.max-object-size" // eg. "256MB", anything bigger is refused rather than cached
+const cConfigStemCachePublicRead string = "stemcache.public-read"        // serve any key the source has, not just referenced ones
+const cStemCacheDefaultMaxSize int64 = 10 * 1024 * 1024 * 1024           //
+const cStemCacheDefaultMaxObjectSize int64 = 256 * 1024 * 1024           //
+const cStemCacheRoutePrefix string = "/stems/"
+const cStemCachePartialDir string = ".partial"
+const cStemCacheTouchInterval = time.Minute         // don't rewrite mtimes on every hit
+const cStemCacheReferenceRefresh = 30 * time.Second // how often unknown keys may trigger a rescan of the jams
+
+var errStemCacheObjectTooLarge = errors.New("stem is larger than the cache's object size limit")
+
+type stemCacheEntry struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	ETag     string    `json:"etag"`
+	Fetched  time.Time `json:"fetched"`
+	LastUsed time.Time `json:"-"`
+	dataPath string
+}
+
+// a fetch in progress, so concurrent misses on the same key wait on one download rather than all starting their own
+type stemCacheFetch struct {
+	done  chan struct{}
+	entry *stemCacheEntry
+	err   error
+}
+
+type StemCache struct {
+	root           string
+	maxBytes       int64
+	maxObjectBytes int64
+	source         *StemStore
+	lock           sync.Mutex
+	entries        map[string]*list.Element // key -> element in lru, holding a *stemCacheEntry
+	lru            *list.List               // most recently used at the front
+	totalBytes     int64
+	fetches        map[string]*stemCacheFetch
+	hits           int64
+	misses         int64
+
+	publicRead         bool
+	listReferencedKeys func() (map[string]bool, error) // every stem key the jams point at, without the leading /
+	referenceLock      sync.RWMutex                    // guards referencedKeys and referencesLoaded
+	refreshLock        sync.Mutex                      // one rescan at a time
+	referencedKeys     map[string]bool
+	referencesLoaded   time.Time
+}
+
+func isStemCacheEnabled() bool {
+	return len(viper.GetString(cConfigStemCacheRoot)) > 0
+}
+
+func newStemCacheFromConfig() (*StemCache, error) {
+
+	source, err := resolveStemStore(viper.GetString(cConfigStemCacheSource))
+	if err != nil {
+		return nil, err
+	}
+	if source == nil {
+		return nil, fmt.Errorf("the stem cache needs %s or an s3 store to fetch from", cConfigStemCacheSource)
+	}
+
+	maxBytes := cStemCacheDefaultMaxSize
+	if viper.IsSet(cConfigStemCacheMaxSize) {
+		maxBytes = int64(viper.GetSizeInBytes(cConfigStemCacheMaxSize))
+	}
+	maxObjectBytes := min(cStemCacheDefaultMaxObjectSize, maxBytes)
+	if viper.IsSet(cConfigStemCacheMaxObjectSize) {
+		maxObjectBytes = int64(viper.GetSizeInBytes(cConfigStemCacheMaxObjectSize))
+	}
+
+	cache, err := newStemCache(viper.GetString(cConfigStemCacheRoot), maxBytes, maxObjectBytes, source)
+	if err != nil {
+		return nil, err
+	}
+	cache.publicRead = viper.GetBool(cConfigStemCachePublicRead)
+	cache.listReferencedKeys = func() (map[string]bool, error) {
+		couchClient, err := connectToCouchDB()
+		if err != nil {
+			return nil, err
+		}
+		defer couchClient.Close()
+		referencedKeys, _, err := collectReferencedStemKeys(couchClient)
+		return referencedKeys, err
+	}
+
+	SysLog.Info("Stem cache ready",
+		zap.String("Root", cache.root),
+		zap.String("Source", source.ObjectURL("")),
+		zap.Int("Entries", len(cache.entries)),
+		zap.Int64("Bytes", cache.totalBytes),
+		zap.Int64("MaxBytes", cache.maxBytes),
+		zap.Int64("MaxObjectBytes", cache.maxObjectBytes),
+		zap.Bool("PublicRead", cache.publicRead),
+	)
+	return cache, nil
+}
+
+func newStemCache(root string, maxBytes int64, maxObjectBytes int64, source *StemStore) (*StemCache, error) {
+
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("%s must be greater than zero", cConfigStemCacheMaxSize)
+	}
+	if maxObjectBytes <= 0 || maxObjectBytes > maxBytes {
+		return nil, fmt.Errorf("%s must be greater than zero and no more than %s", cConfigStemCacheMaxObjectSize, cConfigStemCacheMaxSize)
+	}
+
+	cache := &StemCache{
+		root:           root,
+		maxBytes:       maxBytes,
+		maxObjectBytes: maxObjectBytes,
+		source:         source,
+		entries:        make(map[string]*list.Element),
+		lru:            list.New(),
+		fetches:        make(map[string]*stemCacheFetch),
+	}
+
+	partialRoot := filepath.Join(cache.root, cStemCachePartialDir)
+	os.RemoveAll(partialRoot)
+	if err := os.MkdirAll(partialRoot, os.ModePerm); err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to create stem cache directory [%s]", partialRoot), err)
+	}
+	if err := cache.load(); err != nil {
+		return nil, errors.Join(fmt.Errorf("Unable to read stem cache [%s]", cache.root), err)
+	}
+	cache.lock.Lock()
+	cache.evict()
+	cache.lock.Unlock()
+
+	return cache, nil
+}
+
+func (cache *StemCache) pathsForKey(key string) (string, string) {
+	keyHash := sha256.Sum256([]byte(key))
+	keyHex := hex.EncodeToString(keyHash[:])
+	dataPath := filepath.Join(cache.root, keyHex[0:2], keyHex)
+	return dataPath, dataPath + ".json"
+}
+
+// pick up whatever a previous run left behind, most recently used at the front
+func (cache *StemCache) load() error {
+
+	loaded := []*stemCacheEntry{}
+	err := filepath.WalkDir(cache.root, func(filePath string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == cStemCachePartialDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(filePath, ".json") {
+			return nil
+		}
+
+		dataPath := strings.TrimSuffix(filePath, ".json")
+		entryJson, err := os.ReadFile(filePath)
+		var entry stemCacheEntry
+		if err == nil {
+			err = json.Unmarshal(entryJson, &entry)
+		}
+		var dataInfo os.FileInfo
+		if err == nil {
+			dataInfo, err = os.Stat(dataPath)
+		}
+		if err != nil || dataInfo.Size() != entry.Size {
+			// half-written or damaged, let it be fetched again
+			os.Remove(filePath)
+			os.Remove(dataPath)
+			return nil
+		}
+		entry.dataPath = dataPath
+		entry.LastUsed = dataInfo.ModTime()
+		loaded = append(loaded, &entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].LastUsed.After(loaded[j].LastUsed) })
+	for _, entry := range loaded {
+		cache.entries[entry.Key] = cache.lru.PushBack(entry)
+		cache.totalBytes += entry.Size
+	}
+	return nil
+}
+
+// drop least-recently-used entries until we're back under the limit; call with the lock held
+func (cache *StemCache) evict() {
+	for cache.totalBytes > cache.maxBytes && cache.lru.Len() > 1 {
+		entry := cache.lru.Remove(cache.lru.Back()).(*stemCacheEntry)
+		delete(cache.entries, entry.Key)
+		cache.totalBytes -= entry.Size
+
+		// anyone still streaming this entry keeps their open handle
+		if err := os.Remove(entry.dataPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			SysLog.Warn("[StemCache] Unable to evict", zap.String("Key", entry.Key), zap.Error(err))
+		}
+		os.Remove(entry.dataPath + ".json")
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// pull an object from the source into the cache
+func (cache *StemCache) download(key string) (*stemCacheEntry, error) {
+
+	req, err := cache.source.NewRequest(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cache.source.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &stemDownloadStatusError{StatusCode: resp.StatusCode}
+	}
+	if resp.ContentLength > cache.maxObjectBytes {
+		return nil, errStemCacheObjectTooLarge
+	}
+
+	partialFile, err := os.CreateTemp(filepath.Join(cache.root, cStemCachePartialDir), "fetch-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(partialFile.Name())
+
+	md5Hash := md5.New()
+	// read one byte past the limit, so a source that doesn't send a length can't fill the disk either
+	size, err := io.Copy(io.MultiWriter(partialFile, md5Hash), io.LimitReader(resp.Body, cache.maxObjectBytes+1))
+	if closeErr := partialFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size > cache.maxObjectBytes {
+		return nil, errStemCacheObjectTooLarge
+	}
+	if resp.ContentLength >= 0 && size != resp.ContentLength {
+		return nil, fmt.Errorf("stem fetch size mismatch, got %d, expected %d", size, resp.ContentLength)
+	}
+
+	dataPath, metaPath := cache.pathsForKey(key)
+	entry := &stemCacheEntry{
+		Key:      key,
+		Size:     size,
+		ETag:     fmt.Sprintf("\"%s\"", hex.EncodeToString(md5Hash.Sum(nil))),
+		Fetched:  time.Now().UTC(),
+		LastUsed: time.Now(),
+		dataPath: dataPath,
+	}
+	entryJson, _ := json.Marshal(entry)
+
+	if err = os.MkdirAll(filepath.Dir(dataPath), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(partialFile.Name(), dataPath); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(metaPath, entryJson, 0644); err != nil {
+		os.Remove(dataPath)
+		return nil, err
+	}
+	return entry, nil
+}
+
+// is this key one a jam points at; unknown keys rescan the jams, but no more often than cStemCacheReferenceRefresh so
+// a stream of made-up keys can't keep Couch busy
+func (cache *StemCache) isReferenced(key string) (bool, error) {
+
+	if cache.publicRead {
+		return true, nil
+	}
+
+	cache.referenceLock.RLock()
+	referenced := cache.referencedKeys[key]
+	cache.referenceLock.RUnlock()
+	if referenced {
+		return true, nil
+	}
+
+	cache.refreshLock.Lock()
+	defer cache.refreshLock.Unlock()
+
+	// someone else may have rescanned while we waited
+	cache.referenceLock.RLock()
+	referenced = cache.referencedKeys[key]
+	loaded := cache.referencesLoaded
+	cache.referenceLock.RUnlock()
+	if referenced || (!loaded.IsZero() && time.Since(loaded) < cStemCacheReferenceRefresh) {
+		return referenced, nil
+	}
+
+	referencedKeys, err := cache.listReferencedKeys()
+	if err != nil {
+		return false, err
+	}
+	cache.referenceLock.Lock()
+	cache.referencedKeys = referencedKeys
+	cache.referencesLoaded = time.Now()
+	cache.referenceLock.Unlock()
+
+	return referencedKeys[key], nil
+}
+
+// find a key in the cache, fetching it if we don't have it yet
+func (cache *StemCache) lookup(key string) (*stemCacheEntry, error) {
+
+	cache.lock.Lock()
+	if element, ok := cache.entries[key]; ok {
+		cache.lru.MoveToFront(element)
+		entry := element.Value.(*stemCacheEntry)
+		cache.hits++
+		if time.Since(entry.LastUsed) > cStemCacheTouchInterval {
+			entry.LastUsed = time.Now()
+			os.Chtimes(entry.dataPath, entry.LastUsed, entry.LastUsed)
+		}
+		cache.lock.Unlock()
+		return entry, nil
+	}
+	if inFlight, ok := cache.fetches[key]; ok {
+		cache.lock.Unlock()
+		<-inFlight.done
+		return inFlight.entry, inFlight.err
+	}
+	fetch := &stemCacheFetch{done: make(chan struct{})}
+	cache.fetches[key] = fetch
+	cache.misses++
+	cache.lock.Unlock()
+
+	fetch.entry, fetch.err = cache.download(key)
+
+	cache.lock.Lock()
+	delete(cache.fetches, key)
+	if fetch.err == nil {
+		cache.entries[key] = cache.lru.PushFront(fetch.entry)
+		cache.totalBytes += fetch.entry.Size
+		cache.evict()
+	}
+	cache.lock.Unlock()
+	close(fetch.done)
+
+	return fetch.entry, fetch.err
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// GET / HEAD /stems/<key>; ranges, If-None-Match and friends are all handled by ServeContent against our ETag
+func (cache *StemCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, cStemCacheRoutePrefix)
+	if len(key) == 0 || path.Clean("/"+key) != "/"+key {
+		http.Error(w, "Bad stem key", http.StatusBadRequest)
+		return
+	}
+
+	// the source is fetched from with our credentials, so it's only asked for stems the jams actually use
+	referenced, err := cache.isReferenced(key)
+	if err != nil {
+		SysLog.Error("[StemCache] Unable to check stem references", zap.Error(err))
+		http.Error(w, "Stem references unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if !referenced {
+		http.Error(w, "Stem not found", http.StatusNotFound)
+		return
+	}
+
+	entry, err := cache.lookup(key)
+	if err != nil {
+		var statusErr *stemDownloadStatusError
+		if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusForbidden) {
+			http.Error(w, "Stem not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errStemCacheObjectTooLarge) {
+			SysLog.Warn("[StemCache] Refused oversized stem", zap.String("Key", key), zap.Int64("MaxObjectBytes", cache.maxObjectBytes))
+			http.Error(w, "Stem too large", http.StatusBadGateway)
+			return
+		}
+		SysLog.Error("[StemCache] Fetch failed", zap.String("Key", key), zap.Error(err))
+		http.Error(w, "Stem fetch failed", http.StatusBadGateway)
+		return
+	}
+
+	dataFile, err := os.Open(entry.dataPath)
+	if err != nil {
+		// evicted between lookup and open; rare enough to just ask again
+		http.Error(w, "Stem unavailable, retry", http.StatusServiceUnavailable)
+		return
+	}
+	defer dataFile.Close()
+
+	w.Header().Set("ETag", entry.ETag)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set(HeaderNameContentType, "application/octet-stream")
+	http.ServeContent(w, r, "", entry.Fetched, dataFile)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// stems bypass negroni, as gzip gets in the way of ranged requests and the API's write timeout is too short for big transfers
+type stemCacheRoute struct {
+	next  http.Handler
+	cache *StemCache
+}
+
+func (h *stemCacheRoute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, cStemCacheRoutePrefix) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		SysLog.Warn("Unable to lift write deadline for stem cache", zap.Error(err))
+	}
+	w.Header().Add("Server", "ishani:ourocosm:"+viper.GetString(cConfigCosmFourCC))
+	h.cache.ServeHTTP(w, r)
+}
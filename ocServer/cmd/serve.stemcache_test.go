@@ -0,0 +1,286 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a cache in front of a built-in store, counting how often the store is asked for anything
+type testStemCache struct {
+	cache     *StemCache
+	store     *BuiltinStemStore
+	fetches   atomic.Int32
+	rescans   atomic.Int32
+	reference map[string]bool
+}
+
+func newTestStemCache(t *testing.T, maxBytes int64, maxObjectBytes int64) *testStemCache {
+	t.Helper()
+
+	test := &testStemCache{store: newTestBuiltinStemStore(t), reference: map[string]bool{}}
+	test.store.clock = nil
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		test.fetches.Add(1)
+		test.store.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	serverURL, _ := url.Parse(server.URL)
+	source := &StemStore{
+		httpClient: server.Client(),
+		scheme:     "http",
+		host:       serverURL.Host,
+		bucket:     awsExampleBucket,
+		pathStyle:  true,
+		region:     cS3DefaultRegion,
+		accessKey:  awsExampleAccessKey,
+		secretKey:  awsExampleSecretKey,
+	}
+
+	cache, err := newStemCache(t.TempDir(), maxBytes, maxObjectBytes, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.listReferencedKeys = func() (map[string]bool, error) {
+		test.rescans.Add(1)
+		return maps.Clone(test.reference), nil
+	}
+	test.cache = cache
+	return test
+}
+
+// put an object in the store, and have a jam point at it
+func (test *testStemCache) addStem(t *testing.T, key string, contents string) {
+	t.Helper()
+	objectPath := filepath.Join(test.store.objectRoot, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(objectPath, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	test.reference[key] = true
+}
+
+func (test *testStemCache) get(key string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, cStemCacheRoutePrefix+key, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	recorder := httptest.NewRecorder()
+	test.cache.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func TestStemCacheServesRangesAndETags(t *testing.T) {
+
+	test := newTestStemCache(t, 1024, 1024)
+	test.addStem(t, "attachments/oggs/one", "0123456789")
+
+	recorder := test.get("attachments/oggs/one", nil)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "0123456789" {
+		t.Fatalf("first GET: %d %q", recorder.Code, recorder.Body.String())
+	}
+	etag := recorder.Header().Get("ETag")
+	if etag != `"781e5e245d69b566979b86e28d23f2c7"` {
+		t.Errorf("ETag: %s", etag)
+	}
+
+	recorder = test.get("attachments/oggs/one", http.Header{"Range": {"bytes=2-5"}})
+	if recorder.Code != http.StatusPartialContent || recorder.Body.String() != "2345" {
+		t.Errorf("ranged GET: %d %q", recorder.Code, recorder.Body.String())
+	}
+	recorder = test.get("attachments/oggs/one", http.Header{"If-None-Match": {etag}})
+	if recorder.Code != http.StatusNotModified || recorder.Body.Len() != 0 {
+		t.Errorf("conditional GET: %d %q", recorder.Code, recorder.Body.String())
+	}
+	recorder = test.get("attachments/oggs/one", http.Header{"If-None-Match": {`"something else"`}})
+	if recorder.Code != http.StatusOK {
+		t.Errorf("conditional GET with a stale ETag: %d", recorder.Code)
+	}
+
+	// everything after the first came from disk
+	if fetches := test.fetches.Load(); fetches != 1 {
+		t.Errorf("store asked %d times, want 1", fetches)
+	}
+	if test.cache.hits != 3 || test.cache.misses != 1 {
+		t.Errorf("hits %d, misses %d", test.cache.hits, test.cache.misses)
+	}
+}
+
+func TestStemCacheEvictsLeastRecentlyUsed(t *testing.T) {
+
+	test := newTestStemCache(t, 25, 25)
+	test.addStem(t, "a", "aaaaaaaaaa")
+	test.addStem(t, "b", "bbbbbbbbbb")
+	test.addStem(t, "c", "cccccccccc")
+
+	for _, key := range []string{"a", "b", "a", "c"} {
+		if recorder := test.get(key, nil); recorder.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d", key, recorder.Code)
+		}
+	}
+	// a was used more recently than b, so b made room for c
+	if _, ok := test.cache.entries["b"]; ok || len(test.cache.entries) != 2 || test.cache.totalBytes != 20 {
+		t.Errorf("expected b evicted, holding %d entries / %d bytes", len(test.cache.entries), test.cache.totalBytes)
+	}
+	bDataPath, bMetaPath := test.cache.pathsForKey("b")
+	for _, evictedPath := range []string{bDataPath, bMetaPath} {
+		if _, err := os.Stat(evictedPath); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("evicted file still there: %s", evictedPath)
+		}
+	}
+
+	// what's left is picked up again after a restart
+	reloaded, err := newStemCache(test.cache.root, test.cache.maxBytes, test.cache.maxObjectBytes, test.cache.source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.entries["a"]; !ok || len(reloaded.entries) != 2 || reloaded.totalBytes != 20 {
+		t.Errorf("reloaded %d entries / %d bytes", len(reloaded.entries), reloaded.totalBytes)
+	}
+}
+
+func TestStemCacheRejectsOversizedStems(t *testing.T) {
+
+	test := newTestStemCache(t, 1024, 8)
+	test.addStem(t, "small", "12345678")
+	test.addStem(t, "big", "123456789")
+
+	if recorder := test.get("small", nil); recorder.Code != http.StatusOK {
+		t.Errorf("stem at the limit: %d", recorder.Code)
+	}
+	if recorder := test.get("big", nil); recorder.Code != http.StatusBadGateway {
+		t.Errorf("stem over the limit: %d", recorder.Code)
+	}
+	if _, ok := test.cache.entries["big"]; ok || test.cache.totalBytes != 8 {
+		t.Errorf("oversized stem was cached, %d bytes held", test.cache.totalBytes)
+	}
+	if leftovers, _ := os.ReadDir(filepath.Join(test.cache.root, cStemCachePartialDir)); len(leftovers) != 0 {
+		t.Errorf("refused fetch left %d partial files", len(leftovers))
+	}
+
+	if _, err := newStemCache(t.TempDir(), 8, 9, test.cache.source); err == nil {
+		t.Error("expected an error with an object limit over the cache size")
+	}
+}
+
+func TestStemCacheRejectsKeys(t *testing.T) {
+
+	test := newTestStemCache(t, 1024, 1024)
+	test.addStem(t, "attachments/oggs/one", "referenced")
+	// in the bucket, but no jam points at it
+	if err := os.WriteFile(filepath.Join(test.store.objectRoot, "private"), []byte("not for you"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		target string
+		want   int
+	}{
+		{"unreferenced key", http.MethodGet, "/stems/private", http.StatusNotFound},
+		{"referenced but gone", http.MethodGet, "/stems/attachments/oggs/missing", http.StatusNotFound},
+		{"no key", http.MethodGet, "/stems/", http.StatusBadRequest},
+		{"parent path", http.MethodGet, "/stems/attachments/../private", http.StatusBadRequest},
+		{"doubled slash", http.MethodGet, "/stems/attachments//oggs/one", http.StatusBadRequest},
+		{"trailing slash", http.MethodGet, "/stems/attachments/oggs/", http.StatusBadRequest},
+		{"put", http.MethodPut, "/stems/attachments/oggs/one", http.StatusMethodNotAllowed},
+		{"delete", http.MethodDelete, "/stems/attachments/oggs/one", http.StatusMethodNotAllowed},
+	}
+	test.reference["attachments/oggs/missing"] = true
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "http://cosm.local/", nil)
+			req.URL.Path = tc.target
+			recorder := httptest.NewRecorder()
+			test.cache.ServeHTTP(recorder, req)
+			if recorder.Code != tc.want {
+				t.Errorf("got %d, want %d", recorder.Code, tc.want)
+			}
+			if strings.Contains(recorder.Body.String(), "not for you") {
+				t.Error("unreferenced object was served")
+			}
+		})
+	}
+
+	// the store was only asked for the referenced key it turned out not to have
+	if fetches := test.fetches.Load(); fetches != 1 {
+		t.Errorf("store asked %d times, want 1", fetches)
+	}
+	if len(test.cache.entries) != 0 {
+		t.Errorf("cache holds %d entries", len(test.cache.entries))
+	}
+}
+
+func TestStemCacheReferenceRefresh(t *testing.T) {
+
+	test := newTestStemCache(t, 1024, 1024)
+	test.addStem(t, "one", "first")
+
+	if recorder := test.get("one", nil); recorder.Code != http.StatusOK {
+		t.Fatalf("GET one: %d", recorder.Code)
+	}
+	// a burst of unknown keys only rescans once
+	for range 5 {
+		if recorder := test.get("unknown", nil); recorder.Code != http.StatusNotFound {
+			t.Errorf("unknown key: %d", recorder.Code)
+		}
+	}
+	if rescans := test.rescans.Load(); rescans != 1 {
+		t.Errorf("rescanned %d times, want 1", rescans)
+	}
+
+	// a stem added since the last scan shows up once the refresh interval has passed
+	test.addStem(t, "two", "second")
+	if recorder := test.get("two", nil); recorder.Code != http.StatusNotFound {
+		t.Errorf("new stem before refresh: %d", recorder.Code)
+	}
+	test.cache.referencesLoaded = time.Now().Add(-cStemCacheReferenceRefresh)
+	if recorder := test.get("two", nil); recorder.Code != http.StatusOK || recorder.Body.String() != "second" {
+		t.Errorf("new stem after refresh: %d", recorder.Code)
+	}
+
+	// with no way to check, nothing is fetched
+	test.cache.referencesLoaded = time.Time{}
+	test.cache.listReferencedKeys = func() (map[string]bool, error) { return nil, errors.New("couch is down") }
+	if recorder := test.get("three", nil); recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("failed rescan: %d", recorder.Code)
+	}
+	// but keys already known still are
+	if recorder := test.get("one", nil); recorder.Code != http.StatusOK {
+		t.Errorf("known key during a failed rescan: %d", recorder.Code)
+	}
+}
+
+func TestStemCachePublicRead(t *testing.T) {
+
+	test := newTestStemCache(t, 1024, 1024)
+	if err := os.WriteFile(filepath.Join(test.store.objectRoot, "anything"), []byte("public"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	test.cache.publicRead = true
+
+	if recorder := test.get("anything", nil); recorder.Code != http.StatusOK || recorder.Body.String() != "public" {
+		t.Errorf("public-read GET: %d %q", recorder.Code, recorder.Body.String())
+	}
+	if rescans := test.rescans.Load(); rescans != 0 {
+		t.Errorf("rescanned %d times for a public-read source", rescans)
+	}
+}
@@ -0,0 +1,816 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	kivik "github.com/go-kivik/kivik/v4"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// a small S3-compatible object store that serve can run alongside the COSM API, keeping stems in a local directory so that a
+// complete server is just ocServer plus Couch. it covers what Studio and our own tools use - SigV4 signed PUT / GET / HEAD /
+// DELETE of objects, server-side copy and ListObjectsV2 - on a single bucket, addressed either path-style or virtual-host style
+//
+//	<root>/<bucket>/<key>     the objects, keys mapped straight onto the filesystem
+//	<root>/.uploads/          incoming data lands here first and is renamed into place once it's complete and checked
+//
+// per ourocosm.server.yaml, all under stemstore; setting root turns it on
+const cConfigStemStoreRoot string = "stemstore.root"
+const cConfigStemStoreScheme string = "stemstore.scheme"
+const cConfigStemStoreInternalHost string = "stemstore.internal-host"
+const cConfigStemStoreInternalPort string = "stemstore.internal-port"
+const cConfigStemStoreExternalHost string = "stemstore.external-host"
+const cConfigStemStoreExternalPort string = "stemstore.external-port"
+const cConfigStemStoreBucket string = "stemstore.bucket"
+const cConfigStemStoreAccessKey string = "stemstore.access-key"
+const cConfigStemStoreSecretKey string = "stemstore.secret-key"
+const cConfigStemStorePublicRead string = "stemstore.public-read" // allow unsigned GET / HEAD of objects, defaults to true
+
+const cStemStoreMaxClockSkew = 15 * time.Minute
+const cStemStoreMaxPresignExpiry = 604800 // seconds; a week, as on S3
+const cStemStoreListPageSize = 1000
+const cStemStoreMaxChunkSize = 64 * 1024 * 1024
+const cStemStoreUploadDir string = ".uploads"
+
+const cS3StreamingPayload string = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+const cS3ChunkSigningAlgorithm string = "AWS4-HMAC-SHA256-PAYLOAD"
+
+type BuiltinStemStore struct {
+	objectRoot string // <root>/<bucket>
+	uploadRoot string // <root>/.uploads
+	bucket     string
+	accessKey  string
+	secretKey  string
+	publicRead bool
+	clock      func() time.Time // checks request dates against this, time.Now if nil
+}
+
+func isBuiltinStemStoreEnabled() bool {
+	return len(viper.GetString(cConfigStemStoreRoot)) > 0
+}
+
+func getBuiltinStemStoreExternalHost() string {
+	return fmt.Sprintf("%s://%s:%s",
+		viper.GetString(cConfigStemStoreScheme),
+		viper.GetString(cConfigStemStoreExternalHost),
+		viper.GetString(cConfigStemStoreExternalPort),
+	)
+}
+
+func newBuiltinStemStoreFromConfig() (*BuiltinStemStore, error) {
+
+	configChecks := []string{
+		cConfigStemStoreScheme,
+		cConfigStemStoreInternalHost,
+		cConfigStemStoreInternalPort,
+		cConfigStemStoreExternalHost,
+		cConfigStemStoreExternalPort,
+		cConfigStemStoreBucket,
+		cConfigStemStoreAccessKey,
+		cConfigStemStoreSecretKey,
+	}
+	for _, v := range configChecks {
+		if !viper.IsSet(v) || len(viper.GetString(v)) == 0 {
+			return nil, fmt.Errorf("configuration key '%s' missing or empty", v)
+		}
+	}
+
+	bucket := viper.GetString(cConfigStemStoreBucket)
+	if strings.ContainsAny(bucket, "/\\") || strings.HasPrefix(bucket, ".") {
+		return nil, fmt.Errorf("invalid bucket name [%s]", bucket)
+	}
+
+	storeRoot := viper.GetString(cConfigStemStoreRoot)
+	store := &BuiltinStemStore{
+		objectRoot: filepath.Join(storeRoot, bucket),
+		uploadRoot: filepath.Join(storeRoot, cStemStoreUploadDir),
+		bucket:     bucket,
+		accessKey:  viper.GetString(cConfigStemStoreAccessKey),
+		secretKey:  viper.GetString(cConfigStemStoreSecretKey),
+		publicRead: true,
+	}
+	if viper.IsSet(cConfigStemStorePublicRead) {
+		store.publicRead = viper.GetBool(cConfigStemStorePublicRead)
+	}
+
+	for _, storeDir := range []string{store.objectRoot, store.uploadRoot} {
+		if err := os.MkdirAll(storeDir, os.ModePerm); err != nil {
+			return nil, errors.Join(fmt.Errorf("Unable to create stem store directory [%s]", storeDir), err)
+		}
+	}
+	// anything left in .uploads is from a transfer that never finished
+	if leftovers, err := os.ReadDir(store.uploadRoot); err == nil {
+		for _, leftover := range leftovers {
+			os.Remove(filepath.Join(store.uploadRoot, leftover.Name()))
+		}
+	}
+	return store, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// point app_client_config's S3Endpoint at us, so Studio sends its stems here; any other endpoints are kept but demoted
+func publishBuiltinStemStoreEndpoint(couchClient *kivik.Client) error {
+
+	accDb := couchClient.DB(CouchKnownDatabase_AppClientConfig)
+	storeHost := getBuiltinStemStoreExternalHost()
+	storeDocID := "s3:" + strings.TrimPrefix(strings.TrimPrefix(storeHost, "https://"), "http://")
+
+	resultSet := accDb.AllDocs(context.TODO(), kivik.Params(map[string]interface{}{
+		"include_docs": true,
+		"startkey":     "s3:",
+		"endkey":       "s3:\ufff0",
+	}))
+	defer resultSet.Close()
+
+	storeDoc := map[string]interface{}{}
+	for resultSet.Next() {
+		var endpointDoc map[string]interface{}
+		if err := resultSet.ScanDoc(&endpointDoc); err != nil {
+			return err
+		}
+		if endpointDoc["_id"] == storeDocID {
+			storeDoc = endpointDoc
+			continue
+		}
+		if endpointDoc["primary"] == true {
+			endpointDoc["primary"] = false
+			if _, err := accDb.Put(context.TODO(), endpointDoc["_id"].(string), endpointDoc); err != nil {
+				return err
+			}
+			SysLog.Info("Demoted S3 endpoint", zap.Any("ID", endpointDoc["_id"]))
+		}
+	}
+	if resultSet.Err() != nil {
+		return resultSet.Err()
+	}
+
+	if storeDoc["url"] == storeHost && storeDoc["cdnUrl"] == storeHost && storeDoc["primary"] == true {
+		return nil
+	}
+	storeDoc["type"] = "S3Endpoint"
+	storeDoc["url"] = storeHost
+	storeDoc["cdnUrl"] = storeHost
+	storeDoc["primary"] = true
+	_, err := accDb.Put(context.TODO(), storeDocID, storeDoc)
+	return err
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// S3-style error response
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+	status   int
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newS3Error(status int, code string, message string) *s3Error {
+	return &s3Error{Code: code, Message: message, status: status}
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, s3err *s3Error) {
+	s3err.Resource = r.URL.Path
+	w.Header().Set(HeaderNameContentType, "application/xml")
+	w.WriteHeader(s3err.status)
+	if r.Method != http.MethodHead {
+		io.WriteString(w, xml.Header)
+		xml.NewEncoder(w).Encode(s3err)
+	}
+}
+
+func writeS3XML(w http.ResponseWriter, response any) {
+	w.Header().Set(HeaderNameContentType, "application/xml")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(response)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// what we learned from checking a request's signature; the body still needs checking against payloadHash as it's read
+type stemStoreAuth struct {
+	signed        bool
+	payloadHash   string
+	signingKey    []byte
+	amzDate       string
+	scope         string
+	seedSignature string
+}
+
+// SigV4 wants header values trimmed with runs of spaces squashed
+func s3CanonicalHeaderValue(r *http.Request, name string) string {
+	switch name {
+	case "host":
+		return r.Host
+	case "content-length":
+		if len(r.Header.Values(name)) == 0 && r.ContentLength >= 0 {
+			return strconv.FormatInt(r.ContentLength, 10)
+		}
+	}
+	values := r.Header.Values(name)
+	for i, value := range values {
+		values[i] = strings.Join(strings.Fields(value), " ")
+	}
+	return strings.Join(values, ",")
+}
+
+// check the request's SigV4 signature, from either the Authorization header or a presigned URL. unsigned requests come back with
+// signed=false for the caller to decide about
+func (store *BuiltinStemStore) authenticate(r *http.Request) (*stemStoreAuth, *s3Error) {
+
+	query := r.URL.Query()
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	var expires time.Duration
+
+	if authorization := r.Header.Get("Authorization"); len(authorization) > 0 {
+		if !strings.HasPrefix(authorization, cS3SigningAlgorithm+" ") {
+			return nil, newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "only "+cS3SigningAlgorithm+" is supported")
+		}
+		for _, field := range strings.Split(strings.TrimPrefix(authorization, cS3SigningAlgorithm+" "), ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				signature = value
+			}
+		}
+		amzDate = r.Header.Get("x-amz-date")
+		payloadHash = r.Header.Get("x-amz-content-sha256")
+		if len(payloadHash) == 0 {
+			return nil, newS3Error(http.StatusBadRequest, "InvalidRequest", "missing x-amz-content-sha256")
+		}
+	} else if query.Has("X-Amz-Signature") {
+		if query.Get("X-Amz-Algorithm") != cS3SigningAlgorithm {
+			return nil, newS3Error(http.StatusBadRequest, "AuthorizationQueryParametersError", "only "+cS3SigningAlgorithm+" is supported")
+		}
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = cS3UnsignedPayload
+
+		expirySeconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expirySeconds <= 0 {
+			return nil, newS3Error(http.StatusBadRequest, "AuthorizationQueryParametersError", "bad X-Amz-Expires")
+		}
+		if expirySeconds > cStemStoreMaxPresignExpiry {
+			return nil, newS3Error(http.StatusBadRequest, "AuthorizationQueryParametersError", fmt.Sprintf("X-Amz-Expires must be less than a week (in seconds) that is %d", cStemStoreMaxPresignExpiry))
+		}
+		expires = time.Duration(expirySeconds) * time.Second
+		query.Del("X-Amz-Signature")
+	} else {
+		return &stemStoreAuth{payloadHash: cS3UnsignedPayload}, nil
+	}
+
+	// Credential=<access key>/<date>/<region>/s3/aws4_request; any region will do, there's only us
+	credentialParts := strings.Split(credential, "/")
+	if len(credentialParts) != 5 || credentialParts[3] != "s3" || credentialParts[4] != "aws4_request" {
+		return nil, newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "bad credential scope")
+	}
+	if subtle.ConstantTimeCompare([]byte(credentialParts[0]), []byte(store.accessKey)) != 1 {
+		return nil, newS3Error(http.StatusForbidden, "InvalidAccessKeyId", "unknown access key")
+	}
+	requestTime, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || requestTime.Format("20060102") != credentialParts[1] {
+		return nil, newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "bad request date")
+	}
+	now := time.Now().UTC()
+	if store.clock != nil {
+		now = store.clock().UTC()
+	}
+	if expires > 0 {
+		if now.Before(requestTime.Add(-cStemStoreMaxClockSkew)) || now.After(requestTime.Add(expires)) {
+			return nil, newS3Error(http.StatusForbidden, "AccessDenied", "request has expired")
+		}
+	} else if now.Sub(requestTime).Abs() > cStemStoreMaxClockSkew {
+		return nil, newS3Error(http.StatusForbidden, "RequestTimeTooSkewed", "request time too far from server time")
+	}
+
+	headerNames := strings.Split(signedHeaders, ";")
+	if !sort.StringsAreSorted(headerNames) || !slices.Contains(headerNames, "host") {
+		return nil, newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "bad signed headers")
+	}
+	canonicalHeaders := ""
+	for _, name := range headerNames {
+		canonicalHeaders += name + ":" + s3CanonicalHeaderValue(r, name) + "\n"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		s3EscapePath(r.URL.Path),
+		s3CanonicalQuery(query),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join(credentialParts[1:], "/")
+	signingKey := s3SigningKey(store.secretKey, credentialParts[1], credentialParts[2])
+	expectedSignature := hex.EncodeToString(s3HMAC(signingKey, s3StringToSign(amzDate, scope, canonicalRequest)))
+	if !hmac.Equal([]byte(expectedSignature), []byte(signature)) {
+		return nil, newS3Error(http.StatusForbidden, "SignatureDoesNotMatch", "the request signature does not match")
+	}
+
+	return &stemStoreAuth{
+		signed:        true,
+		payloadHash:   payloadHash,
+		signingKey:    signingKey,
+		amzDate:       amzDate,
+		scope:         scope,
+		seedSignature: signature,
+	}, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// unpacks an aws-chunked body, checking each chunk's signature against the one before it
+type s3ChunkedReader struct {
+	source            *bufio.Reader
+	auth              *stemStoreAuth
+	previousSignature string
+	chunk             []byte
+	done              bool
+}
+
+func (cr *s3ChunkedReader) Read(p []byte) (int, error) {
+
+	for len(cr.chunk) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cr.chunk)
+	cr.chunk = cr.chunk[n:]
+	return n, nil
+}
+
+// <hex size>;chunk-signature=<signature>\r\n<data>\r\n
+func (cr *s3ChunkedReader) nextChunk() error {
+
+	header, err := cr.source.ReadString('\n')
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	sizeField, signatureField, _ := strings.Cut(strings.TrimRight(header, "\r\n"), ";")
+	chunkSize, err := strconv.ParseInt(sizeField, 16, 64)
+	if err != nil || chunkSize < 0 || chunkSize > cStemStoreMaxChunkSize {
+		return fmt.Errorf("bad chunk size [%s]", sizeField)
+	}
+	chunkSignature, ok := strings.CutPrefix(signatureField, "chunk-signature=")
+	if !ok {
+		return fmt.Errorf("missing chunk signature")
+	}
+
+	chunk := make([]byte, chunkSize)
+	if _, err = io.ReadFull(cr.source, chunk); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	trailer := make([]byte, 2)
+	if _, err = io.ReadFull(cr.source, trailer); err != nil || !bytes.Equal(trailer, []byte("\r\n")) {
+		return fmt.Errorf("bad chunk trailer")
+	}
+
+	chunkHash := sha256.Sum256(chunk)
+	stringToSign := strings.Join([]string{
+		cS3ChunkSigningAlgorithm,
+		cr.auth.amzDate,
+		cr.auth.scope,
+		cr.previousSignature,
+		cS3EmptyPayloadHash,
+		hex.EncodeToString(chunkHash[:]),
+	}, "\n")
+	expectedSignature := hex.EncodeToString(s3HMAC(cr.auth.signingKey, stringToSign))
+	if !hmac.Equal([]byte(expectedSignature), []byte(chunkSignature)) {
+		return fmt.Errorf("chunk signature does not match")
+	}
+
+	cr.previousSignature = chunkSignature
+	cr.chunk = chunk
+	cr.done = chunkSize == 0
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// keys map onto the filesystem under the bucket directory, so anything that could step outside it is refused
+func (store *BuiltinStemStore) objectPath(key string) (string, *s3Error) {
+	if len(key) == 0 || strings.HasSuffix(key, "/") || path.Clean("/"+key) != "/"+key || strings.Contains(key, "\\") {
+		return "", newS3Error(http.StatusBadRequest, "InvalidArgument", "unsupported object key")
+	}
+	return filepath.Join(store.objectRoot, filepath.FromSlash(key)), nil
+}
+
+// pull the bucket and key out of the request, virtual-host style if the host starts with our bucket name, path-style otherwise
+func (store *BuiltinStemStore) resolveBucketAndKey(r *http.Request) (string, string) {
+
+	host := r.Host
+	if hostOnly, _, err := net.SplitHostPort(host); err == nil {
+		host = hostOnly
+	}
+	if strings.HasPrefix(host, store.bucket+".") {
+		return store.bucket, strings.TrimPrefix(r.URL.Path, "/")
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	return bucket, key
+}
+
+func (store *BuiltinStemStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	bucket, key := store.resolveBucketAndKey(r)
+	if bucket != store.bucket {
+		writeS3Error(w, r, newS3Error(http.StatusNotFound, "NoSuchBucket", "the specified bucket does not exist"))
+		return
+	}
+
+	auth, s3err := store.authenticate(r)
+	if s3err != nil {
+		SysLog.Warn("[StemStore] Rejected request", zap.String("Method", r.Method), zap.String("URI", r.RequestURI), zap.String("RemoteAddr", r.RemoteAddr), zap.Error(s3err))
+		writeS3Error(w, r, s3err)
+		return
+	}
+	isRead := r.Method == http.MethodGet || r.Method == http.MethodHead
+	if !auth.signed && !(isRead && store.publicRead && len(key) > 0) {
+		writeS3Error(w, r, newS3Error(http.StatusForbidden, "AccessDenied", "access denied"))
+		return
+	}
+
+	if len(key) == 0 {
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodGet && r.URL.Query().Has("location"):
+			writeS3XML(w, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Region  string   `xml:",chardata"`
+			}{Region: cS3DefaultRegion})
+		case r.Method == http.MethodGet:
+			s3err = store.listObjects(w, r)
+		default:
+			s3err = newS3Error(http.StatusNotImplemented, "NotImplemented", "unsupported bucket operation")
+		}
+	} else {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			s3err = store.getObject(w, r, key)
+		case http.MethodPut:
+			if copySource := r.Header.Get("x-amz-copy-source"); len(copySource) > 0 {
+				s3err = store.copyObject(w, copySource, key)
+			} else {
+				s3err = store.putObject(w, r, key, auth)
+			}
+		case http.MethodDelete:
+			s3err = store.deleteObject(w, key)
+		default:
+			s3err = newS3Error(http.StatusNotImplemented, "NotImplemented", "unsupported object operation")
+		}
+	}
+	if s3err != nil {
+		writeS3Error(w, r, s3err)
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+func (store *BuiltinStemStore) getObject(w http.ResponseWriter, r *http.Request, key string) *s3Error {
+
+	objectPath, s3err := store.objectPath(key)
+	if s3err != nil {
+		return s3err
+	}
+	objectFile, err := os.Open(objectPath)
+	if err != nil {
+		return newS3Error(http.StatusNotFound, "NoSuchKey", "the specified key does not exist")
+	}
+	defer objectFile.Close()
+
+	objectInfo, err := objectFile.Stat()
+	if err != nil || objectInfo.IsDir() {
+		return newS3Error(http.StatusNotFound, "NoSuchKey", "the specified key does not exist")
+	}
+	http.ServeContent(w, r, "", objectInfo.ModTime(), objectFile)
+	return nil
+}
+
+// write incoming data into .uploads, hashing as we go, and only move it into place if it all checks out; a length that isn't
+// negative is checked too, and nothing past it is read
+func (store *BuiltinStemStore) storeObject(key string, source io.Reader, expectedLength int64, expectedSHA256 string, expectedMD5 string) (string, *s3Error) {
+
+	objectPath, s3err := store.objectPath(key)
+	if s3err != nil {
+		return "", s3err
+	}
+	uploadFile, err := os.CreateTemp(store.uploadRoot, "upload-*")
+	if err != nil {
+		return "", newS3Error(http.StatusInternalServerError, "InternalError", err.Error())
+	}
+	defer os.Remove(uploadFile.Name())
+
+	if expectedLength >= 0 {
+		source = io.LimitReader(source, expectedLength+1)
+	}
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	written, err := io.Copy(io.MultiWriter(uploadFile, md5Hash, sha256Hash), source)
+	closeErr := uploadFile.Close()
+	if err != nil {
+		return "", newS3Error(http.StatusBadRequest, "IncompleteBody", err.Error())
+	}
+	if closeErr != nil {
+		return "", newS3Error(http.StatusInternalServerError, "InternalError", closeErr.Error())
+	}
+
+	if expectedLength >= 0 && written != expectedLength {
+		return "", newS3Error(http.StatusBadRequest, "IncompleteBody", "the payload does not match x-amz-decoded-content-length")
+	}
+
+	if len(expectedSHA256) > 0 && hex.EncodeToString(sha256Hash.Sum(nil)) != expectedSHA256 {
+		return "", newS3Error(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "the payload does not match x-amz-content-sha256")
+	}
+	if len(expectedMD5) > 0 && base64.StdEncoding.EncodeToString(md5Hash.Sum(nil)) != expectedMD5 {
+		return "", newS3Error(http.StatusBadRequest, "BadDigest", "the payload does not match Content-MD5")
+	}
+
+	if err = os.MkdirAll(filepath.Dir(objectPath), os.ModePerm); err == nil {
+		err = os.Rename(uploadFile.Name(), objectPath)
+	}
+	if err != nil {
+		return "", newS3Error(http.StatusInternalServerError, "InternalError", err.Error())
+	}
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(md5Hash.Sum(nil))), nil
+}
+
+func (store *BuiltinStemStore) putObject(w http.ResponseWriter, r *http.Request, key string, auth *stemStoreAuth) *s3Error {
+
+	var body io.Reader = r.Body
+	expectedLength := int64(-1)
+	expectedSHA256 := ""
+	switch auth.payloadHash {
+	case cS3UnsignedPayload:
+	case cS3StreamingPayload:
+		// Content-Length covers the chunk framing, so it's the decoded length that says how big the object is
+		decodedLength := r.Header.Get("x-amz-decoded-content-length")
+		if len(decodedLength) == 0 {
+			return newS3Error(http.StatusLengthRequired, "MissingContentLength", "missing x-amz-decoded-content-length")
+		}
+		var err error
+		if expectedLength, err = strconv.ParseInt(decodedLength, 10, 64); err != nil || expectedLength < 0 {
+			return newS3Error(http.StatusBadRequest, "InvalidArgument", "bad x-amz-decoded-content-length")
+		}
+		body = &s3ChunkedReader{source: bufio.NewReader(r.Body), auth: auth, previousSignature: auth.seedSignature}
+	default:
+		expectedSHA256 = strings.ToLower(auth.payloadHash)
+	}
+
+	etag, s3err := store.storeObject(key, body, expectedLength, expectedSHA256, r.Header.Get("Content-MD5"))
+	if s3err != nil {
+		return s3err
+	}
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (store *BuiltinStemStore) copyObject(w http.ResponseWriter, copySource string, key string) *s3Error {
+
+	sourcePath, err := url.PathUnescape(copySource)
+	if err != nil {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "bad x-amz-copy-source")
+	}
+	sourceBucket, sourceKey, _ := strings.Cut(strings.TrimPrefix(sourcePath, "/"), "/")
+	if sourceBucket != store.bucket {
+		return newS3Error(http.StatusNotFound, "NoSuchBucket", "the source bucket does not exist")
+	}
+	sourceObjectPath, s3err := store.objectPath(sourceKey)
+	if s3err != nil {
+		return s3err
+	}
+	sourceFile, err := os.Open(sourceObjectPath)
+	if err != nil {
+		return newS3Error(http.StatusNotFound, "NoSuchKey", "the source key does not exist")
+	}
+	defer sourceFile.Close()
+
+	etag, s3err := store.storeObject(key, sourceFile, -1, "", "")
+	if s3err != nil {
+		return s3err
+	}
+	writeS3XML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		LastModified string   `xml:"LastModified"`
+		ETag         string   `xml:"ETag"`
+	}{
+		LastModified: time.Now().UTC().Format(time.RFC3339),
+		ETag:         etag,
+	})
+	return nil
+}
+
+func (store *BuiltinStemStore) deleteObject(w http.ResponseWriter, key string) *s3Error {
+
+	objectPath, s3err := store.objectPath(key)
+	if s3err != nil {
+		return s3err
+	}
+	if err := os.Remove(objectPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return newS3Error(http.StatusInternalServerError, "InternalError", err.Error())
+	}
+	// tidy up any directories the key leaves empty
+	for dir := filepath.Dir(objectPath); dir != store.objectRoot && strings.HasPrefix(dir, store.objectRoot); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+type s3ListContents struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag,omitempty"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3ListCommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListResponse struct {
+	XMLName               xml.Name             `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string               `xml:"Name"`
+	Prefix                string               `xml:"Prefix"`
+	Delimiter             string               `xml:"Delimiter,omitempty"`
+	MaxKeys               int                  `xml:"MaxKeys"`
+	KeyCount              int                  `xml:"KeyCount"`
+	IsTruncated           bool                 `xml:"IsTruncated"`
+	ContinuationToken     string               `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string               `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string               `xml:"StartAfter,omitempty"`
+	Contents              []s3ListContents     `xml:"Contents"`
+	CommonPrefixes        []s3ListCommonPrefix `xml:"CommonPrefixes"`
+}
+
+// ListObjectsV2; keys are gathered and sorted up front, which is fine for the size of store this is meant for
+func (store *BuiltinStemStore) listObjects(w http.ResponseWriter, r *http.Request) *s3Error {
+
+	query := r.URL.Query()
+	response := s3ListResponse{
+		Name:              store.bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		MaxKeys:           cStemStoreListPageSize,
+		ContinuationToken: query.Get("continuation-token"),
+		StartAfter:        query.Get("start-after"),
+	}
+	if maxKeys, err := strconv.Atoi(query.Get("max-keys")); err == nil && maxKeys >= 0 && maxKeys < cStemStoreListPageSize {
+		response.MaxKeys = maxKeys
+	}
+	startAfter := response.StartAfter
+	if len(response.ContinuationToken) > 0 {
+		tokenKey, err := base64.RawURLEncoding.DecodeString(response.ContinuationToken)
+		if err != nil {
+			return newS3Error(http.StatusBadRequest, "InvalidArgument", "bad continuation token")
+		}
+		startAfter = string(tokenKey)
+	}
+
+	// only walk the part of the tree the prefix could be in
+	walkRoot := store.objectRoot
+	if prefixDir := path.Dir(response.Prefix); strings.Contains(response.Prefix, "/") && prefixDir != "." {
+		walkRoot = filepath.Join(store.objectRoot, filepath.FromSlash(path.Clean("/"+prefixDir)))
+	}
+
+	objects := map[string]fs.FileInfo{}
+	err := filepath.WalkDir(walkRoot, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(store.objectRoot, filePath)
+		if err != nil {
+			return err
+		}
+		objectKey := filepath.ToSlash(relativePath)
+		if !strings.HasPrefix(objectKey, response.Prefix) {
+			return nil
+		}
+		if objectInfo, err := d.Info(); err == nil {
+			objects[objectKey] = objectInfo
+		}
+		return nil
+	})
+	if err != nil {
+		return newS3Error(http.StatusInternalServerError, "InternalError", err.Error())
+	}
+
+	objectKeys := make([]string, 0, len(objects))
+	for objectKey := range objects {
+		objectKeys = append(objectKeys, objectKey)
+	}
+	sort.Strings(objectKeys)
+
+	lastEntry := ""
+	seenPrefixes := map[string]bool{}
+	for _, objectKey := range objectKeys {
+		if objectKey <= startAfter {
+			continue
+		}
+		if len(response.Delimiter) > 0 {
+			if i := strings.Index(objectKey[len(response.Prefix):], response.Delimiter); i >= 0 {
+				commonPrefix := objectKey[:len(response.Prefix)+i+len(response.Delimiter)]
+				if commonPrefix <= startAfter || seenPrefixes[commonPrefix] {
+					continue
+				}
+				if response.KeyCount == response.MaxKeys {
+					response.IsTruncated = true
+					break
+				}
+				seenPrefixes[commonPrefix] = true
+				response.CommonPrefixes = append(response.CommonPrefixes, s3ListCommonPrefix{Prefix: commonPrefix})
+				response.KeyCount++
+				// continue from past everything under this prefix
+				lastEntry = commonPrefix + "\U0010FFFF"
+				continue
+			}
+		}
+		if response.KeyCount == response.MaxKeys {
+			response.IsTruncated = true
+			break
+		}
+		objectInfo := objects[objectKey]
+		response.Contents = append(response.Contents, s3ListContents{
+			Key:          objectKey,
+			LastModified: objectInfo.ModTime().UTC().Format("2006-01-02T15:04:05.000Z"),
+			Size:         objectInfo.Size(),
+			StorageClass: "STANDARD",
+		})
+		response.KeyCount++
+		lastEntry = objectKey
+	}
+	if response.IsTruncated {
+		response.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(lastEntry))
+	}
+
+	writeS3XML(w, response)
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// the stem store gets its own listener; stems are far bigger than anything the COSM API moves, so none of its timeouts or gzip
+func newBuiltinStemStoreServer(store *BuiltinStemStore) *http.Server {
+
+	storeAddressInternal := fmt.Sprintf("%s:%s", viper.GetString(cConfigStemStoreInternalHost), viper.GetString(cConfigStemStoreInternalPort))
+	SysLog.Info(fmt.Sprintf("Launching stem store on %s", storeAddressInternal), zap.String("Bucket", store.bucket), zap.String("Root", store.objectRoot))
+	SysLog.Info(fmt.Sprintf("External stem store address is %s", getBuiltinStemStoreExternalHost()))
+
+	return &http.Server{
+		Handler:           store,
+		ReadHeaderTimeout: time.Second * 10,
+		IdleTimeout:       time.Second * 60,
+		Addr:              storeAddressInternal,
+	}
+}
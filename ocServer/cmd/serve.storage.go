@@ -0,0 +1,94 @@
+//
+// OUROCOSM // private Endlesss servers proof-of-concept // ishani.org 2024 // GPLv3
+// https://github.com/Unbundlesss/OUROCOSM
+//
+
+package cmd
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// latest storage report, rebuilt by backgroundStorageUpdater
+type latestStorageReport struct {
+	report *StorageReport
+	mu     sync.Mutex
+}
+
+var storageReportLatest latestStorageReport
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// rebuild the storage report, applying read-only solos if configured, and swap it in as the latest
+func refreshStorageReport() (*StorageReport, error) {
+
+	couchClient, err := connectToCouchDB()
+	if err != nil {
+		return nil, err
+	}
+	defer couchClient.Close()
+
+	report, err := buildStorageReport(couchClient)
+	if err != nil {
+		return nil, err
+	}
+	if viper.GetBool(cConfigQuotaReadOnly) {
+		if err = enforceStorageQuotas(couchClient, report); err != nil {
+			SysLog.Error("[Storage] quota enforcement incomplete", zap.Error(err))
+		}
+	}
+	for _, warning := range report.Warnings {
+		SysLog.Warn("[Storage] " + warning)
+	}
+
+	storageReportLatest.mu.Lock()
+	storageReportLatest.report = report
+	storageReportLatest.mu.Unlock()
+
+	return report, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// goroutine worker that rebuilds the storage report every quota.interval
+func backgroundStorageUpdater(chanStopWork <-chan struct{}) {
+
+	SysLog.Info("backgroundStorageUpdater launched", zap.Duration("Interval", getStorageReportInterval()))
+	for {
+		report, err := refreshStorageReport()
+		if err != nil {
+			SysLog.Error("[Storage] report failed", zap.Error(err))
+		} else {
+			SysLog.Info("[Storage] report updated", zap.Int("Users", len(report.Users)), zap.Int64("Bytes", report.Bytes), zap.Int("Warnings", len(report.Warnings)))
+		}
+
+		select {
+		case <-chanStopWork:
+			SysLog.Info("closing background storage worker")
+			return
+		case <-time.After(getStorageReportInterval()):
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------
+// return the latest storage report. building one reads every Loop in every jam, far too slow for a request, so this
+// only ever hands back what backgroundStorageUpdater last made
+func HandlerCosmStorage(httpResponse http.ResponseWriter, r *http.Request) {
+
+	storageReportLatest.mu.Lock()
+	report := storageReportLatest.report
+	storageReportLatest.mu.Unlock()
+
+	if report == nil {
+		httpResponse.Header().Set("Retry-After", "60")
+		http.Error(httpResponse, "Storage report not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	SysLog.Info("Storage requested", zap.String("RemoteAddr", r.RemoteAddr), zap.Int("Users", len(report.Users)))
+	handlerEmitJson(httpResponse, report)
+}